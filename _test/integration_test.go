@@ -12,9 +12,12 @@ import (
 
 	"friendsocial/activities"
 	"friendsocial/activity_participants"
+	"friendsocial/auth"
+	"friendsocial/config"
 	"friendsocial/friends"
 	"friendsocial/locations"
 	"friendsocial/postgres"
+	"friendsocial/query"
 	"friendsocial/scheduled_activities"
 	"friendsocial/user_activity_preferences"
 	"friendsocial/user_availability"
@@ -25,10 +28,17 @@ import (
 
 const baseURL = "http://localhost:8080"
 
+// session is a user the requests are sent as
+type session struct {
+	User     users.User
+	Password string
+	Token    string // access token sent as the bearer token
+}
+
 type TestIDs struct {
-	UserID                   int
+	User                     session
+	Friend                   session
 	UserAvailabilityID       int
-	FriendID                 int
 	LocationIDs              []int
 	ActivityID               int
 	ScheduledActivityID      int
@@ -44,7 +54,7 @@ func TestIntegration(t *testing.T) {
 		if shouldWipeDatabase {
 			// Perform delete tests here, right before wiping the database
 			deleteAllEntities(t, ids)
-			postgres.InitDB()
+			initDB(t)
 			defer postgres.CloseDB()
 
 			err := wipeDatabase(postgres.DB)
@@ -54,35 +64,36 @@ func TestIntegration(t *testing.T) {
 		}
 	}()
 
+	// Sign up the users the requests are sent as; everything but signing up needs a token
+	user1 := testSignUp(t, "Test User")
+	user2 := testSignUp(t, "Second Test User")
+
 	// Create a set of locations to use throughout the tests
-	ids.LocationIDs = createTestLocations(t)
+	ids.LocationIDs = createTestLocations(t, user1)
 
 	// Test user endpoints
-	user1 := testUserEndpoints(t, ids.LocationIDs[0])
-	ids.UserID = user1.ID
-
-	// Create a second user
-	user2 := testUserEndpoints(t, ids.LocationIDs[1])
+	ids.User = testUserEndpoints(t, user1, ids.LocationIDs[0])
+	ids.Friend = testUserEndpoints(t, user2, ids.LocationIDs[1])
 
 	// Test friend endpoints
-	ids.FriendID = testFriendEndpoints(t, user1.ID, user2.ID)
+	testFriendEndpoints(t, ids.User, ids.Friend)
 
 	// Test user availability endpoints
-	ids.UserAvailabilityID = testUserAvailabilityEndpoints(t, user1.ID)
+	ids.UserAvailabilityID = testUserAvailabilityEndpoints(t, ids.User)
 
 	// Test activity endpoints
-	activity := testActivityEndpoints(t, ids.LocationIDs[2])
+	activity := testActivityEndpoints(t, ids.User, ids.Friend, ids.LocationIDs[2])
 	ids.ActivityID = activity.ID
 
 	// Test scheduled activity endpoints
-	scheduledActivity := testScheduledActivityEndpoints(t, user1.ID, activity.ID)
+	scheduledActivity := testScheduledActivityEndpoints(t, ids.User, activity.ID)
 	ids.ScheduledActivityID = scheduledActivity.ID
 
 	// Test user activity preference endpoints
-	ids.UserActivityPreferenceID = testUserActivityPreferenceEndpoints(t, user1.ID, scheduledActivity.ID)
+	ids.UserActivityPreferenceID = testUserActivityPreferenceEndpoints(t, ids.User, activity.ID)
 
 	// Test activity participant endpoints
-	ids.ActivityParticipantID = testActivityParticipantEndpoints(t, user1.ID, scheduledActivity.ID)
+	ids.ActivityParticipantID = testActivityParticipantEndpoints(t, ids.User, ids.Friend, scheduledActivity.ID)
 }
 
 func TestThreeUsersActivitiesAndFriends(t *testing.T) {
@@ -90,7 +101,7 @@ func TestThreeUsersActivitiesAndFriends(t *testing.T) {
 	shouldWipeDatabase := false
 	defer func() {
 		if shouldWipeDatabase {
-			postgres.InitDB()
+			initDB(t)
 			defer postgres.CloseDB()
 
 			err := wipeDatabase(postgres.DB)
@@ -100,35 +111,34 @@ func TestThreeUsersActivitiesAndFriends(t *testing.T) {
 		}
 	}()
 
-	// Create test locations
-	locationIDs := createTestLocations(t)
-
 	// Create three users
 	users := []users.User{
 		{
-			Name:       "Mitchell Zinck",
-			Email:      "mitchell.zinck@example.com",
-			Password:   "password123",
-			LocationID: &locationIDs[0],
+			Name:     "Mitchell Zinck",
+			Email:    "mitchell.zinck@example.com",
+			Password: "password123",
 		},
 		{
-			Name:       "Lesya Afanasieva",
-			Email:      "lesya.afanasieva@example.com",
-			Password:   "password456",
-			LocationID: &locationIDs[1],
+			Name:     "Lesya Afanasieva",
+			Email:    "lesya.afanasieva@example.com",
+			Password: "password456",
 		},
 		{
-			Name:       "Steve Jobs",
-			Email:      "steve.jobs@example.com",
-			Password:   "password789",
-			LocationID: &locationIDs[2],
+			Name:     "Steve Jobs",
+			Email:    "steve.jobs@example.com",
+			Password: "password789",
 		},
 	}
 
+	sessions := make([]session, len(users))
 	for i := range users {
-		users[i] = testCreateUser(t, users[i])
+		sessions[i] = session{User: testCreateUser(t, users[i]), Password: users[i].Password}
+		sessions[i].Token = testLogin(t, users[i].Email, users[i].Password)
 	}
 
+	// Create test locations
+	locationIDs := createTestLocations(t, sessions[0])
+
 	// Create three activities
 	activities := []activities.Activity{
 		{
@@ -155,38 +165,39 @@ func TestThreeUsersActivitiesAndFriends(t *testing.T) {
 	}
 
 	for i := range activities {
-		activities[i] = testCreateActivity(t, activities[i])
+		activities[i] = testCreateActivity(t, sessions[0], activities[i])
 	}
 
-	// Add all users as friends
-	for i := 0; i < len(users); i++ {
-		for j := i + 1; j < len(users); j++ {
-			friend := friends.Friend{
-				UserID:   users[i].ID,
-				FriendID: users[j].ID,
-			}
-			testCreateFriend(t, friend)
+	// Add all users as friends: each request is accepted by the user it was sent to
+	for i := 0; i < len(sessions); i++ {
+		for j := i + 1; j < len(sessions); j++ {
+			testCreateFriendRequest(t, sessions[i], sessions[j])
+			testAcceptFriendRequest(t, sessions[j], sessions[i])
 		}
 	}
 
-	// Schedule all three activities and add all friends as participants
+	// Schedule all three activities and invite the other users
+	var participantIDs []int
+	for _, s := range sessions[1:] {
+		participantIDs = append(participantIDs, s.User.ID)
+	}
 	for i, activity := range activities {
-		// Create a scheduled activity for each activity
 		scheduledActivity := scheduled_activities.ScheduledActivity{
 			ActivityID:  activity.ID,
+			IsActive:    true,
 			ScheduledAt: time.Now().Add(time.Duration(i+1) * 24 * time.Hour), // Schedule each activity a day after the previous one
 		}
-		createdScheduledActivity := testCreateScheduledActivity(t, scheduledActivity)
+		testCreateScheduledActivity(t, sessions[0], scheduledActivity, participantIDs...)
+	}
+}
 
-		// Add all users as participants
-		for _, user := range users {
-			participant := activity_participants.ActivityParticipant{
-				UserID:              user.ID,
-				ScheduledActivityID: createdScheduledActivity.ID,
-			}
-			testCreateActivityParticipant(t, participant)
-		}
+// initDB connects to the database the server is configured with
+func initDB(t *testing.T) {
+	settings, err := config.Load(nil)
+	if err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
 	}
+	postgres.InitDB(settings.Database)
 }
 
 // wipeDatabase deletes all data from the tables
@@ -216,59 +227,76 @@ func wipeDatabase(db *pgxpool.Pool) error {
 func deleteAllEntities(t *testing.T, ids TestIDs) {
 	t.Run("Delete Tests", func(t *testing.T) {
 		// Delete in reverse order of creation
-		testDeleteActivityParticipant(t, fmt.Sprintf("%d", ids.ActivityParticipantID))
-		testDeleteUserActivityPreference(t, fmt.Sprintf("%d", ids.UserActivityPreferenceID))
-		testDeleteScheduledActivity(t, fmt.Sprintf("%d", ids.ScheduledActivityID))
-		testDeleteActivity(t, fmt.Sprintf("%d", ids.ActivityID))
-		testDeleteFriend(t, fmt.Sprintf("%d", ids.UserID), fmt.Sprintf("%d", ids.FriendID))
-		testDeleteUserAvailability(t, fmt.Sprintf("%d", ids.UserAvailabilityID))
-		testDeleteUser(t, fmt.Sprintf("%d", ids.UserID))
-		testDeleteUser(t, fmt.Sprintf("%d", ids.FriendID))
+		testDeleteActivityParticipant(t, ids.Friend, fmt.Sprintf("%d", ids.ActivityParticipantID))
+		testDeleteUserActivityPreference(t, ids.User, fmt.Sprintf("%d", ids.UserActivityPreferenceID))
+		testDeleteScheduledActivity(t, ids.User, fmt.Sprintf("%d", ids.ScheduledActivityID))
+		testDeleteActivity(t, ids.User, fmt.Sprintf("%d", ids.ActivityID))
+		testDeleteFriend(t, ids.User, fmt.Sprintf("%d", ids.Friend.User.ID))
+		testDeleteUserAvailability(t, ids.User, fmt.Sprintf("%d", ids.UserAvailabilityID))
+		// Locations go before the user who created them, who alone may delete them
 		for _, locationID := range ids.LocationIDs {
-			testDeleteLocation(t, fmt.Sprintf("%d", locationID))
+			testDeleteLocation(t, ids.User, fmt.Sprintf("%d", locationID))
 		}
+		testDeleteUser(t, ids.User)
+		testDeleteUser(t, ids.Friend)
 	})
 }
 
-func testUserEndpoints(t *testing.T, locationID int) users.User {
-	var updatedUser users.User
+// testSignUp creates a user and logs them in
+func testSignUp(t *testing.T, name string) session {
+	user := users.User{
+		Name:     name,
+		Email:    fmt.Sprintf("testuser%d@example.com", time.Now().UnixNano()),
+		Password: "testpassword",
+	}
+	createdUser := testCreateUser(t, user)
+
+	return session{User: createdUser, Password: user.Password, Token: testLogin(t, user.Email, user.Password)}
+}
 
+func testUserEndpoints(t *testing.T, s session, locationID int) session {
 	t.Run("User Endpoints", func(t *testing.T) {
-		// Test creating a user
-		user := users.User{
-			Name:       "Test User",
-			Email:      fmt.Sprintf("testuser%d@example.com", time.Now().UnixNano()),
-			Password:   "testpassword",
-			LocationID: &locationID,
-		}
-		createdUser := testCreateUser(t, user)
+		userID := fmt.Sprintf("%d", s.User.ID)
 
 		// Test getting the user
-		testGetUser(t, fmt.Sprintf("%d", createdUser.ID))
+		testGetUser(t, s, userID)
 
-		// Test full update of the user
-		updatedLocationID := locationID + 1
+		// Without a token the request is refused
+		resp, _ := makeRequest(t, "", "GET", "/users/"+userID, nil)
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("Expected status Unauthorized without a token, got %v", resp.Status)
+		}
+
+		// Test full update of the user, which changes their password
 		updatedUserData := users.User{
-			Name:       "Updated Test User",
+			Name:       "Updated " + s.User.Name,
 			Email:      fmt.Sprintf("updatedtestuser%d@example.com", time.Now().UnixNano()),
 			Password:   "updatedtestpassword",
-			LocationID: &updatedLocationID,
+			LocationID: &locationID,
 		}
-		updatedUser = testUpdateUser(t, fmt.Sprintf("%d", createdUser.ID), updatedUserData)
+		s.User = testUpdateUser(t, s, userID, updatedUserData)
+
+		// A new password signs the user out, so they log in again with it
+		resp, _ = makeRequest(t, s.Token, "GET", "/users/"+userID, nil)
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("Expected the old token to be refused after a password change, got %v", resp.Status)
+		}
+		s.Password = updatedUserData.Password
+		s.Token = testLogin(t, updatedUserData.Email, s.Password)
 
 		// Test partial update of the user
 		partialUpdate := map[string]interface{}{
-			"name": "Partially Updated Test User",
+			"name": "Partially " + updatedUserData.Name,
 		}
-		updatedUser = testPartialUpdateUser(t, fmt.Sprintf("%d", createdUser.ID), partialUpdate)
+		s.User = testPartialUpdateUser(t, s, userID, partialUpdate)
 	})
 
-	return updatedUser
+	return s
 }
 
 // Add this new function to test partial updates
-func testPartialUpdateUser(t *testing.T, userID string, updates map[string]interface{}) users.User {
-	resp, body := makeRequest(t, "PATCH", fmt.Sprintf("/users/%s", userID), updates)
+func testPartialUpdateUser(t *testing.T, s session, userID string, updates map[string]interface{}) users.User {
+	resp, body := makeRequest(t, s.Token, "PATCH", fmt.Sprintf("/users/%s", userID), updates)
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("Expected status OK, got %v", resp.Status)
 	}
@@ -288,9 +316,9 @@ func testPartialUpdateUser(t *testing.T, userID string, updates map[string]inter
 }
 
 func testCreateUser(t *testing.T, user users.User) users.User {
-	resp, body := makeRequest(t, "POST", "/users", user)
+	resp, body := makeRequest(t, "", "POST", "/users", user)
 	if resp.StatusCode != http.StatusCreated {
-		t.Fatalf("Expected status Created, got %v", resp.Status)
+		t.Fatalf("Expected status Created, got %v. Response body: %s", resp.Status, string(body))
 	}
 
 	var createdUser users.User
@@ -306,15 +334,35 @@ func testCreateUser(t *testing.T, user users.User) users.User {
 	return createdUser
 }
 
-func testGetUser(t *testing.T, userID string) {
-	resp, _ := makeRequest(t, "GET", fmt.Sprintf("/users/%s", userID), nil)
+// testLogin returns an access token for the user with the given credentials
+func testLogin(t *testing.T, email, password string) string {
+	resp, body := makeRequest(t, "", "POST", "/auth/login", auth.LoginRequest{Email: email, Password: password})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v. Response body: %s", resp.Status, string(body))
+	}
+
+	var tokens auth.Tokens
+	err := json.Unmarshal(body, &tokens)
+	if err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+
+	if tokens.AccessToken == "" {
+		t.Fatalf("Login returned no access token")
+	}
+
+	return tokens.AccessToken
+}
+
+func testGetUser(t *testing.T, s session, userID string) {
+	resp, _ := makeRequest(t, s.Token, "GET", fmt.Sprintf("/users/%s", userID), nil)
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("Expected status OK, got %v", resp.Status)
 	}
 }
 
-func testUpdateUser(t *testing.T, userID string, updates users.User) users.User {
-	resp, body := makeRequest(t, "PUT", fmt.Sprintf("/users/%s", userID), updates)
+func testUpdateUser(t *testing.T, s session, userID string, updates users.User) users.User {
+	resp, body := makeRequest(t, s.Token, "PUT", fmt.Sprintf("/users/%s", userID), updates)
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("Expected status OK, got %v", resp.Status)
 	}
@@ -328,45 +376,45 @@ func testUpdateUser(t *testing.T, userID string, updates users.User) users.User
 	return updatedUser
 }
 
-func testDeleteUser(t *testing.T, userID string) {
-	resp, _ := makeRequest(t, "DELETE", fmt.Sprintf("/users/%s", userID), nil)
+func testDeleteUser(t *testing.T, s session) {
+	resp, _ := makeRequest(t, s.Token, "DELETE", fmt.Sprintf("/users/%d", s.User.ID), nil)
 	if resp.StatusCode != http.StatusNoContent {
 		t.Fatalf("Expected status No Content, got %v", resp.Status)
 	}
 }
 
-func testUserAvailabilityEndpoints(t *testing.T, userID int) int {
+func testUserAvailabilityEndpoints(t *testing.T, s session) int {
 	var createdAvailabilityID int
 	t.Run("User Availability Endpoints", func(t *testing.T) {
 		availability := user_availability.UserAvailability{
-			UserID:      userID,
+			UserID:      s.User.ID,
 			DayOfWeek:   "Monday",
-			StartTime:   time.Now(),
-			EndTime:     time.Now().Add(time.Hour * 2),
+			StartTime:   "09:00:00",
+			EndTime:     "11:00:00",
 			IsAvailable: true,
 		}
 
 		// Create
-		createdAvailability := testCreateUserAvailability(t, availability)
+		createdAvailability := testCreateUserAvailability(t, s, availability)
 		createdAvailabilityID = createdAvailability.ID
 
 		// Read
-		testGetUserAvailability(t, fmt.Sprintf("%d", createdAvailability.ID))
+		testGetUserAvailability(t, s, fmt.Sprintf("%d", createdAvailability.ID))
 
 		// Update
 		updatedAvailability := user_availability.UserAvailability{
-			UserID:      userID,
+			UserID:      s.User.ID,
 			DayOfWeek:   "Monday",
-			StartTime:   time.Now(),
-			EndTime:     time.Now().Add(time.Hour * 2),
-			IsAvailable: false,
+			StartTime:   "09:00:00",
+			EndTime:     "12:00:00",
+			IsAvailable: true,
 		}
-		testUpdateUserAvailability(t, fmt.Sprintf("%d", createdAvailability.ID), updatedAvailability)
+		testUpdateUserAvailability(t, s, fmt.Sprintf("%d", createdAvailability.ID), updatedAvailability)
 	})
 	return createdAvailabilityID
 }
 
-func testActivityEndpoints(t *testing.T, locationID int) activities.Activity {
+func testActivityEndpoints(t *testing.T, s session, other session, locationID int) activities.Activity {
 	var updatedActivity activities.Activity
 
 	t.Run("Activity Endpoints", func(t *testing.T) {
@@ -379,10 +427,16 @@ func testActivityEndpoints(t *testing.T, locationID int) activities.Activity {
 		}
 
 		// Create
-		createdActivity := testCreateActivity(t, activity)
+		createdActivity := testCreateActivity(t, s, activity)
 
 		// Read
-		testGetActivity(t, fmt.Sprintf("%d", createdActivity.ID))
+		testGetActivity(t, s, fmt.Sprintf("%d", createdActivity.ID))
+
+		// Only the user who created the activity may edit it
+		resp, _ := makeRequest(t, other.Token, "PUT", fmt.Sprintf("/activity/%d", createdActivity.ID), activity)
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("Expected status Forbidden for another user, got %v", resp.Status)
+		}
 
 		// Update
 		updatedActivity = activities.Activity{
@@ -393,43 +447,43 @@ func testActivityEndpoints(t *testing.T, locationID int) activities.Activity {
 			LocationID:    locationID,
 			UserCreated:   true,
 		}
-		updatedActivity = testUpdateActivity(t, fmt.Sprintf("%d", createdActivity.ID), updatedActivity)
+		updatedActivity = testUpdateActivity(t, s, fmt.Sprintf("%d", createdActivity.ID), updatedActivity)
 	})
 
 	return updatedActivity
 }
 
-func testUserActivityPreferenceEndpoints(t *testing.T, userID, activityID int) int {
+func testUserActivityPreferenceEndpoints(t *testing.T, s session, activityID int) int {
 	var createdPreferenceID int
 	t.Run("User Activity Preference Endpoints", func(t *testing.T) {
 		preference := user_activity_preferences.UserActivityPreference{
-			UserID:          userID,
+			UserID:          s.User.ID,
 			ActivityID:      activityID,
 			Frequency:       2,
 			FrequencyPeriod: "week",
 		}
 
 		// Create
-		createdPreference := testCreateUserActivityPreference(t, preference)
+		createdPreference := testCreateUserActivityPreference(t, s, preference)
 		createdPreferenceID = createdPreference.ID
 
 		// Read
-		testGetUserActivityPreference(t, fmt.Sprintf("%d", createdPreference.ID))
+		testGetUserActivityPreference(t, s, fmt.Sprintf("%d", createdPreference.ID))
 
 		// Update
 		updatedPreference := user_activity_preferences.UserActivityPreference{
 			ID:              createdPreference.ID,
-			UserID:          userID,
+			UserID:          s.User.ID,
 			ActivityID:      activityID,
 			Frequency:       3,
 			FrequencyPeriod: "month",
 		}
-		testUpdateUserActivityPreference(t, fmt.Sprintf("%d", createdPreference.ID), updatedPreference)
+		testUpdateUserActivityPreference(t, s, fmt.Sprintf("%d", createdPreference.ID), updatedPreference)
 	})
 	return createdPreferenceID
 }
 
-func testScheduledActivityEndpoints(t *testing.T, userID int, activityID int) scheduled_activities.ScheduledActivity {
+func testScheduledActivityEndpoints(t *testing.T, s session, activityID int) scheduled_activities.ScheduledActivity {
 	var createdScheduledActivity scheduled_activities.ScheduledActivity
 	t.Run("Scheduled Activity Endpoints", func(t *testing.T) {
 		scheduledActivity := scheduled_activities.ScheduledActivity{
@@ -439,68 +493,82 @@ func testScheduledActivityEndpoints(t *testing.T, userID int, activityID int) sc
 		}
 
 		// Create
-		createdScheduledActivity = testCreateScheduledActivity(t, scheduledActivity)
+		createdScheduledActivity = testCreateScheduledActivity(t, s, scheduledActivity)
 
 		// Read
-		testGetScheduledActivity(t, fmt.Sprintf("%d", createdScheduledActivity.ID))
+		testGetScheduledActivity(t, s, fmt.Sprintf("%d", createdScheduledActivity.ID))
 
-		// Update
+		// Update, moving it a day later
 		updatedScheduledActivity := scheduled_activities.ScheduledActivity{
 			ID:          createdScheduledActivity.ID,
 			ActivityID:  activityID,
-			IsActive:    false,
+			IsActive:    true,
 			ScheduledAt: time.Now().Add(48 * time.Hour),
 		}
-		testUpdateScheduledActivity(t, fmt.Sprintf("%d", createdScheduledActivity.ID), updatedScheduledActivity)
+		testUpdateScheduledActivity(t, s, fmt.Sprintf("%d", createdScheduledActivity.ID), updatedScheduledActivity)
 	})
 	return createdScheduledActivity
 }
 
-func testFriendEndpoints(t *testing.T, userID1, userID2 int) int {
-	var createdFriendID int
+func testFriendEndpoints(t *testing.T, s session, other session) {
 	t.Run("Friend Endpoints", func(t *testing.T) {
-		friend := friends.Friend{
-			UserID:   userID1,
-			FriendID: userID2,
+		// A request is pending until the other user accepts it
+		request := testCreateFriendRequest(t, s, other)
+		if request.Status != friends.StatusPending {
+			t.Fatalf("Expected a pending request, got status %s", request.Status)
+		}
+		if testAreFriends(t, s, s.User.ID, other.User.ID) {
+			t.Fatalf("Users are friends before the request was accepted")
 		}
 
-		// Create
-		createdFriend := testCreateFriend(t, friend)
-		createdFriendID = createdFriend.FriendID
+		// Only the user the request was sent to may accept it
+		resp, _ := makeRequest(t, s.Token, "POST", fmt.Sprintf("/friend/requests/%d/%d/accept", s.User.ID, other.User.ID), nil)
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("Expected status Forbidden for the sender, got %v", resp.Status)
+		}
+
+		accepted := testAcceptFriendRequest(t, other, s)
+		if accepted.Status != friends.StatusAccepted {
+			t.Fatalf("Expected an accepted request, got status %s", accepted.Status)
+		}
 
 		// Read
-		testGetFriend(t, fmt.Sprintf("%d", createdFriend.UserID), fmt.Sprintf("%d", createdFriend.FriendID))
+		if !testAreFriends(t, s, s.User.ID, other.User.ID) {
+			t.Fatalf("Users are not friends after the request was accepted")
+		}
+		testGetFriends(t, s, other.User.ID)
 	})
-	return createdFriendID
 }
 
-func testActivityParticipantEndpoints(t *testing.T, userID int, scheduledActivityID int) int {
+func testActivityParticipantEndpoints(t *testing.T, organizer session, invitee session, scheduledActivityID int) int {
 	var createdParticipantID int
 	t.Run("Activity Participant Endpoints", func(t *testing.T) {
 		participant := activity_participants.ActivityParticipant{
-			UserID:              userID,
+			UserID:              invitee.User.ID,
 			ScheduledActivityID: scheduledActivityID,
 		}
 
-		// Create
-		createdParticipant := testCreateActivityParticipant(t, participant)
+		// Create: the organizer invites the other user
+		createdParticipant := testCreateActivityParticipant(t, organizer, participant)
 		createdParticipantID = createdParticipant.ID
 
 		// Read
-		testGetActivityParticipant(t, fmt.Sprintf("%d", createdParticipant.ID))
+		testGetActivityParticipant(t, invitee, fmt.Sprintf("%d", createdParticipant.ID))
 
-		// Update
+		// Update: the invitee answers for themselves
+		comment := "See you there"
 		updatedParticipant := activity_participants.ActivityParticipant{
 			ID:                  createdParticipant.ID,
-			UserID:              userID,
+			UserID:              invitee.User.ID,
 			ScheduledActivityID: scheduledActivityID,
+			Comment:             &comment,
 		}
-		testUpdateActivityParticipant(t, fmt.Sprintf("%d", createdParticipant.ID), updatedParticipant)
+		testUpdateActivityParticipant(t, invitee, fmt.Sprintf("%d", createdParticipant.ID), updatedParticipant)
 	})
 	return createdParticipantID
 }
 
-func createTestLocations(t *testing.T) []int {
+func createTestLocations(t *testing.T, s session) []int {
 	locations := []locations.Location{
 		{
 			Name:      "Test Location 1",
@@ -509,8 +577,8 @@ func createTestLocations(t *testing.T) []int {
 			State:     "TS1",
 			ZipCode:   "12345",
 			Country:   "Test Country 1",
-			Latitude:  40.7128,
-			Longitude: -74.0060,
+			Latitude:  float64Pointer(40.7128),
+			Longitude: float64Pointer(-74.0060),
 		},
 		{
 			Name:      "Test Location 2",
@@ -519,8 +587,8 @@ func createTestLocations(t *testing.T) []int {
 			State:     "TS2",
 			ZipCode:   "67890",
 			Country:   "Test Country 2",
-			Latitude:  34.0522,
-			Longitude: -118.2437,
+			Latitude:  float64Pointer(34.0522),
+			Longitude: float64Pointer(-118.2437),
 		},
 		{
 			Name:      "Test Location 3",
@@ -529,20 +597,20 @@ func createTestLocations(t *testing.T) []int {
 			State:     "TS3",
 			ZipCode:   "13579",
 			Country:   "Test Country 3",
-			Latitude:  41.8781,
-			Longitude: -87.6298,
+			Latitude:  float64Pointer(41.8781),
+			Longitude: float64Pointer(-87.6298),
 		},
 	}
 
 	var locationIDs []int
 	for _, loc := range locations {
-		createdLocation := testCreateLocation(t, loc)
+		createdLocation := testCreateLocation(t, s, loc)
 		locationIDs = append(locationIDs, createdLocation.ID)
 
-		testGetLocation(t, fmt.Sprintf("%d", createdLocation.ID))
+		testGetLocation(t, s, fmt.Sprintf("%d", createdLocation.ID))
 
 		loc.Name = loc.Name + " Updated"
-		testUpdateLocation(t, fmt.Sprintf("%d", createdLocation.ID), loc)
+		testUpdateLocation(t, s, fmt.Sprintf("%d", createdLocation.ID), loc)
 	}
 
 	return locationIDs
@@ -550,8 +618,8 @@ func createTestLocations(t *testing.T) []int {
 
 // Helper functions for each endpoint
 
-func testCreateUserAvailability(t *testing.T, availability user_availability.UserAvailability) user_availability.UserAvailability {
-	resp, body := makeRequest(t, "POST", "/user_availability", availability)
+func testCreateUserAvailability(t *testing.T, s session, availability user_availability.UserAvailability) user_availability.UserAvailability {
+	resp, body := makeRequest(t, s.Token, "POST", "/user_availability", availability)
 	if resp.StatusCode != http.StatusCreated {
 		t.Fatalf("Expected status Created, got %v. Response body: %s", resp.Status, string(body))
 	}
@@ -565,29 +633,29 @@ func testCreateUserAvailability(t *testing.T, availability user_availability.Use
 	return createdAvailability
 }
 
-func testGetUserAvailability(t *testing.T, id string) {
-	resp, _ := makeRequest(t, "GET", fmt.Sprintf("/user_availability/%s", id), nil)
+func testGetUserAvailability(t *testing.T, s session, id string) {
+	resp, _ := makeRequest(t, s.Token, "GET", fmt.Sprintf("/user_availability/%s", id), nil)
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("Expected status OK, got %v", resp.Status)
 	}
 }
 
-func testUpdateUserAvailability(t *testing.T, id string, updates user_availability.UserAvailability) {
-	resp, _ := makeRequest(t, "PUT", fmt.Sprintf("/user_availability/%s", id), updates)
+func testUpdateUserAvailability(t *testing.T, s session, id string, updates user_availability.UserAvailability) {
+	resp, _ := makeRequest(t, s.Token, "PUT", fmt.Sprintf("/user_availability/%s", id), updates)
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("Expected status OK, got %v", resp.Status)
 	}
 }
 
-func testDeleteUserAvailability(t *testing.T, id string) {
-	resp, _ := makeRequest(t, "DELETE", fmt.Sprintf("/user_availability/%s", id), nil)
+func testDeleteUserAvailability(t *testing.T, s session, id string) {
+	resp, _ := makeRequest(t, s.Token, "DELETE", fmt.Sprintf("/user_availability/%s", id), nil)
 	if resp.StatusCode != http.StatusNoContent {
 		t.Fatalf("Expected status No Content, got %v", resp.Status)
 	}
 }
 
-func testCreateActivity(t *testing.T, activity activities.Activity) activities.Activity {
-	resp, body := makeRequest(t, "POST", "/activity", activity)
+func testCreateActivity(t *testing.T, s session, activity activities.Activity) activities.Activity {
+	resp, body := makeRequest(t, s.Token, "POST", "/activity", activity)
 	if resp.StatusCode != http.StatusCreated {
 		t.Logf("Failed to create activity. Activity: %+v", activity)
 		t.Fatalf("Expected status Created, got %v. Response body: %s", resp.Status, string(body))
@@ -606,15 +674,15 @@ func testCreateActivity(t *testing.T, activity activities.Activity) activities.A
 	return createdActivity
 }
 
-func testGetActivity(t *testing.T, activityID string) {
-	resp, body := makeRequest(t, "GET", fmt.Sprintf("/activity/%s", activityID), nil)
+func testGetActivity(t *testing.T, s session, activityID string) {
+	resp, body := makeRequest(t, s.Token, "GET", fmt.Sprintf("/activities/%s", activityID), nil)
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("Expected status OK, got %v. Response body: %s", resp.Status, string(body))
 	}
 }
 
-func testUpdateActivity(t *testing.T, activityID string, updates activities.Activity) activities.Activity {
-	resp, body := makeRequest(t, "PUT", fmt.Sprintf("/activity/%s", activityID), updates)
+func testUpdateActivity(t *testing.T, s session, activityID string, updates activities.Activity) activities.Activity {
+	resp, body := makeRequest(t, s.Token, "PUT", fmt.Sprintf("/activity/%s", activityID), updates)
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("Expected status OK, got %v", resp.Status)
 	}
@@ -628,15 +696,15 @@ func testUpdateActivity(t *testing.T, activityID string, updates activities.Acti
 	return updatedActivity
 }
 
-func testDeleteActivity(t *testing.T, activityID string) {
-	resp, _ := makeRequest(t, "DELETE", fmt.Sprintf("/activity/%s", activityID), nil)
+func testDeleteActivity(t *testing.T, s session, activityID string) {
+	resp, _ := makeRequest(t, s.Token, "DELETE", fmt.Sprintf("/activity/%s", activityID), nil)
 	if resp.StatusCode != http.StatusNoContent {
 		t.Fatalf("Expected status No Content, got %v", resp.Status)
 	}
 }
 
-func testCreateUserActivityPreference(t *testing.T, preference user_activity_preferences.UserActivityPreference) user_activity_preferences.UserActivityPreference {
-	resp, body := makeRequest(t, "POST", "/user_activity_preference", preference)
+func testCreateUserActivityPreference(t *testing.T, s session, preference user_activity_preferences.UserActivityPreference) user_activity_preferences.UserActivityPreference {
+	resp, body := makeRequest(t, s.Token, "POST", "/user_activity_preference", preference)
 	if resp.StatusCode != http.StatusCreated {
 		t.Fatalf("Expected status Created, got %v. Response body: %s", resp.Status, string(body))
 	}
@@ -654,31 +722,32 @@ func testCreateUserActivityPreference(t *testing.T, preference user_activity_pre
 	return createdPreference
 }
 
-func testGetUserActivityPreference(t *testing.T, preferenceID string) {
-	resp, _ := makeRequest(t, "GET", fmt.Sprintf("/user_activity_preference/%s", preferenceID), nil)
+func testGetUserActivityPreference(t *testing.T, s session, preferenceID string) {
+	resp, _ := makeRequest(t, s.Token, "GET", fmt.Sprintf("/user_activity_preference/%s", preferenceID), nil)
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("Expected status OK, got %v", resp.Status)
 	}
 }
 
-func testUpdateUserActivityPreference(t *testing.T, preferenceID string, updates user_activity_preferences.UserActivityPreference) {
-	resp, body := makeRequest(t, "PUT", fmt.Sprintf("/user_activity_preference/%s", preferenceID), updates)
+func testUpdateUserActivityPreference(t *testing.T, s session, preferenceID string, updates user_activity_preferences.UserActivityPreference) {
+	resp, body := makeRequest(t, s.Token, "PUT", fmt.Sprintf("/user_activity_preference/%s", preferenceID), updates)
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("Expected status OK, got %v. Response body: %s", resp.Status, string(body))
 	}
 }
 
-func testDeleteUserActivityPreference(t *testing.T, preferenceID string) {
-	resp, _ := makeRequest(t, "DELETE", fmt.Sprintf("/user_activity_preference/%s", preferenceID), nil)
+func testDeleteUserActivityPreference(t *testing.T, s session, preferenceID string) {
+	resp, _ := makeRequest(t, s.Token, "DELETE", fmt.Sprintf("/user_activity_preference/%s", preferenceID), nil)
 	if resp.StatusCode != http.StatusNoContent {
 		t.Fatalf("Expected status No Content, got %v", resp.Status)
 	}
 }
 
-func testCreateScheduledActivity(t *testing.T, scheduledActivity scheduled_activities.ScheduledActivity) scheduled_activities.ScheduledActivity {
-	resp, body := makeRequest(t, "POST", "/scheduled_activity", scheduledActivity)
+func testCreateScheduledActivity(t *testing.T, s session, scheduledActivity scheduled_activities.ScheduledActivity, participantIDs ...int) scheduled_activities.ScheduledActivity {
+	request := scheduled_activities.CreateRequest{ScheduledActivity: scheduledActivity, ParticipantIDs: participantIDs}
+	resp, body := makeRequest(t, s.Token, "POST", "/scheduled_activity", request)
 	if resp.StatusCode != http.StatusCreated {
-		t.Fatalf("Expected status Created, got %v", resp.Status)
+		t.Fatalf("Expected status Created, got %v. Response body: %s", resp.Status, string(body))
 	}
 
 	var createdScheduledActivity scheduled_activities.ScheduledActivity
@@ -690,29 +759,30 @@ func testCreateScheduledActivity(t *testing.T, scheduledActivity scheduled_activ
 	return createdScheduledActivity
 }
 
-func testGetScheduledActivity(t *testing.T, id string) {
-	resp, _ := makeRequest(t, "GET", fmt.Sprintf("/scheduled_activity/%s", id), nil)
+func testGetScheduledActivity(t *testing.T, s session, id string) {
+	resp, _ := makeRequest(t, s.Token, "GET", fmt.Sprintf("/scheduled_activities/%s", id), nil)
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("Expected status OK, got %v", resp.Status)
 	}
 }
 
-func testUpdateScheduledActivity(t *testing.T, id string, updates scheduled_activities.ScheduledActivity) {
-	resp, _ := makeRequest(t, "PUT", fmt.Sprintf("/scheduled_activity/%s", id), updates)
+func testUpdateScheduledActivity(t *testing.T, s session, id string, updates scheduled_activities.ScheduledActivity) {
+	resp, _ := makeRequest(t, s.Token, "PUT", fmt.Sprintf("/scheduled_activity/%s", id), updates)
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("Expected status OK, got %v", resp.Status)
 	}
 }
 
-func testDeleteScheduledActivity(t *testing.T, id string) {
-	resp, _ := makeRequest(t, "DELETE", fmt.Sprintf("/scheduled_activity/%s", id), nil)
+func testDeleteScheduledActivity(t *testing.T, s session, id string) {
+	resp, _ := makeRequest(t, s.Token, "DELETE", fmt.Sprintf("/scheduled_activity/%s", id), nil)
 	if resp.StatusCode != http.StatusNoContent {
 		t.Fatalf("Expected status No Content, got %v", resp.Status)
 	}
 }
 
-func testCreateFriend(t *testing.T, friend friends.Friend) friends.Friend {
-	resp, body := makeRequest(t, "POST", "/friend", friend)
+func testCreateFriendRequest(t *testing.T, s session, to session) friends.Friend {
+	friend := friends.Friend{UserID: s.User.ID, FriendID: to.User.ID}
+	resp, body := makeRequest(t, s.Token, "POST", "/friend/requests", friend)
 	if resp.StatusCode != http.StatusCreated {
 		t.Fatalf("Expected status Created, got %v. Response body: %s", resp.Status, string(body))
 	}
@@ -726,22 +796,67 @@ func testCreateFriend(t *testing.T, friend friends.Friend) friends.Friend {
 	return createdFriend
 }
 
-func testGetFriend(t *testing.T, userID, friendID string) {
-	resp, body := makeRequest(t, "GET", fmt.Sprintf("/friend/%s/%s", userID, friendID), nil)
+// testAcceptFriendRequest accepts, as s, the request sent by from
+func testAcceptFriendRequest(t *testing.T, s session, from session) friends.Friend {
+	resp, body := makeRequest(t, s.Token, "POST", fmt.Sprintf("/friend/requests/%d/%d/accept", from.User.ID, s.User.ID), nil)
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("Expected status OK, got %v. Response body: %s", resp.Status, string(body))
 	}
+
+	var acceptedFriend friends.Friend
+	err := json.Unmarshal(body, &acceptedFriend)
+	if err != nil {
+		t.Fatalf("Failed to parse response: %v. Response body: %s", err, string(body))
+	}
+
+	return acceptedFriend
 }
 
-func testDeleteFriend(t *testing.T, userID, friendID string) {
-	resp, _ := makeRequest(t, "DELETE", fmt.Sprintf("/friend/%s/%s", userID, friendID), nil)
+func testAreFriends(t *testing.T, s session, userID, friendID int) bool {
+	resp, body := makeRequest(t, s.Token, "GET", fmt.Sprintf("/friend/are_friends/%d/%d", userID, friendID), nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v. Response body: %s", resp.Status, string(body))
+	}
+
+	var areFriends bool
+	err := json.Unmarshal(body, &areFriends)
+	if err != nil {
+		t.Fatalf("Failed to parse response: %v. Response body: %s", err, string(body))
+	}
+
+	return areFriends
+}
+
+// testGetFriends checks that the user's first page of friendships includes friendID
+func testGetFriends(t *testing.T, s session, friendID int) {
+	resp, body := makeRequest(t, s.Token, "GET", fmt.Sprintf("/friend/user/%d", s.User.ID), nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v. Response body: %s", resp.Status, string(body))
+	}
+
+	var page query.Page[friends.Friend]
+	err := json.Unmarshal(body, &page)
+	if err != nil {
+		t.Fatalf("Failed to parse response: %v. Response body: %s", err, string(body))
+	}
+
+	for _, friend := range page.Data {
+		if friend.UserID == friendID || friend.FriendID == friendID {
+			return
+		}
+	}
+	t.Fatalf("Friendship with user %d not listed: %s", friendID, string(body))
+}
+
+func testDeleteFriend(t *testing.T, s session, friendID string) {
+	resp, _ := makeRequest(t, s.Token, "DELETE", fmt.Sprintf("/friend/%d/%s", s.User.ID, friendID), nil)
 	if resp.StatusCode != http.StatusNoContent {
 		t.Fatalf("Expected status No Content, got %v", resp.Status)
 	}
 }
 
-func testCreateActivityParticipant(t *testing.T, participant activity_participants.ActivityParticipant) activity_participants.ActivityParticipant {
-	resp, body := makeRequest(t, "POST", "/activity_participant", participant)
+func testCreateActivityParticipant(t *testing.T, s session, participant activity_participants.ActivityParticipant) activity_participants.ActivityParticipant {
+	resp, body := makeRequest(t, s.Token, "POST", "/activity_participant", participant)
 	if resp.StatusCode != http.StatusCreated {
 		t.Fatalf("Expected status Created, got %v", resp.Status)
 	}
@@ -759,29 +874,29 @@ func testCreateActivityParticipant(t *testing.T, participant activity_participan
 	return createdParticipant
 }
 
-func testGetActivityParticipant(t *testing.T, participantID string) {
-	resp, _ := makeRequest(t, "GET", fmt.Sprintf("/activity_participant/%s", participantID), nil)
+func testGetActivityParticipant(t *testing.T, s session, participantID string) {
+	resp, _ := makeRequest(t, s.Token, "GET", fmt.Sprintf("/activity_participant/%s", participantID), nil)
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("Expected status OK, got %v", resp.Status)
 	}
 }
 
-func testUpdateActivityParticipant(t *testing.T, participantID string, updates activity_participants.ActivityParticipant) {
-	resp, body := makeRequest(t, "PUT", fmt.Sprintf("/activity_participant/%s", participantID), updates)
+func testUpdateActivityParticipant(t *testing.T, s session, participantID string, updates activity_participants.ActivityParticipant) {
+	resp, body := makeRequest(t, s.Token, "PUT", fmt.Sprintf("/activity_participant/%s", participantID), updates)
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("Expected status OK, got %v. Response body: %s", resp.Status, string(body))
 	}
 }
 
-func testDeleteActivityParticipant(t *testing.T, participantID string) {
-	resp, _ := makeRequest(t, "DELETE", fmt.Sprintf("/activity_participant/%s", participantID), nil)
+func testDeleteActivityParticipant(t *testing.T, s session, participantID string) {
+	resp, _ := makeRequest(t, s.Token, "DELETE", fmt.Sprintf("/activity_participant/%s", participantID), nil)
 	if resp.StatusCode != http.StatusNoContent {
 		t.Fatalf("Expected status No Content, got %v", resp.Status)
 	}
 }
 
-func testCreateLocation(t *testing.T, location locations.Location) locations.Location {
-	resp, body := makeRequest(t, "POST", "/location", location)
+func testCreateLocation(t *testing.T, s session, location locations.Location) locations.Location {
+	resp, body := makeRequest(t, s.Token, "POST", "/location", location)
 	if resp.StatusCode != http.StatusCreated {
 		t.Fatalf("Expected status Created, got %v", resp.Status)
 	}
@@ -800,15 +915,15 @@ func testCreateLocation(t *testing.T, location locations.Location) locations.Loc
 	return createdLocation
 }
 
-func testGetLocation(t *testing.T, locationID string) {
-	resp, _ := makeRequest(t, "GET", fmt.Sprintf("/location/%s", locationID), nil)
+func testGetLocation(t *testing.T, s session, locationID string) {
+	resp, _ := makeRequest(t, s.Token, "GET", fmt.Sprintf("/locations/%s", locationID), nil)
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("Expected status OK, got %v", resp.Status)
 	}
 }
 
-func testUpdateLocation(t *testing.T, locationID string, updates locations.Location) locations.Location {
-	resp, body := makeRequest(t, "PUT", fmt.Sprintf("/location/%s", locationID), updates)
+func testUpdateLocation(t *testing.T, s session, locationID string, updates locations.Location) locations.Location {
+	resp, body := makeRequest(t, s.Token, "PUT", fmt.Sprintf("/location/%s", locationID), updates)
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("Expected status OK, got %v", resp.Status)
 	}
@@ -822,14 +937,15 @@ func testUpdateLocation(t *testing.T, locationID string, updates locations.Locat
 	return updatedLocation
 }
 
-func testDeleteLocation(t *testing.T, locationID string) {
-	resp, _ := makeRequest(t, "DELETE", fmt.Sprintf("/location/%s", locationID), nil)
+func testDeleteLocation(t *testing.T, s session, locationID string) {
+	resp, _ := makeRequest(t, s.Token, "DELETE", fmt.Sprintf("/location/%s", locationID), nil)
 	if resp.StatusCode != http.StatusNoContent {
 		t.Fatalf("Expected status No Content, got %v", resp.Status)
 	}
 }
 
-func makeRequest(t *testing.T, method, path string, body interface{}) (*http.Response, []byte) {
+// makeRequest sends a request with token as the bearer token, or without one when it is empty
+func makeRequest(t *testing.T, token, method, path string, body interface{}) (*http.Response, []byte) {
 	var reqBody []byte
 	var err error
 
@@ -846,6 +962,9 @@ func makeRequest(t *testing.T, method, path string, body interface{}) (*http.Res
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
@@ -861,3 +980,7 @@ func makeRequest(t *testing.T, method, path string, body interface{}) (*http.Res
 
 	return resp, respBody
 }
+
+func float64Pointer(value float64) *float64 {
+	return &value
+}
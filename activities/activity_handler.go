@@ -1,7 +1,11 @@
 package activities
 
 import (
+	"context"
 	"encoding/json"
+	"friendsocial/activity_participants"
+	"friendsocial/auth"
+	"friendsocial/query"
 	"net/http"
 	"strconv"
 	"strings"
@@ -9,11 +13,12 @@ import (
 
 // ActivityService defines the interface for activity services
 type ActivityService interface {
-	Create(activity Activity) (Activity, error)
-	ReadAll() ([]Activity, error)
-	Read(ids []int) ([]Activity, error)
-	Update(id string, activity Activity) (Activity, bool, error)
-	Delete(id string) (bool, error)
+	Create(ctx context.Context, activity Activity) (Activity, error)
+	ReadAll(ctx context.Context, params query.Params) (query.Page[Activity], error)
+	Read(ctx context.Context, ids []int) ([]Activity, error)
+	Update(ctx context.Context, id string, activity Activity) (Activity, bool, error)
+	Delete(ctx context.Context, id string) (bool, error)
+	CanEdit(ctx context.Context, id string, userID int) (bool, error)
 }
 
 // ActivityError represents an error response
@@ -54,7 +59,15 @@ func (aH *ActivityHTTPHandler) HandleHTTPPost(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	newActivity, err := aH.activityService.Create(activity)
+	// The caller creates it, whatever the body says
+	callerID, _ := auth.CallerID(r.Context())
+	activity.CreatedBy = &callerID
+
+	newActivity, err := aH.activityService.Create(r.Context(), activity)
+	if err == activity_participants.ErrInvalidCapacity {
+		aH.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	if err != nil {
 		aH.errorResponse(w, http.StatusInternalServerError, err.Error())
 		return
@@ -72,20 +85,29 @@ func (aH *ActivityHTTPHandler) HandleHTTPPost(w http.ResponseWriter, r *http.Req
 // HandleHTTPGet handles fetching all activities
 //
 //	@Summary		Get all activities
-//	@Description	Get all activities
+//	@Description	Get all activities. Filter with id, name, location_id and user_created, e.g. ?user_created=true
 //	@Tags			activities
 //	@Produce		json
-//	@Success		200	{array}		Activity
-//	@Failure		400	{object}	ActivityError
-//	@Failure		500	{object}	ActivityError
+//	@Param			limit	query		int		false	"Items per page, defaults to 50, at most 200"
+//	@Param			cursor	query		string	false	"next_cursor of the previous page"
+//	@Param			sort	query		string	false	"Field to sort by, prefixed with - for descending: id, name"
+//	@Success		200		{object}	query.Page[Activity]
+//	@Failure		400		{object}	ActivityError
+//	@Failure		500		{object}	ActivityError
 //	@Router			/activities [get]
 func (aH *ActivityHTTPHandler) HandleHTTPGet(w http.ResponseWriter, r *http.Request) {
-	activities, err := aH.activityService.ReadAll()
+	params, err := query.Parse(r.URL.RawQuery, listSpec)
 	if err != nil {
 		aH.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
+	activities, err := aH.activityService.ReadAll(r.Context(), params)
+	if err != nil {
+		aH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(activities)
 	if err != nil {
@@ -119,7 +141,7 @@ func (aH *ActivityHTTPHandler) HandleHTTPGetWithID(w http.ResponseWriter, r *htt
 		}
 		intIDs = append(intIDs, intID)
 	}
-	activities, err := aH.activityService.Read(intIDs)
+	activities, err := aH.activityService.Read(r.Context(), intIDs)
 	if err != nil {
 		aH.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -149,6 +171,7 @@ func (aH *ActivityHTTPHandler) HandleHTTPGetWithID(w http.ResponseWriter, r *htt
 //	@Param			activity	body		Activity	true	"Updated Activity object"
 //	@Success		200			{object}	Activity
 //	@Failure		400			{object}	ActivityError
+//	@Failure		403			{object}	ActivityError
 //	@Failure		404			{object}	ActivityError
 //	@Failure		500			{object}	ActivityError
 //	@Router			/activities/{id} [put]
@@ -162,7 +185,7 @@ func (aH *ActivityHTTPHandler) HandleHTTPPut(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	activity, found, err := aH.activityService.Update(id, updatedActivity)
+	activity, found, err := aH.activityService.Update(r.Context(), id, updatedActivity)
 	if err != nil {
 		aH.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -189,13 +212,14 @@ func (aH *ActivityHTTPHandler) HandleHTTPPut(w http.ResponseWriter, r *http.Requ
 //	@Param			id	path	string	true	"Activity ID"
 //	@Success		204
 //	@Failure		400	{object}	ActivityError
+//	@Failure		403	{object}	ActivityError
 //	@Failure		404	{object}	ActivityError
 //	@Failure		500	{object}	ActivityError
 //	@Router			/activities/{id} [delete]
 func (aH *ActivityHTTPHandler) HandleHTTPDelete(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 
-	found, err := aH.activityService.Delete(id)
+	found, err := aH.activityService.Delete(r.Context(), id)
 	if err != nil {
 		aH.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -209,6 +233,28 @@ func (aH *ActivityHTTPHandler) HandleHTTPDelete(w http.ResponseWriter, r *http.R
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// RegisterRoutes adds the activity routes to mux
+func (aH *ActivityHTTPHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("POST /activity", aH.HandleHTTPPost)
+	mux.HandleFunc("GET /activities", aH.HandleHTTPGet)
+	mux.HandleFunc("GET /activities/{ids}", aH.HandleHTTPGetWithID)
+	mux.HandleFunc("PUT /activity/{id}", aH.HandleHTTPPut)
+	mux.HandleFunc("DELETE /activity/{id}", aH.HandleHTTPDelete)
+}
+
+// AuthorizationRules returns the ownership rules for activity routes
+func (aH *ActivityHTTPHandler) AuthorizationRules() map[string]auth.Rule {
+	return map[string]auth.Rule{
+		"PUT /activity/{id}":    aH.canEdit,
+		"DELETE /activity/{id}": aH.canEdit,
+	}
+}
+
+// canEdit allows only the creator of the activity in the path
+func (aH *ActivityHTTPHandler) canEdit(r *http.Request, callerID int) (bool, error) {
+	return aH.activityService.CanEdit(r.Context(), r.PathValue("id"), callerID)
+}
+
 func (aH *ActivityHTTPHandler) errorResponse(w http.ResponseWriter, statusCode int, errorString string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
@@ -2,8 +2,10 @@ package activities
 
 import (
 	"context"
-	"sync"
+	"friendsocial/activity_participants"
+	"friendsocial/query"
 
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/lib/pq"
 )
@@ -16,10 +18,14 @@ type Activity struct {
 	EstimatedTime string `json:"estimated_time"` // Interval type stored as string for simplicity
 	LocationID    int    `json:"location_id"`
 	UserCreated   bool   `json:"user_created"` // Add this field
+	// Default participant limits for scheduled activities that do not set their own
+	MinParticipants *int `json:"min_participants,omitempty"`
+	MaxParticipants *int `json:"max_participants,omitempty"`
+	// CreatedBy is the only user who may edit or delete the activity. It is set on creation.
+	CreatedBy *int `json:"created_by"`
 }
 
 type Service struct {
-	sync.Mutex
 	db *pgxpool.Pool
 }
 
@@ -29,14 +35,15 @@ func NewService(db *pgxpool.Pool) *Service {
 	}
 }
 
-func (activityService *Service) Create(activity Activity) (Activity, error) {
-	activityService.Lock()
-	defer activityService.Unlock()
+func (activityService *Service) Create(ctx context.Context, activity Activity) (Activity, error) {
+	if err := activity_participants.ValidateCapacity(activity.MinParticipants, activity.MaxParticipants); err != nil {
+		return Activity{}, err
+	}
 
 	err := activityService.db.QueryRow(
-		context.Background(),
-		"INSERT INTO activities (name, emoji, description, estimated_time, location_id, user_created) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
-		activity.Name, activity.Emoji, activity.Description, activity.EstimatedTime, activity.LocationID, activity.UserCreated,
+		ctx,
+		"INSERT INTO activities (name, emoji, description, estimated_time, location_id, user_created, min_participants, max_participants, created_by) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id",
+		activity.Name, activity.Emoji, activity.Description, activity.EstimatedTime, activity.LocationID, activity.UserCreated, activity.MinParticipants, activity.MaxParticipants, activity.CreatedBy,
 	).Scan(&activity.ID)
 
 	if err != nil {
@@ -46,39 +53,50 @@ func (activityService *Service) Create(activity Activity) (Activity, error) {
 	return activity, nil
 }
 
-func (activityService *Service) ReadAll() ([]Activity, error) {
-	activityService.Lock()
-	defer activityService.Unlock()
+// listSpec are the fields activities can be listed by
+var listSpec = query.Spec{
+	Fields: map[string]query.Field{
+		"id":           {Column: "id", Kind: query.Int},
+		"name":         {Column: "name", Kind: query.String, Sortable: true},
+		"location_id":  {Column: "location_id", Kind: query.Int},
+		"user_created": {Column: "COALESCE(user_created, FALSE)", Kind: query.Bool},
+	},
+	Key: "id",
+}
 
-	rows, err := activityService.db.Query(context.Background(), "SELECT id, name, emoji, description, estimated_time::text, location_id, user_created FROM activities")
+func (activityService *Service) ReadAll(ctx context.Context, params query.Params) (query.Page[Activity], error) {
+	sql, args := params.Apply("SELECT id, name, emoji, description, estimated_time::text, location_id, user_created, min_participants, max_participants, created_by FROM activities")
+	rows, err := activityService.db.Query(ctx, sql, args...)
 	if err != nil {
-		return nil, err
+		return query.Page[Activity]{}, err
 	}
 	defer rows.Close()
 
 	var activities []Activity
 	for rows.Next() {
 		var activity Activity
-		if err := rows.Scan(&activity.ID, &activity.Name, &activity.Emoji, &activity.Description, &activity.EstimatedTime, &activity.LocationID, &activity.UserCreated); err != nil {
-			return nil, err
+		if err := rows.Scan(&activity.ID, &activity.Name, &activity.Emoji, &activity.Description, &activity.EstimatedTime, &activity.LocationID, &activity.UserCreated, &activity.MinParticipants, &activity.MaxParticipants, &activity.CreatedBy); err != nil {
+			return query.Page[Activity]{}, err
 		}
 		activities = append(activities, activity)
 	}
+	if err := rows.Err(); err != nil {
+		return query.Page[Activity]{}, err
+	}
 
-	return activities, nil
+	return query.NewPage(params, activities, func(activity Activity, sort string) (int, interface{}) {
+		return activity.ID, activity.Name
+	}), nil
 }
 
-func (activityService *Service) Read(ids []int) ([]Activity, error) {
-	activityService.Lock()
-	defer activityService.Unlock()
-
+func (activityService *Service) Read(ctx context.Context, ids []int) ([]Activity, error) {
 	if len(ids) == 0 {
 		return []Activity{}, nil
 	}
 
-	query := "SELECT id, name, emoji, description, estimated_time::text, location_id, user_created FROM activities WHERE id = ANY($1)"
+	query := "SELECT id, name, emoji, description, estimated_time::text, location_id, user_created, min_participants, max_participants, created_by FROM activities WHERE id = ANY($1)"
 	var activities []Activity
-	rows, err := activityService.db.Query(context.Background(), query, pq.Array(ids))
+	rows, err := activityService.db.Query(ctx, query, pq.Array(ids))
 	if err != nil {
 		return nil, err
 	}
@@ -87,7 +105,7 @@ func (activityService *Service) Read(ids []int) ([]Activity, error) {
 	for rows.Next() {
 		var activity Activity
 		if err := rows.Scan(&activity.ID, &activity.Name, &activity.Emoji, &activity.Description,
-			&activity.EstimatedTime, &activity.LocationID, &activity.UserCreated); err != nil {
+			&activity.EstimatedTime, &activity.LocationID, &activity.UserCreated, &activity.MinParticipants, &activity.MaxParticipants, &activity.CreatedBy); err != nil {
 			return nil, err
 		}
 		activities = append(activities, activity)
@@ -100,30 +118,29 @@ func (activityService *Service) Read(ids []int) ([]Activity, error) {
 	return activities, nil
 }
 
-func (activityService *Service) Update(id string, activity Activity) (Activity, bool, error) {
-	activityService.Lock()
-	defer activityService.Unlock()
+func (activityService *Service) Update(ctx context.Context, id string, activity Activity) (Activity, bool, error) {
+	if err := activity_participants.ValidateCapacity(activity.MinParticipants, activity.MaxParticipants); err != nil {
+		return Activity{}, false, err
+	}
 
-	cmdTag, err := activityService.db.Exec(context.Background(),
-		"UPDATE activities SET name = $1, emoji = $2, description = $3, estimated_time = $4, location_id = $5, user_created = $6 WHERE id = $7",
-		activity.Name, activity.Emoji, activity.Description, activity.EstimatedTime, activity.LocationID, activity.UserCreated, id)
+	// created_by is kept
+	err := activityService.db.QueryRow(ctx,
+		"UPDATE activities SET name = $1, emoji = $2, description = $3, estimated_time = $4, location_id = $5, user_created = $6, min_participants = $7, max_participants = $8 WHERE id = $9 RETURNING id, created_by",
+		activity.Name, activity.Emoji, activity.Description, activity.EstimatedTime, activity.LocationID, activity.UserCreated, activity.MinParticipants, activity.MaxParticipants, id,
+	).Scan(&activity.ID, &activity.CreatedBy)
 
 	if err != nil {
+		if err == pgx.ErrNoRows {
+			return Activity{}, false, nil
+		}
 		return Activity{}, false, err
 	}
 
-	if cmdTag.RowsAffected() == 0 {
-		return Activity{}, false, nil
-	}
-
 	return activity, true, nil
 }
 
-func (activityService *Service) Delete(id string) (bool, error) {
-	activityService.Lock()
-	defer activityService.Unlock()
-
-	cmdTag, err := activityService.db.Exec(context.Background(), "DELETE FROM activities WHERE id = $1", id)
+func (activityService *Service) Delete(ctx context.Context, id string) (bool, error) {
+	cmdTag, err := activityService.db.Exec(ctx, "DELETE FROM activities WHERE id = $1", id)
 	if err != nil {
 		return false, err
 	}
@@ -134,3 +151,18 @@ func (activityService *Service) Delete(id string) (bool, error) {
 
 	return true, nil
 }
+
+// CanEdit reports whether a user may change an activity, which only its creator may. Unknown IDs
+// report true so that callers can answer 404 rather than 403.
+func (activityService *Service) CanEdit(ctx context.Context, id string, userID int) (bool, error) {
+	var allowed bool
+	err := activityService.db.QueryRow(ctx,
+		`SELECT NOT EXISTS (SELECT 1 FROM activities WHERE id = $1)
+		     OR EXISTS (SELECT 1 FROM activities WHERE id = $1 AND created_by = $2)`,
+		id, userID).Scan(&allowed)
+	if err != nil {
+		return false, err
+	}
+
+	return allowed, nil
+}
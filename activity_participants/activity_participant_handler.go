@@ -1,20 +1,28 @@
 package activity_participants
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"friendsocial/auth"
+	"friendsocial/query"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
 // ActivityParticipantService defines the methods for handling activity participants
 type ActivityParticipantService interface {
-	Create(participant ActivityParticipant) (ActivityParticipant, error)
-	ReadAll() ([]ActivityParticipant, error)
-	Read(ids []string) ([]ActivityParticipant, error)
-	Update(id string, participant ActivityParticipant) (ActivityParticipant, bool, error)
-	Delete(id string) (bool, error)
-	GetActivitiesByUserID(userID string) ([]ActivityParticipant, error)
-	GetParticipantsByScheduledActivityID(scheduledActivityID []string) ([]ActivityParticipant, error)
+	Create(ctx context.Context, participant ActivityParticipant) (ActivityParticipant, error)
+	ReadAll(ctx context.Context, params query.Params) (query.Page[ActivityParticipant], error)
+	Read(ctx context.Context, ids []string) ([]ActivityParticipant, error)
+	Update(ctx context.Context, id string, participant ActivityParticipant) (ActivityParticipant, bool, error)
+	Delete(ctx context.Context, id string) (bool, error)
+	GetActivitiesByUserID(ctx context.Context, userID string) ([]ActivityParticipant, error)
+	GetParticipantsByScheduledActivityID(ctx context.Context, scheduledActivityID []string) ([]ActivityParticipant, error)
+	CanManage(ctx context.Context, scheduledActivityID int, userID int) (bool, error)
+	RSVP(ctx context.Context, scheduledActivityID int, userID int, rsvp RSVPRequest) (ActivityParticipant, bool, error)
+	ReadRSVPSummaries(ctx context.Context, scheduledActivityIDs []string) ([]RSVPSummary, error)
 }
 
 // ActivityParticipantError represents the structure of an error response
@@ -56,7 +64,15 @@ func (aH *ActivityParticipantHTTPHandler) HandleHTTPPost(w http.ResponseWriter,
 		return
 	}
 
-	newParticipant, err := aH.activityParticipantService.Create(participant)
+	newParticipant, err := aH.activityParticipantService.Create(r.Context(), participant)
+	if err == ErrBlocked {
+		aH.errorResponse(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if errors.Is(err, ErrInvalidStatus) || errors.Is(err, ErrInvalidTransition) {
+		aH.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	if err != nil {
 		aH.errorResponse(w, http.StatusInternalServerError, err.Error())
 		return
@@ -74,20 +90,29 @@ func (aH *ActivityParticipantHTTPHandler) HandleHTTPPost(w http.ResponseWriter,
 // HandleHTTPGet retrieves all activity participants
 //
 //	@Summary		Get all activity participants
-//	@Description	Retrieve all activity participants
+//	@Description	Retrieve all activity participants. Filter with id, user_id, scheduled_activity_id, invite_status and responded_at, e.g. ?invite_status=Accepted
 //	@Tags			participants
 //	@Produce		json
-//	@Success		200	{array}		ActivityParticipant
-//	@Failure		400	{object}	ActivityParticipantError
-//	@Failure		500	{object}	ActivityParticipantError
+//	@Param			limit	query		int		false	"Items per page, defaults to 50, at most 200"
+//	@Param			cursor	query		string	false	"next_cursor of the previous page"
+//	@Param			sort	query		string	false	"Field to sort by, prefixed with - for descending: id"
+//	@Success		200		{object}	query.Page[ActivityParticipant]
+//	@Failure		400		{object}	ActivityParticipantError
+//	@Failure		500		{object}	ActivityParticipantError
 //	@Router			/participants [get]
 func (aH *ActivityParticipantHTTPHandler) HandleHTTPGet(w http.ResponseWriter, r *http.Request) {
-	participants, err := aH.activityParticipantService.ReadAll()
+	params, err := query.Parse(r.URL.RawQuery, listSpec)
 	if err != nil {
 		aH.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
+	participants, err := aH.activityParticipantService.ReadAll(r.Context(), params)
+	if err != nil {
+		aH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(participants)
 	if err != nil {
@@ -111,7 +136,7 @@ func (aH *ActivityParticipantHTTPHandler) HandleHTTPGet(w http.ResponseWriter, r
 func (aH *ActivityParticipantHTTPHandler) HandleHTTPGetWithID(w http.ResponseWriter, r *http.Request) {
 	ids := r.PathValue("ids")
 
-	participants, err := aH.activityParticipantService.Read([]string{ids})
+	participants, err := aH.activityParticipantService.Read(r.Context(), []string{ids})
 	if err != nil {
 		aH.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -142,6 +167,7 @@ func (aH *ActivityParticipantHTTPHandler) HandleHTTPGetWithID(w http.ResponseWri
 //	@Success		200			{object}	ActivityParticipant
 //	@Failure		400			{object}	ActivityParticipantError
 //	@Failure		404			{object}	ActivityParticipantError
+//	@Failure		409			{object}	ActivityParticipantError
 //	@Failure		500			{object}	ActivityParticipantError
 //	@Router			/participants/{id} [put]
 func (aH *ActivityParticipantHTTPHandler) HandleHTTPPut(w http.ResponseWriter, r *http.Request) {
@@ -154,7 +180,11 @@ func (aH *ActivityParticipantHTTPHandler) HandleHTTPPut(w http.ResponseWriter, r
 		return
 	}
 
-	participant, found, err := aH.activityParticipantService.Update(id, updatedParticipant)
+	participant, found, err := aH.activityParticipantService.Update(r.Context(), id, updatedParticipant)
+	if errors.Is(err, ErrInvalidTransition) {
+		aH.errorResponse(w, http.StatusConflict, err.Error())
+		return
+	}
 	if err != nil {
 		aH.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -186,7 +216,7 @@ func (aH *ActivityParticipantHTTPHandler) HandleHTTPPut(w http.ResponseWriter, r
 func (aH *ActivityParticipantHTTPHandler) HandleHTTPDelete(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 
-	found, err := aH.activityParticipantService.Delete(id)
+	found, err := aH.activityParticipantService.Delete(r.Context(), id)
 	if err != nil {
 		aH.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -214,7 +244,7 @@ func (aH *ActivityParticipantHTTPHandler) HandleHTTPDelete(w http.ResponseWriter
 func (aH *ActivityParticipantHTTPHandler) HandleHTTPGetActivitiesByUserID(w http.ResponseWriter, r *http.Request) {
 	userID := r.PathValue("user_id")
 
-	participants, err := aH.activityParticipantService.GetActivitiesByUserID(userID)
+	participants, err := aH.activityParticipantService.GetActivitiesByUserID(r.Context(), userID)
 	if err != nil {
 		aH.errorResponse(w, http.StatusInternalServerError, err.Error())
 		return
@@ -243,7 +273,7 @@ func (aH *ActivityParticipantHTTPHandler) HandleHTTPGetParticipantsByActivityID(
 	scheduledActivityIDs := r.PathValue("scheduled_activity_ids")
 
 	idList := strings.Split(scheduledActivityIDs, ",")
-	participants, err := aH.activityParticipantService.GetParticipantsByScheduledActivityID(idList)
+	participants, err := aH.activityParticipantService.GetParticipantsByScheduledActivityID(r.Context(), idList)
 	if err != nil {
 		aH.errorResponse(w, http.StatusInternalServerError, err.Error())
 		return
@@ -257,6 +287,174 @@ func (aH *ActivityParticipantHTTPHandler) HandleHTTPGetParticipantsByActivityID(
 	}
 }
 
+// HandleHTTPPostRSVP records the caller's response to their invitation
+//
+//	@Summary		RSVP to a scheduled activity
+//	@Description	Accept, decline, or answer maybe or tentative to the caller's invitation, with an optional comment
+//	@Tags			participants
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		int			true	"Scheduled Activity ID"
+//	@Param			rsvp	body		RSVPRequest	true	"Response"
+//	@Success		200		{object}	ActivityParticipant
+//	@Failure		400		{object}	ActivityParticipantError
+//	@Failure		404		{object}	ActivityParticipantError
+//	@Failure		409		{object}	ActivityParticipantError
+//	@Failure		500		{object}	ActivityParticipantError
+//	@Router			/scheduled_activities/{id}/rsvp [post]
+func (aH *ActivityParticipantHTTPHandler) HandleHTTPPostRSVP(w http.ResponseWriter, r *http.Request) {
+	scheduledActivityID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		aH.errorResponse(w, http.StatusBadRequest, "invalid scheduled activity id")
+		return
+	}
+
+	callerID, ok := auth.CallerID(r.Context())
+	if !ok {
+		aH.errorResponse(w, http.StatusUnauthorized, "missing caller")
+		return
+	}
+
+	var rsvp RSVPRequest
+	if err := json.NewDecoder(r.Body).Decode(&rsvp); err != nil {
+		aH.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	participant, found, err := aH.activityParticipantService.RSVP(r.Context(), scheduledActivityID, callerID, rsvp)
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrInvalidStatus):
+		aH.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	case errors.Is(err, ErrInvalidTransition), errors.Is(err, ErrRSVPClosed):
+		aH.errorResponse(w, http.StatusConflict, err.Error())
+		return
+	default:
+		aH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if !found {
+		aH.errorResponse(w, http.StatusNotFound, "no invitation to this scheduled activity")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(participant)
+	if err != nil {
+		aH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// HandleHTTPGetRSVPSummaries counts and lists the invitees of scheduled activities by status
+//
+//	@Summary		Get RSVP summaries
+//	@Description	Per-status counts and attendee lists for one or more comma-separated scheduled activities
+//	@Tags			participants
+//	@Produce		json
+//	@Param			ids	path		string	true	"Scheduled Activity IDs"
+//	@Success		200	{array}		RSVPSummary
+//	@Failure		400	{object}	ActivityParticipantError
+//	@Failure		500	{object}	ActivityParticipantError
+//	@Router			/scheduled_activities/{ids}/rsvps [get]
+func (aH *ActivityParticipantHTTPHandler) HandleHTTPGetRSVPSummaries(w http.ResponseWriter, r *http.Request) {
+	idList := strings.Split(r.PathValue("ids"), ",")
+	for _, id := range idList {
+		if _, err := strconv.Atoi(id); err != nil {
+			aH.errorResponse(w, http.StatusBadRequest, "invalid scheduled activity id: "+id)
+			return
+		}
+	}
+
+	summaries, err := aH.activityParticipantService.ReadRSVPSummaries(r.Context(), idList)
+	if err != nil {
+		aH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(summaries)
+	if err != nil {
+		aH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// RegisterRoutes adds the activity participant routes to mux
+func (aH *ActivityParticipantHTTPHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("POST /activity_participant", aH.HandleHTTPPost)
+	mux.HandleFunc("GET /activity_participants", aH.HandleHTTPGet)
+	mux.HandleFunc("GET /activity_participant/{ids}", aH.HandleHTTPGetWithID)
+	mux.HandleFunc("PUT /activity_participant/{id}", aH.HandleHTTPPut)
+	mux.HandleFunc("DELETE /activity_participant/{id}", aH.HandleHTTPDelete)
+	mux.HandleFunc("GET /activity_participants/user/{user_id}", aH.HandleHTTPGetActivitiesByUserID)
+	mux.HandleFunc("GET /activity_participants/scheduled_activities/{scheduled_activity_ids}", aH.HandleHTTPGetParticipantsByActivityID)
+	mux.HandleFunc("POST /scheduled_activities/{id}/rsvp", aH.HandleHTTPPostRSVP)
+	mux.HandleFunc("GET /scheduled_activities/{ids}/rsvps", aH.HandleHTTPGetRSVPSummaries)
+}
+
+// AuthorizationRules returns the ownership rules for activity participant routes. Organizers
+// invite users and remove them; invitees answer and leave through their own rows.
+func (aH *ActivityParticipantHTTPHandler) AuthorizationRules() map[string]auth.Rule {
+	return map[string]auth.Rule{
+		"POST /activity_participant":        auth.AllOf(aH.canManageBodyActivity, aH.isBodyInvitation),
+		"PUT /activity_participant/{id}":    auth.AllOf(aH.isParticipant, aH.isBodyUser),
+		"DELETE /activity_participant/{id}": auth.AnyOf(aH.isParticipant, aH.canManageParticipantActivity),
+	}
+}
+
+// isParticipant allows the invitee of the participant row in the path
+func (aH *ActivityParticipantHTTPHandler) isParticipant(r *http.Request, callerID int) (bool, error) {
+	participants, err := aH.activityParticipantService.Read(r.Context(), []string{r.PathValue("id")})
+	if err != nil {
+		return false, err
+	}
+	if len(participants) == 0 {
+		// Let the handler answer 404
+		return true, nil
+	}
+	return participants[0].UserID == callerID, nil
+}
+
+// canManageParticipantActivity allows organizers of the scheduled activity the participant row belongs to
+func (aH *ActivityParticipantHTTPHandler) canManageParticipantActivity(r *http.Request, callerID int) (bool, error) {
+	participants, err := aH.activityParticipantService.Read(r.Context(), []string{r.PathValue("id")})
+	if err != nil || len(participants) == 0 {
+		return false, err
+	}
+	return aH.activityParticipantService.CanManage(r.Context(), participants[0].ScheduledActivityID, callerID)
+}
+
+// isBodyUser allows callers to write participant rows only for themselves
+func (aH *ActivityParticipantHTTPHandler) isBodyUser(r *http.Request, callerID int) (bool, error) {
+	var participant ActivityParticipant
+	if err := auth.PeekJSON(r, &participant); err != nil {
+		// Let the handler answer 400
+		return true, nil
+	}
+	return participant.UserID == callerID, nil
+}
+
+// canManageBodyActivity allows organizers to invite others to their scheduled activity
+func (aH *ActivityParticipantHTTPHandler) canManageBodyActivity(r *http.Request, callerID int) (bool, error) {
+	var participant ActivityParticipant
+	if err := auth.PeekJSON(r, &participant); err != nil {
+		return true, nil
+	}
+	return aH.activityParticipantService.CanManage(r.Context(), participant.ScheduledActivityID, callerID)
+}
+
+// isBodyInvitation allows plain invitations; only invitees may answer on their own behalf
+func (aH *ActivityParticipantHTTPHandler) isBodyInvitation(r *http.Request, callerID int) (bool, error) {
+	var participant ActivityParticipant
+	if err := auth.PeekJSON(r, &participant); err != nil {
+		return true, nil
+	}
+	return participant.InviteStatus == "" || participant.InviteStatus == StatusPending, nil
+}
+
 func (aH *ActivityParticipantHTTPHandler) errorResponse(w http.ResponseWriter, statusCode int, errorString string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
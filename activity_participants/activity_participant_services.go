@@ -2,21 +2,46 @@ package activity_participants
 
 import (
 	"context"
-	"sync"
-
+	"errors"
+	"fmt"
+	"friendsocial/notifications"
+	"friendsocial/query"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/lib/pq"
 )
 
+var (
+	// ErrBlocked is returned when an invitee and someone already attending have blocked each other
+	ErrBlocked = errors.New("user cannot be invited because of a block")
+	// ErrMoved is returned when an update would move an invitation to another scheduled activity
+	ErrMoved = errors.New("scheduled_activity_id cannot be changed, invite the user to the other scheduled activity instead")
+)
+
 type ActivityParticipant struct {
-	ID                  int    `json:"id"`
-	UserID              int    `json:"user_id"`
-	ScheduledActivityID int    `json:"scheduled_activity_id"`
-	InviteStatus        string `json:"invite_status"`
+	ID                  int        `json:"id"`
+	UserID              int        `json:"user_id"`
+	ScheduledActivityID int        `json:"scheduled_activity_id"`
+	InviteStatus        string     `json:"invite_status"`
+	Comment             *string    `json:"comment,omitempty"`
+	RespondedAt         *time.Time `json:"responded_at,omitempty"`
+	WaitlistedAt        *time.Time `json:"waitlisted_at,omitempty"` // orders the waitlist
+}
+
+// participantColumns is the column list scanned by scanParticipant
+const participantColumns = "id, user_id, scheduled_activity_id, invite_status, comment, responded_at, waitlisted_at"
+
+func scanParticipant(row pgx.Row) (ActivityParticipant, error) {
+	var participant ActivityParticipant
+	err := row.Scan(&participant.ID, &participant.UserID, &participant.ScheduledActivityID, &participant.InviteStatus,
+		&participant.Comment, &participant.RespondedAt, &participant.WaitlistedAt)
+	return participant, err
 }
 
 type Service struct {
-	sync.Mutex
 	db *pgxpool.Pool
 }
 
@@ -26,61 +51,132 @@ func NewService(db *pgxpool.Pool) *Service {
 	}
 }
 
-func (s *Service) Create(participant ActivityParticipant) (ActivityParticipant, error) {
-	s.Lock()
-	defer s.Unlock()
-
+// Create invites a user to a scheduled activity. The invitation is Pending unless invite_status
+// says otherwise; joining as Accepted lands on the waitlist when the activity is full.
+func (s *Service) Create(ctx context.Context, participant ActivityParticipant) (ActivityParticipant, error) {
+	// Blocked users are never invited alongside the organizer or participants who blocked them
+	var blocked bool
 	err := s.db.QueryRow(
-		context.Background(),
-		`INSERT INTO activity_participants 
-		(user_id, scheduled_activity_id) 
-		VALUES ($1, $2) 
-		RETURNING id`,
+		ctx,
+		`SELECT EXISTS (
+		     SELECT 1 FROM friends f
+		     JOIN (
+		         SELECT user_id FROM activity_participants WHERE scheduled_activity_id = $2
+		         UNION
+		         SELECT organizer_id FROM scheduled_activities WHERE id = $2
+		     ) attendees ON f.user_ordered_id1 = LEAST($1::int, attendees.user_id)
+		                AND f.user_ordered_id2 = GREATEST($1::int, attendees.user_id)
+		     WHERE f.status = 'blocked')`,
 		participant.UserID, participant.ScheduledActivityID,
-	).Scan(&participant.ID)
+	).Scan(&blocked)
+	if err != nil {
+		return ActivityParticipant{}, err
+	}
+	if blocked {
+		return ActivityParticipant{}, ErrBlocked
+	}
+
+	if participant.InviteStatus == "" {
+		participant.InviteStatus = StatusPending
+	}
+	if err := checkTransition(StatusPending, participant.InviteStatus); err != nil {
+		return ActivityParticipant{}, err
+	}
 
+	tx, err := s.db.Begin(ctx)
 	if err != nil {
 		return ActivityParticipant{}, err
 	}
+	defer tx.Rollback(context.Background())
+
+	// Joining directly is an acceptance and waits for a free place like any other
+	status, err := resolveStatus(ctx, tx, participant.ScheduledActivityID, 0, StatusPending, participant.InviteStatus)
+	if err == pgx.ErrNoRows {
+		// Let the foreign key report the unknown scheduled activity
+		status, err = participant.InviteStatus, nil
+	}
+	if err != nil {
+		return ActivityParticipant{}, err
+	}
+
+	participant, err = scanParticipant(tx.QueryRow(
+		ctx,
+		`INSERT INTO activity_participants 
+		(user_id, scheduled_activity_id, invite_status, comment, responded_at, waitlisted_at) 
+		VALUES ($1, $2, $3, $4,
+		        CASE WHEN $3 <> 'Pending' THEN now() END,
+		        CASE WHEN $3 = 'Waitlisted' THEN now() END) 
+		RETURNING `+participantColumns,
+		participant.UserID, participant.ScheduledActivityID, status, participant.Comment,
+	))
+	if err != nil {
+		return ActivityParticipant{}, err
+	}
+
+	if participant.InviteStatus == StatusPending {
+		err = notifications.Emit(ctx, tx, notifications.Notification{
+			UserID:              participant.UserID,
+			Type:                notifications.TypeActivityInvite,
+			ScheduledActivityID: &participant.ScheduledActivityID,
+		})
+	} else {
+		err = notifyRSVP(ctx, tx, participant)
+	}
+	if err != nil {
+		return ActivityParticipant{}, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return ActivityParticipant{}, err
+	}
 
 	return participant, nil
 }
 
-func (s *Service) ReadAll() ([]ActivityParticipant, error) {
-	s.Lock()
-	defer s.Unlock()
+// listSpec are the fields participants can be listed by
+var listSpec = query.Spec{
+	Fields: map[string]query.Field{
+		"id":                    {Column: "id", Kind: query.Int},
+		"user_id":               {Column: "user_id", Kind: query.Int},
+		"scheduled_activity_id": {Column: "scheduled_activity_id", Kind: query.Int},
+		"invite_status":         {Column: "invite_status", Kind: query.String},
+		"responded_at":          {Column: "responded_at", Kind: query.Time},
+	},
+	Key: "id",
+}
 
-	rows, err := s.db.Query(context.Background(),
-		"SELECT id, user_id, scheduled_activity_id, invite_status FROM activity_participants")
+func (s *Service) ReadAll(ctx context.Context, params query.Params) (query.Page[ActivityParticipant], error) {
+	sql, args := params.Apply("SELECT " + participantColumns + " FROM activity_participants")
+	rows, err := s.db.Query(ctx, sql, args...)
 	if err != nil {
-		return nil, err
+		return query.Page[ActivityParticipant]{}, err
 	}
 	defer rows.Close()
 
 	var participants []ActivityParticipant
 	for rows.Next() {
-		var participant ActivityParticipant
-		err := rows.Scan(
-			&participant.ID, &participant.UserID, &participant.ScheduledActivityID, &participant.InviteStatus)
+		participant, err := scanParticipant(rows)
 		if err != nil {
-			return nil, err
+			return query.Page[ActivityParticipant]{}, err
 		}
 		participants = append(participants, participant)
 	}
+	if err := rows.Err(); err != nil {
+		return query.Page[ActivityParticipant]{}, err
+	}
 
-	return participants, nil
+	return query.NewPage(params, participants, func(participant ActivityParticipant, sort string) (int, interface{}) {
+		return participant.ID, nil
+	}), nil
 }
 
-func (s *Service) Read(ids []string) ([]ActivityParticipant, error) {
-	s.Lock()
-	defer s.Unlock()
-
+func (s *Service) Read(ctx context.Context, ids []string) ([]ActivityParticipant, error) {
 	if len(ids) == 0 {
 		return []ActivityParticipant{}, nil
 	}
 
-	query := "SELECT id, user_id, scheduled_activity_id, invite_status FROM activity_participants WHERE id = ANY($1)"
-	rows, err := s.db.Query(context.Background(), query, pq.Array(ids))
+	query := "SELECT " + participantColumns + " FROM activity_participants WHERE id = ANY($1)"
+	rows, err := s.db.Query(ctx, query, pq.Array(ids))
 	if err != nil {
 		return nil, err
 	}
@@ -88,8 +184,8 @@ func (s *Service) Read(ids []string) ([]ActivityParticipant, error) {
 
 	var participants []ActivityParticipant
 	for rows.Next() {
-		var participant ActivityParticipant
-		if err := rows.Scan(&participant.ID, &participant.UserID, &participant.ScheduledActivityID, &participant.InviteStatus); err != nil {
+		participant, err := scanParticipant(rows)
+		if err != nil {
 			return nil, err
 		}
 		participants = append(participants, participant)
@@ -102,50 +198,122 @@ func (s *Service) Read(ids []string) ([]ActivityParticipant, error) {
 	return participants, nil
 }
 
-func (s *Service) Update(id string, participant ActivityParticipant) (ActivityParticipant, bool, error) {
-	s.Lock()
-	defer s.Unlock()
+// Update rewrites a participant row. A change of invite_status must follow the RSVP transition
+// table and stamps responded_at; an empty invite_status keeps the current one. Acceptances are
+// subject to the scheduled activity's capacity like RSVPs are. The row stays with its scheduled
+// activity: a zero scheduled_activity_id keeps it and any other returns ErrMoved.
+func (s *Service) Update(ctx context.Context, id string, participant ActivityParticipant) (ActivityParticipant, bool, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return ActivityParticipant{}, false, err
+	}
+	defer tx.Rollback(context.Background())
+
+	var current string
+	var currentScheduledActivityID int
+	err = tx.QueryRow(ctx,
+		"SELECT invite_status, scheduled_activity_id FROM activity_participants WHERE id = $1 FOR UPDATE",
+		id).Scan(&current, &currentScheduledActivityID)
+	if err == pgx.ErrNoRows {
+		return ActivityParticipant{}, false, nil
+	}
+	if err != nil {
+		return ActivityParticipant{}, false, err
+	}
+
+	if participant.ScheduledActivityID != 0 && participant.ScheduledActivityID != currentScheduledActivityID {
+		return ActivityParticipant{}, true, ErrMoved
+	}
+	participant.ScheduledActivityID = currentScheduledActivityID
 
-	cmdTag, err := s.db.Exec(
-		context.Background(),
-		`UPDATE activity_participants 
-		SET user_id = $1, scheduled_activity_id = $2, invite_status = $3
-		WHERE id = $4`,
-		participant.UserID, participant.ScheduledActivityID, participant.InviteStatus, id)
+	if participant.InviteStatus == "" {
+		participant.InviteStatus = current
+	}
+	if err := checkTransition(current, participant.InviteStatus); err != nil {
+		return ActivityParticipant{}, true, err
+	}
+	if participant.Comment != nil && len([]rune(*participant.Comment)) > maxCommentLength {
+		return ActivityParticipant{}, true, fmt.Errorf("%w: comment is longer than %d characters", ErrInvalidStatus, maxCommentLength)
+	}
+
+	participantID, _ := strconv.Atoi(id)
+	status, err := resolveStatus(ctx, tx, participant.ScheduledActivityID, participantID, current, participant.InviteStatus)
+	if err != nil {
+		return ActivityParticipant{}, true, err
+	}
 
+	updated, err := scanParticipant(tx.QueryRow(
+		ctx,
+		`UPDATE activity_participants 
+		SET user_id = $1, invite_status = $2,
+		    comment = COALESCE($3, comment),
+		    responded_at = CASE WHEN invite_status <> $2 THEN now() ELSE responded_at END,
+		    waitlisted_at = CASE WHEN $2 = 'Waitlisted' THEN COALESCE(waitlisted_at, now()) END
+		WHERE id = $4
+		RETURNING `+participantColumns,
+		participant.UserID, status, participant.Comment, id))
 	if err != nil {
 		return ActivityParticipant{}, false, err
 	}
 
-	if cmdTag.RowsAffected() == 0 {
-		return ActivityParticipant{}, false, nil
+	if current == StatusAccepted && status != StatusAccepted {
+		if _, err := PromoteWaitlisted(ctx, tx, currentScheduledActivityID); err != nil {
+			return ActivityParticipant{}, true, err
+		}
 	}
 
-	return participant, true, nil
-}
+	if updated.InviteStatus != current {
+		if err := notifyRSVP(ctx, tx, updated); err != nil {
+			return ActivityParticipant{}, true, err
+		}
+		if err := publishStatusChange(ctx, tx, updated, current); err != nil {
+			return ActivityParticipant{}, true, err
+		}
+	}
 
-func (s *Service) Delete(id string) (bool, error) {
-	s.Lock()
-	defer s.Unlock()
+	if err := tx.Commit(ctx); err != nil {
+		return ActivityParticipant{}, false, err
+	}
+
+	return updated, true, nil
+}
 
-	cmdTag, err := s.db.Exec(context.Background(), "DELETE FROM activity_participants WHERE id = $1", id)
+// Delete removes a participant row. Removing an accepted participant promotes the next waitlisted one.
+func (s *Service) Delete(ctx context.Context, id string) (bool, error) {
+	tx, err := s.db.Begin(ctx)
 	if err != nil {
 		return false, err
 	}
-
-	if cmdTag.RowsAffected() == 0 {
+	defer tx.Rollback(context.Background())
+
+	var scheduledActivityID int
+	var status string
+	err = tx.QueryRow(ctx,
+		"DELETE FROM activity_participants WHERE id = $1 RETURNING scheduled_activity_id, invite_status",
+		id).Scan(&scheduledActivityID, &status)
+	if err == pgx.ErrNoRows {
 		return false, nil
 	}
+	if err != nil {
+		return false, err
+	}
+
+	if status == StatusAccepted {
+		if _, err := PromoteWaitlisted(ctx, tx, scheduledActivityID); err != nil {
+			return false, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return false, err
+	}
 
 	return true, nil
 }
 
-func (s *Service) GetActivitiesByUserID(userID string) ([]ActivityParticipant, error) {
-	s.Lock()
-	defer s.Unlock()
-
-	rows, err := s.db.Query(context.Background(),
-		`SELECT id, user_id, scheduled_activity_id, invite_status 
+func (s *Service) GetActivitiesByUserID(ctx context.Context, userID string) ([]ActivityParticipant, error) {
+	rows, err := s.db.Query(ctx,
+		`SELECT `+participantColumns+`
          FROM activity_participants 
          WHERE user_id = $1`, userID)
 	if err != nil {
@@ -155,8 +323,7 @@ func (s *Service) GetActivitiesByUserID(userID string) ([]ActivityParticipant, e
 
 	var participants []ActivityParticipant
 	for rows.Next() {
-		var participant ActivityParticipant
-		err := rows.Scan(&participant.ID, &participant.UserID, &participant.ScheduledActivityID, &participant.InviteStatus)
+		participant, err := scanParticipant(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -166,14 +333,26 @@ func (s *Service) GetActivitiesByUserID(userID string) ([]ActivityParticipant, e
 	return participants, nil
 }
 
-func (s *Service) GetParticipantsByScheduledActivityID(scheduledActivityID []string) ([]ActivityParticipant, error) {
-	s.Lock()
-	defer s.Unlock()
+// CanManage reports whether a user organizes a scheduled activity. Unknown scheduled activities
+// report true so that callers can answer 404 rather than 403.
+func (s *Service) CanManage(ctx context.Context, scheduledActivityID int, userID int) (bool, error) {
+	var allowed bool
+	err := s.db.QueryRow(ctx,
+		`SELECT NOT EXISTS (SELECT 1 FROM scheduled_activities WHERE id = $1)
+		     OR EXISTS (SELECT 1 FROM scheduled_activities WHERE id = $1 AND organizer_id = $2)`,
+		scheduledActivityID, userID).Scan(&allowed)
+	if err != nil {
+		return false, err
+	}
+
+	return allowed, nil
+}
 
-	query := `SELECT id, user_id, scheduled_activity_id, invite_status 
+func (s *Service) GetParticipantsByScheduledActivityID(ctx context.Context, scheduledActivityID []string) ([]ActivityParticipant, error) {
+	query := `SELECT ` + participantColumns + `
          FROM activity_participants 
          WHERE scheduled_activity_id = ANY($1)`
-	rows, err := s.db.Query(context.Background(), query, pq.Array(scheduledActivityID))
+	rows, err := s.db.Query(ctx, query, pq.Array(scheduledActivityID))
 	if err != nil {
 		return nil, err
 	}
@@ -181,8 +360,8 @@ func (s *Service) GetParticipantsByScheduledActivityID(scheduledActivityID []str
 
 	var participants []ActivityParticipant
 	for rows.Next() {
-		var participant ActivityParticipant
-		if err := rows.Scan(&participant.ID, &participant.UserID, &participant.ScheduledActivityID, &participant.InviteStatus); err != nil {
+		participant, err := scanParticipant(rows)
+		if err != nil {
 			return nil, err
 		}
 		participants = append(participants, participant)
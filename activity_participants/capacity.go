@@ -0,0 +1,185 @@
+package activity_participants
+
+import (
+	"context"
+	"errors"
+	"friendsocial/notifications"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// ErrInvalidCapacity is returned for participant limits that are below one or out of order
+var ErrInvalidCapacity = errors.New("min_participants and max_participants must be at least 1 and min_participants cannot exceed max_participants")
+
+// ValidateCapacity checks optional min/max participant counts for activities and scheduled activities
+func ValidateCapacity(minParticipants *int, maxParticipants *int) error {
+	if minParticipants != nil && *minParticipants < 1 {
+		return ErrInvalidCapacity
+	}
+	if maxParticipants != nil && *maxParticipants < 1 {
+		return ErrInvalidCapacity
+	}
+	if minParticipants != nil && maxParticipants != nil && *minParticipants > *maxParticipants {
+		return ErrInvalidCapacity
+	}
+	return nil
+}
+
+// lockCapacity locks a scheduled activity so that capacity decisions for it are serialized, and
+// returns its effective max_participants, whether it is still active, and how many invitations
+// other than excludeID are accepted. A nil maximum means the activity has no limit.
+func lockCapacity(ctx context.Context, tx pgx.Tx, scheduledActivityID int, excludeID int) (*int, bool, int, error) {
+	var maxParticipants *int
+	var isActive bool
+	err := tx.QueryRow(ctx,
+		`SELECT COALESCE(sa.max_participants, a.max_participants), sa.is_active
+		 FROM scheduled_activities sa
+		 JOIN activities a ON a.id = sa.activity_id
+		 WHERE sa.id = $1
+		 FOR UPDATE OF sa`,
+		scheduledActivityID).Scan(&maxParticipants, &isActive)
+	if err != nil {
+		return nil, false, 0, err
+	}
+
+	// Counted by a statement of its own, whose snapshot is taken once the lock is held, so that
+	// acceptances committed while this transaction waited for it are included
+	var accepted int
+	err = tx.QueryRow(ctx,
+		`SELECT count(*) FROM activity_participants
+		 WHERE scheduled_activity_id = $1 AND invite_status = 'Accepted' AND id <> $2`,
+		scheduledActivityID, excludeID).Scan(&accepted)
+	return maxParticipants, isActive, accepted, err
+}
+
+// resolveStatus returns the status to store for a requested one: acceptances that would exceed
+// the scheduled activity's max_participants join the waitlist instead
+func resolveStatus(ctx context.Context, tx pgx.Tx, scheduledActivityID int, participantID int, current string, requested string) (string, error) {
+	if requested != StatusAccepted || current == StatusAccepted {
+		return requested, nil
+	}
+
+	maxParticipants, _, accepted, err := lockCapacity(ctx, tx, scheduledActivityID, participantID)
+	if err != nil {
+		return "", err
+	}
+	if maxParticipants != nil && accepted >= *maxParticipants {
+		return StatusWaitlisted, nil
+	}
+	return StatusAccepted, nil
+}
+
+// PromoteWaitlisted accepts waitlisted invitations to an active scheduled activity, first come
+// first served, until it is full again. It runs in the caller's transaction after an acceptance
+// is withdrawn or the capacity grows, notifies the promoted users and returns their invitations.
+func PromoteWaitlisted(ctx context.Context, tx pgx.Tx, scheduledActivityID int) ([]ActivityParticipant, error) {
+	maxParticipants, isActive, accepted, err := lockCapacity(ctx, tx, scheduledActivityID, 0)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !isActive {
+		return nil, nil
+	}
+
+	// A NULL limit promotes everyone
+	var free *int
+	if maxParticipants != nil {
+		n := *maxParticipants - accepted
+		if n <= 0 {
+			return nil, nil
+		}
+		free = &n
+	}
+
+	rows, err := tx.Query(ctx,
+		`UPDATE activity_participants
+		 SET invite_status = 'Accepted', waitlisted_at = NULL, responded_at = now()
+		 WHERE id IN (
+		     SELECT id FROM activity_participants
+		     WHERE scheduled_activity_id = $1 AND invite_status = 'Waitlisted'
+		     ORDER BY waitlisted_at, id
+		     LIMIT $2)
+		 RETURNING `+participantColumns,
+		scheduledActivityID, free)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var promoted []ActivityParticipant
+	for rows.Next() {
+		participant, err := scanParticipant(rows)
+		if err != nil {
+			return nil, err
+		}
+		promoted = append(promoted, participant)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, participant := range promoted {
+		err := notifications.Emit(ctx, tx, notifications.Notification{
+			UserID:              participant.UserID,
+			Type:                notifications.TypeWaitlistPromoted,
+			ScheduledActivityID: &participant.ScheduledActivityID,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := publishStatusChange(ctx, tx, participant, StatusWaitlisted); err != nil {
+			return nil, err
+		}
+	}
+
+	return promoted, nil
+}
+
+// ResetInvitations asks everyone invited to a scheduled activity to respond again, e.g. after it
+// moved to another time
+func ResetInvitations(ctx context.Context, tx pgx.Tx, scheduledActivityID int) error {
+	rows, err := tx.Query(ctx,
+		`UPDATE activity_participants ap
+		 SET invite_status = 'Pending', responded_at = NULL, waitlisted_at = NULL
+		 FROM activity_participants previous
+		 WHERE previous.id = ap.id AND ap.scheduled_activity_id = $1
+		 RETURNING ap.id, ap.user_id, ap.scheduled_activity_id, ap.invite_status, ap.comment, ap.responded_at, ap.waitlisted_at,
+		           previous.invite_status`,
+		scheduledActivityID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type change struct {
+		participant ActivityParticipant
+		previous    string
+	}
+	var changes []change
+	for rows.Next() {
+		var c change
+		p := &c.participant
+		err := rows.Scan(&p.ID, &p.UserID, &p.ScheduledActivityID, &p.InviteStatus, &p.Comment, &p.RespondedAt, &p.WaitlistedAt, &c.previous)
+		if err != nil {
+			return err
+		}
+		if c.previous != StatusPending {
+			changes = append(changes, c)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range changes {
+		if err := publishStatusChange(ctx, tx, c.participant, c.previous); err != nil {
+			return err
+		}
+	}
+	return nil
+}
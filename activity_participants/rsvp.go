@@ -0,0 +1,255 @@
+package activity_participants
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"friendsocial/notifications"
+	"friendsocial/webhooks"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/lib/pq"
+)
+
+// Invite statuses stored in activity_participants.invite_status
+const (
+	StatusPending   = "Pending"
+	StatusAccepted  = "Accepted"
+	StatusDeclined  = "Declined"
+	StatusMaybe     = "Maybe"
+	StatusTentative = "Tentative"
+	// StatusWaitlisted is set instead of Accepted when the scheduled activity is full
+	StatusWaitlisted = "Waitlisted"
+)
+
+// Statuses lists every invite status in the order summaries report them
+var Statuses = []string{StatusPending, StatusAccepted, StatusWaitlisted, StatusTentative, StatusMaybe, StatusDeclined}
+
+// maxCommentLength matches activity_participants.comment
+const maxCommentLength = 500
+
+var (
+	// ErrInvalidStatus is returned for an invite status or RSVP response that does not exist
+	ErrInvalidStatus = errors.New("invalid invite status")
+	// ErrInvalidTransition is returned when an invitation cannot move from its current status to the requested one
+	ErrInvalidTransition = errors.New("invalid invite status transition")
+	// ErrRSVPClosed is returned when responding to a cancelled or already started scheduled activity
+	ErrRSVPClosed = errors.New("scheduled activity no longer accepts responses")
+)
+
+// transitions lists the statuses an invitation may move to from each status. Invitations only
+// return to Pending when the organizer reschedules the activity, and only become Waitlisted when
+// an acceptance does not fit.
+var transitions = map[string][]string{
+	StatusPending:    {StatusAccepted, StatusDeclined, StatusMaybe, StatusTentative},
+	StatusAccepted:   {StatusDeclined, StatusMaybe, StatusTentative},
+	StatusWaitlisted: {StatusAccepted, StatusDeclined, StatusMaybe, StatusTentative},
+	StatusDeclined:   {StatusAccepted, StatusMaybe, StatusTentative},
+	StatusMaybe:      {StatusAccepted, StatusDeclined, StatusTentative},
+	StatusTentative:  {StatusAccepted, StatusDeclined, StatusMaybe},
+}
+
+// rsvpResponses maps the responses accepted by the RSVP endpoint to invite statuses
+var rsvpResponses = map[string]string{
+	"accept":    StatusAccepted,
+	"decline":   StatusDeclined,
+	"maybe":     StatusMaybe,
+	"tentative": StatusTentative,
+}
+
+// RSVPRequest is an invitee's response to a scheduled activity
+type RSVPRequest struct {
+	Response string  `json:"response"` // accept, decline, maybe or tentative
+	Comment  *string `json:"comment,omitempty"`
+}
+
+// Attendee is one invitee in an RSVP summary
+type Attendee struct {
+	UserID      int        `json:"user_id"`
+	Comment     *string    `json:"comment,omitempty"`
+	RespondedAt *time.Time `json:"responded_at,omitempty"`
+}
+
+// RSVPSummary counts the invitations of a scheduled activity by status and lists who is in each
+type RSVPSummary struct {
+	ScheduledActivityID int                   `json:"scheduled_activity_id"`
+	Counts              map[string]int        `json:"counts"`
+	Attendees           map[string][]Attendee `json:"attendees"`
+}
+
+// checkTransition validates moving an invitation from one status to another. Keeping the same
+// status is always allowed so that invitees can update their comment.
+func checkTransition(from string, to string) error {
+	if _, ok := transitions[to]; !ok {
+		return fmt.Errorf("%w: %q", ErrInvalidStatus, to)
+	}
+	if from == to {
+		return nil
+	}
+	for _, next := range transitions[from] {
+		if next == to {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s to %s", ErrInvalidTransition, from, to)
+}
+
+// RSVP records a user's response to their invitation to a scheduled activity. Accepting a full
+// activity puts the user on its waitlist, and withdrawing an acceptance promotes the next
+// waitlisted user. It reports false when the user is not invited.
+func (s *Service) RSVP(ctx context.Context, scheduledActivityID int, userID int, rsvp RSVPRequest) (ActivityParticipant, bool, error) {
+	status, ok := rsvpResponses[strings.ToLower(strings.TrimSpace(rsvp.Response))]
+	if !ok {
+		return ActivityParticipant{}, false, fmt.Errorf("%w: response must be accept, decline, maybe or tentative", ErrInvalidStatus)
+	}
+	if rsvp.Comment != nil && len([]rune(*rsvp.Comment)) > maxCommentLength {
+		return ActivityParticipant{}, false, fmt.Errorf("%w: comment is longer than %d characters", ErrInvalidStatus, maxCommentLength)
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return ActivityParticipant{}, false, err
+	}
+	defer tx.Rollback(context.Background())
+
+	var id int
+	var current string
+	var isActive bool
+	var scheduledAt time.Time
+	err = tx.QueryRow(ctx,
+		`SELECT ap.id, ap.invite_status, sa.is_active, sa.scheduled_at
+		 FROM activity_participants ap
+		 JOIN scheduled_activities sa ON sa.id = ap.scheduled_activity_id
+		 WHERE ap.scheduled_activity_id = $1 AND ap.user_id = $2
+		 FOR UPDATE OF ap`,
+		scheduledActivityID, userID).Scan(&id, &current, &isActive, &scheduledAt)
+	if err == pgx.ErrNoRows {
+		return ActivityParticipant{}, false, nil
+	}
+	if err != nil {
+		return ActivityParticipant{}, false, err
+	}
+
+	if !isActive || !scheduledAt.After(time.Now()) {
+		return ActivityParticipant{}, true, ErrRSVPClosed
+	}
+	if err := checkTransition(current, status); err != nil {
+		return ActivityParticipant{}, true, err
+	}
+	status, err = resolveStatus(ctx, tx, scheduledActivityID, id, current, status)
+	if err != nil {
+		return ActivityParticipant{}, true, err
+	}
+
+	// Answering again while waitlisted keeps the user's place in the queue
+	participant, err := scanParticipant(tx.QueryRow(ctx,
+		`UPDATE activity_participants
+		 SET invite_status = $1, comment = $2, responded_at = now(),
+		     waitlisted_at = CASE WHEN $1 = 'Waitlisted' THEN COALESCE(waitlisted_at, now()) END
+		 WHERE id = $3
+		 RETURNING `+participantColumns,
+		status, rsvp.Comment, id))
+	if err != nil {
+		return ActivityParticipant{}, true, err
+	}
+
+	if current == StatusAccepted && status != StatusAccepted {
+		if _, err := PromoteWaitlisted(ctx, tx, scheduledActivityID); err != nil {
+			return ActivityParticipant{}, true, err
+		}
+	}
+
+	// Answering the same again, e.g. to change the comment, tells no one
+	if status != current {
+		if err := notifyRSVP(ctx, tx, participant); err != nil {
+			return ActivityParticipant{}, true, err
+		}
+		if err := publishStatusChange(ctx, tx, participant, current); err != nil {
+			return ActivityParticipant{}, true, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return ActivityParticipant{}, true, err
+	}
+
+	return participant, true, nil
+}
+
+// notifyRSVP tells the organizer how an invitee responded
+func notifyRSVP(ctx context.Context, db notifications.Execer, participant ActivityParticipant) error {
+	data := map[string]interface{}{"invite_status": participant.InviteStatus}
+	if participant.Comment != nil {
+		data["comment"] = *participant.Comment
+	}
+	return notifications.EmitToOrganizer(ctx, db, participant.ScheduledActivityID, notifications.Notification{
+		Type:    notifications.TypeRSVP,
+		ActorID: &participant.UserID,
+		Data:    data,
+	})
+}
+
+// publishStatusChange writes an activity_participant.status_changed event to the outbox
+func publishStatusChange(ctx context.Context, db webhooks.Execer, participant ActivityParticipant, previous string) error {
+	return webhooks.Publish(ctx, db, webhooks.EventActivityParticipantStatusChanged, participant.ScheduledActivityID, map[string]interface{}{
+		"participant":     participant,
+		"previous_status": previous,
+	})
+}
+
+// ReadRSVPSummaries counts and lists the invitees of each scheduled activity by status. Unknown
+// scheduled activities are left out.
+func (s *Service) ReadRSVPSummaries(ctx context.Context, scheduledActivityIDs []string) ([]RSVPSummary, error) {
+	rows, err := s.db.Query(ctx,
+		`SELECT sa.id, ap.user_id, ap.invite_status, ap.comment, ap.responded_at
+		 FROM scheduled_activities sa
+		 LEFT JOIN activity_participants ap ON ap.scheduled_activity_id = sa.id
+		 WHERE sa.id = ANY($1)
+		 ORDER BY sa.id, COALESCE(ap.waitlisted_at, ap.responded_at) NULLS LAST, ap.user_id`,
+		pq.Array(scheduledActivityIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summaries := []RSVPSummary{}
+	for rows.Next() {
+		var scheduledActivityID int
+		var userID *int
+		var status *string
+		var attendee Attendee
+		if err := rows.Scan(&scheduledActivityID, &userID, &status, &attendee.Comment, &attendee.RespondedAt); err != nil {
+			return nil, err
+		}
+
+		if len(summaries) == 0 || summaries[len(summaries)-1].ScheduledActivityID != scheduledActivityID {
+			summary := RSVPSummary{
+				ScheduledActivityID: scheduledActivityID,
+				Counts:              make(map[string]int, len(Statuses)),
+				Attendees:           make(map[string][]Attendee, len(Statuses)),
+			}
+			for _, s := range Statuses {
+				summary.Counts[s] = 0
+				summary.Attendees[s] = []Attendee{}
+			}
+			summaries = append(summaries, summary)
+		}
+
+		if userID == nil {
+			// Scheduled activity without invitations
+			continue
+		}
+		attendee.UserID = *userID
+		summary := &summaries[len(summaries)-1]
+		summary.Counts[*status]++
+		summary.Attendees[*status] = append(summary.Attendees[*status], attendee)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return summaries, nil
+}
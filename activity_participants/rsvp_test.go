@@ -0,0 +1,59 @@
+package activity_participants
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckTransition(t *testing.T) {
+	tests := []struct {
+		from    string
+		to      string
+		wantErr error
+	}{
+		{StatusPending, StatusAccepted, nil},
+		{StatusPending, StatusDeclined, nil},
+		{StatusPending, StatusMaybe, nil},
+		{StatusPending, StatusTentative, nil},
+		{StatusAccepted, StatusDeclined, nil},
+		{StatusDeclined, StatusAccepted, nil},
+		{StatusMaybe, StatusTentative, nil},
+		{StatusWaitlisted, StatusAccepted, nil},
+		{StatusWaitlisted, StatusDeclined, nil},
+		// Keeping the status lets invitees update their comment
+		{StatusAccepted, StatusAccepted, nil},
+		{StatusPending, StatusPending, nil},
+		{StatusWaitlisted, StatusWaitlisted, nil},
+		// Only rescheduling returns invitations to Pending, and only a full activity waitlists them
+		{StatusAccepted, StatusPending, ErrInvalidTransition},
+		{StatusDeclined, StatusPending, ErrInvalidTransition},
+		{StatusPending, StatusWaitlisted, ErrInvalidTransition},
+		{StatusAccepted, StatusWaitlisted, ErrInvalidTransition},
+		{"", StatusAccepted, ErrInvalidTransition},
+		{StatusPending, "Going", ErrInvalidStatus},
+		{StatusPending, "accepted", ErrInvalidStatus},
+		{StatusPending, "", ErrInvalidStatus},
+	}
+	for _, tt := range tests {
+		err := checkTransition(tt.from, tt.to)
+		if tt.wantErr == nil && err != nil {
+			t.Errorf("checkTransition(%q, %q): %v", tt.from, tt.to, err)
+		}
+		if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+			t.Errorf("checkTransition(%q, %q) error = %v, want %v", tt.from, tt.to, err, tt.wantErr)
+		}
+	}
+}
+
+func TestTransitionsCoverStatuses(t *testing.T) {
+	for _, status := range Statuses {
+		if _, ok := transitions[status]; !ok {
+			t.Errorf("no transitions from %s", status)
+		}
+	}
+	for response, status := range rsvpResponses {
+		if err := checkTransition(StatusPending, status); err != nil {
+			t.Errorf("response %q cannot answer a pending invitation: %v", response, err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"friendsocial/activities"
+	"friendsocial/activity_participants"
+	"friendsocial/auth"
+	"friendsocial/calendar"
+	"friendsocial/config"
+	"friendsocial/delivery"
+	"friendsocial/feed"
+	"friendsocial/friends"
+	"friendsocial/locations"
+	"friendsocial/notifications"
+	"friendsocial/reminders"
+	"friendsocial/scheduled_activities"
+	"friendsocial/user_activity_preferences"
+	"friendsocial/user_activity_preferences_participants"
+	"friendsocial/user_availability"
+	"friendsocial/users"
+	"friendsocial/webhooks"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// routeRegistrar is an HTTP handler that adds its own routes to a mux
+type routeRegistrar interface {
+	RegisterRoutes(mux *http.ServeMux)
+}
+
+// ruleProvider is an HTTP handler whose routes need more than a signed in user
+type ruleProvider interface {
+	AuthorizationRules() map[string]auth.Rule
+}
+
+// app holds the services, HTTP handlers and background workers of the server, wired together
+type app struct {
+	authService                              *auth.Service
+	userService                              *users.Service
+	availabilityService                      *user_availability.Service
+	userActivityPreferenceService            *user_activity_preferences.Service
+	userActivityPreferenceParticipantService *user_activity_preferences_participants.Service
+	scheduledActivityService                 *scheduled_activities.Service
+	friendService                            *friends.Service
+	activityParticipantService               *activity_participants.Service
+	notificationService                      *notifications.Service
+	deviceService                            *delivery.Service
+	webhookService                           *webhooks.Service
+	reminderService                          *reminders.Service
+	calendarService                          *calendar.Service
+	feedService                              *feed.Service
+	locationService                          *locations.Service
+	activityService                          *activities.Service
+
+	mux        *http.ServeMux
+	authorizer *auth.Authorizer
+	timeouts   *routeTimeouts
+	// workers run in the background until their context is cancelled
+	workers []func(context.Context)
+}
+
+// newApp creates the services on db and registers their handlers' routes
+func newApp(db *pgxpool.Pool, cfg config.Config) (*app, error) {
+	a := &app{
+		authService:                              auth.NewService(db, []byte(cfg.Auth.TokenSecret)),
+		userService:                              users.NewService(db),
+		availabilityService:                      user_availability.NewService(db),
+		userActivityPreferenceService:            user_activity_preferences.NewService(db),
+		userActivityPreferenceParticipantService: user_activity_preferences_participants.NewService(db),
+		friendService:                            friends.NewService(db),
+		activityParticipantService:               activity_participants.NewService(db),
+		notificationService:                      notifications.NewService(db),
+		deviceService:                            delivery.NewService(db),
+		webhookService:                           webhooks.NewService(db),
+		reminderService:                          reminders.NewService(db),
+		calendarService:                          calendar.NewService(db),
+		feedService:                              feed.NewService(db),
+		locationService:                          locations.NewService(db),
+		activityService:                          activities.NewService(db),
+		mux:                                      http.NewServeMux(),
+	}
+	a.scheduledActivityService = scheduled_activities.NewService(db, a.userActivityPreferenceService, cfg.Scheduling.MaterializeHorizon)
+	a.authorizer = auth.NewAuthorizer(a.authService)
+	a.timeouts = newRouteTimeouts(a.mux, cfg.Server.RequestTimeout)
+
+	a.authorizer.Public("POST /auth/login", "POST /auth/logout", "POST /auth/refresh", "POST /users", "GET /calendar/{token}")
+	a.register(
+		auth.NewAuthHTTPHandler(a.authService),
+		users.NewUserHTTPHandler(a.userService),
+		user_availability.NewUserAvailabilityHTTPHandler(a.availabilityService, cfg.Features.ICSImportLocalPaths),
+		user_activity_preferences.NewUserActivityPreferenceHTTPHandler(a.userActivityPreferenceService),
+		user_activity_preferences_participants.NewUserActivityPreferenceParticipantHTTPHandler(a.userActivityPreferenceParticipantService),
+		scheduled_activities.NewScheduledActivityHTTPHandler(a.scheduledActivityService, a.userActivityPreferenceService),
+		friends.NewFriendHTTPHandler(a.friendService),
+		activity_participants.NewActivityParticipantHTTPHandler(a.activityParticipantService),
+		notifications.NewNotificationHTTPHandler(a.notificationService),
+		delivery.NewDeviceHTTPHandler(a.deviceService),
+		webhooks.NewWebhookHTTPHandler(a.webhookService),
+		reminders.NewReminderHTTPHandler(a.reminderService),
+		calendar.NewCalendarHTTPHandler(a.calendarService),
+		feed.NewFeedHTTPHandler(a.feedService),
+		locations.NewLocationHTTPHandler(a.locationService),
+		activities.NewActivityHTTPHandler(a.activityService),
+	)
+	a.timeouts.Set(cfg.Server.SlowRequestTimeout,
+		"POST /user_availability/user/{user_id}/import",
+		"GET /users/{id}/calendar.ics",
+		"GET /calendar/{token}",
+	)
+
+	// Keep recurring series materialized ahead of time
+	materializer := scheduled_activities.NewMaterializer(a.scheduledActivityService, cfg.Scheduling.MaterializeInterval)
+	capacityMonitor := scheduled_activities.NewCapacityMonitor(a.scheduledActivityService, cfg.Scheduling.CapacityCheckInterval, cfg.Scheduling.CancelCutoff)
+	a.workers = append(a.workers, materializer.Run, capacityMonitor.Run)
+
+	// Send queued notifications over push and email
+	transports, err := delivery.NewTransports(delivery.Config{
+		IOS:      cfg.Delivery.IOS,
+		Android:  cfg.Delivery.Android,
+		Email:    cfg.Delivery.Email,
+		StubPath: cfg.Delivery.StubPath,
+		APNs:     delivery.APNsConfig(cfg.Delivery.APNs),
+		FCM:      delivery.FCMConfig(cfg.Delivery.FCM),
+		SMTP:     delivery.SMTPConfig(cfg.Delivery.SMTP),
+	})
+	if err != nil {
+		return nil, err
+	}
+	dispatcher := delivery.NewDispatcher(db, transports, 10*time.Second)
+	a.workers = append(a.workers, dispatcher.Run)
+
+	// Deliver outbox events to webhook subscribers
+	if cfg.Features.Webhooks {
+		webhookDispatcher := webhooks.NewDispatcher(db, 5*time.Second)
+		a.workers = append(a.workers, webhookDispatcher.Run)
+	}
+
+	// Remind participants of the activities they accepted
+	if cfg.Features.Reminders {
+		reminderScheduler := reminders.NewScheduler(a.reminderService, time.Minute)
+		a.workers = append(a.workers, reminderScheduler.Run)
+	}
+
+	return a, nil
+}
+
+// register adds the handlers' routes to the mux and their authorization rules to the authorizer
+func (a *app) register(handlers ...routeRegistrar) {
+	for _, handler := range handlers {
+		handler.RegisterRoutes(a.mux)
+		if rules, ok := handler.(ruleProvider); ok {
+			a.authorizer.Require(rules.AuthorizationRules())
+		}
+	}
+}
+
+// handler is the server's root handler: route timeouts, then authorization, then the routes
+func (a *app) handler() http.Handler {
+	return a.timeouts.Middleware(a.authorizer.Middleware(a.mux))
+}
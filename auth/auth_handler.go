@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// AuthService defines the interface for authentication operations
+type AuthService interface {
+	Login(ctx context.Context, email string, password string) (Tokens, error)
+	Refresh(ctx context.Context, refreshToken string) (Tokens, error)
+	Logout(ctx context.Context, refreshToken string) (bool, error)
+	ValidateAccessToken(ctx context.Context, token string) (Claims, error)
+}
+
+// AuthError represents an error response
+type AuthError struct {
+	StatusCode int    `json:"status_code"`
+	Error      string `json:"error"`
+}
+
+// LoginRequest is the payload for POST /auth/login
+type LoginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// RefreshRequest is the payload for POST /auth/refresh and POST /auth/logout
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// AuthHTTPHandler handles HTTP requests for authentication
+type AuthHTTPHandler struct {
+	authService AuthService
+}
+
+// NewAuthHTTPHandler creates a new AuthHTTPHandler
+func NewAuthHTTPHandler(authService AuthService) *AuthHTTPHandler {
+	return &AuthHTTPHandler{
+		authService: authService,
+	}
+}
+
+// HandleHTTPPostLogin exchanges credentials for a token pair
+//
+//	@Summary		Log in
+//	@Description	Verify a user's email and password and issue access and refresh tokens
+//	@Tags			auth
+//	@Accept			json
+//	@Produce		json
+//	@Param			credentials	body		LoginRequest	true	"User credentials"
+//	@Success		200			{object}	Tokens
+//	@Failure		400			{object}	AuthError
+//	@Failure		401			{object}	AuthError
+//	@Failure		500			{object}	AuthError
+//	@Router			/auth/login [post]
+func (h *AuthHTTPHandler) HandleHTTPPostLogin(w http.ResponseWriter, r *http.Request) {
+	var request LoginRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		h.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if request.Email == "" || request.Password == "" {
+		h.errorResponse(w, http.StatusBadRequest, "email and password are required")
+		return
+	}
+
+	tokens, err := h.authService.Login(r.Context(), request.Email, request.Password)
+	if err == ErrInvalidCredentials {
+		h.errorResponse(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if err != nil {
+		h.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.tokensResponse(w, tokens)
+}
+
+// HandleHTTPPostRefresh rotates a refresh token
+//
+//	@Summary		Refresh tokens
+//	@Description	Exchange a refresh token for a new access and refresh token pair
+//	@Tags			auth
+//	@Accept			json
+//	@Produce		json
+//	@Param			request	body		RefreshRequest	true	"Refresh token"
+//	@Success		200		{object}	Tokens
+//	@Failure		400		{object}	AuthError
+//	@Failure		401		{object}	AuthError
+//	@Failure		500		{object}	AuthError
+//	@Router			/auth/refresh [post]
+func (h *AuthHTTPHandler) HandleHTTPPostRefresh(w http.ResponseWriter, r *http.Request) {
+	var request RefreshRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		h.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tokens, err := h.authService.Refresh(r.Context(), request.RefreshToken)
+	if err == ErrInvalidToken {
+		h.errorResponse(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if err != nil {
+		h.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.tokensResponse(w, tokens)
+}
+
+// HandleHTTPPostLogout revokes a refresh token
+//
+//	@Summary		Log out
+//	@Description	Revoke the session belonging to a refresh token
+//	@Tags			auth
+//	@Accept			json
+//	@Param			request	body	RefreshRequest	true	"Refresh token"
+//	@Success		204		"No Content"
+//	@Failure		400		{object}	AuthError
+//	@Failure		401		{object}	AuthError
+//	@Failure		500		{object}	AuthError
+//	@Router			/auth/logout [post]
+func (h *AuthHTTPHandler) HandleHTTPPostLogout(w http.ResponseWriter, r *http.Request) {
+	var request RefreshRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		h.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	found, err := h.authService.Logout(r.Context(), request.RefreshToken)
+	if err != nil {
+		h.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if !found {
+		h.errorResponse(w, http.StatusUnauthorized, ErrInvalidToken.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *AuthHTTPHandler) tokensResponse(w http.ResponseWriter, tokens Tokens) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	err := json.NewEncoder(w).Encode(tokens)
+	if err != nil {
+		h.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// RegisterRoutes adds the auth routes to mux
+func (h *AuthHTTPHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("POST /auth/login", h.HandleHTTPPostLogin)
+	mux.HandleFunc("POST /auth/logout", h.HandleHTTPPostLogout)
+	mux.HandleFunc("POST /auth/refresh", h.HandleHTTPPostRefresh)
+}
+
+// errorResponse sends a JSON error response
+func (h *AuthHTTPHandler) errorResponse(w http.ResponseWriter, statusCode int, errorString string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	encodingError := json.NewEncoder(w).Encode(AuthError{
+		StatusCode: statusCode,
+		Error:      errorString,
+	})
+	if encodingError != nil {
+		http.Error(w, encodingError.Error(), http.StatusInternalServerError)
+	}
+}
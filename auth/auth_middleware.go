@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Rule decides whether an authenticated caller may perform a request. Path values from the
+// matched route pattern are available through r.PathValue.
+type Rule func(r *http.Request, callerID int) (bool, error)
+
+type contextKey struct{}
+
+// Authorizer resolves the caller of every request from its bearer token and applies the
+// ownership rule registered for the matched route
+type Authorizer struct {
+	authService AuthService
+	public      map[string]bool
+	rules       map[string]Rule
+}
+
+// NewAuthorizer creates a new Authorizer. Every route requires a valid token unless it is
+// registered with Public.
+func NewAuthorizer(authService AuthService) *Authorizer {
+	return &Authorizer{
+		authService: authService,
+		public:      make(map[string]bool),
+		rules:       make(map[string]Rule),
+	}
+}
+
+// Public marks route patterns that may be called without a token
+func (a *Authorizer) Public(patterns ...string) {
+	for _, pattern := range patterns {
+		a.public[pattern] = true
+	}
+}
+
+// Require registers ownership rules keyed by the route pattern they protect
+func (a *Authorizer) Require(rules map[string]Rule) {
+	for pattern, rule := range rules {
+		a.rules[pattern] = rule
+	}
+}
+
+// Middleware wraps a ServeMux so that authentication and authorization run before routing
+func (a *Authorizer) Middleware(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		if pattern == "" || a.public[pattern] {
+			// Unknown routes fall through so the mux can answer 404/405
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || token == "" {
+			a.errorResponse(w, http.StatusUnauthorized, "missing bearer token")
+			return
+		}
+
+		claims, err := a.authService.ValidateAccessToken(r.Context(), token)
+		if errors.Is(err, ErrInvalidToken) {
+			a.errorResponse(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if err != nil {
+			a.errorResponse(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), contextKey{}, claims.UserID))
+
+		if rule, ok := a.rules[pattern]; ok {
+			setPathValues(r, pattern)
+
+			allowed, err := rule(r, claims.UserID)
+			if err != nil {
+				a.errorResponse(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if !allowed {
+				a.errorResponse(w, http.StatusForbidden, "Forbidden")
+				return
+			}
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// CallerID returns the authenticated user ID stored on the request context
+func CallerID(ctx context.Context) (int, bool) {
+	userID, ok := ctx.Value(contextKey{}).(int)
+	return userID, ok
+}
+
+// Authenticated allows any caller with a valid token
+func Authenticated(r *http.Request, callerID int) (bool, error) {
+	return true, nil
+}
+
+// Self allows the caller only when the named path value is their own user ID
+func Self(name string) Rule {
+	return func(r *http.Request, callerID int) (bool, error) {
+		userID, err := strconv.Atoi(r.PathValue(name))
+		if err != nil {
+			return false, nil
+		}
+		return userID == callerID, nil
+	}
+}
+
+// AnyOf allows the caller when at least one of the rules does
+func AnyOf(rules ...Rule) Rule {
+	return func(r *http.Request, callerID int) (bool, error) {
+		for _, rule := range rules {
+			allowed, err := rule(r, callerID)
+			if err != nil || allowed {
+				return allowed, err
+			}
+		}
+		return false, nil
+	}
+}
+
+// AllOf allows the caller only when every rule does
+func AllOf(rules ...Rule) Rule {
+	return func(r *http.Request, callerID int) (bool, error) {
+		for _, rule := range rules {
+			allowed, err := rule(r, callerID)
+			if err != nil || !allowed {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+}
+
+// PeekJSON decodes the request body into v and restores it so the handler can read it again
+func PeekJSON(r *http.Request, v interface{}) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	return json.Unmarshal(body, v)
+}
+
+// setPathValues fills in r.PathValue for the wildcards of a pattern such as "PUT /users/{id}",
+// since the mux only does so after the middleware has run
+func setPathValues(r *http.Request, pattern string) {
+	if _, path, found := strings.Cut(pattern, " "); found {
+		pattern = path
+	}
+	if i := strings.Index(pattern, "/"); i > 0 {
+		// Strip a host prefix
+		pattern = pattern[i:]
+	}
+
+	patternSegments := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathSegments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	for i, segment := range patternSegments {
+		if i >= len(pathSegments) {
+			return
+		}
+		if !strings.HasPrefix(segment, "{") || !strings.HasSuffix(segment, "}") {
+			continue
+		}
+
+		name := strings.TrimSuffix(strings.TrimSuffix(segment[1:len(segment)-1], "..."), "$")
+		if strings.HasSuffix(segment, "...}") {
+			r.SetPathValue(name, strings.Join(pathSegments[i:], "/"))
+			return
+		}
+		r.SetPathValue(name, pathSegments[i])
+	}
+}
+
+func (a *Authorizer) errorResponse(w http.ResponseWriter, statusCode int, errorString string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	encodingError := json.NewEncoder(w).Encode(AuthError{
+		StatusCode: statusCode,
+		Error:      errorString,
+	})
+	if encodingError != nil {
+		http.Error(w, encodingError.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,202 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeAuthService accepts the tokens in its map, each standing for a user ID
+type fakeAuthService struct {
+	tokens map[string]int
+	err    error // returned for every token when set
+}
+
+func (f *fakeAuthService) Login(ctx context.Context, email string, password string) (Tokens, error) {
+	return Tokens{}, ErrInvalidCredentials
+}
+
+func (f *fakeAuthService) Refresh(ctx context.Context, refreshToken string) (Tokens, error) {
+	return Tokens{}, ErrInvalidToken
+}
+
+func (f *fakeAuthService) Logout(ctx context.Context, refreshToken string) (bool, error) {
+	return false, nil
+}
+
+func (f *fakeAuthService) ValidateAccessToken(ctx context.Context, token string) (Claims, error) {
+	if f.err != nil {
+		return Claims{}, f.err
+	}
+	userID, ok := f.tokens[token]
+	if !ok {
+		return Claims{}, ErrInvalidToken
+	}
+	return Claims{UserID: userID}, nil
+}
+
+func allow(r *http.Request, callerID int) (bool, error) { return true, nil }
+func deny(r *http.Request, callerID int) (bool, error)  { return false, nil }
+func fail(r *http.Request, callerID int) (bool, error)  { return false, errors.New("lookup failed") }
+
+func TestMiddleware(t *testing.T) {
+	service := &fakeAuthService{tokens: map[string]int{"alice": 1, "bob": 2}}
+	authorizer := NewAuthorizer(service)
+	authorizer.Public("POST /users")
+	authorizer.Require(map[string]Rule{
+		"PUT /users/{id}":        Self("id"),
+		"DELETE /things/{id}":    fail,
+		"POST /things/{id}/copy": AllOf(Self("id"), deny),
+	})
+
+	mux := http.NewServeMux()
+	for _, pattern := range []string{"POST /users", "GET /users", "PUT /users/{id}", "DELETE /things/{id}", "POST /things/{id}/copy"} {
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			callerID, _ := CallerID(r.Context())
+			io.WriteString(w, r.Pattern+" as "+strconv.Itoa(callerID))
+		})
+	}
+	handler := authorizer.Middleware(mux)
+
+	tests := []struct {
+		method     string
+		target     string
+		token      string
+		wantStatus int
+		wantBody   string // a part of the response body
+	}{
+		{"POST", "/users", "", http.StatusOK, "POST /users as 0"},
+		{"GET", "/users", "", http.StatusUnauthorized, "missing bearer token"},
+		{"GET", "/users", "mallory", http.StatusUnauthorized, ErrInvalidToken.Error()},
+		{"GET", "/users", "alice", http.StatusOK, "GET /users as 1"},
+		{"PUT", "/users/2", "bob", http.StatusOK, "PUT /users/{id} as 2"},
+		{"PUT", "/users/2", "alice", http.StatusForbidden, "Forbidden"},
+		{"PUT", "/users/bob", "bob", http.StatusForbidden, "Forbidden"},
+		{"DELETE", "/things/7", "alice", http.StatusInternalServerError, "lookup failed"},
+		{"POST", "/things/1/copy", "alice", http.StatusForbidden, "Forbidden"},
+		{"GET", "/nowhere", "", http.StatusNotFound, ""},
+		{"PATCH", "/users/1", "", http.StatusMethodNotAllowed, ""},
+	}
+	for _, tt := range tests {
+		request := httptest.NewRequest(tt.method, tt.target, nil)
+		if tt.token != "" {
+			request.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != tt.wantStatus {
+			t.Errorf("%s %s as %q: status %d, want %d: %s", tt.method, tt.target, tt.token, recorder.Code, tt.wantStatus, recorder.Body)
+		}
+		if !strings.Contains(recorder.Body.String(), tt.wantBody) {
+			t.Errorf("%s %s as %q: body %s does not contain %s", tt.method, tt.target, tt.token, recorder.Body, tt.wantBody)
+		}
+	}
+
+	// A failing token lookup is the server's fault, not the caller's
+	service.err = errors.New("database is down")
+	request := httptest.NewRequest("GET", "/users", nil)
+	request.Header.Set("Authorization", "Bearer alice")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("status %d when the token cannot be checked, want %d", recorder.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestRules(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     Rule
+		userID   string // the {id} path value
+		callerID int
+		want     bool
+		wantErr  bool
+	}{
+		{"Self matches", Self("id"), "7", 7, true, false},
+		{"Self other user", Self("id"), "8", 7, false, false},
+		{"Self not a number", Self("id"), "me", 7, false, false},
+		{"Self missing value", Self("user_id"), "7", 7, false, false},
+		{"AnyOf none", AnyOf(), "7", 7, false, false},
+		{"AnyOf first allows", AnyOf(allow, fail), "7", 7, true, false},
+		{"AnyOf later allows", AnyOf(deny, Self("id")), "7", 7, true, false},
+		{"AnyOf all deny", AnyOf(deny, Self("id")), "8", 7, false, false},
+		{"AnyOf error", AnyOf(deny, fail, allow), "7", 7, false, true},
+		{"AllOf none", AllOf(), "7", 7, true, false},
+		{"AllOf all allow", AllOf(allow, Self("id")), "7", 7, true, false},
+		{"AllOf one denies", AllOf(allow, Self("id")), "8", 7, false, false},
+		{"AllOf denial first", AllOf(deny, fail), "7", 7, false, false},
+		{"AllOf error", AllOf(allow, fail), "7", 7, false, true},
+	}
+	for _, tt := range tests {
+		request := httptest.NewRequest("GET", "/users/"+tt.userID, nil)
+		request.SetPathValue("id", tt.userID)
+
+		allowed, err := tt.rule(request, tt.callerID)
+		if allowed != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("%s: got %v, %v, want %v, error %v", tt.name, allowed, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestPeekJSON(t *testing.T) {
+	request := httptest.NewRequest("POST", "/friend/requests", strings.NewReader(`{"user_id": 3, "friend_id": 4}`))
+
+	var peeked struct {
+		UserID int `json:"user_id"`
+	}
+	if err := PeekJSON(request, &peeked); err != nil {
+		t.Fatalf("PeekJSON: %v", err)
+	}
+	if peeked.UserID != 3 {
+		t.Errorf("peeked user_id %d, want 3", peeked.UserID)
+	}
+
+	// The handler reads the whole body again
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		t.Fatalf("reading the restored body: %v", err)
+	}
+	if string(body) != `{"user_id": 3, "friend_id": 4}` {
+		t.Errorf("restored body %q", body)
+	}
+
+	// A malformed body is reported and still restored for the handler to answer 400
+	request = httptest.NewRequest("POST", "/friend/requests", strings.NewReader(`{"user_id":`))
+	if err := PeekJSON(request, &peeked); err == nil {
+		t.Errorf("PeekJSON accepted a malformed body")
+	}
+	if body, _ := io.ReadAll(request.Body); string(body) != `{"user_id":` {
+		t.Errorf("restored malformed body %q", body)
+	}
+}
+
+func TestSetPathValues(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    map[string]string
+	}{
+		{"PUT /users/{id}", "/users/7", map[string]string{"id": "7"}},
+		{"POST /friend/requests/{user_id}/{friend_id}/accept", "/friend/requests/3/4/accept", map[string]string{"user_id": "3", "friend_id": "4"}},
+		{"GET /files/{path...}", "/files/a/b/c.txt", map[string]string{"path": "a/b/c.txt"}},
+		{"GET example.com/users/{id}", "/users/9", map[string]string{"id": "9"}},
+		{"/users/{id}/", "/users/5/", map[string]string{"id": "5"}},
+		{"GET /users/{id}/devices/{device_id}", "/users/5", map[string]string{"id": "5", "device_id": ""}},
+	}
+	for _, tt := range tests {
+		request := httptest.NewRequest("GET", tt.path, nil)
+		setPathValues(request, tt.pattern)
+
+		for name, want := range tt.want {
+			if got := request.PathValue(name); got != want {
+				t.Errorf("%s on %s: %s = %q, want %q", tt.pattern, tt.path, name, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// maxPasswordBytes is the most bcrypt hashes, longer passwords are refused rather than truncated
+const maxPasswordBytes = 72
+
+// timingDummyHash is compared against when no user matches the email
+const timingDummyHash = "$2a$10$I4ZNgYdaVIg3gwWTWZhgkuYPl9bkYlJ0PYdftFmRNEbex.vRZVfHq"
+
+var (
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrInvalidToken       = errors.New("invalid or expired token")
+	ErrEmptyPassword      = errors.New("password must not be empty")
+	ErrPasswordTooLong    = fmt.Errorf("password must be at most %d bytes", maxPasswordBytes)
+)
+
+// Tokens is the pair of tokens issued on login and refresh
+type Tokens struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	UserID       int    `json:"user_id"`
+}
+
+// Claims is the payload carried by a signed access token
+type Claims struct {
+	UserID    int   `json:"sub"`
+	SessionID int   `json:"sid"`
+	IssuedAt  int64 `json:"iat"`
+	ExpiresAt int64 `json:"exp"`
+}
+
+type Service struct {
+	db     *pgxpool.Pool
+	secret []byte
+}
+
+func NewService(db *pgxpool.Pool, secret []byte) *Service {
+	if len(secret) == 0 {
+		// Tokens signed with a random secret do not survive a restart, which is fine for development only
+		log.Println("auth: no token secret configured, generating an ephemeral one")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatalf("Unable to generate token secret: %v", err)
+		}
+	}
+
+	return &Service{
+		db:     db,
+		secret: secret,
+	}
+}
+
+// ValidatePassword returns why a plaintext password cannot be hashed, or nil
+func ValidatePassword(password string) error {
+	if password == "" {
+		return ErrEmptyPassword
+	}
+	if len(password) > maxPasswordBytes {
+		return ErrPasswordTooLong
+	}
+	return nil
+}
+
+// HashPassword returns the bcrypt hash of a plaintext password
+func HashPassword(password string) (string, error) {
+	if err := ValidatePassword(password); err != nil {
+		return "", err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+// checkPassword compares a plaintext password against a stored value. Rows written before
+// passwords were hashed are compared verbatim so that they can be upgraded on login.
+func checkPassword(stored string, password string) (ok bool, legacy bool) {
+	if isBcryptHash(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil, false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1, true
+}
+
+func isBcryptHash(value string) bool {
+	return strings.HasPrefix(value, "$2a$") || strings.HasPrefix(value, "$2b$") || strings.HasPrefix(value, "$2y$")
+}
+
+// Login verifies a user's credentials and opens a new session
+func (s *Service) Login(ctx context.Context, email string, password string) (Tokens, error) {
+	var userID int
+	var stored string
+	err := s.db.QueryRow(
+		ctx,
+		"SELECT id, password FROM users WHERE email = $1",
+		email,
+	).Scan(&userID, &stored)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			// Spend the same time as a real comparison so unknown emails cannot be detected by timing
+			bcrypt.CompareHashAndPassword([]byte(timingDummyHash), []byte(password))
+			return Tokens{}, ErrInvalidCredentials
+		}
+		return Tokens{}, err
+	}
+
+	ok, legacy := checkPassword(stored, password)
+	if !ok {
+		return Tokens{}, ErrInvalidCredentials
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return Tokens{}, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	if legacy {
+		hash, err := HashPassword(password)
+		if err != nil {
+			return Tokens{}, err
+		}
+		// Only the value that was checked is replaced, in case the password changed meanwhile
+		_, err = tx.Exec(ctx, "UPDATE users SET password = $1 WHERE id = $2 AND password = $3", hash, userID, stored)
+		if err != nil {
+			return Tokens{}, fmt.Errorf("failed to upgrade password hash: %v", err)
+		}
+	}
+
+	tokens, err := s.createSession(ctx, tx, userID)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return Tokens{}, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return tokens, nil
+}
+
+// Refresh exchanges a valid refresh token for a new token pair. The old refresh token is revoked.
+func (s *Service) Refresh(ctx context.Context, refreshToken string) (Tokens, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return Tokens{}, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	var userID int
+	err = tx.QueryRow(
+		ctx,
+		`UPDATE user_sessions SET revoked_at = NOW()
+		 WHERE refresh_token_hash = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		 RETURNING user_id`,
+		hashRefreshToken(refreshToken),
+	).Scan(&userID)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return Tokens{}, ErrInvalidToken
+		}
+		return Tokens{}, err
+	}
+
+	tokens, err := s.createSession(ctx, tx, userID)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return Tokens{}, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return tokens, nil
+}
+
+// RevokeSessions deletes every session of a user in tx, so that their access and refresh tokens
+// stop working when the transaction commits
+func RevokeSessions(ctx context.Context, tx pgx.Tx, userID string) error {
+	_, err := tx.Exec(ctx, "DELETE FROM user_sessions WHERE user_id = $1", userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke sessions: %v", err)
+	}
+	return nil
+}
+
+// Logout revokes the session belonging to a refresh token
+func (s *Service) Logout(ctx context.Context, refreshToken string) (bool, error) {
+	cmdTag, err := s.db.Exec(
+		ctx,
+		"UPDATE user_sessions SET revoked_at = NOW() WHERE refresh_token_hash = $1 AND revoked_at IS NULL",
+		hashRefreshToken(refreshToken),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	if cmdTag.RowsAffected() == 0 {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// ValidateAccessToken verifies the signature and expiry of an access token and that its session
+// is still open, and returns its claims. Logging out or refreshing closes the session, so its
+// access tokens stop working straight away rather than when they expire.
+func (s *Service) ValidateAccessToken(ctx context.Context, token string) (Claims, error) {
+	claims, err := s.parseAccessToken(token)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	var open bool
+	err = s.db.QueryRow(
+		ctx,
+		"SELECT revoked_at IS NULL AND expires_at > NOW() FROM user_sessions WHERE id = $1 AND user_id = $2",
+		claims.SessionID, claims.UserID,
+	).Scan(&open)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return Claims{}, ErrInvalidToken
+		}
+		return Claims{}, fmt.Errorf("failed to read session: %v", err)
+	}
+	if !open {
+		return Claims{}, ErrInvalidToken
+	}
+
+	return claims, nil
+}
+
+// parseAccessToken verifies the signature and expiry of an access token and returns its claims
+func (s *Service) parseAccessToken(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, ErrInvalidToken
+	}
+
+	expected := s.sign(parts[0] + "." + parts[1])
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return Claims{}, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return Claims{}, ErrInvalidToken
+	}
+
+	return claims, nil
+}
+
+func (s *Service) createSession(ctx context.Context, tx pgx.Tx, userID int) (Tokens, error) {
+	refreshToken, err := randomToken()
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	var sessionID int
+	err = tx.QueryRow(
+		ctx,
+		`INSERT INTO user_sessions (user_id, refresh_token_hash, expires_at)
+		 VALUES ($1, $2, $3) RETURNING id`,
+		userID, hashRefreshToken(refreshToken), time.Now().Add(RefreshTokenTTL),
+	).Scan(&sessionID)
+	if err != nil {
+		return Tokens{}, fmt.Errorf("failed to create session: %v", err)
+	}
+
+	now := time.Now()
+	accessToken, err := s.signClaims(Claims{
+		UserID:    userID,
+		SessionID: sessionID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(AccessTokenTTL).Unix(),
+	})
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	return Tokens{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(AccessTokenTTL.Seconds()),
+		UserID:       userID,
+	}, nil
+}
+
+// signClaims encodes claims as an HS256 JWT
+func (s *Service) signClaims(claims Claims) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + s.sign(unsigned), nil
+}
+
+func (s *Service) sign(value string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Refresh tokens are stored hashed so that a database leak does not leak live sessions
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAccessToken(t *testing.T) {
+	service := &Service{secret: []byte("test secret")}
+	other := &Service{secret: []byte("another secret")}
+	now := time.Now()
+	claims := Claims{UserID: 7, SessionID: 3, IssuedAt: now.Unix(), ExpiresAt: now.Add(AccessTokenTTL).Unix()}
+
+	sign := func(s *Service, claims Claims) string {
+		token, err := s.signClaims(claims)
+		if err != nil {
+			t.Fatalf("signClaims: %v", err)
+		}
+		return token
+	}
+	valid := sign(service, claims)
+	parts := strings.Split(valid, ".")
+
+	// The payload of another user under the original signature
+	forged := claims
+	forged.UserID = 8
+	payload, _ := json.Marshal(forged)
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+
+	expired := claims
+	expired.ExpiresAt = now.Add(-time.Second).Unix()
+
+	notJSON := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte("not json"))
+	notJSON += "." + service.sign(notJSON)
+	notBase64 := parts[0] + ".***"
+	notBase64 += "." + service.sign(notBase64)
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"valid", valid, false},
+		{"signed with another secret", sign(other, claims), true},
+		{"tampered payload", tampered, true},
+		{"expired", sign(service, expired), true},
+		{"no signature", parts[0] + "." + parts[1], true},
+		{"extra part", valid + ".x", true},
+		{"empty", "", true},
+		{"payload not JSON", notJSON, true},
+		{"payload not base64", notBase64, true},
+	}
+	for _, tt := range tests {
+		got, err := service.parseAccessToken(tt.token)
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("%s: error %v, want %v", tt.name, err, ErrInvalidToken)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if got != claims {
+			t.Errorf("%s: claims %+v, want %+v", tt.name, got, claims)
+		}
+	}
+}
+
+func TestValidateAccessTokenRejectsBeforeSessionLookup(t *testing.T) {
+	// Without a database, a token that fails parsing must not reach the session lookup
+	service := &Service{secret: []byte("test secret")}
+	token, _ := (&Service{secret: []byte("another secret")}).signClaims(Claims{UserID: 7, ExpiresAt: time.Now().Add(time.Hour).Unix()})
+
+	if _, err := service.ValidateAccessToken(context.Background(), token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("error %v, want %v", err, ErrInvalidToken)
+	}
+}
+
+func TestValidatePassword(t *testing.T) {
+	tests := []struct {
+		password string
+		want     error
+	}{
+		{"", ErrEmptyPassword},
+		{"x", nil},
+		{strings.Repeat("x", maxPasswordBytes), nil},
+		{strings.Repeat("x", maxPasswordBytes+1), ErrPasswordTooLong},
+		{strings.Repeat("é", maxPasswordBytes/2), nil},
+		{strings.Repeat("é", maxPasswordBytes/2) + "x", ErrPasswordTooLong}, // bytes count, not characters
+	}
+	for _, tt := range tests {
+		if err := ValidatePassword(tt.password); err != tt.want {
+			t.Errorf("ValidatePassword of %d bytes = %v, want %v", len(tt.password), err, tt.want)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatalf("HashPassword: %v", err)
+	}
+	if _, err := HashPassword(""); err != ErrEmptyPassword {
+		t.Errorf("HashPassword of an empty password: %v, want %v", err, ErrEmptyPassword)
+	}
+
+	tests := []struct {
+		stored     string
+		password   string
+		wantOK     bool
+		wantLegacy bool
+	}{
+		{hash, "correct horse", true, false},
+		{hash, "battery staple", false, false},
+		{"correct horse", "correct horse", true, true}, // stored before passwords were hashed
+		{"correct horse", "battery staple", false, true},
+	}
+	for _, tt := range tests {
+		ok, legacy := checkPassword(tt.stored, tt.password)
+		if ok != tt.wantOK || legacy != tt.wantLegacy {
+			t.Errorf("checkPassword(%q, %q) = %v, %v, want %v, %v", tt.stored, tt.password, ok, legacy, tt.wantOK, tt.wantLegacy)
+		}
+	}
+}
+
+func TestRefreshTokens(t *testing.T) {
+	first, err := randomToken()
+	if err != nil {
+		t.Fatalf("randomToken: %v", err)
+	}
+	second, _ := randomToken()
+	if first == second {
+		t.Errorf("randomToken returned %q twice", first)
+	}
+
+	// The stored hash is stable, so that a presented token finds its session
+	if hashRefreshToken(first) != hashRefreshToken(first) || hashRefreshToken(first) == hashRefreshToken(second) {
+		t.Errorf("hashRefreshToken is not a stable, distinct hash")
+	}
+	if hash := hashRefreshToken(first); len(hash) != 64 || strings.Contains(hash, first) {
+		t.Errorf("hashRefreshToken(%q) = %q", first, hash)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"friendsocial/activities"
+	"friendsocial/config"
+	"friendsocial/locations"
+	"friendsocial/postgres"
+	"friendsocial/scheduled_activities"
+	"friendsocial/user_activity_preferences"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const benchUsage = `usage: friendsocial bench [bench flags] [-- server flags]
+
+Measures GET /scheduled_activities and PUT /scheduled_activity/{id} under parallel load, calling
+the handlers in-process against the configured database. A throwaway location, activity and
+inactive scheduled activity are created for the writes and deleted afterwards. Use a development
+database: the rows being listed are whatever it holds.
+
+bench flags:`
+
+// benchOptions configure a bench run
+type benchOptions struct {
+	workers    []int
+	duration   time.Duration
+	writeRatio float64
+	serialized bool
+}
+
+// benchResult is what one concurrency level achieved
+type benchResult struct {
+	reads   []time.Duration
+	writes  []time.Duration
+	errors  int
+	elapsed time.Duration
+}
+
+// runBench runs the bench subcommand. args follow "bench" on the command line.
+func runBench(args []string) error {
+	options := benchOptions{}
+	var workers string
+	var writePercent int
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), benchUsage)
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&workers, "workers", "1,4,16,64", "comma separated numbers of concurrent clients, each measured in turn")
+	flags.DurationVar(&options.duration, "duration", 10*time.Second, "how long each number of clients is measured")
+	flags.IntVar(&writePercent, "writes", 20, "percentage of requests that are writes")
+	flags.BoolVar(&options.serialized, "serialized", false, "let one request run at a time, like the per-service mutexes used to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	for _, field := range strings.Split(workers, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || n < 1 {
+			return fmt.Errorf("-workers takes positive numbers, not %q", field)
+		}
+		options.workers = append(options.workers, n)
+	}
+	if writePercent < 0 || writePercent > 100 {
+		return errors.New("-writes must be between 0 and 100")
+	}
+	options.writeRatio = float64(writePercent) / 100
+
+	cfg, err := config.Load(flags.Args())
+	if err != nil {
+		return err
+	}
+	// Enough connections for every client, otherwise the pool is what gets measured
+	cfg.Database.MaxConns = max(cfg.Database.MaxConns, int32(slices.Max(options.workers)))
+	postgres.InitDB(cfg.Database)
+	defer postgres.CloseDB()
+
+	ctx := context.Background()
+	preferenceService := user_activity_preferences.NewService(postgres.DB)
+	scheduledActivityService := scheduled_activities.NewService(postgres.DB, preferenceService, cfg.Scheduling.MaterializeHorizon)
+	scheduledActivityManager := scheduled_activities.NewScheduledActivityHTTPHandler(scheduledActivityService, preferenceService)
+	routes := http.NewServeMux()
+	scheduledActivityManager.RegisterRoutes(routes)
+
+	fixture, cleanup, err := createBenchFixture(ctx, scheduledActivityService)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "WORKERS\tREQ/S\tREADS/S\tWRITES/S\tREAD P50\tREAD P99\tWRITE P50\tWRITE P99\tERRORS\t")
+	for _, n := range options.workers {
+		result := benchLevel(routes, fixture, n, options)
+		total := float64(len(result.reads)+len(result.writes)) / result.elapsed.Seconds()
+		fmt.Fprintf(w, "%d\t%.0f\t%.0f\t%.0f\t%s\t%s\t%s\t%s\t%d\t\n", n, total,
+			float64(len(result.reads))/result.elapsed.Seconds(), float64(len(result.writes))/result.elapsed.Seconds(),
+			percentile(result.reads, 0.50), percentile(result.reads, 0.99),
+			percentile(result.writes, 0.50), percentile(result.writes, 0.99),
+			result.errors)
+		w.Flush()
+	}
+	return nil
+}
+
+// createBenchFixture creates the rows the writes edit and returns a function that deletes them
+func createBenchFixture(ctx context.Context, scheduledActivityService *scheduled_activities.Service) (scheduled_activities.ScheduledActivity, func(), error) {
+	locationService := locations.NewService(postgres.DB)
+	activityService := activities.NewService(postgres.DB)
+
+	location, err := locationService.Create(ctx, locations.Location{Name: "bench", Address: "bench", City: "bench", Country: "bench"})
+	if err != nil {
+		return scheduled_activities.ScheduledActivity{}, nil, fmt.Errorf("unable to create bench location: %v", err)
+	}
+	activity, err := activityService.Create(ctx, activities.Activity{Name: "bench", EstimatedTime: "1 hour", LocationID: location.ID})
+	if err != nil {
+		locationService.Delete(ctx, strconv.Itoa(location.ID))
+		return scheduled_activities.ScheduledActivity{}, nil, fmt.Errorf("unable to create bench activity: %v", err)
+	}
+	// Inactive, so that editing it notifies nobody and publishes no events
+	scheduledActivity, err := scheduledActivityService.Create(ctx, scheduled_activities.ScheduledActivity{
+		ActivityID:  activity.ID,
+		IsActive:    false,
+		ScheduledAt: time.Now().AddDate(1, 0, 0).Truncate(time.Minute),
+	}, nil)
+	if err != nil {
+		activityService.Delete(ctx, strconv.Itoa(activity.ID))
+		locationService.Delete(ctx, strconv.Itoa(location.ID))
+		return scheduled_activities.ScheduledActivity{}, nil, fmt.Errorf("unable to create bench scheduled activity: %v", err)
+	}
+
+	cleanup := func() {
+		scheduledActivityService.Delete(ctx, strconv.Itoa(scheduledActivity.ID))
+		activityService.Delete(ctx, strconv.Itoa(activity.ID))
+		locationService.Delete(ctx, strconv.Itoa(location.ID))
+	}
+	return scheduledActivity, cleanup, nil
+}
+
+// benchLevel keeps n clients sending requests for the configured duration
+func benchLevel(routes http.Handler, fixture scheduled_activities.ScheduledActivity, n int, options benchOptions) benchResult {
+	var serial sync.Mutex
+	var mu sync.Mutex
+	var result benchResult
+	deadline := time.Now().Add(options.duration)
+
+	var clients sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		clients.Add(1)
+		go func(seed int64) {
+			defer clients.Done()
+			random := rand.New(rand.NewSource(seed))
+			var reads, writes []time.Duration
+			failed := 0
+
+			for time.Now().Before(deadline) {
+				write := random.Float64() < options.writeRatio
+				var request *http.Request
+				if write {
+					edited := fixture
+					edited.ScheduledAt = fixture.ScheduledAt.Add(time.Duration(random.Intn(60*24)) * time.Minute)
+					body, _ := json.Marshal(edited)
+					request = httptest.NewRequest(http.MethodPut, "/scheduled_activity/"+strconv.Itoa(fixture.ID), bytes.NewReader(body))
+				} else {
+					request = httptest.NewRequest(http.MethodGet, "/scheduled_activities", nil)
+				}
+				recorder := httptest.NewRecorder()
+
+				began := time.Now()
+				if options.serialized {
+					serial.Lock()
+				}
+				routes.ServeHTTP(recorder, request)
+				if options.serialized {
+					serial.Unlock()
+				}
+				took := time.Since(began)
+
+				switch {
+				case recorder.Code != http.StatusOK:
+					failed++
+				case write:
+					writes = append(writes, took)
+				default:
+					reads = append(reads, took)
+				}
+			}
+
+			mu.Lock()
+			result.reads = append(result.reads, reads...)
+			result.writes = append(result.writes, writes...)
+			result.errors += failed
+			mu.Unlock()
+		}(int64(i))
+	}
+	clients.Wait()
+	result.elapsed = time.Since(start)
+
+	return result
+}
+
+// percentile returns the latency below which the given fraction of samples fall
+func percentile(samples []time.Duration, fraction float64) string {
+	if len(samples) == 0 {
+		return "-"
+	}
+	slices.Sort(samples)
+	index := int(float64(len(samples)-1) * fraction)
+	return samples[index].Round(10 * time.Microsecond).String()
+}
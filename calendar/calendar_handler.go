@@ -0,0 +1,196 @@
+package calendar
+
+import (
+	"context"
+	"encoding/json"
+	"friendsocial/auth"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CalendarService defines the methods for exporting calendars
+type CalendarService interface {
+	Calendar(ctx context.Context, userID int) (string, error)
+	RotateFeed(ctx context.Context, userID int) (Feed, error)
+	RevokeFeed(ctx context.Context, userID int) (bool, error)
+	FeedOwner(ctx context.Context, token string) (int, bool, error)
+}
+
+// CalendarError represents the structure of an error response
+type CalendarError struct {
+	StatusCode int    `json:"status_code"`
+	Error      string `json:"error"`
+}
+
+// CalendarHTTPHandler handles HTTP requests for calendar exports
+type CalendarHTTPHandler struct {
+	calendarService CalendarService
+}
+
+// NewCalendarHTTPHandler creates a new handler for calendar exports
+func NewCalendarHTTPHandler(calendarService CalendarService) *CalendarHTTPHandler {
+	return &CalendarHTTPHandler{
+		calendarService: calendarService,
+	}
+}
+
+// HandleHTTPGet exports a user's calendar
+//
+//	@Summary		Export a user's calendar
+//	@Description	Export the scheduled activities a user was invited to as an iCalendar (RFC 5545) file. Recurring series are exported with their RRULE.
+//	@Tags			calendar
+//	@Produce		text/calendar
+//	@Param			id	path		int	true	"User ID"
+//	@Success		200	{string}	string
+//	@Failure		400	{object}	CalendarError
+//	@Failure		500	{object}	CalendarError
+//	@Router			/users/{id}/calendar.ics [get]
+func (cH *CalendarHTTPHandler) HandleHTTPGet(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		cH.errorResponse(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	cH.calendarResponse(w, r, userID)
+}
+
+// HandleHTTPGetFeed serves a calendar feed to calendar apps, which authenticate with the feed's
+// secret token instead of a bearer token
+//
+//	@Summary		Subscribe to a calendar feed
+//	@Description	Serve the calendar of the user a feed token belongs to. Calendar apps subscribe to this URL.
+//	@Tags			calendar
+//	@Produce		text/calendar
+//	@Param			token	path		string	true	"Feed token followed by .ics"
+//	@Success		200		{string}	string
+//	@Failure		404		{object}	CalendarError
+//	@Failure		500		{object}	CalendarError
+//	@Router			/calendar/{token} [get]
+func (cH *CalendarHTTPHandler) HandleHTTPGetFeed(w http.ResponseWriter, r *http.Request) {
+	token, found := strings.CutSuffix(r.PathValue("token"), ".ics")
+	if !found || token == "" {
+		cH.errorResponse(w, http.StatusNotFound, "Calendar feed not found")
+		return
+	}
+
+	userID, found, err := cH.calendarService.FeedOwner(r.Context(), token)
+	if err != nil {
+		cH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !found {
+		cH.errorResponse(w, http.StatusNotFound, "Calendar feed not found")
+		return
+	}
+
+	cH.calendarResponse(w, r, userID)
+}
+
+// HandleHTTPPostFeed issues a new calendar feed URL
+//
+//	@Summary		Rotate a calendar feed
+//	@Description	Issue a new secret feed URL for a user's calendar. The previous URL stops working. The token is not shown again.
+//	@Tags			calendar
+//	@Produce		json
+//	@Param			id	path		int	true	"User ID"
+//	@Success		201	{object}	Feed
+//	@Failure		400	{object}	CalendarError
+//	@Failure		500	{object}	CalendarError
+//	@Router			/users/{id}/calendar_feed [post]
+func (cH *CalendarHTTPHandler) HandleHTTPPostFeed(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		cH.errorResponse(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	feed, err := cH.calendarService.RotateFeed(r.Context(), userID)
+	if err != nil {
+		cH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(feed)
+	if err != nil {
+		cH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// HandleHTTPDeleteFeed turns off a user's calendar feed
+//
+//	@Summary		Revoke a calendar feed
+//	@Description	Turn off a user's secret feed URL
+//	@Tags			calendar
+//	@Param			id	path	int	true	"User ID"
+//	@Success		204	"No Content"
+//	@Failure		400	{object}	CalendarError
+//	@Failure		404	{object}	CalendarError
+//	@Failure		500	{object}	CalendarError
+//	@Router			/users/{id}/calendar_feed [delete]
+func (cH *CalendarHTTPHandler) HandleHTTPDeleteFeed(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		cH.errorResponse(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	found, err := cH.calendarService.RevokeFeed(r.Context(), userID)
+	if err != nil {
+		cH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !found {
+		cH.errorResponse(w, http.StatusNotFound, "Calendar feed not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegisterRoutes adds the calendar routes to mux
+func (cH *CalendarHTTPHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /users/{id}/calendar.ics", cH.HandleHTTPGet)
+	mux.HandleFunc("POST /users/{id}/calendar_feed", cH.HandleHTTPPostFeed)
+	mux.HandleFunc("DELETE /users/{id}/calendar_feed", cH.HandleHTTPDeleteFeed)
+	mux.HandleFunc("GET /calendar/{token}", cH.HandleHTTPGetFeed)
+}
+
+// AuthorizationRules returns the ownership rules for calendar routes. The feed itself is public
+// and guarded by its token.
+func (cH *CalendarHTTPHandler) AuthorizationRules() map[string]auth.Rule {
+	return map[string]auth.Rule{
+		"GET /users/{id}/calendar.ics":     auth.Self("id"),
+		"POST /users/{id}/calendar_feed":   auth.Self("id"),
+		"DELETE /users/{id}/calendar_feed": auth.Self("id"),
+	}
+}
+
+func (cH *CalendarHTTPHandler) calendarResponse(w http.ResponseWriter, r *http.Request, userID int) {
+	calendar, err := cH.calendarService.Calendar(r.Context(), userID)
+	if err != nil {
+		cH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="friendsocial.ics"`)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Write([]byte(calendar))
+}
+
+func (cH *CalendarHTTPHandler) errorResponse(w http.ResponseWriter, statusCode int, errorString string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	encodingError := json.NewEncoder(w).Encode(CalendarError{
+		StatusCode: statusCode,
+		Error:      errorString,
+	})
+	if encodingError != nil {
+		http.Error(w, encodingError.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,460 @@
+package calendar
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"friendsocial/user_activity_preferences"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/lib/pq"
+)
+
+// prodID identifies FriendSocial as the producer of its calendars
+const prodID = "-//FriendSocial//Calendar//EN"
+
+// Feed is a user's secret calendar feed. Calendar apps cannot send a bearer token, so the token
+// in the URL is the only credential; it is stored hashed and only returned when it is issued.
+type Feed struct {
+	UserID    int       `json:"user_id"`
+	Token     string    `json:"token,omitempty"`
+	URL       string    `json:"url,omitempty"` // path of the feed, relative to the API
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// details are what an event shows of its activity and location
+type details struct {
+	summary     string
+	description string
+	duration    time.Duration
+	location    string
+	latitude    *float64
+	longitude   *float64
+}
+
+// detailsColumns lists the activity (a) and location (l) columns scanned into details by detailsDest
+const detailsColumns = `a.name, COALESCE(a.emoji, ''), a.description, EXTRACT(EPOCH FROM a.estimated_time)::bigint,
+	l.name, l.address, l.city, COALESCE(l.state, ''), COALESCE(l.zip_code, ''), l.country, l.latitude, l.longitude`
+
+// detailsDest returns the scan destinations for detailsColumns. finish must be called after
+// scanning to assemble the details.
+func detailsDest(d *details) (dest []interface{}, finish func()) {
+	var name, emoji, locationName, address, city, state, zipCode, country string
+	var seconds int64
+	dest = []interface{}{&name, &emoji, &d.description, &seconds,
+		&locationName, &address, &city, &state, &zipCode, &country, &d.latitude, &d.longitude}
+	return dest, func() {
+		d.summary = strings.TrimSpace(emoji + " " + name)
+		d.duration = time.Duration(seconds) * time.Second
+		d.location = joinNonEmpty(", ", locationName, address, city, joinNonEmpty(" ", state, zipCode), country)
+	}
+}
+
+// attendee is a participant of a scheduled activity
+type attendee struct {
+	name         string
+	email        string
+	inviteStatus string
+}
+
+// occurrence is a scheduled activity in a user's calendar
+type occurrence struct {
+	id            int
+	isActive      bool
+	scheduledAt   time.Time
+	recurrenceID  *time.Time
+	seriesID      *int // the series the user follows, if the scheduled activity belongs to one
+	participating bool // false for occurrences of a followed series the user was not invited to
+	details       details
+	attendees     []attendee
+}
+
+// series is a recurring user activity preference the user takes part in
+type series struct {
+	id             int
+	recurrence     user_activity_preferences.Recurrence
+	organizerName  string
+	organizerEmail string
+	details        details
+	occurrences    []occurrence
+}
+
+type Service struct {
+	db *pgxpool.Pool
+}
+
+func NewService(db *pgxpool.Pool) *Service {
+	return &Service{
+		db: db,
+	}
+}
+
+// Calendar returns a user's scheduled activities as an iCalendar object. Series the user takes
+// part in are exported as one recurring event with an RRULE, plus an overriding instance for each
+// occurrence that has been scheduled so that its time, status and attendees are exact.
+func (s *Service) Calendar(ctx context.Context, userID int) (string, error) {
+	occurrences, err := s.readOccurrences(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.readAttendees(ctx, occurrences); err != nil {
+		return "", err
+	}
+
+	seriesByID, err := s.readSeries(ctx, occurrences)
+	if err != nil {
+		return "", err
+	}
+
+	var standalone []occurrence
+	for _, occurrence := range occurrences {
+		if occurrence.seriesID != nil && occurrence.recurrenceID != nil {
+			if series, ok := seriesByID[*occurrence.seriesID]; ok {
+				series.occurrences = append(series.occurrences, occurrence)
+				continue
+			}
+		}
+		if occurrence.participating {
+			standalone = append(standalone, occurrence)
+		}
+	}
+
+	w := &icsWriter{}
+	now := time.Now()
+	w.line("BEGIN", "VCALENDAR")
+	w.line("VERSION", "2.0")
+	w.line("PRODID", prodID)
+	w.line("CALSCALE", "GREGORIAN")
+	w.line("METHOD", "PUBLISH")
+	w.text("X-WR-CALNAME", "FriendSocial")
+
+	// Series are written in their own time zone, which the calendar has to define
+	sorted := sortedSeries(seriesByID)
+	zones := make(map[string]time.Time)
+	var locations []*time.Location
+	for _, series := range sorted {
+		loc := series.recurrence.Start.Location()
+		from, ok := zones[loc.String()]
+		if !ok {
+			locations = append(locations, loc)
+		}
+		if !ok || series.recurrence.Start.Before(from) {
+			zones[loc.String()] = series.recurrence.Start
+		}
+	}
+	for _, loc := range locations {
+		w.vtimezone(loc, zones[loc.String()], now.AddDate(vtimezoneYears, 0, 0))
+	}
+
+	for _, series := range sorted {
+		writeSeries(w, series, now)
+	}
+	for _, occurrence := range standalone {
+		writeOccurrence(w, occurrence, occurrenceUID(occurrence.id), nil, now)
+	}
+
+	w.line("END", "VCALENDAR")
+	return w.String(), nil
+}
+
+// readOccurrences returns the scheduled activities the user was invited to, and every scheduled
+// occurrence of the series they take part in
+func (s *Service) readOccurrences(ctx context.Context, userID int) ([]occurrence, error) {
+	rows, err := s.db.Query(ctx,
+		`SELECT sa.id, COALESCE(sa.is_active, TRUE), sa.scheduled_at, sa.recurrence_id,
+		        CASE WHEN uapp.user_id IS NOT NULL THEN sa.user_activity_preference_id END,
+		        ap.id IS NOT NULL, `+detailsColumns+`
+		 FROM scheduled_activities sa
+		 JOIN activities a ON a.id = sa.activity_id
+		 JOIN locations l ON l.id = a.location_id
+		 LEFT JOIN activity_participants ap ON ap.scheduled_activity_id = sa.id AND ap.user_id = $1
+		 LEFT JOIN user_activity_preferences_participants uapp
+		        ON uapp.user_activity_preference_id = sa.user_activity_preference_id AND uapp.user_id = $1
+		 WHERE ap.id IS NOT NULL OR uapp.user_id IS NOT NULL
+		 ORDER BY sa.scheduled_at, sa.id`,
+		userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scheduled activities: %v", err)
+	}
+	defer rows.Close()
+
+	var occurrences []occurrence
+	for rows.Next() {
+		var occurrence occurrence
+		dest, finish := detailsDest(&occurrence.details)
+		err := rows.Scan(append([]interface{}{&occurrence.id, &occurrence.isActive, &occurrence.scheduledAt,
+			&occurrence.recurrenceID, &occurrence.seriesID, &occurrence.participating}, dest...)...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan scheduled activity: %v", err)
+		}
+		finish()
+		occurrences = append(occurrences, occurrence)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read scheduled activities: %v", err)
+	}
+
+	return occurrences, nil
+}
+
+// readAttendees fills in the participants of the occurrences the user was invited to
+func (s *Service) readAttendees(ctx context.Context, occurrences []occurrence) error {
+	index := make(map[int]int)
+	var ids []int
+	for i, occurrence := range occurrences {
+		if occurrence.participating {
+			index[occurrence.id] = i
+			ids = append(ids, occurrence.id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	rows, err := s.db.Query(ctx,
+		`SELECT ap.scheduled_activity_id, u.name, u.email, ap.invite_status
+		 FROM activity_participants ap
+		 JOIN users u ON u.id = ap.user_id
+		 WHERE ap.scheduled_activity_id = ANY($1)
+		 ORDER BY ap.scheduled_activity_id, u.name, u.id`,
+		pq.Array(ids))
+	if err != nil {
+		return fmt.Errorf("failed to read participants: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var scheduledActivityID int
+		var attendee attendee
+		if err := rows.Scan(&scheduledActivityID, &attendee.name, &attendee.email, &attendee.inviteStatus); err != nil {
+			return fmt.Errorf("failed to scan participant: %v", err)
+		}
+		i := index[scheduledActivityID]
+		occurrences[i].attendees = append(occurrences[i].attendees, attendee)
+	}
+	return rows.Err()
+}
+
+// readSeries loads the recurrence of every series among the occurrences. Series without an
+// RRULE, or whose recurrence does not parse, are left out and their occurrences exported on
+// their own.
+func (s *Service) readSeries(ctx context.Context, occurrences []occurrence) (map[int]*series, error) {
+	var ids []int
+	seen := make(map[int]bool)
+	for _, occurrence := range occurrences {
+		if occurrence.seriesID != nil && !seen[*occurrence.seriesID] {
+			seen[*occurrence.seriesID] = true
+			ids = append(ids, *occurrence.seriesID)
+		}
+	}
+
+	seriesByID := make(map[int]*series)
+	if len(ids) == 0 {
+		return seriesByID, nil
+	}
+
+	rows, err := s.db.Query(ctx,
+		`SELECT uap.id, COALESCE(uap.rrule, ''), COALESCE(to_char(uap.dtstart, 'YYYY-MM-DD"T"HH24:MI:SS'), ''),
+		        COALESCE(uap.time_zone, ''), COALESCE(uap.exdates, '{}'), u.name, u.email, `+detailsColumns+`
+		 FROM user_activity_preferences uap
+		 JOIN users u ON u.id = uap.user_id
+		 JOIN activities a ON a.id = uap.activity_id
+		 JOIN locations l ON l.id = a.location_id
+		 WHERE uap.id = ANY($1)`,
+		pq.Array(ids))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read series: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var preference user_activity_preferences.UserActivityPreference
+		series := &series{}
+		dest, finish := detailsDest(&series.details)
+		err := rows.Scan(append([]interface{}{&preference.ID, &preference.RRule, &preference.DTStart,
+			&preference.TimeZone, &preference.ExDates, &series.organizerName, &series.organizerEmail}, dest...)...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan series: %v", err)
+		}
+		finish()
+
+		recurrence, err := preference.Recurrence()
+		if err != nil {
+			continue
+		}
+		series.id = preference.ID
+		series.recurrence = recurrence
+		seriesByID[series.id] = series
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read series: %v", err)
+	}
+
+	return seriesByID, nil
+}
+
+// writeSeries writes the recurring event of a series followed by its scheduled occurrences.
+// Occurrences the user was not invited to are excluded from the rule rather than shown.
+func writeSeries(w *icsWriter, series *series, now time.Time) {
+	loc := series.recurrence.Start.Location()
+	uid := seriesUID(series.id)
+
+	w.line("BEGIN", "VEVENT")
+	w.line("UID", uid)
+	w.utc("DTSTAMP", now)
+	w.local("DTSTART", series.recurrence.Start, loc)
+	w.local("DTEND", series.recurrence.Start.Add(series.details.duration), loc)
+	w.line("RRULE", series.recurrence.Rule.String())
+	exDates := series.recurrence.ExDates
+	for _, occurrence := range series.occurrences {
+		if !occurrence.participating {
+			exDates = append(exDates, *occurrence.recurrenceID)
+		}
+	}
+	if len(exDates) > 0 {
+		values := make([]string, len(exDates))
+		for i, exDate := range exDates {
+			values[i] = exDate.In(loc).Format(localLayout)
+		}
+		w.line("EXDATE;TZID="+loc.String(), strings.Join(values, ","))
+	}
+	writeDetails(w, series.details)
+	w.line("ORGANIZER;CN="+quoteParam(series.organizerName), "mailto:"+series.organizerEmail)
+	w.line("STATUS", "CONFIRMED")
+	w.line("END", "VEVENT")
+
+	for _, occurrence := range series.occurrences {
+		if occurrence.participating {
+			writeOccurrence(w, occurrence, uid, loc, now)
+		}
+	}
+}
+
+// writeOccurrence writes a scheduled activity. Occurrences of a series are written as an instance
+// of the series' event, identified by the series' uid and their RECURRENCE-ID in loc.
+func writeOccurrence(w *icsWriter, occurrence occurrence, uid string, loc *time.Location, now time.Time) {
+	w.line("BEGIN", "VEVENT")
+	w.line("UID", uid)
+	w.utc("DTSTAMP", now)
+	if loc != nil {
+		w.local("RECURRENCE-ID", *occurrence.recurrenceID, loc)
+	}
+	w.utc("DTSTART", occurrence.scheduledAt)
+	w.utc("DTEND", occurrence.scheduledAt.Add(occurrence.details.duration))
+	writeDetails(w, occurrence.details)
+	for _, attendee := range occurrence.attendees {
+		partStat, ok := partStats[attendee.inviteStatus]
+		if !ok {
+			partStat = "NEEDS-ACTION"
+		}
+		w.line("ATTENDEE;CN="+quoteParam(attendee.name)+";PARTSTAT="+partStat, "mailto:"+attendee.email)
+	}
+	if occurrence.isActive {
+		w.line("STATUS", "CONFIRMED")
+	} else {
+		w.line("STATUS", "CANCELLED")
+	}
+	w.line("END", "VEVENT")
+}
+
+func writeDetails(w *icsWriter, details details) {
+	w.text("SUMMARY", details.summary)
+	if details.description != "" {
+		w.text("DESCRIPTION", details.description)
+	}
+	w.text("LOCATION", details.location)
+	if details.latitude != nil && details.longitude != nil {
+		w.line("GEO", strconv.FormatFloat(*details.latitude, 'f', -1, 64)+";"+strconv.FormatFloat(*details.longitude, 'f', -1, 64))
+	}
+}
+
+func sortedSeries(seriesByID map[int]*series) []*series {
+	sorted := make([]*series, 0, len(seriesByID))
+	for _, series := range seriesByID {
+		sorted = append(sorted, series)
+	}
+	slices.SortFunc(sorted, func(a, b *series) int {
+		return a.id - b.id
+	})
+	return sorted
+}
+
+func occurrenceUID(id int) string {
+	return fmt.Sprintf("scheduled-activity-%d@friendsocial", id)
+}
+
+func seriesUID(id int) string {
+	return fmt.Sprintf("series-%d@friendsocial", id)
+}
+
+func joinNonEmpty(separator string, values ...string) string {
+	var parts []string
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			parts = append(parts, value)
+		}
+	}
+	return strings.Join(parts, separator)
+}
+
+// RotateFeed issues a new feed token for a user, replacing the previous one
+func (s *Service) RotateFeed(ctx context.Context, userID int) (Feed, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return Feed{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	feed := Feed{UserID: userID, Token: token, URL: "/calendar/" + token + ".ics"}
+	err := s.db.QueryRow(ctx,
+		`INSERT INTO calendar_feeds (user_id, token_hash)
+		 VALUES ($1, $2)
+		 ON CONFLICT (user_id) DO UPDATE SET token_hash = EXCLUDED.token_hash, created_at = CURRENT_TIMESTAMP
+		 RETURNING created_at`,
+		userID, hashToken(token)).Scan(&feed.CreatedAt)
+	if err != nil {
+		return Feed{}, err
+	}
+
+	return feed, nil
+}
+
+// RevokeFeed turns off a user's feed. It reports whether there was one.
+func (s *Service) RevokeFeed(ctx context.Context, userID int) (bool, error) {
+	result, err := s.db.Exec(ctx, "DELETE FROM calendar_feeds WHERE user_id = $1", userID)
+	if err != nil {
+		return false, err
+	}
+
+	return result.RowsAffected() > 0, nil
+}
+
+// FeedOwner returns the user a feed token belongs to
+func (s *Service) FeedOwner(ctx context.Context, token string) (int, bool, error) {
+	var userID int
+	err := s.db.QueryRow(ctx,
+		"SELECT user_id FROM calendar_feeds WHERE token_hash = $1", hashToken(token)).Scan(&userID)
+	if err == pgx.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	return userID, true, nil
+}
+
+// Feed tokens are stored hashed so that a database leak does not expose anyone's calendar
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
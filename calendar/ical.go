@@ -0,0 +1,158 @@
+package calendar
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	utcLayout   = "20060102T150405Z"
+	localLayout = "20060102T150405"
+	// maxLineLength is the longest a content line may be before it is folded, in octets (RFC 5545 3.1)
+	maxLineLength = 75
+	// vtimezoneYears is how many years past the export a VTIMEZONE lists the offset changes of
+	vtimezoneYears = 10
+)
+
+// partStats maps invite_status to the PARTSTAT of an ATTENDEE
+var partStats = map[string]string{
+	"Pending":    "NEEDS-ACTION",
+	"Waitlisted": "NEEDS-ACTION",
+	"Accepted":   "ACCEPTED",
+	"Declined":   "DECLINED",
+	"Maybe":      "TENTATIVE",
+	"Tentative":  "TENTATIVE",
+}
+
+// icsWriter builds an iCalendar object one content line at a time
+type icsWriter struct {
+	builder strings.Builder
+}
+
+// line writes a property whose value is already in iCalendar form
+func (w *icsWriter) line(name string, value string) {
+	content := name + ":" + value
+	limit := maxLineLength
+	for len(content) > limit {
+		cut := limit
+		for !utf8.RuneStart(content[cut]) {
+			cut--
+		}
+		w.builder.WriteString(content[:cut])
+		w.builder.WriteString("\r\n ")
+		content = content[cut:]
+		// The leading space of a continuation line counts towards its length
+		limit = maxLineLength - 1
+	}
+	w.builder.WriteString(content)
+	w.builder.WriteString("\r\n")
+}
+
+// text writes a TEXT property, escaping its value
+func (w *icsWriter) text(name string, value string) {
+	w.line(name, escapeText(value))
+}
+
+// utc writes a DATE-TIME property in UTC
+func (w *icsWriter) utc(name string, t time.Time) {
+	w.line(name, t.UTC().Format(utcLayout))
+}
+
+// local writes a DATE-TIME property as wall-clock time in loc. The calendar must contain a
+// VTIMEZONE for loc, see vtimezone.
+func (w *icsWriter) local(name string, t time.Time, loc *time.Location) {
+	w.line(name+";TZID="+loc.String(), t.In(loc).Format(localLayout))
+}
+
+// vtimezone writes the VTIMEZONE component that TZID=loc refers to. Its observances are the offset
+// changes of Go's time zone database between from and to, each with its own DTSTART, so clients
+// need no rules of their own to resolve the wall-clock times.
+func (w *icsWriter) vtimezone(loc *time.Location, from time.Time, to time.Time) {
+	w.line("BEGIN", "VTIMEZONE")
+	w.line("TZID", loc.String())
+
+	start := from.Unix()
+	_, offset := from.In(loc).Zone()
+	w.observance(time.Unix(start, 0).In(loc), offset)
+	for day := start; day < to.Unix(); day += 24 * 60 * 60 {
+		next := day + 24*60*60
+		if sameZone(time.Unix(day, 0).In(loc), time.Unix(next, 0).In(loc)) {
+			continue
+		}
+		// Narrow the change down to the second it happens at
+		before, after := day, next
+		for after-before > 1 {
+			middle := before + (after-before)/2
+			if sameZone(time.Unix(before, 0).In(loc), time.Unix(middle, 0).In(loc)) {
+				before = middle
+			} else {
+				after = middle
+			}
+		}
+		_, previous := time.Unix(before, 0).In(loc).Zone()
+		w.observance(time.Unix(after, 0).In(loc), previous)
+	}
+
+	w.line("END", "VTIMEZONE")
+}
+
+// observance writes the STANDARD or DAYLIGHT sub-component that starts at the given instant,
+// coming from the previous UTC offset in seconds
+func (w *icsWriter) observance(start time.Time, previous int) {
+	name, offset := start.Zone()
+	kind := "STANDARD"
+	if start.IsDST() {
+		kind = "DAYLIGHT"
+	}
+
+	w.line("BEGIN", kind)
+	// DTSTART is the wall-clock time just before the change
+	w.line("DTSTART", start.UTC().Add(time.Duration(previous)*time.Second).Format(localLayout))
+	w.line("TZOFFSETFROM", formatOffset(previous))
+	w.line("TZOFFSETTO", formatOffset(offset))
+	w.text("TZNAME", name)
+	w.line("END", kind)
+}
+
+// sameZone reports whether two times in the same location have the same offset and abbreviation
+func sameZone(a time.Time, b time.Time) bool {
+	aName, aOffset := a.Zone()
+	bName, bOffset := b.Zone()
+	return aName == bName && aOffset == bOffset && a.IsDST() == b.IsDST()
+}
+
+// formatOffset formats a UTC offset in seconds as a UTC-OFFSET value such as +0100 (RFC 5545 3.3.14)
+func formatOffset(offset int) string {
+	sign := "+"
+	if offset < 0 {
+		sign = "-"
+		offset = -offset
+	}
+	value := fmt.Sprintf("%s%02d%02d", sign, offset/3600, offset%3600/60)
+	if seconds := offset % 60; seconds != 0 {
+		value += fmt.Sprintf("%02d", seconds)
+	}
+	return value
+}
+
+func (w *icsWriter) String() string {
+	return w.builder.String()
+}
+
+// escapeText escapes a TEXT value (RFC 5545 3.3.11)
+func escapeText(value string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	).Replace(value)
+}
+
+// quoteParam quotes a parameter value such as CN, which may not contain double quotes
+func quoteParam(value string) string {
+	return `"` + strings.ReplaceAll(value, `"`, "'") + `"`
+}
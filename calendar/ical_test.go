@@ -0,0 +1,156 @@
+package calendar
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestICSWriterLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string // empty when only the folding rules are checked
+	}{
+		{
+			name:  "short line",
+			value: "Board games",
+			want:  "SUMMARY:Board games\r\n",
+		},
+		{
+			name:  "exactly 75 octets",
+			value: strings.Repeat("a", 75-len("SUMMARY:")),
+			want:  "SUMMARY:" + strings.Repeat("a", 67) + "\r\n",
+		},
+		{
+			name:  "76 octets",
+			value: strings.Repeat("a", 76-len("SUMMARY:")),
+			want:  "SUMMARY:" + strings.Repeat("a", 67) + "\r\n a\r\n",
+		},
+		{
+			name:  "several continuation lines",
+			value: strings.Repeat("abcdefghij", 30),
+		},
+		{
+			name:  "multi-byte characters are not split",
+			value: strings.Repeat("€", 60),
+		},
+		{
+			name:  "mixed widths",
+			value: "x" + strings.Repeat("ä😀", 40),
+		},
+	}
+	for _, tt := range tests {
+		var w icsWriter
+		w.line("SUMMARY", tt.value)
+		got := w.String()
+
+		if tt.want != "" && got != tt.want {
+			t.Errorf("%s: line = %q, want %q", tt.name, got, tt.want)
+		}
+		if !strings.HasSuffix(got, "\r\n") {
+			t.Errorf("%s: %q does not end with CRLF", tt.name, got)
+			continue
+		}
+		lines := strings.Split(strings.TrimSuffix(got, "\r\n"), "\r\n")
+		for i, line := range lines {
+			if len(line) > maxLineLength {
+				t.Errorf("%s: line %d is %d octets long", tt.name, i, len(line))
+			}
+			if !utf8.ValidString(line) {
+				t.Errorf("%s: line %d splits a character: %q", tt.name, i, line)
+			}
+			if i > 0 && !strings.HasPrefix(line, " ") {
+				t.Errorf("%s: continuation line %d does not start with a space: %q", tt.name, i, line)
+			}
+		}
+		// Unfolding removes each CRLF with the space after it
+		if unfolded := strings.ReplaceAll(strings.TrimSuffix(got, "\r\n"), "\r\n ", ""); unfolded != "SUMMARY:"+tt.value {
+			t.Errorf("%s: unfolded to %q", tt.name, unfolded)
+		}
+	}
+}
+
+func TestEscapeText(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"Board games", "Board games"},
+		{"Pizza, pasta; wine", `Pizza\, pasta\; wine`},
+		{`C:\games`, `C:\\games`},
+		{"first line\nsecond line", `first line\nsecond line`},
+		{"first line\r\nsecond line", `first line\nsecond line`},
+		{`\n is not a newline`, `\\n is not a newline`},
+		{"Time: 19:00", "Time: 19:00"},
+	}
+	for _, tt := range tests {
+		if got := escapeText(tt.value); got != tt.want {
+			t.Errorf("escapeText(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestFormatOffset(t *testing.T) {
+	tests := []struct {
+		offset int
+		want   string
+	}{
+		{0, "+0000"},
+		{3600, "+0100"},
+		{-5 * 3600, "-0500"},
+		{5*3600 + 30*60, "+0530"},
+		{-(3*3600 + 30*60), "-0330"},
+		{1172, "+001932"},
+	}
+	for _, tt := range tests {
+		if got := formatOffset(tt.offset); got != tt.want {
+			t.Errorf("formatOffset(%d) = %q, want %q", tt.offset, got, tt.want)
+		}
+	}
+}
+
+func TestVTimezone(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var w icsWriter
+	w.vtimezone(newYork, time.Date(2024, 9, 1, 0, 0, 0, 0, newYork), time.Date(2025, 6, 1, 0, 0, 0, 0, newYork))
+	got := w.String()
+
+	want := strings.Join([]string{
+		"BEGIN:VTIMEZONE",
+		"TZID:America/New_York",
+		"BEGIN:DAYLIGHT",
+		"DTSTART:20240901T000000",
+		"TZOFFSETFROM:-0400",
+		"TZOFFSETTO:-0400",
+		"TZNAME:EDT",
+		"END:DAYLIGHT",
+		"BEGIN:STANDARD",
+		"DTSTART:20241103T020000",
+		"TZOFFSETFROM:-0400",
+		"TZOFFSETTO:-0500",
+		"TZNAME:EST",
+		"END:STANDARD",
+		"BEGIN:DAYLIGHT",
+		"DTSTART:20250309T020000",
+		"TZOFFSETFROM:-0500",
+		"TZOFFSETTO:-0400",
+		"TZNAME:EDT",
+		"END:DAYLIGHT",
+		"END:VTIMEZONE",
+	}, "\r\n") + "\r\n"
+	if got != want {
+		t.Errorf("vtimezone =\n%s\nwant\n%s", got, want)
+	}
+
+	w = icsWriter{}
+	w.vtimezone(time.UTC, time.Date(2024, 9, 1, 0, 0, 0, 0, time.UTC), time.Date(2034, 9, 1, 0, 0, 0, 0, time.UTC))
+	if got := strings.Count(w.String(), "BEGIN:STANDARD"); got != 1 {
+		t.Errorf("UTC has %d STANDARD observances, want 1", got)
+	}
+}
@@ -0,0 +1,454 @@
+// Package config loads the server's settings. Every setting has a default and can be set, from
+// lowest to highest precedence, in a YAML file, in an environment variable or with a flag:
+//
+//	database:
+//	  dsn: postgres://friendsocial@db:5432/friendsocialdb
+//	  max_conns: 20
+//	server:
+//	  addr: ":8443"
+//	  tls_cert_file: /etc/friendsocial/tls.crt
+//	  tls_key_file: /etc/friendsocial/tls.key
+//
+// The file is read from the path given by -config or FRIENDSOCIAL_CONFIG. Durations are written
+// like 30s or 5m.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Database   Database   `yaml:"database"`
+	Server     Server     `yaml:"server"`
+	Auth       Auth       `yaml:"auth"`
+	Features   Features   `yaml:"features"`
+	Scheduling Scheduling `yaml:"scheduling"`
+	Delivery   Delivery   `yaml:"delivery"`
+}
+
+// Database configures the connection pool
+type Database struct {
+	DSN             string        `yaml:"dsn"`
+	MaxConns        int32         `yaml:"max_conns"`
+	MinConns        int32         `yaml:"min_conns"`
+	MaxConnLifetime time.Duration `yaml:"max_conn_lifetime"`
+	MaxConnIdleTime time.Duration `yaml:"max_conn_idle_time"`
+	ConnectTimeout  time.Duration `yaml:"connect_timeout"`
+}
+
+// Server configures the HTTP listener. TLS is served when both certificate files are set.
+type Server struct {
+	Addr              string        `yaml:"addr"`
+	TLSCertFile       string        `yaml:"tls_cert_file"`
+	TLSKeyFile        string        `yaml:"tls_key_file"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	// RequestTimeout bounds how long a handler may run; SlowRequestTimeout applies instead to the
+	// routes that import or export calendars. A request that runs out of time is answered with
+	// 503 and its database work is cancelled. Zero means no limit.
+	RequestTimeout     time.Duration `yaml:"request_timeout"`
+	SlowRequestTimeout time.Duration `yaml:"slow_request_timeout"`
+	// ShutdownTimeout is how long in-flight requests and background workers get to finish after
+	// SIGTERM or SIGINT before the server stops anyway
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+// TLS reports whether the server is configured to serve HTTPS
+func (s Server) TLS() bool {
+	return s.TLSCertFile != "" || s.TLSKeyFile != ""
+}
+
+type Auth struct {
+	// TokenSecret signs access tokens. When empty an ephemeral secret is generated, so tokens do
+	// not survive a restart.
+	TokenSecret string `yaml:"token_secret"`
+}
+
+// Features turns optional behaviour on and off
+type Features struct {
+	// ICSImportLocalPaths lets calendar imports read a file from the server's disk. Development only.
+	ICSImportLocalPaths bool `yaml:"ics_import_local_paths"`
+	// Reminders runs the scheduler that reminds participants of upcoming activities
+	Reminders bool `yaml:"reminders"`
+	// Webhooks runs the dispatcher that delivers outbox events to webhook subscribers
+	Webhooks bool `yaml:"webhooks"`
+}
+
+// Scheduling configures the background work on scheduled activities
+type Scheduling struct {
+	// CapacityCheckInterval is how often under-filled activities are cancelled and waitlisted
+	// participants promoted
+	CapacityCheckInterval time.Duration `yaml:"capacity_check_interval"`
+	// CancelCutoff is how long before it starts a scheduled activity must have reached its
+	// min_participants, otherwise it is cancelled
+	CancelCutoff time.Duration `yaml:"cancel_cutoff"`
+	// MaterializeInterval is how often recurring series are extended up to MaterializeHorizon
+	MaterializeInterval time.Duration `yaml:"materialize_interval"`
+	// MaterializeHorizon is how far ahead the scheduled activities of recurring series are created
+	MaterializeHorizon time.Duration `yaml:"materialize_horizon"`
+}
+
+// Delivery selects how notifications are sent on each channel and holds the credentials of the
+// transports. IOS is "apns" or "stub", Android "fcm" or "stub" and Email "smtp" or "stub"; the stub
+// writes JSON lines to StubPath, or stdout when it is empty.
+type Delivery struct {
+	IOS      string `yaml:"ios"`
+	Android  string `yaml:"android"`
+	Email    string `yaml:"email"`
+	StubPath string `yaml:"stub_path"`
+	APNs     APNs   `yaml:"apns"`
+	FCM      FCM    `yaml:"fcm"`
+	SMTP     SMTP   `yaml:"smtp"`
+}
+
+// APNs configures push notifications to iOS devices
+type APNs struct {
+	KeyPath  string `yaml:"key_path"` // .p8 signing key
+	KeyID    string `yaml:"key_id"`
+	TeamID   string `yaml:"team_id"`
+	Topic    string `yaml:"topic"`    // the app's bundle ID
+	Endpoint string `yaml:"endpoint"` // production when empty
+}
+
+// FCM configures push notifications to Android devices
+type FCM struct {
+	CredentialsPath string `yaml:"credentials_path"` // service account JSON key
+	Endpoint        string `yaml:"endpoint"`
+}
+
+// SMTP configures email
+type SMTP struct {
+	Addr     string `yaml:"addr"` // host:port
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+}
+
+// Default returns the settings used when nothing else is configured: a local database and plain
+// HTTP on port 8080.
+func Default() Config {
+	return Config{
+		Database: Database{
+			DSN:             "postgres://localhost:5432/friendsocialdb?sslmode=disable",
+			MaxConns:        10,
+			MinConns:        0,
+			MaxConnLifetime: time.Hour,
+			MaxConnIdleTime: 30 * time.Minute,
+			ConnectTimeout:  5 * time.Second,
+		},
+		Server: Server{
+			Addr:               ":8080",
+			ReadHeaderTimeout:  5 * time.Second,
+			ReadTimeout:        30 * time.Second,
+			WriteTimeout:       30 * time.Second,
+			IdleTimeout:        2 * time.Minute,
+			RequestTimeout:     10 * time.Second,
+			SlowRequestTimeout: 25 * time.Second,
+			ShutdownTimeout:    30 * time.Second,
+		},
+		Features: Features{
+			Reminders: true,
+			Webhooks:  true,
+		},
+		Scheduling: Scheduling{
+			CapacityCheckInterval: 15 * time.Minute,
+			CancelCutoff:          24 * time.Hour,
+			MaterializeInterval:   time.Hour,
+			MaterializeHorizon:    8 * 7 * 24 * time.Hour,
+		},
+		Delivery: Delivery{
+			IOS:     "stub",
+			Android: "stub",
+			Email:   "stub",
+		},
+	}
+}
+
+// setting is a value that can be set by an environment variable and a flag
+type setting struct {
+	env    string
+	flag   string
+	usage  string
+	target interface{} // pointer to the Config field
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"DATABASE_URL", "database-url", "PostgreSQL connection string", &c.Database.DSN},
+		{"DATABASE_MAX_CONNS", "database-max-conns", "maximum open database connections", &c.Database.MaxConns},
+		{"DATABASE_MIN_CONNS", "database-min-conns", "database connections kept open when idle", &c.Database.MinConns},
+		{"DATABASE_MAX_CONN_LIFETIME", "database-max-conn-lifetime", "age after which a database connection is closed", &c.Database.MaxConnLifetime},
+		{"DATABASE_MAX_CONN_IDLE_TIME", "database-max-conn-idle-time", "idle time after which a database connection is closed", &c.Database.MaxConnIdleTime},
+		{"DATABASE_CONNECT_TIMEOUT", "database-connect-timeout", "timeout for connecting to the database", &c.Database.ConnectTimeout},
+		{"LISTEN_ADDR", "addr", "address the HTTP server listens on", &c.Server.Addr},
+		{"TLS_CERT_FILE", "tls-cert", "TLS certificate file", &c.Server.TLSCertFile},
+		{"TLS_KEY_FILE", "tls-key", "TLS private key file", &c.Server.TLSKeyFile},
+		{"HTTP_READ_HEADER_TIMEOUT", "read-header-timeout", "timeout for reading request headers", &c.Server.ReadHeaderTimeout},
+		{"HTTP_READ_TIMEOUT", "read-timeout", "timeout for reading a whole request", &c.Server.ReadTimeout},
+		{"HTTP_WRITE_TIMEOUT", "write-timeout", "timeout for writing a response", &c.Server.WriteTimeout},
+		{"HTTP_IDLE_TIMEOUT", "idle-timeout", "how long idle keep-alive connections stay open", &c.Server.IdleTimeout},
+		{"HTTP_REQUEST_TIMEOUT", "request-timeout", "how long a request may run", &c.Server.RequestTimeout},
+		{"HTTP_SLOW_REQUEST_TIMEOUT", "slow-request-timeout", "how long a calendar import or export may run", &c.Server.SlowRequestTimeout},
+		{"SHUTDOWN_TIMEOUT", "shutdown-timeout", "how long in-flight work may take to finish on shutdown", &c.Server.ShutdownTimeout},
+		{"AUTH_TOKEN_SECRET", "auth-token-secret", "secret that signs access tokens", &c.Auth.TokenSecret},
+		{"ICS_IMPORT_LOCAL_PATHS", "ics-import-local-paths", "let calendar imports read files from the server's disk", &c.Features.ICSImportLocalPaths},
+		{"FEATURE_REMINDERS", "reminders", "send reminders of upcoming activities", &c.Features.Reminders},
+		{"FEATURE_WEBHOOKS", "webhooks", "deliver events to webhook subscribers", &c.Features.Webhooks},
+		{"CAPACITY_CHECK_INTERVAL", "capacity-check-interval", "how often under-filled activities are cancelled and waitlists promoted", &c.Scheduling.CapacityCheckInterval},
+		{"CANCEL_CUTOFF", "cancel-cutoff", "how long before it starts an activity must have its minimum participants", &c.Scheduling.CancelCutoff},
+		{"MATERIALIZE_INTERVAL", "materialize-interval", "how often recurring series are extended", &c.Scheduling.MaterializeInterval},
+		{"MATERIALIZE_HORIZON", "materialize-horizon", "how far ahead the activities of recurring series are created", &c.Scheduling.MaterializeHorizon},
+		{"DELIVERY_IOS", "delivery-ios", "iOS push transport: apns or stub", &c.Delivery.IOS},
+		{"DELIVERY_ANDROID", "delivery-android", "Android push transport: fcm or stub", &c.Delivery.Android},
+		{"DELIVERY_EMAIL", "delivery-email", "email transport: smtp or stub", &c.Delivery.Email},
+		{"DELIVERY_STUB_PATH", "delivery-stub-path", "file the stub transport appends to, stdout when empty", &c.Delivery.StubPath},
+		{"APNS_KEY_PATH", "apns-key-path", "APNs .p8 signing key file", &c.Delivery.APNs.KeyPath},
+		{"APNS_KEY_ID", "apns-key-id", "APNs key ID", &c.Delivery.APNs.KeyID},
+		{"APNS_TEAM_ID", "apns-team-id", "APNs team ID", &c.Delivery.APNs.TeamID},
+		{"APNS_TOPIC", "apns-topic", "APNs topic, the app's bundle ID", &c.Delivery.APNs.Topic},
+		{"APNS_ENDPOINT", "apns-endpoint", "APNs endpoint, production when empty", &c.Delivery.APNs.Endpoint},
+		{"FCM_CREDENTIALS_PATH", "fcm-credentials-path", "FCM service account JSON key file", &c.Delivery.FCM.CredentialsPath},
+		{"FCM_ENDPOINT", "fcm-endpoint", "FCM endpoint", &c.Delivery.FCM.Endpoint},
+		{"SMTP_ADDR", "smtp-addr", "SMTP server host:port", &c.Delivery.SMTP.Addr},
+		{"SMTP_USERNAME", "smtp-username", "SMTP username", &c.Delivery.SMTP.Username},
+		{"SMTP_PASSWORD", "smtp-password", "SMTP password", &c.Delivery.SMTP.Password},
+		{"SMTP_FROM", "smtp-from", "sender address of emails", &c.Delivery.SMTP.From},
+	}
+}
+
+// Load reads the configuration from the file, the environment and the command line arguments
+// (without the program name) and validates it. Errors name every setting that is wrong.
+func Load(args []string) (Config, error) {
+	config := Default()
+	settings := config.settings()
+
+	// Flags are parsed first to find -config, but applied last so that they win
+	var path string
+	var flagged []func() error
+	flags := flag.NewFlagSet("friendsocial", flag.ContinueOnError)
+	flags.StringVar(&path, "config", os.Getenv("FRIENDSOCIAL_CONFIG"), "YAML configuration file (FRIENDSOCIAL_CONFIG)")
+	for _, s := range settings {
+		s := s
+		apply := func(value string) error {
+			flagged = append(flagged, func() error {
+				if err := set(s.target, value); err != nil {
+					return fmt.Errorf("-%s: %v", s.flag, err)
+				}
+				return nil
+			})
+			return nil
+		}
+		// Boolean flags can be given without a value, e.g. -reminders=false or -ics-import-local-paths
+		if _, ok := s.target.(*bool); ok {
+			flags.BoolFunc(s.flag, s.usage+" ("+s.env+")", apply)
+		} else {
+			flags.Func(s.flag, s.usage+" ("+s.env+")", apply)
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	if path != "" {
+		if err := config.readFile(path); err != nil {
+			return Config{}, err
+		}
+	}
+
+	var problems []string
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.env); ok {
+			if err := set(s.target, value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", s.env, err))
+			}
+		}
+	}
+	for _, apply := range flagged {
+		if err := apply(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return Config{}, &Error{Problems: problems}
+	}
+
+	return config, config.Validate()
+}
+
+func (c *Config) readFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to read configuration file: %v", err)
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("unable to parse configuration file %s: %v", path, err)
+	}
+	return nil
+}
+
+// set parses a value into a Config field
+func set(target interface{}, value string) error {
+	switch target := target.(type) {
+	case *string:
+		*target = value
+	case *int32:
+		n, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		*target = int32(n)
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", value)
+		}
+		*target = b
+	case *time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration such as 30s or 5m", value)
+		}
+		*target = d
+	default:
+		panic(fmt.Sprintf("config: unsupported setting type %T", target))
+	}
+	return nil
+}
+
+// Error reports every problem found in a configuration
+type Error struct {
+	Problems []string
+}
+
+func (e *Error) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// Validate checks that the settings are usable together
+func (c Config) Validate() error {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Database.DSN == "" {
+		problem("database.dsn is required")
+	} else if _, err := pgxpool.ParseConfig(c.Database.DSN); err != nil {
+		problem("database.dsn cannot be parsed: %v", err)
+	}
+	if c.Database.MaxConns < 1 {
+		problem("database.max_conns must be at least 1")
+	}
+	if c.Database.MinConns < 0 || c.Database.MinConns > c.Database.MaxConns {
+		problem("database.min_conns must be between 0 and database.max_conns")
+	}
+
+	if c.Server.Addr == "" {
+		problem("server.addr is required")
+	}
+	if c.Server.TLS() {
+		if c.Server.TLSCertFile == "" || c.Server.TLSKeyFile == "" {
+			problem("server.tls_cert_file and server.tls_key_file must be set together")
+		}
+		if c.Server.TLSCertFile != "" {
+			if _, err := os.Stat(c.Server.TLSCertFile); err != nil {
+				problem("server.tls_cert_file: %v", err)
+			}
+		}
+		if c.Server.TLSKeyFile != "" {
+			if _, err := os.Stat(c.Server.TLSKeyFile); err != nil {
+				problem("server.tls_key_file: %v", err)
+			}
+		}
+	}
+
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"database.max_conn_lifetime", c.Database.MaxConnLifetime},
+		{"database.max_conn_idle_time", c.Database.MaxConnIdleTime},
+		{"database.connect_timeout", c.Database.ConnectTimeout},
+		{"server.read_header_timeout", c.Server.ReadHeaderTimeout},
+		{"server.read_timeout", c.Server.ReadTimeout},
+		{"server.write_timeout", c.Server.WriteTimeout},
+		{"server.idle_timeout", c.Server.IdleTimeout},
+		{"server.request_timeout", c.Server.RequestTimeout},
+		{"server.slow_request_timeout", c.Server.SlowRequestTimeout},
+		{"server.shutdown_timeout", c.Server.ShutdownTimeout},
+		{"scheduling.cancel_cutoff", c.Scheduling.CancelCutoff},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			problem("%s cannot be negative", d.name)
+		}
+	}
+
+	if c.Scheduling.CapacityCheckInterval <= 0 {
+		problem("scheduling.capacity_check_interval must be positive")
+	}
+	if c.Scheduling.MaterializeInterval <= 0 {
+		problem("scheduling.materialize_interval must be positive")
+	}
+	if c.Scheduling.MaterializeHorizon <= 0 {
+		problem("scheduling.materialize_horizon must be positive")
+	}
+
+	transports := []struct {
+		name      string
+		value     string
+		transport string
+	}{
+		{"delivery.ios", c.Delivery.IOS, "apns"},
+		{"delivery.android", c.Delivery.Android, "fcm"},
+		{"delivery.email", c.Delivery.Email, "smtp"},
+	}
+	for _, t := range transports {
+		if t.value != "stub" && t.value != t.transport {
+			problem("%s must be %s or stub", t.name, t.transport)
+		}
+	}
+	if c.Delivery.IOS == "apns" {
+		apns := c.Delivery.APNs
+		if apns.KeyPath == "" || apns.KeyID == "" || apns.TeamID == "" || apns.Topic == "" {
+			problem("delivery.apns.key_path, key_id, team_id and topic are required with delivery.ios apns")
+		}
+	}
+	if c.Delivery.Android == "fcm" && c.Delivery.FCM.CredentialsPath == "" {
+		problem("delivery.fcm.credentials_path is required with delivery.android fcm")
+	}
+	if c.Delivery.Email == "smtp" && (c.Delivery.SMTP.Addr == "" || c.Delivery.SMTP.From == "") {
+		problem("delivery.smtp.addr and from are required with delivery.email smtp")
+	}
+
+	// A handler that outlives the write timeout cannot send its 503, the connection is just closed
+	if c.Server.WriteTimeout > 0 {
+		if c.Server.RequestTimeout >= c.Server.WriteTimeout {
+			problem("server.request_timeout must be shorter than server.write_timeout")
+		}
+		if c.Server.SlowRequestTimeout >= c.Server.WriteTimeout {
+			problem("server.slow_request_timeout must be shorter than server.write_timeout")
+		}
+	}
+
+	if len(problems) > 0 {
+		return &Error{Problems: problems}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clearEnv unsets the environment variables of every setting for the duration of the test
+func clearEnv(t *testing.T) {
+	t.Helper()
+	config := Default()
+	envs := []string{"FRIENDSOCIAL_CONFIG"}
+	for _, s := range config.settings() {
+		envs = append(envs, s.env)
+	}
+	for _, env := range envs {
+		if value, ok := os.LookupEnv(env); ok {
+			t.Setenv(env, value) // restores the value after the test
+			os.Unsetenv(env)
+		}
+	}
+}
+
+// writeFile writes a configuration file into the test's temporary directory
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "friendsocial.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	clearEnv(t)
+	path := writeFile(t, `
+database:
+  max_conns: 20
+  min_conns: 2
+server:
+  addr: ":9000"
+  request_timeout: 5s
+features:
+  reminders: false
+scheduling:
+  cancel_cutoff: 12h
+  materialize_horizon: 672h
+delivery:
+  email: smtp
+  smtp:
+    addr: mail.example.com:587
+    from: noreply@example.com
+`)
+	t.Setenv("FRIENDSOCIAL_CONFIG", path)
+	t.Setenv("LISTEN_ADDR", ":9100")
+	t.Setenv("DATABASE_MAX_CONNS", "30")
+	t.Setenv("CANCEL_CUTOFF", "6h")
+
+	config, err := Load([]string{"-addr", ":9200", "-reminders", "-cancel-cutoff=3h"})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"default only", config.Server.ReadTimeout, 30 * time.Second},
+		{"file over default", config.Database.MinConns, int32(2)},
+		{"file over default", config.Server.RequestTimeout, 5 * time.Second},
+		{"file over default", config.Delivery.SMTP.From, "noreply@example.com"},
+		{"environment over file", config.Database.MaxConns, int32(30)},
+		{"flag over environment and file", config.Server.Addr, ":9200"},
+		{"flag over environment and file", config.Scheduling.CancelCutoff, 3 * time.Hour},
+		{"default only", config.Scheduling.MaterializeInterval, time.Hour},
+		{"file over default", config.Scheduling.MaterializeHorizon, 4 * 7 * 24 * time.Hour},
+		{"boolean flag without a value", config.Features.Reminders, true},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigFlag(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("FRIENDSOCIAL_CONFIG", writeFile(t, "server:\n  addr: \":9000\"\n"))
+	path := writeFile(t, "server:\n  addr: \":9300\"\n")
+
+	config, err := Load([]string{"-config", path})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if config.Server.Addr != ":9300" {
+		t.Errorf("addr = %q, want the one of the -config file", config.Server.Addr)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		env      map[string]string
+		args     []string
+		problems []string // every problem the error must name, empty when any error will do
+	}{
+		{
+			name: "unknown field in the file",
+			file: "server:\n  adress: \":9000\"\n",
+		},
+		{
+			name: "unparsable values in the environment and flags are all reported",
+			env:  map[string]string{"DATABASE_MAX_CONNS": "many", "FEATURE_WEBHOOKS": "yes please"},
+			args: []string{"-request-timeout", "10"},
+			problems: []string{
+				`DATABASE_MAX_CONNS: "many" is not a number`,
+				`FEATURE_WEBHOOKS: "yes please" is not true or false`,
+				`-request-timeout: "10" is not a duration such as 30s or 5m`,
+			},
+		},
+		{
+			name:     "invalid combination",
+			env:      map[string]string{"DELIVERY_IOS": "apns"},
+			problems: []string{"delivery.apns.key_path, key_id, team_id and topic are required with delivery.ios apns"},
+		},
+		{
+			name: "unknown flag",
+			args: []string{"-verbose"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			if tt.file != "" {
+				t.Setenv("FRIENDSOCIAL_CONFIG", writeFile(t, tt.file))
+			}
+			for env, value := range tt.env {
+				t.Setenv(env, value)
+			}
+
+			_, err := Load(tt.args)
+			if err == nil {
+				t.Fatalf("Load succeeded")
+			}
+			if len(tt.problems) == 0 {
+				return
+			}
+			var configErr *Error
+			if !errors.As(err, &configErr) {
+				t.Fatalf("error %v is not a *Error", err)
+			}
+			for _, problem := range tt.problems {
+				if !strings.Contains(strings.Join(configErr.Problems, "\n"), problem) {
+					t.Errorf("problems %q do not include %q", configErr.Problems, problem)
+				}
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(c *Config)
+		problem string // empty when the configuration is valid
+	}{
+		{"defaults", func(c *Config) {}, ""},
+		{"no limits", func(c *Config) {
+			c.Server.RequestTimeout, c.Server.SlowRequestTimeout, c.Server.WriteTimeout = 0, 0, 0
+		}, ""},
+		{"missing DSN", func(c *Config) { c.Database.DSN = "" }, "database.dsn is required"},
+		{"bad DSN", func(c *Config) { c.Database.DSN = "postgres://:notaport" }, "database.dsn cannot be parsed"},
+		{"no connections", func(c *Config) { c.Database.MaxConns = 0 }, "database.max_conns must be at least 1"},
+		{"more idle than open connections", func(c *Config) { c.Database.MinConns = 11 }, "database.min_conns must be between 0 and database.max_conns"},
+		{"missing address", func(c *Config) { c.Server.Addr = "" }, "server.addr is required"},
+		{"certificate without key", func(c *Config) { c.Server.TLSCertFile = os.Args[0] }, "must be set together"},
+		{"missing certificate", func(c *Config) {
+			c.Server.TLSCertFile, c.Server.TLSKeyFile = "/nonexistent/tls.crt", os.Args[0]
+		}, "server.tls_cert_file:"},
+		{"negative duration", func(c *Config) { c.Database.ConnectTimeout = -time.Second }, "database.connect_timeout cannot be negative"},
+		{"negative cutoff", func(c *Config) { c.Scheduling.CancelCutoff = -time.Hour }, "scheduling.cancel_cutoff cannot be negative"},
+		{"no capacity checks", func(c *Config) { c.Scheduling.CapacityCheckInterval = 0 }, "scheduling.capacity_check_interval must be positive"},
+		{"no materializing", func(c *Config) { c.Scheduling.MaterializeInterval = 0 }, "scheduling.materialize_interval must be positive"},
+		{"nothing materialized ahead", func(c *Config) { c.Scheduling.MaterializeHorizon = -time.Hour }, "scheduling.materialize_horizon must be positive"},
+		{"unknown transport", func(c *Config) { c.Delivery.Android = "apns" }, "delivery.android must be fcm or stub"},
+		{"FCM without credentials", func(c *Config) { c.Delivery.Android = "fcm" }, "delivery.fcm.credentials_path is required"},
+		{"SMTP without sender", func(c *Config) {
+			c.Delivery.Email = "smtp"
+			c.Delivery.SMTP.Addr = "mail.example.com:587"
+		}, "delivery.smtp.addr and from are required"},
+		{"request outlives the write timeout", func(c *Config) { c.Server.RequestTimeout = c.Server.WriteTimeout }, "server.request_timeout must be shorter than server.write_timeout"},
+		{"slow request outlives the write timeout", func(c *Config) { c.Server.SlowRequestTimeout = time.Minute }, "server.slow_request_timeout must be shorter than server.write_timeout"},
+	}
+	for _, tt := range tests {
+		config := Default()
+		tt.change(&config)
+		err := config.Validate()
+		if tt.problem == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.problem) {
+			t.Errorf("%s: error = %v, want one containing %q", tt.name, err, tt.problem)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package delivery
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// apnsTokenLifetime is how long a provider token is reused. Apple accepts tokens for an hour and
+// rejects refreshes more often than every 20 minutes.
+const apnsTokenLifetime = 50 * time.Minute
+
+// APNsConfig configures token-based authentication with the Apple Push Notification service
+type APNsConfig struct {
+	KeyPath  string // .p8 signing key
+	KeyID    string
+	TeamID   string
+	Topic    string // the app's bundle ID
+	Endpoint string // defaults to production; https://api.sandbox.push.apple.com for development builds
+}
+
+// APNsTransport sends push notifications to iOS devices through the APNs HTTP/2 API
+type APNsTransport struct {
+	config APNsConfig
+	key    *ecdsa.PrivateKey
+	client *http.Client
+
+	mu       sync.Mutex
+	token    string
+	issuedAt time.Time
+}
+
+// NewAPNsTransport loads the signing key and creates an APNs transport
+func NewAPNsTransport(config APNsConfig) (*APNsTransport, error) {
+	if config.KeyPath == "" || config.KeyID == "" || config.TeamID == "" || config.Topic == "" {
+		return nil, errors.New("the APNs key path, key ID, team ID and topic are required")
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "https://api.push.apple.com"
+	}
+
+	pemBytes, err := os.ReadFile(config.KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read APNs key: %w", err)
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("APNs key is not PEM encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse APNs key: %w", err)
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("APNs key is not an ECDSA key")
+	}
+
+	return &APNsTransport{
+		config: config,
+		key:    key,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (t *APNsTransport) Name() string {
+	return "apns"
+}
+
+func (t *APNsTransport) Send(ctx context.Context, target Target, message Message) error {
+	payload := map[string]interface{}{
+		"aps": map[string]interface{}{
+			"alert": map[string]string{"title": message.Title, "body": message.Body},
+			"sound": "default",
+		},
+	}
+	for key, value := range message.Data {
+		payload[key] = value
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrPermanent, err)
+	}
+
+	token, err := t.providerToken()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.config.Endpoint+"/3/device/"+url.PathEscape(target.Address), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "bearer "+token)
+	req.Header.Set("apns-topic", t.config.Topic)
+	req.Header.Set("apns-push-type", "alert")
+	req.Header.Set("apns-priority", "10")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var apnsErr struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(resp.Body).Decode(&apnsErr)
+
+	switch {
+	case resp.StatusCode == http.StatusGone, apnsErr.Reason == "BadDeviceToken", apnsErr.Reason == "Unregistered":
+		return fmt.Errorf("%w: %s", ErrUnregistered, apnsErr.Reason)
+	case apnsErr.Reason == "ExpiredProviderToken":
+		t.mu.Lock()
+		t.token = ""
+		t.mu.Unlock()
+		return fmt.Errorf("apns: %s", apnsErr.Reason)
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("apns: %d %s", resp.StatusCode, apnsErr.Reason)
+	default:
+		return fmt.Errorf("%w: apns: %d %s", ErrPermanent, resp.StatusCode, apnsErr.Reason)
+	}
+}
+
+// providerToken returns a cached ES256 JWT, signing a new one when it is about to expire
+func (t *APNsTransport) providerToken() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.token != "" && time.Since(t.issuedAt) < apnsTokenLifetime {
+		return t.token, nil
+	}
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": t.config.KeyID})
+	claims, _ := json.Marshal(map[string]interface{}{"iss": t.config.TeamID, "iat": now.Unix()})
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, t.key, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign APNs token: %w", err)
+	}
+	// JWS encodes ES256 signatures as r || s, each padded to 32 bytes
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	t.token = signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+	t.issuedAt = now
+	return t.token, nil
+}
@@ -0,0 +1,154 @@
+package delivery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"friendsocial/auth"
+	"net/http"
+)
+
+// DeviceService defines the methods for managing push notification devices
+type DeviceService interface {
+	RegisterDevice(ctx context.Context, userID string, device Device) (Device, error)
+	ReadDevices(ctx context.Context, userID string) ([]Device, error)
+	DeleteDevice(ctx context.Context, userID string, deviceID string) (bool, error)
+}
+
+// DeviceError represents the structure of an error response
+type DeviceError struct {
+	StatusCode int    `json:"status_code"`
+	Error      string `json:"error"`
+}
+
+// DeviceHTTPHandler handles HTTP requests for push notification devices
+type DeviceHTTPHandler struct {
+	deviceService DeviceService
+}
+
+// NewDeviceHTTPHandler creates a new handler for push notification devices
+func NewDeviceHTTPHandler(deviceService DeviceService) *DeviceHTTPHandler {
+	return &DeviceHTTPHandler{
+		deviceService: deviceService,
+	}
+}
+
+// HandleHTTPPost registers a device
+//
+//	@Summary		Register a device
+//	@Description	Register a device token to receive push notifications. Registering a known token again refreshes it and moves it to this user.
+//	@Tags			devices
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		int		true	"User ID"
+//	@Param			device	body		Device	true	"Platform and token"
+//	@Success		201		{object}	Device
+//	@Failure		400		{object}	DeviceError
+//	@Failure		500		{object}	DeviceError
+//	@Router			/users/{id}/devices [post]
+func (dH *DeviceHTTPHandler) HandleHTTPPost(w http.ResponseWriter, r *http.Request) {
+	var device Device
+	err := json.NewDecoder(r.Body).Decode(&device)
+	if err != nil {
+		dH.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	device, err = dH.deviceService.RegisterDevice(r.Context(), r.PathValue("id"), device)
+	if errors.Is(err, ErrInvalidPlatform) || errors.Is(err, ErrInvalidToken) {
+		dH.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		dH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(device)
+	if err != nil {
+		dH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// HandleHTTPGet retrieves a user's devices
+//
+//	@Summary		Get a user's devices
+//	@Description	Retrieve the devices a user registered for push notifications
+//	@Tags			devices
+//	@Produce		json
+//	@Param			id	path		int	true	"User ID"
+//	@Success		200	{array}		Device
+//	@Failure		500	{object}	DeviceError
+//	@Router			/users/{id}/devices [get]
+func (dH *DeviceHTTPHandler) HandleHTTPGet(w http.ResponseWriter, r *http.Request) {
+	devices, err := dH.deviceService.ReadDevices(r.Context(), r.PathValue("id"))
+	if err != nil {
+		dH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(devices)
+	if err != nil {
+		dH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// HandleHTTPDelete unregisters a device
+//
+//	@Summary		Unregister a device
+//	@Description	Stop sending push notifications to a device
+//	@Tags			devices
+//	@Param			id			path	int	true	"User ID"
+//	@Param			device_id	path	int	true	"Device ID"
+//	@Success		204
+//	@Failure		404	{object}	DeviceError
+//	@Failure		500	{object}	DeviceError
+//	@Router			/users/{id}/devices/{device_id} [delete]
+func (dH *DeviceHTTPHandler) HandleHTTPDelete(w http.ResponseWriter, r *http.Request) {
+	deleted, err := dH.deviceService.DeleteDevice(r.Context(), r.PathValue("id"), r.PathValue("device_id"))
+	if err != nil {
+		dH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if !deleted {
+		dH.errorResponse(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegisterRoutes adds the device routes to mux
+func (dH *DeviceHTTPHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("POST /users/{id}/devices", dH.HandleHTTPPost)
+	mux.HandleFunc("GET /users/{id}/devices", dH.HandleHTTPGet)
+	mux.HandleFunc("DELETE /users/{id}/devices/{device_id}", dH.HandleHTTPDelete)
+}
+
+// AuthorizationRules returns the ownership rules for device routes. Users only manage their own
+// devices.
+func (dH *DeviceHTTPHandler) AuthorizationRules() map[string]auth.Rule {
+	return map[string]auth.Rule{
+		"POST /users/{id}/devices":               auth.Self("id"),
+		"GET /users/{id}/devices":                auth.Self("id"),
+		"DELETE /users/{id}/devices/{device_id}": auth.Self("id"),
+	}
+}
+
+func (dH *DeviceHTTPHandler) errorResponse(w http.ResponseWriter, statusCode int, errorString string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	encodingError := json.NewEncoder(w).Encode(DeviceError{
+		StatusCode: statusCode,
+		Error:      errorString,
+	})
+	if encodingError != nil {
+		http.Error(w, encodingError.Error(), http.StatusInternalServerError)
+	}
+}
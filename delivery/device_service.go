@@ -0,0 +1,101 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// maxTokenLength bounds device tokens. APNs tokens are 64 hex characters and FCM tokens a few
+// hundred.
+const maxTokenLength = 4096
+
+var (
+	ErrInvalidPlatform = errors.New("platform must be ios or android")
+	ErrInvalidToken    = errors.New("token is required and must be at most 4096 characters")
+)
+
+// Device is a phone registered to receive push notifications
+type Device struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"user_id"`
+	Platform   string    `json:"platform"` // ios or android
+	Token      string    `json:"token"`    // APNs device token or FCM registration token
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+}
+
+// deviceColumns is the column list scanned by scanDevice
+const deviceColumns = "id, user_id, platform, token, created_at, last_seen_at"
+
+func scanDevice(row pgx.Row) (Device, error) {
+	var device Device
+	err := row.Scan(&device.ID, &device.UserID, &device.Platform, &device.Token, &device.CreatedAt, &device.LastSeenAt)
+	return device, err
+}
+
+type Service struct {
+	db *pgxpool.Pool
+}
+
+func NewService(db *pgxpool.Pool) *Service {
+	return &Service{
+		db: db,
+	}
+}
+
+// RegisterDevice registers a device for a user. A token is only ever registered once, so
+// registering it again, possibly after another user signed in on the same phone, moves it to the
+// given user.
+func (s *Service) RegisterDevice(ctx context.Context, userID string, device Device) (Device, error) {
+	if device.Platform != ChannelIOS && device.Platform != ChannelAndroid {
+		return Device{}, ErrInvalidPlatform
+	}
+	device.Token = strings.TrimSpace(device.Token)
+	if device.Token == "" || len(device.Token) > maxTokenLength {
+		return Device{}, ErrInvalidToken
+	}
+
+	return scanDevice(s.db.QueryRow(ctx,
+		`INSERT INTO user_devices (user_id, platform, token)
+		 VALUES ($1, $2, $3)
+		 ON CONFLICT (platform, token) DO UPDATE SET user_id = EXCLUDED.user_id, last_seen_at = now()
+		 RETURNING `+deviceColumns,
+		userID, device.Platform, device.Token))
+}
+
+// ReadDevices returns a user's registered devices
+func (s *Service) ReadDevices(ctx context.Context, userID string) ([]Device, error) {
+	rows, err := s.db.Query(ctx,
+		"SELECT "+deviceColumns+" FROM user_devices WHERE user_id = $1 ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := []Device{}
+	for rows.Next() {
+		device, err := scanDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+
+	return devices, rows.Err()
+}
+
+// DeleteDevice unregisters one of a user's devices
+func (s *Service) DeleteDevice(ctx context.Context, userID string, deviceID string) (bool, error) {
+	cmdTag, err := s.db.Exec(ctx,
+		"DELETE FROM user_devices WHERE id = $1 AND user_id = $2", deviceID, userID)
+	if err != nil {
+		return false, err
+	}
+
+	return cmdTag.RowsAffected() > 0, nil
+}
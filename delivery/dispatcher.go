@@ -0,0 +1,222 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"friendsocial/notifications"
+	"friendsocial/worker"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const (
+	// MaxAttempts is how many times a delivery is tried before it is given up on
+	MaxAttempts = 6
+	// dispatchBatchSize is how many deliveries one pass claims at most
+	dispatchBatchSize = 100
+	// claimLease keeps a claimed delivery from being picked up again while it is being sent. A
+	// dispatcher that dies mid-send leaves it to be retried once the lease runs out.
+	claimLease = 5 * time.Minute
+	// sendTimeout bounds a single attempt
+	sendTimeout = 30 * time.Second
+)
+
+// Delivery statuses
+const (
+	StatusPending = "pending"
+	StatusSent    = "sent"
+	StatusFailed  = "failed"
+)
+
+// Backoff returns how long to wait before retrying after the given failed attempt: 30 seconds,
+// doubling with every attempt up to an hour
+func Backoff(attempt int) time.Duration {
+	delay := 30 * time.Second
+	for i := 1; i < attempt && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	if delay > time.Hour {
+		delay = time.Hour
+	}
+	return delay
+}
+
+// Dispatcher periodically sends pending notification deliveries over their channel's transport
+// and records the outcome in notification_deliveries. Deliveries are claimed with SKIP LOCKED, so
+// several server instances can dispatch at the same time.
+type Dispatcher struct {
+	db         *pgxpool.Pool
+	transports map[string]Transport
+	interval   time.Duration
+}
+
+// NewDispatcher creates a Dispatcher that runs every interval
+func NewDispatcher(db *pgxpool.Pool, transports map[string]Transport, interval time.Duration) *Dispatcher {
+	return &Dispatcher{
+		db:         db,
+		transports: transports,
+		interval:   interval,
+	}
+}
+
+// claimedDelivery is a delivery claimed for sending, with what is needed to render it
+type claimedDelivery struct {
+	id           int
+	channel      string
+	target       string
+	deviceID     *int
+	attempts     int
+	notification notifications.Notification
+	subject      Subject
+}
+
+// Run dispatches pending deliveries immediately and then every interval until ctx is done, see
+// worker.RunEvery.
+func (d *Dispatcher) Run(ctx context.Context) {
+	worker.RunEvery(ctx, d.interval, func(ctx context.Context) {
+		sent, failed, err := d.RunOnce(ctx)
+		if err != nil {
+			log.Printf("delivery dispatcher: %v", err)
+		} else if sent > 0 || failed > 0 {
+			log.Printf("delivery dispatcher: sent %d deliveries, %d failed", sent, failed)
+		}
+	})
+}
+
+// RunOnce sends every delivery that is due, one batch at a time, and returns how many were sent
+// and how many failed for good. Deliveries that failed but may succeed later are rescheduled.
+func (d *Dispatcher) RunOnce(ctx context.Context) (int, int, error) {
+	sent, failed := 0, 0
+	for {
+		deliveries, err := d.claim(ctx)
+		if err != nil {
+			return sent, failed, err
+		}
+
+		for _, delivery := range deliveries {
+			status, err := d.send(ctx, delivery)
+			if err != nil {
+				// One broken delivery should not hold back the others
+				log.Printf("delivery dispatcher: delivery %d: %v", delivery.id, err)
+				continue
+			}
+			switch status {
+			case StatusSent:
+				sent++
+			case StatusFailed:
+				failed++
+			}
+		}
+
+		if len(deliveries) < dispatchBatchSize || ctx.Err() != nil {
+			return sent, failed, ctx.Err()
+		}
+	}
+}
+
+// claim leases a batch of due deliveries and counts the attempt
+func (d *Dispatcher) claim(ctx context.Context) ([]claimedDelivery, error) {
+	rows, err := d.db.Query(ctx,
+		`WITH claimed AS (
+		     UPDATE notification_deliveries nd
+		     SET attempts = nd.attempts + 1, next_attempt_at = now() + make_interval(secs => $2)
+		     FROM (
+		         SELECT id FROM notification_deliveries
+		         WHERE status = 'pending' AND next_attempt_at <= now()
+		         ORDER BY next_attempt_at
+		         LIMIT $1
+		         FOR UPDATE SKIP LOCKED
+		     ) due
+		     WHERE nd.id = due.id
+		     RETURNING nd.id, nd.notification_id, nd.channel, nd.target, nd.device_id, nd.attempts
+		 )
+		 SELECT claimed.id, claimed.channel, claimed.target, claimed.device_id, claimed.attempts,
+		        n.id, n.user_id, n.type, n.actor_id, n.scheduled_activity_id, n.data, n.read_at, n.created_at,
+		        COALESCE(actor.name, ''), a.name, sa.scheduled_at
+		 FROM claimed
+		 JOIN notifications n ON n.id = claimed.notification_id
+		 LEFT JOIN users actor ON actor.id = n.actor_id
+		 LEFT JOIN scheduled_activities sa ON sa.id = n.scheduled_activity_id
+		 LEFT JOIN activities a ON a.id = sa.activity_id
+		 ORDER BY claimed.id`,
+		dispatchBatchSize, claimLease.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim deliveries: %v", err)
+	}
+	defer rows.Close()
+
+	var deliveries []claimedDelivery
+	for rows.Next() {
+		var delivery claimedDelivery
+		n := &delivery.notification
+		err := rows.Scan(&delivery.id, &delivery.channel, &delivery.target, &delivery.deviceID, &delivery.attempts,
+			&n.ID, &n.UserID, &n.Type, &n.ActorID, &n.ScheduledActivityID, &n.Data, &n.ReadAt, &n.CreatedAt,
+			&delivery.subject.ActorName, &delivery.subject.ActivityName, &delivery.subject.ScheduledAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan delivery: %v", err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// send attempts a claimed delivery and records the outcome, returning the delivery's new status
+func (d *Dispatcher) send(ctx context.Context, delivery claimedDelivery) (string, error) {
+	transport, ok := d.transports[delivery.channel]
+	if !ok {
+		return StatusFailed, d.record(delivery, StatusFailed, "", fmt.Errorf("no transport for channel %q", delivery.channel))
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+	err := transport.Send(sendCtx, Target{Channel: delivery.channel, Address: delivery.target}, Render(delivery.notification, delivery.subject))
+
+	status := outcome(err, delivery.attempts)
+	if errors.Is(err, ErrUnregistered) && delivery.deviceID != nil {
+		if _, delErr := d.db.Exec(context.Background(), "DELETE FROM user_devices WHERE id = $1", *delivery.deviceID); delErr != nil {
+			return status, fmt.Errorf("failed to remove unregistered device: %v", delErr)
+		}
+	}
+
+	return status, d.record(delivery, status, transport.Name(), err)
+}
+
+// outcome returns the status of a delivery after an attempt that returned err: sent, failed for
+// good, or still pending to be retried
+func outcome(err error, attempts int) string {
+	switch {
+	case err == nil:
+		return StatusSent
+	case errors.Is(err, ErrUnregistered), errors.Is(err, ErrPermanent), attempts >= MaxAttempts:
+		return StatusFailed
+	default:
+		return StatusPending
+	}
+}
+
+// record stores the outcome of an attempt. Pending deliveries are retried after the backoff.
+func (d *Dispatcher) record(delivery claimedDelivery, status string, provider string, sendErr error) error {
+	var lastError *string
+	if sendErr != nil {
+		message := sendErr.Error()
+		lastError = &message
+	}
+
+	_, err := d.db.Exec(context.Background(),
+		`UPDATE notification_deliveries
+		 SET status = $2,
+		     provider = NULLIF($3, ''),
+		     last_error = $4,
+		     sent_at = CASE WHEN $2 = 'sent' THEN now() END,
+		     next_attempt_at = CASE WHEN $2 = 'pending' THEN now() + make_interval(secs => $5) ELSE next_attempt_at END
+		 WHERE id = $1`,
+		delivery.id, status, provider, lastError, Backoff(delivery.attempts).Seconds())
+	if err != nil {
+		return fmt.Errorf("failed to record outcome: %v", err)
+	}
+	return nil
+}
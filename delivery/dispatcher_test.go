@@ -0,0 +1,51 @@
+package delivery
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, 30 * time.Second},
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{5, 8 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{50, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := Backoff(tt.attempt); got != tt.want {
+			t.Errorf("Backoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestOutcome(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		attempts int
+		want     string
+	}{
+		{"sent", nil, 1, StatusSent},
+		{"sent on the last attempt", nil, MaxAttempts, StatusSent},
+		{"temporary failure", errors.New("connection reset"), 1, StatusPending},
+		{"temporary failure on the last attempt", errors.New("connection reset"), MaxAttempts, StatusFailed},
+		{"unregistered device", ErrUnregistered, 1, StatusFailed},
+		{"wrapped unregistered device", fmt.Errorf("apns: 410: %w", ErrUnregistered), 1, StatusFailed},
+		{"permanent failure", fmt.Errorf("smtp: 550: %w", ErrPermanent), 1, StatusFailed},
+	}
+	for _, tt := range tests {
+		if got := outcome(tt.err, tt.attempts); got != tt.want {
+			t.Errorf("%s: outcome(%v, %d) = %q, want %q", tt.name, tt.err, tt.attempts, got, tt.want)
+		}
+	}
+}
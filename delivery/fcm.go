@@ -0,0 +1,209 @@
+package delivery
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const fcmScope = "https://www.googleapis.com/auth/firebase.messaging"
+
+// FCMConfig configures the Firebase Cloud Messaging HTTP v1 API
+type FCMConfig struct {
+	CredentialsPath string // service account JSON key
+	Endpoint        string // defaults to https://fcm.googleapis.com
+}
+
+// FCMTransport sends push notifications to Android devices through FCM, authenticating with a
+// service account
+type FCMTransport struct {
+	endpoint    string
+	projectID   string
+	clientEmail string
+	tokenURI    string
+	key         *rsa.PrivateKey
+	client      *http.Client
+
+	mu          sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+}
+
+// NewFCMTransport loads the service account and creates an FCM transport
+func NewFCMTransport(config FCMConfig) (*FCMTransport, error) {
+	if config.CredentialsPath == "" {
+		return nil, errors.New("the FCM credentials path is required")
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "https://fcm.googleapis.com"
+	}
+
+	raw, err := os.ReadFile(config.CredentialsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read FCM credentials: %w", err)
+	}
+	var credentials struct {
+		ProjectID   string `json:"project_id"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(raw, &credentials); err != nil {
+		return nil, fmt.Errorf("failed to parse FCM credentials: %w", err)
+	}
+
+	block, _ := pem.Decode([]byte(credentials.PrivateKey))
+	if block == nil {
+		return nil, errors.New("FCM private key is not PEM encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse FCM private key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("FCM private key is not an RSA key")
+	}
+
+	return &FCMTransport{
+		endpoint:    config.Endpoint,
+		projectID:   credentials.ProjectID,
+		clientEmail: credentials.ClientEmail,
+		tokenURI:    credentials.TokenURI,
+		key:         key,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (t *FCMTransport) Name() string {
+	return "fcm"
+}
+
+func (t *FCMTransport) Send(ctx context.Context, target Target, message Message) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"message": map[string]interface{}{
+			"token":        target.Address,
+			"notification": map[string]string{"title": message.Title, "body": message.Body},
+			"data":         message.Data,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrPermanent, err)
+	}
+
+	accessToken, err := t.token(ctx)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		fmt.Sprintf("%s/v1/projects/%s/messages:send", t.endpoint, t.projectID), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var fcmErr struct {
+		Error struct {
+			Status  string `json:"status"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&fcmErr)
+
+	switch {
+	case fcmErr.Error.Status == "UNREGISTERED" || resp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("%w: %s", ErrUnregistered, fcmErr.Error.Message)
+	case resp.StatusCode == http.StatusUnauthorized:
+		t.mu.Lock()
+		t.accessToken = ""
+		t.mu.Unlock()
+		return fmt.Errorf("fcm: %s", fcmErr.Error.Message)
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("fcm: %d %s", resp.StatusCode, fcmErr.Error.Status)
+	default:
+		return fmt.Errorf("%w: fcm: %d %s %s", ErrPermanent, resp.StatusCode, fcmErr.Error.Status, fcmErr.Error.Message)
+	}
+}
+
+// token returns a cached OAuth access token, exchanging a signed service account assertion for a
+// new one when it is about to expire
+func (t *FCMTransport) token(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.accessToken != "" && time.Until(t.expiresAt) > time.Minute {
+		return t.accessToken, nil
+	}
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   t.clientEmail,
+		"scope": fcmScope,
+		"aud":   t.tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, t.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign FCM assertion: %w", err)
+	}
+	assertion := signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil || resp.StatusCode != http.StatusOK || tokenResp.AccessToken == "" {
+		return "", fmt.Errorf("fcm: failed to get access token: %d", resp.StatusCode)
+	}
+
+	t.accessToken = tokenResp.AccessToken
+	t.expiresAt = now.Add(time.Duration(tokenResp.ExpiresIn) * time.Second)
+	return t.accessToken, nil
+}
@@ -0,0 +1,134 @@
+package delivery
+
+import (
+	"fmt"
+	"friendsocial/notifications"
+	"strconv"
+	"time"
+)
+
+// timeFormat is how activity times appear in messages. Times are given in UTC unless the
+// notification carries the recipient's time zone.
+const timeFormat = "Mon Jan 2, 15:04 MST"
+
+// rsvpPhrases describe an invitee's response in an rsvp notification
+var rsvpPhrases = map[string]string{
+	"Accepted":   "is going to",
+	"Declined":   "can't make it to",
+	"Maybe":      "might come to",
+	"Tentative":  "tentatively accepted",
+	"Waitlisted": "joined the waitlist for",
+	"Pending":    "has not decided on",
+}
+
+// Subject is what a notification is about, looked up when it is delivered. ActivityName and
+// ScheduledAt are nil when the scheduled activity no longer exists.
+type Subject struct {
+	ActorName    string
+	ActivityName *string
+	ScheduledAt  *time.Time
+}
+
+// Render turns a notification into the message sent to a user
+func Render(notification notifications.Notification, subject Subject) Message {
+	actor := subject.ActorName
+	if actor == "" {
+		actor = "Someone"
+	}
+	activity := "An activity"
+	if subject.ActivityName != nil {
+		activity = *subject.ActivityName
+	}
+	loc := time.UTC
+	if timeZone, ok := notification.Data["time_zone"].(string); ok {
+		if parsed, err := time.LoadLocation(timeZone); err == nil {
+			loc = parsed
+		}
+	}
+	when := dataTime(notification.Data, "scheduled_at", loc)
+	if subject.ScheduledAt != nil {
+		when = subject.ScheduledAt.In(loc).Format(timeFormat)
+	}
+
+	message := Message{
+		Data: map[string]string{
+			"notification_id": strconv.Itoa(notification.ID),
+			"type":            notification.Type,
+		},
+	}
+	if notification.ScheduledActivityID != nil {
+		message.Data["scheduled_activity_id"] = strconv.Itoa(*notification.ScheduledActivityID)
+	}
+
+	switch notification.Type {
+	case notifications.TypeFriendRequest:
+		message.Title = "New friend request"
+		message.Body = fmt.Sprintf("%s sent you a friend request", actor)
+	case notifications.TypeFriendAccepted:
+		message.Title = "Friend request accepted"
+		message.Body = fmt.Sprintf("%s is now your friend", actor)
+	case notifications.TypeActivityInvite:
+		message.Title = "New invitation"
+		message.Body = fmt.Sprintf("%s invited you to %s on %s", actor, activity, when)
+		if occurrences, ok := notification.Data["occurrences"].(float64); ok && occurrences > 1 {
+			message.Body = fmt.Sprintf("%s invited you to %s, %d times starting %s", actor, activity, int(occurrences), when)
+		}
+	case notifications.TypeRSVP:
+		status, _ := notification.Data["invite_status"].(string)
+		phrase, ok := rsvpPhrases[status]
+		if !ok {
+			phrase = "responded to"
+		}
+		message.Title = fmt.Sprintf("%s responded", actor)
+		message.Body = fmt.Sprintf("%s %s %s on %s", actor, phrase, activity, when)
+		if comment, ok := notification.Data["comment"].(string); ok && comment != "" {
+			message.Body += fmt.Sprintf(": %q", comment)
+		}
+	case notifications.TypeWaitlistPromoted:
+		message.Title = "You're in"
+		message.Body = fmt.Sprintf("A spot opened up, you're now going to %s on %s", activity, when)
+	case notifications.TypeActivityRescheduled:
+		message.Title = fmt.Sprintf("%s was rescheduled", activity)
+		message.Body = fmt.Sprintf("%s moved from %s to %s", activity, dataTime(notification.Data, "previous_scheduled_at", loc), when)
+	case notifications.TypeActivityCancelled:
+		message.Title = fmt.Sprintf("%s was cancelled", activity)
+		message.Body = fmt.Sprintf("%s on %s will not take place", activity, when)
+		if reason, _ := notification.Data["reason"].(string); reason == "min_participants" {
+			message.Body += " because not enough people accepted"
+		}
+	case notifications.TypeActivityReminder:
+		offset, _ := notification.Data["offset_minutes"].(float64)
+		message.Title = fmt.Sprintf("%s starts in %s", activity, humanizeMinutes(int(offset)))
+		message.Body = fmt.Sprintf("Reminder: %s is on %s", activity, when)
+	default:
+		message.Title = "New notification"
+		message.Body = "You have a new notification"
+	}
+
+	return message
+}
+
+// dataTime formats a time stored in a notification's data, which holds it as an RFC 3339 string
+func dataTime(data map[string]interface{}, key string, loc *time.Location) string {
+	value, _ := data[key].(string)
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "an unknown time"
+	}
+	return parsed.In(loc).Format(timeFormat)
+}
+
+// humanizeMinutes turns a reminder offset into e.g. "1 day", "2 hours" or "30 minutes"
+func humanizeMinutes(minutes int) string {
+	unit, n := "minute", minutes
+	switch {
+	case minutes >= 24*60 && minutes%(24*60) == 0:
+		unit, n = "day", minutes/(24*60)
+	case minutes >= 60 && minutes%60 == 0:
+		unit, n = "hour", minutes/60
+	}
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
@@ -0,0 +1,91 @@
+package delivery
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"time"
+)
+
+// SMTPConfig configures email delivery. Without a username no authentication is attempted, which
+// suits local sinks such as MailHog.
+type SMTPConfig struct {
+	Addr     string // host:port
+	Username string
+	Password string
+	From     string
+}
+
+// SMTPTransport sends plain text email
+type SMTPTransport struct {
+	config SMTPConfig
+	auth   smtp.Auth
+	from   mail.Address
+}
+
+// NewSMTPTransport creates an SMTP transport
+func NewSMTPTransport(config SMTPConfig) (*SMTPTransport, error) {
+	if config.Addr == "" || config.From == "" {
+		return nil, errors.New("the SMTP address and from address are required")
+	}
+	from, err := mail.ParseAddress(config.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP from address: %w", err)
+	}
+	host, _, err := net.SplitHostPort(config.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP address: %w", err)
+	}
+
+	transport := &SMTPTransport{config: config, from: *from}
+	if config.Username != "" {
+		transport.auth = smtp.PlainAuth("", config.Username, config.Password, host)
+	}
+	return transport, nil
+}
+
+func (t *SMTPTransport) Name() string {
+	return "smtp"
+}
+
+func (t *SMTPTransport) Send(ctx context.Context, target Target, message Message) error {
+	to, err := mail.ParseAddress(target.Address)
+	if err != nil {
+		return fmt.Errorf("%w: invalid address %q", ErrPermanent, target.Address)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", t.from.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", to.String())
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", message.Title))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(message.Body)
+	msg.WriteString("\r\n")
+
+	// net/smtp has no context support, so the send runs on its own and is abandoned on cancel
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(t.config.Addr, t.auth, t.from.Address, []string{to.Address}, msg.Bytes())
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-done:
+		var protoErr *textproto.Error
+		if errors.As(err, &protoErr) && protoErr.Code >= 500 {
+			// 5xx replies such as an unknown mailbox will not succeed on retry
+			return fmt.Errorf("%w: %v", ErrPermanent, err)
+		}
+		return err
+	}
+}
@@ -0,0 +1,55 @@
+package delivery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// StubTransport writes every message as a JSON line instead of sending it, for development and
+// tests
+type StubTransport struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// stubRecord is one line written by the stub
+type stubRecord struct {
+	SentAt  time.Time `json:"sent_at"`
+	Target  Target    `json:"target"`
+	Message Message   `json:"message"`
+}
+
+// NewStubTransport creates a stub that appends to the file at path, or writes to stdout when
+// path is empty or "-"
+func NewStubTransport(path string) (*StubTransport, error) {
+	if path == "" || path == "-" {
+		return &StubTransport{out: os.Stdout}, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stub output: %w", err)
+	}
+	return &StubTransport{out: file}, nil
+}
+
+func (t *StubTransport) Name() string {
+	return "stub"
+}
+
+func (t *StubTransport) Send(ctx context.Context, target Target, message Message) error {
+	line, err := json.Marshal(stubRecord{SentAt: time.Now(), Target: target, Message: message})
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, err = t.out.Write(append(line, '\n'))
+	return err
+}
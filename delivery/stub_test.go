@@ -0,0 +1,82 @@
+package delivery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStubTransportSend(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  Target
+		message Message
+	}{
+		{
+			name:    "push",
+			target:  Target{Channel: ChannelIOS, Address: "device-token"},
+			message: Message{Title: "New invitation", Body: "Ana invited you to Climbing", Data: map[string]string{"scheduled_activity_id": "7"}},
+		},
+		{
+			name:    "email without data",
+			target:  Target{Channel: ChannelEmail, Address: "ana@example.com"},
+			message: Message{Title: "Reminder", Body: "Climbing starts in an hour"},
+		},
+	}
+
+	var out bytes.Buffer
+	stub := &StubTransport{out: &out}
+	for _, tt := range tests {
+		if err := stub.Send(context.Background(), tt.target, tt.message); err != nil {
+			t.Fatalf("%s: Send: %v", tt.name, err)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != len(tests) {
+		t.Fatalf("wrote %d lines, want %d: %q", len(lines), len(tests), out.String())
+	}
+	for i, tt := range tests {
+		var record stubRecord
+		if err := json.Unmarshal([]byte(lines[i]), &record); err != nil {
+			t.Fatalf("%s: line %q is not JSON: %v", tt.name, lines[i], err)
+		}
+		if record.SentAt.IsZero() {
+			t.Errorf("%s: sent_at is missing", tt.name)
+		}
+		if record.Target != tt.target {
+			t.Errorf("%s: target = %+v, want %+v", tt.name, record.Target, tt.target)
+		}
+		if record.Message.Title != tt.message.Title || record.Message.Body != tt.message.Body || len(record.Message.Data) != len(tt.message.Data) {
+			t.Errorf("%s: message = %+v, want %+v", tt.name, record.Message, tt.message)
+		}
+	}
+	if strings.Contains(lines[1], `"data"`) {
+		t.Errorf("empty data is written: %s", lines[1])
+	}
+}
+
+func TestNewStubTransportAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deliveries.jsonl")
+	for i := 0; i < 2; i++ {
+		stub, err := NewStubTransport(path)
+		if err != nil {
+			t.Fatalf("NewStubTransport: %v", err)
+		}
+		if err := stub.Send(context.Background(), Target{Channel: ChannelEmail, Address: "ana@example.com"}, Message{Title: "Hi"}); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(content), "\n"); got != 2 {
+		t.Errorf("file has %d lines, want 2", got)
+	}
+}
@@ -0,0 +1,89 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Delivery channels. Push channels are the platform a device registered with.
+const (
+	ChannelIOS     = "ios"
+	ChannelAndroid = "android"
+	ChannelEmail   = "email"
+)
+
+var (
+	// ErrUnregistered is returned by transports when the device token is no longer valid. The
+	// device is removed and the delivery is not retried.
+	ErrUnregistered = errors.New("device token is no longer registered")
+	// ErrPermanent is returned by transports for failures that retrying cannot fix
+	ErrPermanent = errors.New("permanent delivery failure")
+)
+
+// Message is a rendered notification
+type Message struct {
+	Title string            `json:"title"`
+	Body  string            `json:"body"`
+	Data  map[string]string `json:"data,omitempty"` // passed to the client app with push messages
+}
+
+// Target is where a message goes: a device token for push channels, an address for email
+type Target struct {
+	Channel string `json:"channel"`
+	Address string `json:"address"`
+}
+
+// Transport sends messages over one channel
+type Transport interface {
+	Name() string
+	Send(ctx context.Context, target Target, message Message) error
+}
+
+// Config selects the transport of each channel and configures it. IOS is "apns" or "stub",
+// Android "fcm" or "stub" and Email "smtp" or "stub"; an empty name means the stub, which writes
+// to StubPath or stdout.
+type Config struct {
+	IOS      string
+	Android  string
+	Email    string
+	StubPath string
+	APNs     APNsConfig
+	FCM      FCMConfig
+	SMTP     SMTPConfig
+}
+
+// NewTransports builds the transport of each channel
+func NewTransports(config Config) (map[string]Transport, error) {
+	stub, err := NewStubTransport(config.StubPath)
+	if err != nil {
+		return nil, err
+	}
+
+	transports := make(map[string]Transport)
+	for channel, name := range map[string]string{
+		ChannelIOS:     config.IOS,
+		ChannelAndroid: config.Android,
+		ChannelEmail:   config.Email,
+	} {
+		var transport Transport
+		switch {
+		case name == "" || name == "stub":
+			transport = stub
+		case name == "apns" && channel == ChannelIOS:
+			transport, err = NewAPNsTransport(config.APNs)
+		case name == "fcm" && channel == ChannelAndroid:
+			transport, err = NewFCMTransport(config.FCM)
+		case name == "smtp" && channel == ChannelEmail:
+			transport, err = NewSMTPTransport(config.SMTP)
+		default:
+			return nil, fmt.Errorf("unknown %s transport %q", channel, name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure %s transport: %w", channel, err)
+		}
+		transports[channel] = transport
+	}
+
+	return transports, nil
+}
@@ -0,0 +1,99 @@
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"friendsocial/auth"
+	"friendsocial/query"
+	"net/http"
+	"strconv"
+)
+
+// FeedService defines the methods for reading feeds
+type FeedService interface {
+	Read(ctx context.Context, userID int, params query.Params) (query.Page[Entry], error)
+}
+
+// FeedError represents the structure of an error response
+type FeedError struct {
+	StatusCode int    `json:"status_code"`
+	Error      string `json:"error"`
+}
+
+// FeedHTTPHandler handles HTTP requests for feeds
+type FeedHTTPHandler struct {
+	feedService FeedService
+}
+
+// NewFeedHTTPHandler creates a new handler for feeds
+func NewFeedHTTPHandler(feedService FeedService) *FeedHTTPHandler {
+	return &FeedHTTPHandler{
+		feedService: feedService,
+	}
+}
+
+// HandleHTTPGet retrieves a page of a user's feed
+//
+//	@Summary		Get a user's feed
+//	@Description	Retrieve the upcoming scheduled activities the user was invited to or their friends accepted, ordered by start time, each with its activity, location, invitation counts and the friends attending. Filter with scheduled_at, activity_id, location_id and city, e.g. ?city=Halifax
+//	@Tags			feed
+//	@Produce		json
+//	@Param			id		path		int		true	"User ID"
+//	@Param			limit	query		int		false	"Entries per page, defaults to 50, at most 200"
+//	@Param			cursor	query		string	false	"next_cursor of the previous page"
+//	@Param			sort	query		string	false	"Field to sort by, prefixed with - for descending: scheduled_at"
+//	@Success		200		{object}	query.Page[Entry]
+//	@Failure		400		{object}	FeedError
+//	@Failure		500		{object}	FeedError
+//	@Router			/users/{id}/feed [get]
+func (fH *FeedHTTPHandler) HandleHTTPGet(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		fH.errorResponse(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	params, err := query.Parse(r.URL.RawQuery, listSpec)
+	if err != nil {
+		fH.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	page, err := fH.feedService.Read(r.Context(), userID, params)
+	if err != nil {
+		fH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(page)
+	if err != nil {
+		fH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// RegisterRoutes adds the feed routes to mux
+func (fH *FeedHTTPHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /users/{id}/feed", fH.HandleHTTPGet)
+}
+
+// AuthorizationRules returns the ownership rules for feed routes. A feed shows what the user's
+// friends are up to, so only the user may read it.
+func (fH *FeedHTTPHandler) AuthorizationRules() map[string]auth.Rule {
+	return map[string]auth.Rule{
+		"GET /users/{id}/feed": auth.Self("id"),
+	}
+}
+
+func (fH *FeedHTTPHandler) errorResponse(w http.ResponseWriter, statusCode int, errorString string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	encodingError := json.NewEncoder(w).Encode(FeedError{
+		StatusCode: statusCode,
+		Error:      errorString,
+	})
+	if encodingError != nil {
+		http.Error(w, encodingError.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,177 @@
+package feed
+
+import (
+	"context"
+	"fmt"
+	"friendsocial/activities"
+	"friendsocial/activity_participants"
+	"friendsocial/locations"
+	"friendsocial/query"
+	"friendsocial/scheduled_activities"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/lib/pq"
+)
+
+// Friend is a friend of the feed's user who accepted a scheduled activity
+type Friend struct {
+	ID             int     `json:"id"`
+	Name           string  `json:"name"`
+	ProfilePicture *string `json:"profile_picture,omitempty"`
+}
+
+// Entry is an upcoming scheduled activity with everything needed to show it
+type Entry struct {
+	ScheduledActivity scheduled_activities.ScheduledActivity `json:"scheduled_activity"`
+	Activity          activities.Activity                    `json:"activity"`
+	Location          locations.Location                     `json:"location"`
+	// MyStatus is the user's invite_status, or nil when only their friends were invited
+	MyStatus *string `json:"my_status"`
+	// FriendsAttending are the user's friends who accepted
+	FriendsAttending []Friend `json:"friends_attending"`
+	// Counts are the scheduled activity's invitations by invite_status
+	Counts map[string]int `json:"counts"`
+}
+
+type Service struct {
+	db *pgxpool.Pool
+}
+
+func NewService(db *pgxpool.Pool) *Service {
+	return &Service{
+		db: db,
+	}
+}
+
+// listSpec are the fields a feed can be filtered and sorted by
+var listSpec = query.Spec{
+	Fields: map[string]query.Field{
+		"scheduled_at": {Column: "sa.scheduled_at", Kind: query.Time, Sortable: true},
+		"activity_id":  {Column: "sa.activity_id", Kind: query.Int},
+		"location_id":  {Column: "l.id", Kind: query.Int},
+		"city":         {Column: "l.city", Kind: query.String},
+	},
+	Key:         "sa.id",
+	DefaultSort: "scheduled_at",
+}
+
+// Read returns a page of a user's feed: the active scheduled activities that have not started yet
+// and that the user was invited to and has not declined, or that one of their friends accepted.
+// Entries are ordered by start time unless params sort them otherwise.
+func (s *Service) Read(ctx context.Context, userID int, params query.Params) (query.Page[Entry], error) {
+	sql, args := params.Apply(
+		`WITH circle AS (
+		     SELECT CASE WHEN f.user_id = $1 THEN f.friend_id ELSE f.user_id END AS user_id
+		     FROM friends f
+		     WHERE (f.user_id = $1 OR f.friend_id = $1) AND f.status = 'accepted'
+		 ), visible AS (
+		     SELECT ap.scheduled_activity_id AS id FROM activity_participants ap
+		     WHERE ap.user_id = $1 AND ap.invite_status <> 'Declined'
+		     UNION
+		     SELECT ap.scheduled_activity_id FROM activity_participants ap
+		     JOIN circle c ON c.user_id = ap.user_id
+		     WHERE ap.invite_status = 'Accepted'
+		 )
+		 SELECT sa.id, sa.activity_id, sa.is_active, sa.scheduled_at, sa.user_activity_preference_id, sa.recurrence_id,
+		        sa.is_exception, sa.min_participants, sa.max_participants, sa.organizer_id,
+		        a.id, a.name, COALESCE(a.emoji, ''), a.description, a.estimated_time::text, a.location_id,
+		        COALESCE(a.user_created, FALSE), a.min_participants, a.max_participants,
+		        l.id, l.name, l.address, l.city, COALESCE(l.state, ''), COALESCE(l.zip_code, ''), l.country, l.latitude, l.longitude,
+		        me.invite_status
+		 FROM visible v
+		 JOIN scheduled_activities sa ON sa.id = v.id AND sa.is_active AND sa.scheduled_at > now()
+		 JOIN activities a ON a.id = sa.activity_id
+		 JOIN locations l ON l.id = a.location_id
+		 LEFT JOIN activity_participants me ON me.scheduled_activity_id = sa.id AND me.user_id = $1`,
+		userID)
+	rows, err := s.db.Query(ctx, sql, args...)
+	if err != nil {
+		return query.Page[Entry]{}, fmt.Errorf("failed to read feed: %v", err)
+	}
+	defer rows.Close()
+
+	var entries []Entry
+	for rows.Next() {
+		var entry Entry
+		sa, a, l := &entry.ScheduledActivity, &entry.Activity, &entry.Location
+		err := rows.Scan(&sa.ID, &sa.ActivityID, &sa.IsActive, &sa.ScheduledAt, &sa.UserActivityPreferenceID, &sa.RecurrenceID,
+			&sa.IsException, &sa.MinParticipants, &sa.MaxParticipants, &sa.OrganizerID,
+			&a.ID, &a.Name, &a.Emoji, &a.Description, &a.EstimatedTime, &a.LocationID,
+			&a.UserCreated, &a.MinParticipants, &a.MaxParticipants,
+			&l.ID, &l.Name, &l.Address, &l.City, &l.State, &l.ZipCode, &l.Country, &l.Latitude, &l.Longitude,
+			&entry.MyStatus)
+		if err != nil {
+			return query.Page[Entry]{}, fmt.Errorf("failed to scan feed entry: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return query.Page[Entry]{}, fmt.Errorf("failed to read feed: %v", err)
+	}
+
+	page := query.NewPage(params, entries, func(entry Entry, sort string) (int, interface{}) {
+		return entry.ScheduledActivity.ID, entry.ScheduledActivity.ScheduledAt
+	})
+
+	if err := s.readParticipants(ctx, userID, page.Data); err != nil {
+		return query.Page[Entry]{}, err
+	}
+
+	return page, nil
+}
+
+// readParticipants fills in the invitation counts and the friends attending of the entries
+func (s *Service) readParticipants(ctx context.Context, userID int, entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	index := make(map[int]*Entry, len(entries))
+	ids := make([]int, len(entries))
+	for i := range entries {
+		entry := &entries[i]
+		entry.FriendsAttending = []Friend{}
+		entry.Counts = make(map[string]int, len(activity_participants.Statuses))
+		for _, status := range activity_participants.Statuses {
+			entry.Counts[status] = 0
+		}
+		index[entry.ScheduledActivity.ID] = entry
+		ids[i] = entry.ScheduledActivity.ID
+	}
+
+	rows, err := s.db.Query(ctx,
+		`SELECT ap.scheduled_activity_id, ap.invite_status, u.id, u.name, u.profile_picture,
+		        EXISTS (
+		            SELECT 1 FROM friends f
+		            WHERE f.status = 'accepted'
+		              AND f.user_ordered_id1 = LEAST(u.id, $2)
+		              AND f.user_ordered_id2 = GREATEST(u.id, $2))
+		 FROM activity_participants ap
+		 JOIN users u ON u.id = ap.user_id
+		 WHERE ap.scheduled_activity_id = ANY($1)
+		 ORDER BY ap.scheduled_activity_id, ap.responded_at NULLS LAST, u.id`,
+		pq.Array(ids), userID)
+	if err != nil {
+		return fmt.Errorf("failed to read participants: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var scheduledActivityID int
+		var status string
+		var friend Friend
+		var isFriend bool
+		if err := rows.Scan(&scheduledActivityID, &status, &friend.ID, &friend.Name, &friend.ProfilePicture, &isFriend); err != nil {
+			return fmt.Errorf("failed to scan participant: %v", err)
+		}
+
+		entry := index[scheduledActivityID]
+		entry.Counts[status]++
+		if isFriend && status == activity_participants.StatusAccepted {
+			entry.FriendsAttending = append(entry.FriendsAttending, friend)
+		}
+	}
+
+	return rows.Err()
+}
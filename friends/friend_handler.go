@@ -1,18 +1,33 @@
 package friends
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"friendsocial/auth"
+	"friendsocial/query"
+	"friendsocial/users"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 )
 
 // FriendService defines the interface for the friend service
 type FriendService interface {
-	Create(userID string, friendID string) (Friend, error)
-	ReadByUserID(userID string) ([]Friend, error)
-	ReadByFriendID(friendID string) ([]Friend, error)
-	UsersAreFriends(userID string, friendID string) (bool, error)
-	Delete(userID string, friendID string) (bool, error)
+	Create(ctx context.Context, userID string, friendID string) (Friend, error)
+	ReadByUserID(ctx context.Context, userID string, params query.Params) (query.Page[Friend], error)
+	ReadFriendUsers(ctx context.Context, userID string, params query.Params) (query.Page[users.User], error)
+	ReadMutualFriends(ctx context.Context, userID string, otherID string) ([]users.User, error)
+	ReadSuggestions(ctx context.Context, userID string, limit int) ([]Suggestion, error)
+	ReadByFriendID(ctx context.Context, friendID string) ([]Friend, error)
+	UsersAreFriends(ctx context.Context, userID string, friendID string) (bool, error)
+	Delete(ctx context.Context, userID string, friendID string) (bool, error)
+	Accept(ctx context.Context, userID string, friendID string) (Friend, bool, error)
+	Decline(ctx context.Context, userID string, friendID string) (Friend, bool, error)
+	Cancel(ctx context.Context, userID string, friendID string) (bool, error)
+	Block(ctx context.Context, userID string, blockedID string) (Friend, error)
+	ReadRequests(ctx context.Context, userID string, direction string, params query.Params) (query.Page[Friend], error)
 }
 
 // FriendError represents an error response
@@ -33,18 +48,21 @@ func NewFriendHTTPHandler(friendService FriendService) *FriendHTTPHandler {
 	}
 }
 
-// HandleHTTPPost creates a new friendship
+// HandleHTTPPost sends a friend request
 //
-//	@Summary		Create a new friendship
-//	@Description	Create a new friendship between two users
+//	@Summary		Send a friend request
+//	@Description	Send a friend request from user_id to friend_id. A pending request in the other direction is accepted instead.
 //	@Tags			friends
 //	@Accept			json
 //	@Produce		json
 //	@Param			friend	body		Friend	true	"Friendship information"
 //	@Success		201		{object}	Friend
 //	@Failure		400		{object}	FriendError
+//	@Failure		403		{object}	FriendError
+//	@Failure		404		{object}	FriendError
+//	@Failure		409		{object}	FriendError
 //	@Failure		500		{object}	FriendError
-//	@Router			/friends [post]
+//	@Router			/friend/requests [post]
 func (fH *FriendHTTPHandler) HandleHTTPPost(w http.ResponseWriter, r *http.Request) {
 	var friend Friend
 	err := json.NewDecoder(r.Body).Decode(&friend)
@@ -53,11 +71,27 @@ func (fH *FriendHTTPHandler) HandleHTTPPost(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	if friend.UserID == friend.FriendID {
+		fH.errorResponse(w, http.StatusBadRequest, "users cannot befriend themselves")
+		return
+	}
+
 	friendIDStr := strconv.Itoa(friend.UserID)
 	friendFriendIDStr := strconv.Itoa(friend.FriendID)
 
-	newFriend, err := fH.friendService.Create(friendIDStr, friendFriendIDStr)
-	if err != nil {
+	newFriend, err := fH.friendService.Create(r.Context(), friendIDStr, friendFriendIDStr)
+	switch err {
+	case nil:
+	case ErrBlocked:
+		fH.errorResponse(w, http.StatusForbidden, err.Error())
+		return
+	case ErrUserNotFound:
+		fH.errorResponse(w, http.StatusNotFound, err.Error())
+		return
+	case ErrAlreadyFriends, ErrRequestExists:
+		fH.errorResponse(w, http.StatusConflict, err.Error())
+		return
+	default:
 		fH.errorResponse(w, http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -71,20 +105,45 @@ func (fH *FriendHTTPHandler) HandleHTTPPost(w http.ResponseWriter, r *http.Reque
 	}
 }
 
-// HandleHTTPGet retrieves all friends of a user
+// HandleHTTPGet retrieves the friends of a user
 //
-//	@Summary		Get all friends of a user
-//	@Description	Retrieve all friendships for a given user
+//	@Summary		Get the friends of a user
+//	@Description	Retrieve a page of the friendships of a given user, filtered with other_id and created_at, or of the friends' profiles with expand=user, filtered with name, email and location_id
 //	@Tags			friends
 //	@Produce		json
 //	@Param			user_id	path		string	true	"User ID"
-//	@Success		200		{array}		Friend
+//	@Param			expand	query		string	false	"user to return users.User instead of friendships"
+//	@Param			limit	query		int		false	"Items per page, defaults to 50, at most 200"
+//	@Param			cursor	query		string	false	"next_cursor of the previous page"
+//	@Param			sort	query		string	false	"Field to sort by, prefixed with - for descending: other_id, or name and email with expand=user"
+//	@Success		200		{object}	query.Page[Friend]
+//	@Failure		400		{object}	FriendError
 //	@Failure		500		{object}	FriendError
-//	@Router			/friends/{user_id} [get]
+//	@Router			/friend/user/{user_id} [get]
 func (fH *FriendHTTPHandler) HandleHTTPGetByUserID(w http.ResponseWriter, r *http.Request) {
 	userID := r.PathValue("user_id")
+	expand, rawQuery := listOption(r.URL.RawQuery, "expand")
 
-	friends, err := fH.friendService.ReadByUserID(userID)
+	var friends interface{}
+	var params query.Params
+	var err error
+	switch expand {
+	case "":
+		if params, err = query.Parse(rawQuery, listSpec); err == nil {
+			friends, err = fH.friendService.ReadByUserID(r.Context(), userID, params)
+		}
+	case "user":
+		if params, err = query.Parse(rawQuery, friendUsersSpec); err == nil {
+			friends, err = fH.friendService.ReadFriendUsers(r.Context(), userID, params)
+		}
+	default:
+		fH.errorResponse(w, http.StatusBadRequest, "expand must be user")
+		return
+	}
+	if errors.Is(err, query.ErrInvalidQuery) {
+		fH.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	if err != nil {
 		fH.errorResponse(w, http.StatusInternalServerError, err.Error())
 		return
@@ -113,7 +172,7 @@ func (fH *FriendHTTPHandler) HandleHTTPGetByUserID(w http.ResponseWriter, r *htt
 func (fH *FriendHTTPHandler) HandleHTTPGetByFriendID(w http.ResponseWriter, r *http.Request) {
 	friendID := r.PathValue("friend_id")
 
-	exists, err := fH.friendService.ReadByFriendID(friendID)
+	exists, err := fH.friendService.ReadByFriendID(r.Context(), friendID)
 	if err != nil {
 		fH.errorResponse(w, http.StatusInternalServerError, err.Error())
 		return
@@ -130,19 +189,19 @@ func (fH *FriendHTTPHandler) HandleHTTPGetByFriendID(w http.ResponseWriter, r *h
 // HandleHTTPDelete deletes a friendship
 //
 //	@Summary		Delete a friendship
-//	@Description	Delete an existing friendship between two users
+//	@Description	Delete an existing friendship between two users, in whichever direction it was created
 //	@Tags			friends
 //	@Param			user_id		path	string	true	"User ID"
 //	@Param			friend_id	path	string	true	"Friend ID"
 //	@Success		204
 //	@Failure		404	{object}	FriendError
 //	@Failure		500	{object}	FriendError
-//	@Router			/friends/{user_id}/{friend_id} [delete]
+//	@Router			/friend/{user_id}/{friend_id} [delete]
 func (fH *FriendHTTPHandler) HandleHTTPDelete(w http.ResponseWriter, r *http.Request) {
 	userID := r.PathValue("user_id")
 	friendID := r.PathValue("friend_id")
 
-	found, err := fH.friendService.Delete(userID, friendID)
+	found, err := fH.friendService.Delete(r.Context(), userID, friendID)
 	if err != nil {
 		fH.errorResponse(w, http.StatusInternalServerError, err.Error())
 		return
@@ -167,7 +226,7 @@ func (fH *FriendHTTPHandler) HandleHTTPGetAreFriends(w http.ResponseWriter, r *h
 	userID := r.PathValue("user_id")
 	friendID := r.PathValue("friend_id")
 
-	areFriends, err := fH.friendService.UsersAreFriends(userID, friendID)
+	areFriends, err := fH.friendService.UsersAreFriends(r.Context(), userID, friendID)
 	if err != nil {
 		fH.errorResponse(w, http.StatusInternalServerError, err.Error())
 		return
@@ -182,6 +241,307 @@ func (fH *FriendHTTPHandler) HandleHTTPGetAreFriends(w http.ResponseWriter, r *h
 	}
 }
 
+// HandleHTTPGetMutual retrieves the friends two users have in common
+//
+//	@Summary		Get mutual friends
+//	@Description	Retrieve the users who are friends with both user_id and other_id
+//	@Tags			friends
+//	@Produce		json
+//	@Param			user_id		path		string	true	"User ID"
+//	@Param			other_id	path		string	true	"Other user ID"
+//	@Success		200			{array}		users.User
+//	@Failure		500			{object}	FriendError
+//	@Router			/friend/user/{user_id}/mutual/{other_id} [get]
+func (fH *FriendHTTPHandler) HandleHTTPGetMutual(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("user_id")
+	otherID := r.PathValue("other_id")
+
+	mutualFriends, err := fH.friendService.ReadMutualFriends(r.Context(), userID, otherID)
+	if err != nil {
+		fH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(mutualFriends)
+	if err != nil {
+		fH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// HandleHTTPGetSuggestions retrieves "people you may know" for a user
+//
+//	@Summary		Get friend suggestions
+//	@Description	Rank friends of friends by mutual friends and shared activities, excluding existing friends, pending requests and blocks
+//	@Tags			friends
+//	@Produce		json
+//	@Param			user_id	path		string	true	"User ID"
+//	@Param			limit	query		int		false	"Maximum number of suggestions (default 20, max 100)"
+//	@Success		200		{array}		Suggestion
+//	@Failure		400		{object}	FriendError
+//	@Failure		500		{object}	FriendError
+//	@Router			/friend/user/{user_id}/suggestions [get]
+func (fH *FriendHTTPHandler) HandleHTTPGetSuggestions(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("user_id")
+
+	limit := 20
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed < 1 || parsed > 100 {
+			fH.errorResponse(w, http.StatusBadRequest, "limit must be between 1 and 100")
+			return
+		}
+		limit = parsed
+	}
+
+	suggestions, err := fH.friendService.ReadSuggestions(r.Context(), userID, limit)
+	if err != nil {
+		fH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(suggestions)
+	if err != nil {
+		fH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// HandleHTTPGetRequests retrieves a user's pending friend requests
+//
+//	@Summary		Get pending friend requests
+//	@Description	Retrieve a page of the requests received by the user, or sent by them with direction=outgoing. Filter with other_id and created_at.
+//	@Tags			friends
+//	@Produce		json
+//	@Param			user_id		path		string	true	"User ID"
+//	@Param			direction	query		string	false	"incoming (default) or outgoing"
+//	@Param			limit		query		int		false	"Items per page, defaults to 50, at most 200"
+//	@Param			cursor		query		string	false	"next_cursor of the previous page"
+//	@Param			sort		query		string	false	"Field to sort by, prefixed with - for descending: other_id"
+//	@Success		200			{object}	query.Page[Friend]
+//	@Failure		400			{object}	FriendError
+//	@Failure		500			{object}	FriendError
+//	@Router			/friend/requests/user/{user_id} [get]
+func (fH *FriendHTTPHandler) HandleHTTPGetRequests(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("user_id")
+	direction, rawQuery := listOption(r.URL.RawQuery, "direction")
+
+	if direction != "" && direction != "incoming" && direction != "outgoing" {
+		fH.errorResponse(w, http.StatusBadRequest, "direction must be incoming or outgoing")
+		return
+	}
+
+	params, err := query.Parse(rawQuery, listSpec)
+	if err != nil {
+		fH.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	requests, err := fH.friendService.ReadRequests(r.Context(), userID, direction, params)
+	if err != nil {
+		fH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(requests)
+	if err != nil {
+		fH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// HandleHTTPPostAccept accepts a pending friend request
+//
+//	@Summary		Accept a friend request
+//	@Description	Accept the pending request sent by user_id to friend_id
+//	@Tags			friends
+//	@Produce		json
+//	@Param			user_id		path		string	true	"Requesting user ID"
+//	@Param			friend_id	path		string	true	"Receiving user ID"
+//	@Success		200			{object}	Friend
+//	@Failure		404			{object}	FriendError
+//	@Failure		500			{object}	FriendError
+//	@Router			/friend/requests/{user_id}/{friend_id}/accept [post]
+func (fH *FriendHTTPHandler) HandleHTTPPostAccept(w http.ResponseWriter, r *http.Request) {
+	fH.respond(w, r, fH.friendService.Accept)
+}
+
+// HandleHTTPPostDecline declines a pending friend request
+//
+//	@Summary		Decline a friend request
+//	@Description	Decline the pending request sent by user_id to friend_id
+//	@Tags			friends
+//	@Produce		json
+//	@Param			user_id		path		string	true	"Requesting user ID"
+//	@Param			friend_id	path		string	true	"Receiving user ID"
+//	@Success		200			{object}	Friend
+//	@Failure		404			{object}	FriendError
+//	@Failure		500			{object}	FriendError
+//	@Router			/friend/requests/{user_id}/{friend_id}/decline [post]
+func (fH *FriendHTTPHandler) HandleHTTPPostDecline(w http.ResponseWriter, r *http.Request) {
+	fH.respond(w, r, fH.friendService.Decline)
+}
+
+func (fH *FriendHTTPHandler) respond(w http.ResponseWriter, r *http.Request, respond func(ctx context.Context, userID string, friendID string) (Friend, bool, error)) {
+	userID := r.PathValue("user_id")
+	friendID := r.PathValue("friend_id")
+
+	friend, found, err := respond(r.Context(), userID, friendID)
+	if err != nil {
+		fH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if !found {
+		fH.errorResponse(w, http.StatusNotFound, "Friend request not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(friend)
+	if err != nil {
+		fH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// HandleHTTPDeleteRequest cancels a pending friend request
+//
+//	@Summary		Cancel a friend request
+//	@Description	Withdraw the pending request sent by user_id to friend_id
+//	@Tags			friends
+//	@Param			user_id		path	string	true	"Requesting user ID"
+//	@Param			friend_id	path	string	true	"Receiving user ID"
+//	@Success		204
+//	@Failure		404	{object}	FriendError
+//	@Failure		500	{object}	FriendError
+//	@Router			/friend/requests/{user_id}/{friend_id} [delete]
+func (fH *FriendHTTPHandler) HandleHTTPDeleteRequest(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("user_id")
+	friendID := r.PathValue("friend_id")
+
+	found, err := fH.friendService.Cancel(r.Context(), userID, friendID)
+	if err != nil {
+		fH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if !found {
+		fH.errorResponse(w, http.StatusNotFound, "Friend request not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleHTTPPostBlock blocks a user
+//
+//	@Summary		Block a user
+//	@Description	user_id blocks friend_id, replacing any friendship or pending request between them. A block placed by friend_id is kept.
+//	@Tags			friends
+//	@Accept			json
+//	@Produce		json
+//	@Param			friend	body		Friend	true	"Blocking user_id and blocked friend_id"
+//	@Success		201		{object}	Friend
+//	@Failure		400		{object}	FriendError
+//	@Failure		409		{object}	FriendError
+//	@Failure		500		{object}	FriendError
+//	@Router			/friend/requests/block [post]
+func (fH *FriendHTTPHandler) HandleHTTPPostBlock(w http.ResponseWriter, r *http.Request) {
+	var friend Friend
+	err := json.NewDecoder(r.Body).Decode(&friend)
+	if err != nil {
+		fH.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if friend.UserID == friend.FriendID {
+		fH.errorResponse(w, http.StatusBadRequest, "users cannot block themselves")
+		return
+	}
+
+	blocked, err := fH.friendService.Block(r.Context(), strconv.Itoa(friend.UserID), strconv.Itoa(friend.FriendID))
+	if err == ErrBlocked {
+		fH.errorResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		fH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(blocked)
+	if err != nil {
+		fH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// RegisterRoutes adds the friend routes to mux
+func (fH *FriendHTTPHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("POST /friend", fH.HandleHTTPPost)
+	mux.HandleFunc("GET /friend/user/{user_id}", fH.HandleHTTPGetByUserID)
+	mux.HandleFunc("GET /friend/user/{user_id}/mutual/{other_id}", fH.HandleHTTPGetMutual)
+	mux.HandleFunc("GET /friend/user/{user_id}/suggestions", fH.HandleHTTPGetSuggestions)
+	mux.HandleFunc("GET /friend/friend/{friend_id}", fH.HandleHTTPGetByFriendID)
+	mux.HandleFunc("GET /friend/are_friends/{user_id}/{friend_id}", fH.HandleHTTPGetAreFriends)
+	mux.HandleFunc("DELETE /friend/{user_id}/{friend_id}", fH.HandleHTTPDelete)
+	mux.HandleFunc("POST /friend/requests", fH.HandleHTTPPost)
+	mux.HandleFunc("GET /friend/requests/user/{user_id}", fH.HandleHTTPGetRequests)
+	mux.HandleFunc("POST /friend/requests/{user_id}/{friend_id}/accept", fH.HandleHTTPPostAccept)
+	mux.HandleFunc("POST /friend/requests/{user_id}/{friend_id}/decline", fH.HandleHTTPPostDecline)
+	mux.HandleFunc("DELETE /friend/requests/{user_id}/{friend_id}", fH.HandleHTTPDeleteRequest)
+	mux.HandleFunc("POST /friend/requests/block", fH.HandleHTTPPostBlock)
+}
+
+// AuthorizationRules returns the ownership rules for friend routes. Requests are sent and
+// cancelled by user_id and answered by friend_id.
+func (fH *FriendHTTPHandler) AuthorizationRules() map[string]auth.Rule {
+	return map[string]auth.Rule{
+		"POST /friend":                                        fH.isBodyUser,
+		"DELETE /friend/{user_id}/{friend_id}":                auth.Self("user_id"),
+		"POST /friend/requests":                               fH.isBodyUser,
+		"GET /friend/user/{user_id}/suggestions":              auth.Self("user_id"),
+		"GET /friend/requests/user/{user_id}":                 auth.Self("user_id"),
+		"POST /friend/requests/{user_id}/{friend_id}/accept":  auth.Self("friend_id"),
+		"POST /friend/requests/{user_id}/{friend_id}/decline": auth.Self("friend_id"),
+		"DELETE /friend/requests/{user_id}/{friend_id}":       auth.Self("user_id"),
+		"POST /friend/requests/block":                         fH.isBodyUser,
+	}
+}
+
+// isBodyUser stops callers from befriending people on behalf of someone else
+func (fH *FriendHTTPHandler) isBodyUser(r *http.Request, callerID int) (bool, error) {
+	var friend Friend
+	if err := auth.PeekJSON(r, &friend); err != nil {
+		// Let the handler answer 400
+		return true, nil
+	}
+	return friend.UserID == callerID, nil
+}
+
+// listOption takes the parameter name, e.g. expand, out of the raw query of a list and returns its
+// value and the list parameters left for query.Parse
+func listOption(rawQuery string, name string) (string, string) {
+	var value string
+	var rest []string
+	for _, part := range strings.Split(rawQuery, "&") {
+		if raw, found := strings.CutPrefix(part, name+"="); found {
+			value, _ = url.QueryUnescape(raw)
+			continue
+		}
+		if part != "" {
+			rest = append(rest, part)
+		}
+	}
+	return value, strings.Join(rest, "&")
+}
+
 // errorResponse sends a JSON error response
 func (fH *FriendHTTPHandler) errorResponse(w http.ResponseWriter, statusCode int, errorString string) {
 	w.Header().Set("Content-Type", "application/json")
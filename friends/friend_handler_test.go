@@ -0,0 +1,24 @@
+package friends
+
+import "testing"
+
+func TestListOption(t *testing.T) {
+	tests := []struct {
+		rawQuery  string
+		wantValue string
+		wantRest  string
+	}{
+		{"", "", ""},
+		{"expand=user", "user", ""},
+		{"limit=5&expand=user&sort=-name", "user", "limit=5&sort=-name"},
+		{"created_at>=2024-09-01", "", "created_at>=2024-09-01"},
+		{"expand=us%65r&limit=5", "user", "limit=5"},
+		{"expanded=user", "", "expanded=user"},
+	}
+	for _, tt := range tests {
+		value, rest := listOption(tt.rawQuery, "expand")
+		if value != tt.wantValue || rest != tt.wantRest {
+			t.Errorf("listOption(%q) = %q, %q, want %q, %q", tt.rawQuery, value, rest, tt.wantValue, tt.wantRest)
+		}
+	}
+}
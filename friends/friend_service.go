@@ -2,21 +2,57 @@ package friends
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"friendsocial/notifications"
+	"friendsocial/query"
+	"friendsocial/users"
 	"strconv"
-	"sync"
 
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
+// Friendship statuses. A row's user_id is the user who sent the request, or who placed the block.
+const (
+	StatusPending  = "pending"
+	StatusAccepted = "accepted"
+	StatusDeclined = "declined"
+	StatusBlocked  = "blocked"
+)
+
+// pairLockClass is the first key of the advisory locks taken by LockPair
+const pairLockClass int32 = 0x66737072 // "fspr"
+
+var (
+	ErrBlocked        = errors.New("one of the users has blocked the other")
+	ErrAlreadyFriends = errors.New("users are already friends")
+	ErrRequestExists  = errors.New("a friend request is already pending")
+	ErrUserNotFound   = errors.New("user not found")
+)
+
 type Friend struct {
-	UserID    int    `json:"user_id"`
-	FriendID  int    `json:"friend_id"`
-	CreatedAt string `json:"created_at"`
+	UserID      int     `json:"user_id"`
+	FriendID    int     `json:"friend_id"`
+	Status      string  `json:"status"`
+	CreatedAt   string  `json:"created_at"`
+	RespondedAt *string `json:"responded_at,omitempty"`
 }
 
+// Suggestion is a friend of a friend ranked for "people you may know"
+type Suggestion struct {
+	User             users.User `json:"user"`
+	MutualFriends    int        `json:"mutual_friends"`
+	SharedActivities int        `json:"shared_activities"`
+}
+
+// acceptedFriendIDs selects the IDs of everyone the user in $1 is friends with
+const acceptedFriendIDs = `
+	SELECT CASE WHEN user_id = $1 THEN friend_id ELSE user_id END AS id
+	FROM friends WHERE (user_id = $1 OR friend_id = $1) AND status = 'accepted'`
+
 type Service struct {
-	sync.Mutex
 	db *pgxpool.Pool
 }
 
@@ -26,39 +62,239 @@ func NewService(db *pgxpool.Pool) *Service {
 	}
 }
 
-// Creates a friendship between two users
-func (friendService *Service) Create(userID string, friendID string) (Friend, error) {
-	friendService.Lock()
-	defer friendService.Unlock()
+// Sends a friend request from userID to friendID. If friendID already asked userID, the pending
+// request is accepted instead.
+func (friendService *Service) Create(ctx context.Context, userID string, friendID string) (Friend, error) {
+	tx, err := friendService.db.Begin(ctx)
+	if err != nil {
+		return Friend{}, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	// Without a friends row to lock, the pair lock keeps a concurrent Block from slipping in
+	// between the check below and the insert
+	if err := LockPair(ctx, tx, userID, friendID); err != nil {
+		return Friend{}, err
+	}
 
-	_, err := friendService.db.Exec(
-		context.Background(),
-		"INSERT INTO friends (user_id, friend_id) VALUES ($1, $2)",
+	var existing Friend
+	err = tx.QueryRow(
+		ctx,
+		`SELECT user_id, friend_id, status FROM friends
+		 WHERE user_ordered_id1 = LEAST($1::int, $2::int) AND user_ordered_id2 = GREATEST($1::int, $2::int)
+		 FOR UPDATE`,
+		userID, friendID,
+	).Scan(&existing.UserID, &existing.FriendID, &existing.Status)
+	if err != nil && err != pgx.ErrNoRows {
+		return Friend{}, err
+	}
+
+	if err == nil {
+		switch existing.Status {
+		case StatusBlocked:
+			return Friend{}, ErrBlocked
+		case StatusAccepted:
+			return Friend{}, ErrAlreadyFriends
+		case StatusPending:
+			if strconv.Itoa(existing.UserID) == userID {
+				return Friend{}, ErrRequestExists
+			}
+			friend, err := scanFriend(tx.QueryRow(
+				ctx,
+				`UPDATE friends SET status = $3, responded_at = CURRENT_TIMESTAMP
+				 WHERE user_id = $1 AND friend_id = $2
+				 RETURNING user_id, friend_id, status, created_at::text, responded_at::text`,
+				existing.UserID, existing.FriendID, StatusAccepted,
+			))
+			if err != nil {
+				return Friend{}, err
+			}
+			err = notifications.Emit(ctx, tx, notifications.Notification{
+				UserID:  friend.UserID,
+				Type:    notifications.TypeFriendAccepted,
+				ActorID: &friend.FriendID,
+			})
+			if err != nil {
+				return Friend{}, err
+			}
+			return friend, tx.Commit(ctx)
+		case StatusDeclined:
+			// A declined request may be sent again, by either user
+			_, err = tx.Exec(ctx, "DELETE FROM friends WHERE user_id = $1 AND friend_id = $2", existing.UserID, existing.FriendID)
+			if err != nil {
+				return Friend{}, err
+			}
+		}
+	}
+
+	friend, err := scanFriend(tx.QueryRow(
+		ctx,
+		`INSERT INTO friends (user_id, friend_id, status) VALUES ($1, $2, $3)
+		 RETURNING user_id, friend_id, status, created_at::text, responded_at::text`,
+		userID, friendID, StatusPending,
+	))
+	if err != nil {
+		// The other user sent a request at the same moment: unique_violation on uq_friends_pair
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return Friend{}, ErrRequestExists
+		}
+		// foreign_key_violation: one of the users does not exist
+		if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+			return Friend{}, ErrUserNotFound
+		}
+		return Friend{}, err
+	}
+
+	err = notifications.Emit(ctx, tx, notifications.Notification{
+		UserID:  friend.FriendID,
+		Type:    notifications.TypeFriendRequest,
+		ActorID: &friend.UserID,
+	})
+	if err != nil {
+		return Friend{}, err
+	}
+
+	return friend, tx.Commit(ctx)
+}
+
+// Accept marks a pending request from userID to friendID as accepted
+func (friendService *Service) Accept(ctx context.Context, userID string, friendID string) (Friend, bool, error) {
+	return friendService.respond(ctx, userID, friendID, StatusAccepted)
+}
+
+// Decline marks a pending request from userID to friendID as declined
+func (friendService *Service) Decline(ctx context.Context, userID string, friendID string) (Friend, bool, error) {
+	return friendService.respond(ctx, userID, friendID, StatusDeclined)
+}
+
+func (friendService *Service) respond(ctx context.Context, userID string, friendID string, status string) (Friend, bool, error) {
+	tx, err := friendService.db.Begin(ctx)
+	if err != nil {
+		return Friend{}, false, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	friend, err := scanFriend(tx.QueryRow(
+		ctx,
+		`UPDATE friends SET status = $3, responded_at = CURRENT_TIMESTAMP
+		 WHERE user_id = $1 AND friend_id = $2 AND status = 'pending'
+		 RETURNING user_id, friend_id, status, created_at::text, responded_at::text`,
+		userID, friendID, status,
+	))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return Friend{}, false, nil
+		}
+		return Friend{}, false, err
+	}
+
+	// Declined requests are not announced
+	if friend.Status == StatusAccepted {
+		err = notifications.Emit(ctx, tx, notifications.Notification{
+			UserID:  friend.UserID,
+			Type:    notifications.TypeFriendAccepted,
+			ActorID: &friend.FriendID,
+		})
+		if err != nil {
+			return Friend{}, false, err
+		}
+	}
+
+	return friend, true, tx.Commit(ctx)
+}
+
+// Cancel withdraws a pending request from userID to friendID
+func (friendService *Service) Cancel(ctx context.Context, userID string, friendID string) (bool, error) {
+	cmdTag, err := friendService.db.Exec(
+		ctx,
+		"DELETE FROM friends WHERE user_id = $1 AND friend_id = $2 AND status = 'pending'",
 		userID, friendID,
 	)
 	if err != nil {
+		return false, err
+	}
+
+	return cmdTag.RowsAffected() > 0, nil
+}
+
+// Block replaces any relationship between the two users with a block placed by userID. Blocking
+// again returns the existing block. A block placed by blockedID is kept and ErrBlocked is
+// returned, so that the blocked user cannot replace it with one of their own and then remove it.
+func (friendService *Service) Block(ctx context.Context, userID string, blockedID string) (Friend, error) {
+	tx, err := friendService.db.Begin(ctx)
+	if err != nil {
+		return Friend{}, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	if err := LockPair(ctx, tx, userID, blockedID); err != nil {
 		return Friend{}, err
 	}
 
-	userIDStr, _ := strconv.Atoi(userID)
-	friendIDStr, _ := strconv.Atoi(friendID)
+	existing, err := scanFriend(tx.QueryRow(
+		ctx,
+		`SELECT user_id, friend_id, status, created_at::text, responded_at::text FROM friends
+		 WHERE user_ordered_id1 = LEAST($1::int, $2::int) AND user_ordered_id2 = GREATEST($1::int, $2::int)
+		 FOR UPDATE`,
+		userID, blockedID,
+	))
+	if err != nil && err != pgx.ErrNoRows {
+		return Friend{}, err
+	}
+	if err == nil && existing.Status == StatusBlocked {
+		if strconv.Itoa(existing.UserID) == userID {
+			return existing, nil
+		}
+		return Friend{}, ErrBlocked
+	}
 
-	// Return the friendship details without querying again
-	return Friend{
-		UserID:    userIDStr,
-		FriendID:  friendIDStr,
-		CreatedAt: "", // We assume created_at is automatically handled by the database.
-	}, nil
+	_, err = tx.Exec(
+		ctx,
+		`DELETE FROM friends
+		 WHERE user_ordered_id1 = LEAST($1::int, $2::int) AND user_ordered_id2 = GREATEST($1::int, $2::int)`,
+		userID, blockedID,
+	)
+	if err != nil {
+		return Friend{}, err
+	}
+
+	friend, err := scanFriend(tx.QueryRow(
+		ctx,
+		`INSERT INTO friends (user_id, friend_id, status, responded_at) VALUES ($1, $2, $3, CURRENT_TIMESTAMP)
+		 RETURNING user_id, friend_id, status, created_at::text, responded_at::text`,
+		userID, blockedID, StatusBlocked,
+	))
+	if err != nil {
+		// The other user blocked this one at the same moment: unique_violation on uq_friends_pair
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return Friend{}, ErrBlocked
+		}
+		return Friend{}, err
+	}
+
+	return friend, tx.Commit(ctx)
 }
 
-// Removes a friendship between two users
-func (friendService *Service) Delete(userID string, friendID string) (bool, error) {
-	friendService.Lock()
-	defer friendService.Unlock()
+// Retrieves a page of the pending requests received by ("incoming") or sent by ("outgoing") a user
+func (friendService *Service) ReadRequests(ctx context.Context, userID string, direction string, params query.Params) (query.Page[Friend], error) {
+	column := "friend_id"
+	if direction == "outgoing" {
+		column = "user_id"
+	}
 
+	return friendService.readPage(ctx, userID, params, column+" = $1 AND status = 'pending'")
+}
+
+// Removes the relationship between userID and friendID in either direction. A block can only be
+// removed by the user who placed it.
+func (friendService *Service) Delete(ctx context.Context, userID string, friendID string) (bool, error) {
 	cmdTag, err := friendService.db.Exec(
-		context.Background(),
-		"DELETE FROM friends WHERE user_id = $1 AND friend_id = $2",
+		ctx,
+		`DELETE FROM friends
+		 WHERE user_ordered_id1 = LEAST($1::int, $2::int) AND user_ordered_id2 = GREATEST($1::int, $2::int)
+		   AND (status <> 'blocked' OR user_id = $1)`,
 		userID, friendID,
 	)
 	if err != nil {
@@ -72,68 +308,195 @@ func (friendService *Service) Delete(userID string, friendID string) (bool, erro
 	return true, nil
 }
 
-// Retrieves all friends of a given user
-func (friendService *Service) ReadByUserID(userID string) ([]Friend, error) {
-	friendService.Lock()
-	defer friendService.Unlock()
+// friendUsersSpec are the fields the profiles of a user's friends can be listed by
+var friendUsersSpec = query.Spec{
+	Fields: map[string]query.Field{
+		"name":        {Column: "u.name", Kind: query.String, Sortable: true},
+		"email":       {Column: "u.email", Kind: query.String, Sortable: true},
+		"location_id": {Column: "u.location_id", Kind: query.Int},
+	},
+	Key:         "u.id",
+	DefaultSort: "name",
+}
 
-	rows, err := friendService.db.Query(
-		context.Background(),
-		"SELECT user_id, friend_id, created_at::text FROM friends WHERE user_id = $1 OR friend_id = $1",
+// Retrieves a page of the user profiles of everyone a given user is friends with
+func (friendService *Service) ReadFriendUsers(ctx context.Context, userID string, params query.Params) (query.Page[users.User], error) {
+	sql, args := params.Apply(
+		`SELECT u.id, u.name, u.email, u.location_id, u.profile_picture FROM friends f
+		 JOIN users u ON u.id = CASE WHEN f.user_id = $1 THEN f.friend_id ELSE f.user_id END
+		  AND (f.user_id = $1 OR f.friend_id = $1) AND f.status = 'accepted'`,
 		userID,
 	)
+	rows, err := friendService.db.Query(ctx, sql, args...)
+	if err != nil {
+		return query.Page[users.User]{}, err
+	}
+	defer rows.Close()
+
+	var friendUsers []users.User
+	for rows.Next() {
+		var user users.User
+		if err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.LocationID, &user.ProfilePicture); err != nil {
+			return query.Page[users.User]{}, err
+		}
+		friendUsers = append(friendUsers, user)
+	}
+	if err := rows.Err(); err != nil {
+		return query.Page[users.User]{}, err
+	}
+
+	return query.NewPage(params, friendUsers, func(user users.User, sort string) (int, interface{}) {
+		if sort == "email" {
+			return user.ID, user.Email
+		}
+		return user.ID, user.Name
+	}), nil
+}
+
+// Retrieves the users who are friends with both userID and otherID
+func (friendService *Service) ReadMutualFriends(ctx context.Context, userID string, otherID string) ([]users.User, error) {
+	rows, err := friendService.db.Query(
+		ctx,
+		`WITH mine AS (`+acceptedFriendIDs+`),
+		      theirs AS (
+		          SELECT CASE WHEN user_id = $2 THEN friend_id ELSE user_id END AS id
+		          FROM friends WHERE (user_id = $2 OR friend_id = $2) AND status = 'accepted')
+		 SELECT u.id, u.name, u.email, u.location_id, u.profile_picture FROM users u
+		 WHERE u.id IN (SELECT id FROM mine INTERSECT SELECT id FROM theirs)
+		 ORDER BY u.name`,
+		userID, otherID,
+	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var friends []Friend
+	var mutualFriends []users.User
 	for rows.Next() {
-		var friend Friend
-		if err := rows.Scan(&friend.UserID, &friend.FriendID, &friend.CreatedAt); err != nil {
+		var user users.User
+		if err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.LocationID, &user.ProfilePicture); err != nil {
 			return nil, err
 		}
-		friends = append(friends, friend)
+		mutualFriends = append(mutualFriends, user)
 	}
 
-	return friends, nil
+	return mutualFriends, rows.Err()
 }
 
-func (friendService *Service) ReadByFriendID(friendID string) ([]Friend, error) {
-	friendService.Lock()
-	defer friendService.Unlock()
-
+// Ranks friends of a user's friends by how many friends they share and how many activities they
+// have both accepted. Anyone the user already has a relationship with, including pending
+// requests and blocks in either direction, is left out.
+func (friendService *Service) ReadSuggestions(ctx context.Context, userID string, limit int) ([]Suggestion, error) {
 	rows, err := friendService.db.Query(
-		context.Background(),
-		"SELECT user_id, friend_id, created_at::text FROM friends WHERE friend_id = $1",
-		friendID,
+		ctx,
+		`WITH mine AS (`+acceptedFriendIDs+`),
+		      candidates AS (
+		          SELECT CASE WHEN f.user_id = mine.id THEN f.friend_id ELSE f.user_id END AS id,
+		                 COUNT(DISTINCT mine.id) AS mutual_friends
+		          FROM mine
+		          JOIN friends f ON (f.user_id = mine.id OR f.friend_id = mine.id) AND f.status = 'accepted'
+		          GROUP BY 1)
+		 SELECT u.id, u.name, u.email, u.location_id, u.profile_picture, c.mutual_friends,
+		        (SELECT COUNT(DISTINCT mine_ap.scheduled_activity_id)
+		         FROM activity_participants mine_ap
+		         JOIN activity_participants theirs_ap ON theirs_ap.scheduled_activity_id = mine_ap.scheduled_activity_id
+		         WHERE mine_ap.user_id = $1 AND theirs_ap.user_id = c.id
+		           AND mine_ap.invite_status = 'Accepted' AND theirs_ap.invite_status = 'Accepted') AS shared_activities
+		 FROM candidates c
+		 JOIN users u ON u.id = c.id
+		 WHERE c.id <> $1
+		   AND NOT EXISTS (
+		       SELECT 1 FROM friends f
+		       WHERE f.user_ordered_id1 = LEAST($1::int, c.id) AND f.user_ordered_id2 = GREATEST($1::int, c.id))
+		 ORDER BY c.mutual_friends DESC, shared_activities DESC, u.id
+		 LIMIT $2`,
+		userID, limit,
 	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var friends []Friend
+	var suggestions []Suggestion
 	for rows.Next() {
-		var friend Friend
-		if err := rows.Scan(&friend.UserID, &friend.FriendID, &friend.CreatedAt); err != nil {
+		var suggestion Suggestion
+		user := &suggestion.User
+		if err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.LocationID, &user.ProfilePicture, &suggestion.MutualFriends, &suggestion.SharedActivities); err != nil {
 			return nil, err
 		}
-		friends = append(friends, friend)
+		suggestions = append(suggestions, suggestion)
 	}
 
-	return friends, nil
+	return suggestions, rows.Err()
 }
 
-// Checks if two users are friends
-func (friendService *Service) UsersAreFriends(userID string, friendID string) (bool, error) {
-	friendService.Lock()
-	defer friendService.Unlock()
+// Retrieves a page of the friendships of a given user
+func (friendService *Service) ReadByUserID(ctx context.Context, userID string, params query.Params) (query.Page[Friend], error) {
+	return friendService.readPage(ctx, userID, params, "(user_id = $1 OR friend_id = $1) AND status = 'accepted'")
+}
+
+// listSpec are the fields a user's friendships and friend requests can be listed by. other_id is
+// the user on the other side, which is unique among the rows of one user.
+var listSpec = query.Spec{
+	Fields: map[string]query.Field{
+		"other_id":   {Column: "other_id", Kind: query.Int},
+		"created_at": {Column: "created_at", Kind: query.Time},
+	},
+	Key: "other_id",
+}
+
+// readPage reads a page of the friends rows of the user in $1 that match condition
+func (friendService *Service) readPage(ctx context.Context, userID string, params query.Params, condition string) (query.Page[Friend], error) {
+	sql, args := params.Apply(
+		`SELECT user_id, friend_id, status, created_at::text, responded_at::text FROM (
+		     SELECT *, CASE WHEN user_id = $1 THEN friend_id ELSE user_id END AS other_id FROM friends
+		     WHERE `+condition+`
+		 ) friends`,
+		userID,
+	)
+	rows, err := friendService.db.Query(ctx, sql, args...)
+	if err != nil {
+		return query.Page[Friend]{}, err
+	}
+	defer rows.Close()
+
+	friends, err := scanFriends(rows)
+	if err != nil {
+		return query.Page[Friend]{}, err
+	}
+
+	return query.NewPage(params, friends, func(friend Friend, sort string) (int, interface{}) {
+		if strconv.Itoa(friend.UserID) == userID {
+			return friend.FriendID, nil
+		}
+		return friend.UserID, nil
+	}), nil
+}
+
+func (friendService *Service) ReadByFriendID(ctx context.Context, friendID string) ([]Friend, error) {
+	rows, err := friendService.db.Query(
+		ctx,
+		`SELECT user_id, friend_id, status, created_at::text, responded_at::text FROM friends
+		 WHERE (friend_id = $1 OR user_id = $1) AND status = 'accepted'`,
+		friendID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanFriends(rows)
+}
 
+// Checks if two users are friends
+func (friendService *Service) UsersAreFriends(ctx context.Context, userID string, friendID string) (bool, error) {
 	var exists bool
 	err := friendService.db.QueryRow(
-		context.Background(),
-		"SELECT EXISTS(SELECT 1 FROM friends WHERE user_id = $1 AND friend_id = $2)",
+		ctx,
+		`SELECT EXISTS(
+		     SELECT 1 FROM friends
+		     WHERE user_ordered_id1 = LEAST($1::int, $2::int) AND user_ordered_id2 = GREATEST($1::int, $2::int)
+		       AND status = 'accepted')`,
 		userID, friendID,
 	).Scan(&exists)
 	if err != nil {
@@ -145,3 +508,39 @@ func (friendService *Service) UsersAreFriends(userID string, friendID string) (b
 
 	return exists, nil
 }
+
+// LockPair takes a transaction advisory lock on the pair of users, which Block holds while it
+// places a block. Code that checks for a block before adding one user next to the other takes it
+// too, so that a block is either seen by the check or placed after the addition; there may be no
+// friends row to lock yet.
+func LockPair(ctx context.Context, tx pgx.Tx, userID string, otherID string) error {
+	_, err := tx.Exec(
+		ctx,
+		`SELECT pg_advisory_xact_lock($1, hashtext(LEAST($2::int, $3::int) || ':' || GREATEST($2::int, $3::int)))`,
+		pairLockClass, userID, otherID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to lock users: %v", err)
+	}
+
+	return nil
+}
+
+func scanFriend(row pgx.Row) (Friend, error) {
+	var friend Friend
+	err := row.Scan(&friend.UserID, &friend.FriendID, &friend.Status, &friend.CreatedAt, &friend.RespondedAt)
+	return friend, err
+}
+
+func scanFriends(rows pgx.Rows) ([]Friend, error) {
+	var friends []Friend
+	for rows.Next() {
+		friend, err := scanFriend(rows)
+		if err != nil {
+			return nil, err
+		}
+		friends = append(friends, friend)
+	}
+
+	return friends, rows.Err()
+}
@@ -1,7 +1,10 @@
 package locations
 
 import (
+	"context"
 	"encoding/json"
+	"friendsocial/auth"
+	"friendsocial/query"
 	"net/http"
 	"strconv"
 	"strings"
@@ -9,11 +12,12 @@ import (
 
 // LocationService defines the service interface for handling Locations
 type LocationService interface {
-	Create(location Location) (Location, error)
-	ReadAll() ([]Location, error)
-	Read(ids []int) ([]Location, error)
-	Update(id string, location Location) (Location, bool, error)
-	Delete(id string) (bool, error)
+	Create(ctx context.Context, location Location) (Location, error)
+	ReadAll(ctx context.Context, params query.Params) (query.Page[Location], error)
+	Read(ctx context.Context, ids []int) ([]Location, error)
+	Update(ctx context.Context, id string, location Location) (Location, bool, error)
+	Delete(ctx context.Context, id string) (bool, error)
+	CanEdit(ctx context.Context, id string, userID int) (bool, error)
 }
 
 // LocationError represents the error response structure
@@ -54,7 +58,11 @@ func (aH *LocationHTTPHandler) HandleHTTPPost(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	newLocation, err := aH.locationService.Create(location)
+	// The caller creates it, whatever the body says
+	callerID, _ := auth.CallerID(r.Context())
+	location.CreatedBy = &callerID
+
+	newLocation, err := aH.locationService.Create(r.Context(), location)
 	if err != nil {
 		aH.errorResponse(w, http.StatusInternalServerError, err.Error())
 		return
@@ -72,21 +80,30 @@ func (aH *LocationHTTPHandler) HandleHTTPPost(w http.ResponseWriter, r *http.Req
 // HandleHTTPGet handles retrieving all Locations
 //
 //	@Summary		Get all Locations
-//	@Description	Get all Locations
+//	@Description	Get all Locations. Filter with id, name, city, state, zip_code and country, e.g. ?city=Halifax
 //	@Tags			locations
 //	@Accept			json
 //	@Produce		json
-//	@Success		200	{array}		Location
-//	@Failure		400	{object}	LocationError
-//	@Failure		500	{object}	LocationError
+//	@Param			limit	query		int		false	"Items per page, defaults to 50, at most 200"
+//	@Param			cursor	query		string	false	"next_cursor of the previous page"
+//	@Param			sort	query		string	false	"Field to sort by, prefixed with - for descending: id, name, city, country"
+//	@Success		200		{object}	query.Page[Location]
+//	@Failure		400		{object}	LocationError
+//	@Failure		500		{object}	LocationError
 //	@Router			/locations [get]
 func (aH *LocationHTTPHandler) HandleHTTPGet(w http.ResponseWriter, r *http.Request) {
-	locations, err := aH.locationService.ReadAll()
+	params, err := query.Parse(r.URL.RawQuery, listSpec)
 	if err != nil {
 		aH.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
+	locations, err := aH.locationService.ReadAll(r.Context(), params)
+	if err != nil {
+		aH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(locations)
 	if err != nil {
@@ -121,7 +138,7 @@ func (aH *LocationHTTPHandler) HandleHTTPGetWithID(w http.ResponseWriter, r *htt
 		}
 		intIDs = append(intIDs, intID)
 	}
-	locations, err := aH.locationService.Read(intIDs)
+	locations, err := aH.locationService.Read(r.Context(), intIDs)
 	if err != nil {
 		aH.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -151,6 +168,7 @@ func (aH *LocationHTTPHandler) HandleHTTPGetWithID(w http.ResponseWriter, r *htt
 //	@Param			location	body		Location	true	"Updated Location data"
 //	@Success		200			{object}	Location
 //	@Failure		400			{object}	LocationError
+//	@Failure		403			{object}	LocationError
 //	@Failure		404			{object}	LocationError
 //	@Failure		500			{object}	LocationError
 //	@Router			/location/{id} [put]
@@ -164,7 +182,7 @@ func (aH *LocationHTTPHandler) HandleHTTPPut(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	location, found, err := aH.locationService.Update(id, updatedLocation)
+	location, found, err := aH.locationService.Update(r.Context(), id, updatedLocation)
 	if err != nil {
 		aH.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -191,13 +209,14 @@ func (aH *LocationHTTPHandler) HandleHTTPPut(w http.ResponseWriter, r *http.Requ
 //	@Param			id	path	string	true	"Location ID"
 //	@Success		204	"No Content"
 //	@Failure		400	{object}	LocationError
+//	@Failure		403	{object}	LocationError
 //	@Failure		404	{object}	LocationError
 //	@Failure		500	{object}	LocationError
 //	@Router			/location/{id} [delete]
 func (aH *LocationHTTPHandler) HandleHTTPDelete(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 
-	found, err := aH.locationService.Delete(id)
+	found, err := aH.locationService.Delete(r.Context(), id)
 	if err != nil {
 		aH.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -211,6 +230,28 @@ func (aH *LocationHTTPHandler) HandleHTTPDelete(w http.ResponseWriter, r *http.R
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// RegisterRoutes adds the location routes to mux
+func (aH *LocationHTTPHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("POST /location", aH.HandleHTTPPost)
+	mux.HandleFunc("GET /locations", aH.HandleHTTPGet)
+	mux.HandleFunc("GET /locations/{ids}", aH.HandleHTTPGetWithID)
+	mux.HandleFunc("PUT /location/{id}", aH.HandleHTTPPut)
+	mux.HandleFunc("DELETE /location/{id}", aH.HandleHTTPDelete)
+}
+
+// AuthorizationRules returns the ownership rules for location routes
+func (aH *LocationHTTPHandler) AuthorizationRules() map[string]auth.Rule {
+	return map[string]auth.Rule{
+		"PUT /location/{id}":    aH.canEdit,
+		"DELETE /location/{id}": aH.canEdit,
+	}
+}
+
+// canEdit allows only the creator of the location in the path
+func (aH *LocationHTTPHandler) canEdit(r *http.Request, callerID int) (bool, error) {
+	return aH.locationService.CanEdit(r.Context(), r.PathValue("id"), callerID)
+}
+
 // errorResponse sends an error response with the specified status code and message
 func (aH *LocationHTTPHandler) errorResponse(w http.ResponseWriter, statusCode int, errorString string) {
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,184 @@
+package locations
+
+import (
+	"context"
+	"errors"
+	"friendsocial/query"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeLocationService keeps locations in memory
+type fakeLocationService struct {
+	locations map[int]Location
+	nextID    int
+	params    query.Params // of the last ReadAll
+}
+
+func newFakeLocationService() *fakeLocationService {
+	return &fakeLocationService{locations: make(map[int]Location), nextID: 1}
+}
+
+func (f *fakeLocationService) Create(ctx context.Context, location Location) (Location, error) {
+	if location.Name == "" {
+		return Location{}, errors.New("name is required")
+	}
+	location.ID = f.nextID
+	f.nextID++
+	f.locations[location.ID] = location
+	return location, nil
+}
+
+func (f *fakeLocationService) ReadAll(ctx context.Context, params query.Params) (query.Page[Location], error) {
+	f.params = params
+	var items []Location
+	for _, location := range f.locations {
+		items = append(items, location)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+	return query.NewPage(params, items, func(item Location, sort string) (int, interface{}) {
+		return item.ID, item.Name
+	}), nil
+}
+
+func (f *fakeLocationService) Read(ctx context.Context, ids []int) ([]Location, error) {
+	var found []Location
+	for _, id := range ids {
+		if location, ok := f.locations[id]; ok {
+			found = append(found, location)
+		}
+	}
+	return found, nil
+}
+
+func (f *fakeLocationService) Update(ctx context.Context, id string, location Location) (Location, bool, error) {
+	intID, err := strconv.Atoi(id)
+	if err != nil {
+		return Location{}, false, err
+	}
+	if _, ok := f.locations[intID]; !ok {
+		return Location{}, false, nil
+	}
+	location.ID = intID
+	f.locations[intID] = location
+	return location, true, nil
+}
+
+func (f *fakeLocationService) Delete(ctx context.Context, id string) (bool, error) {
+	intID, err := strconv.Atoi(id)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := f.locations[intID]; !ok {
+		return false, nil
+	}
+	delete(f.locations, intID)
+	return true, nil
+}
+
+func (f *fakeLocationService) CanEdit(ctx context.Context, id string, userID int) (bool, error) {
+	intID, err := strconv.Atoi(id)
+	if err != nil {
+		return false, err
+	}
+	location, ok := f.locations[intID]
+	return !ok || (location.CreatedBy != nil && *location.CreatedBy == userID), nil
+}
+
+func TestLocationHTTPHandler(t *testing.T) {
+	service := newFakeLocationService()
+	mux := http.NewServeMux()
+	NewLocationHTTPHandler(service).RegisterRoutes(mux)
+
+	// The requests run in order against the same service
+	tests := []struct {
+		method     string
+		target     string
+		body       string
+		wantStatus int
+		wantBody   string // a part of the response body
+	}{
+		{"POST", "/location", `{"name": "Central Park", "city": "New York"}`, http.StatusCreated, `"id":1`},
+		{"POST", "/location", `{"name": "Point Pleasant", "city": "Halifax"}`, http.StatusCreated, `"id":2`},
+		{"POST", "/location", `{"name": `, http.StatusBadRequest, `"status_code":400`},
+		{"POST", "/location", `{"city": "Nowhere"}`, http.StatusInternalServerError, `"error":"name is required"`},
+		{"GET", "/locations/1", "", http.StatusOK, `"name":"Central Park"`},
+		{"GET", "/locations/1,2", "", http.StatusOK, `"city":"Halifax"`},
+		{"GET", "/locations/3", "", http.StatusNotFound, `"error":"Not Found"`},
+		{"GET", "/locations/one", "", http.StatusBadRequest, `"error":"Invalid ID format"`},
+		{"GET", "/locations?limit=1", "", http.StatusOK, `"next_cursor":"`},
+		{"GET", "/locations?sort=-name", "", http.StatusOK, `"next_cursor":null`},
+		{"GET", "/locations?sort=zip_code", "", http.StatusBadRequest, `cannot sort by`},
+		{"GET", "/locations?elevation>=100", "", http.StatusBadRequest, `unknown field`},
+		{"PUT", "/location/2", `{"name": "Point Pleasant Park", "city": "Halifax"}`, http.StatusOK, `"name":"Point Pleasant Park"`},
+		{"PUT", "/location/9", `{"name": "Somewhere"}`, http.StatusNotFound, `"status_code":404`},
+		{"PUT", "/location/2", `[]`, http.StatusBadRequest, `"status_code":400`},
+		{"DELETE", "/location/1", "", http.StatusNoContent, ""},
+		{"DELETE", "/location/1", "", http.StatusNotFound, `"status_code":404`},
+		{"GET", "/locations/1", "", http.StatusNotFound, `"status_code":404`},
+		{"PATCH", "/location/2", `{}`, http.StatusMethodNotAllowed, ""},
+	}
+	for _, tt := range tests {
+		request := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+
+		if recorder.Code != tt.wantStatus {
+			t.Errorf("%s %s: status %d, want %d: %s", tt.method, tt.target, recorder.Code, tt.wantStatus, recorder.Body)
+		}
+		if !strings.Contains(recorder.Body.String(), tt.wantBody) {
+			t.Errorf("%s %s: body %s does not contain %s", tt.method, tt.target, recorder.Body, tt.wantBody)
+		}
+		if tt.wantBody != "" && recorder.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s: Content-Type %q", tt.method, tt.target, recorder.Header().Get("Content-Type"))
+		}
+	}
+
+	// The list parameters reach the service parsed
+	request := httptest.NewRequest("GET", "/locations?limit=5&sort=-city&country=Canada", nil)
+	mux.ServeHTTP(httptest.NewRecorder(), request)
+	if service.params.Limit != 5 || service.params.Sort != "city" || !service.params.Desc || len(service.params.Filters) != 1 {
+		t.Errorf("service got params %+v", service.params)
+	}
+}
+
+func TestLocationCanEdit(t *testing.T) {
+	service := newFakeLocationService()
+	creator := 7
+	service.locations[1] = Location{ID: 1, Name: "Central Park", CreatedBy: &creator}
+	service.locations[2] = Location{ID: 2, Name: "Point Pleasant"}
+	handler := NewLocationHTTPHandler(service)
+	rules := handler.AuthorizationRules()
+
+	tests := []struct {
+		route    string
+		target   string
+		callerID int
+		want     bool
+	}{
+		{"PUT /location/{id}", "/location/1", 7, true},
+		{"PUT /location/{id}", "/location/1", 8, false},
+		{"DELETE /location/{id}", "/location/1", 8, false},
+		{"DELETE /location/{id}", "/location/2", 7, false}, // no known creator
+		{"PUT /location/{id}", "/location/9", 8, true},     // the handler answers 404
+	}
+	for _, tt := range tests {
+		rule, ok := rules[tt.route]
+		if !ok {
+			t.Fatalf("no rule for %s", tt.route)
+		}
+		request := httptest.NewRequest("PUT", tt.target, nil)
+		request.SetPathValue("id", strings.TrimPrefix(tt.target, "/location/"))
+		got, err := rule(request, tt.callerID)
+		if err != nil {
+			t.Errorf("%s %s: %v", tt.route, tt.target, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s %s by %d: allowed %v, want %v", tt.route, tt.target, tt.callerID, got, tt.want)
+		}
+	}
+}
@@ -2,9 +2,9 @@ package locations
 
 import (
 	"context"
-	"strconv"
-	"sync"
+	"friendsocial/query"
 
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/lib/pq"
 )
@@ -19,10 +19,11 @@ type Location struct {
 	Country   string   `json:"country"`
 	Latitude  *float64 `json:"latitude"`
 	Longitude *float64 `json:"longitude"`
+	// CreatedBy is the only user who may edit or delete the location. It is set on creation.
+	CreatedBy *int `json:"created_by"`
 }
 
 type Service struct {
-	sync.Mutex
 	db *pgxpool.Pool
 }
 
@@ -32,15 +33,12 @@ func NewService(db *pgxpool.Pool) *Service {
 	}
 }
 
-func (service *Service) Create(location Location) (Location, error) {
-	service.Lock()
-	defer service.Unlock()
-
+func (service *Service) Create(ctx context.Context, location Location) (Location, error) {
 	var id int
 	err := service.db.QueryRow(
-		context.Background(),
-		"INSERT INTO locations (name, address, city, state, zip_code, country, latitude, longitude) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id",
-		location.Name, location.Address, location.City, location.State, location.ZipCode, location.Country, location.Latitude, location.Longitude,
+		ctx,
+		"INSERT INTO locations (name, address, city, state, zip_code, country, latitude, longitude, created_by) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id",
+		location.Name, location.Address, location.City, location.State, location.ZipCode, location.Country, location.Latitude, location.Longitude, location.CreatedBy,
 	).Scan(&id)
 	if err != nil {
 		return Location{}, err
@@ -50,34 +48,53 @@ func (service *Service) Create(location Location) (Location, error) {
 	return location, nil
 }
 
-func (service *Service) ReadAll() ([]Location, error) {
-	service.Lock()
-	defer service.Unlock()
+// listSpec are the fields locations can be listed by
+var listSpec = query.Spec{
+	Fields: map[string]query.Field{
+		"id":       {Column: "id", Kind: query.Int},
+		"name":     {Column: "name", Kind: query.String, Sortable: true},
+		"city":     {Column: "city", Kind: query.String, Sortable: true},
+		"state":    {Column: "state", Kind: query.String},
+		"zip_code": {Column: "zip_code", Kind: query.String},
+		"country":  {Column: "country", Kind: query.String, Sortable: true},
+	},
+	Key: "id",
+}
 
-	rows, err := service.db.Query(context.Background(), "SELECT id, name, address, city, state, zip_code, country, latitude, longitude FROM locations")
+func (service *Service) ReadAll(ctx context.Context, params query.Params) (query.Page[Location], error) {
+	sql, args := params.Apply("SELECT id, name, address, city, state, zip_code, country, latitude, longitude, created_by FROM locations")
+	rows, err := service.db.Query(ctx, sql, args...)
 	if err != nil {
-		return nil, err
+		return query.Page[Location]{}, err
 	}
 	defer rows.Close()
 
 	var locations []Location
 	for rows.Next() {
 		var location Location
-		if err := rows.Scan(&location.ID, &location.Name, &location.Address, &location.City, &location.State, &location.ZipCode, &location.Country, &location.Latitude, &location.Longitude); err != nil {
-			return nil, err
+		if err := rows.Scan(&location.ID, &location.Name, &location.Address, &location.City, &location.State, &location.ZipCode, &location.Country, &location.Latitude, &location.Longitude, &location.CreatedBy); err != nil {
+			return query.Page[Location]{}, err
 		}
 		locations = append(locations, location)
 	}
+	if err := rows.Err(); err != nil {
+		return query.Page[Location]{}, err
+	}
 
-	return locations, nil
+	return query.NewPage(params, locations, func(location Location, sort string) (int, interface{}) {
+		switch sort {
+		case "city":
+			return location.ID, location.City
+		case "country":
+			return location.ID, location.Country
+		}
+		return location.ID, location.Name
+	}), nil
 }
 
-func (service *Service) Read(ids []int) ([]Location, error) {
-	service.Lock()
-	defer service.Unlock()
-
-	query := `SELECT id, name, address, city, state, zip_code, country, latitude, longitude FROM locations WHERE id = ANY($1)`
-	rows, err := service.db.Query(context.Background(), query, pq.Array(ids))
+func (service *Service) Read(ctx context.Context, ids []int) ([]Location, error) {
+	query := `SELECT id, name, address, city, state, zip_code, country, latitude, longitude, created_by FROM locations WHERE id = ANY($1)`
+	rows, err := service.db.Query(ctx, query, pq.Array(ids))
 	if err != nil {
 		return nil, err
 	}
@@ -86,7 +103,7 @@ func (service *Service) Read(ids []int) ([]Location, error) {
 	var locations []Location
 	for rows.Next() {
 		var location Location
-		if err := rows.Scan(&location.ID, &location.Name, &location.Address, &location.City, &location.State, &location.ZipCode, &location.Country, &location.Latitude, &location.Longitude); err != nil {
+		if err := rows.Scan(&location.ID, &location.Name, &location.Address, &location.City, &location.State, &location.ZipCode, &location.Country, &location.Latitude, &location.Longitude, &location.CreatedBy); err != nil {
 			return nil, err
 		}
 		locations = append(locations, location)
@@ -95,29 +112,23 @@ func (service *Service) Read(ids []int) ([]Location, error) {
 	return locations, nil
 }
 
-func (service *Service) Update(id string, location Location) (Location, bool, error) {
-	service.Lock()
-	defer service.Unlock()
-
-	cmdTag, err := service.db.Exec(context.Background(), "UPDATE locations SET name = $1, address = $2, city = $3, state = $4, zip_code = $5, country = $6, latitude = $7, longitude = $8 WHERE id = $9",
-		location.Name, location.Address, location.City, location.State, location.ZipCode, location.Country, location.Latitude, location.Longitude, id)
+func (service *Service) Update(ctx context.Context, id string, location Location) (Location, bool, error) {
+	// created_by is kept
+	err := service.db.QueryRow(ctx, "UPDATE locations SET name = $1, address = $2, city = $3, state = $4, zip_code = $5, country = $6, latitude = $7, longitude = $8 WHERE id = $9 RETURNING id, created_by",
+		location.Name, location.Address, location.City, location.State, location.ZipCode, location.Country, location.Latitude, location.Longitude, id,
+	).Scan(&location.ID, &location.CreatedBy)
 	if err != nil {
+		if err == pgx.ErrNoRows {
+			return Location{}, false, nil
+		}
 		return Location{}, false, err
 	}
 
-	if cmdTag.RowsAffected() == 0 {
-		return Location{}, false, nil
-	}
-
-	location.ID, _ = strconv.Atoi(id)
 	return location, true, nil
 }
 
-func (service *Service) Delete(id string) (bool, error) {
-	service.Lock()
-	defer service.Unlock()
-
-	cmdTag, err := service.db.Exec(context.Background(), "DELETE FROM locations WHERE id = $1", id)
+func (service *Service) Delete(ctx context.Context, id string) (bool, error) {
+	cmdTag, err := service.db.Exec(ctx, "DELETE FROM locations WHERE id = $1", id)
 	if err != nil {
 		return false, err
 	}
@@ -128,3 +139,18 @@ func (service *Service) Delete(id string) (bool, error) {
 
 	return true, nil
 }
+
+// CanEdit reports whether a user may change a location, which only its creator may. Unknown IDs
+// report true so that callers can answer 404 rather than 403.
+func (service *Service) CanEdit(ctx context.Context, id string, userID int) (bool, error) {
+	var allowed bool
+	err := service.db.QueryRow(ctx,
+		`SELECT NOT EXISTS (SELECT 1 FROM locations WHERE id = $1)
+		     OR EXISTS (SELECT 1 FROM locations WHERE id = $1 AND created_by = $2)`,
+		id, userID).Scan(&allowed)
+	if err != nil {
+		return false, err
+	}
+
+	return allowed, nil
+}
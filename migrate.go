@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"friendsocial/config"
+	"friendsocial/migrations"
+	"friendsocial/postgres"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const migrateUsage = `usage: friendsocial migrate <command> [flags]
+
+commands:
+  up             apply every pending migration
+  down [n]       revert the last n applied migrations, 1 by default
+  status         list the migrations and when they were applied
+  baseline [n]   record migrations up to n, 1 by default, as applied without running them, for a
+                 database created from the old config/db_create.sql
+  create <name>  add empty up and down files to ` + migrations.SourceDir + `
+
+flags configure the database connection as they do for the server`
+
+// runMigrate runs the migrate subcommand. args follow "migrate" on the command line.
+func runMigrate(args []string) error {
+	// Positional arguments come first, flags after them
+	var positional []string
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		positional, args = append(positional, args[0]), args[1:]
+	}
+	if len(positional) == 0 {
+		return errors.New(migrateUsage)
+	}
+	command, positional := positional[0], positional[1:]
+
+	if command == "create" {
+		if len(positional) != 1 {
+			return errors.New("usage: friendsocial migrate create <name>")
+		}
+		paths, err := migrations.Create(migrations.SourceDir, positional[0])
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			fmt.Println("created", path)
+		}
+		return nil
+	}
+
+	n := 1
+	switch {
+	case command == "down" && len(positional) == 1:
+		parsed, err := strconv.Atoi(positional[0])
+		if err != nil || parsed < 1 {
+			return fmt.Errorf("down takes a number of migrations, not %q", positional[0])
+		}
+		n = parsed
+	case command == "baseline" && len(positional) == 1:
+		parsed, err := strconv.Atoi(positional[0])
+		if err != nil || parsed < 1 {
+			return fmt.Errorf("baseline takes a migration version, not %q", positional[0])
+		}
+		n = parsed
+	case command != "up" && command != "down" && command != "status" && command != "baseline":
+		return fmt.Errorf("unknown migrate command %q\n\n%s", command, migrateUsage)
+	case len(positional) > 0:
+		return fmt.Errorf("unexpected argument %q\n\n%s", positional[0], migrateUsage)
+	}
+
+	cfg, err := config.Load(args)
+	if err != nil {
+		return err
+	}
+	postgres.InitDB(cfg.Database)
+	defer postgres.CloseDB()
+
+	migrator, err := migrations.NewMigrator(postgres.DB)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	switch command {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, migration := range applied {
+			fmt.Println("applied", migration)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("no pending migrations")
+		}
+		return err
+	case "down":
+		reverted, err := migrator.Down(ctx, n)
+		for _, migration := range reverted {
+			fmt.Println("reverted", migration)
+		}
+		if err == nil && len(reverted) == 0 {
+			fmt.Println("no applied migrations")
+		}
+		return err
+	case "baseline":
+		recorded, err := migrator.Baseline(ctx, n)
+		for _, migration := range recorded {
+			fmt.Println("recorded", migration)
+		}
+		return err
+	default:
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "MIGRATION\tAPPLIED\tNOTE")
+		for _, status := range statuses {
+			appliedAt, note := "pending", ""
+			if status.AppliedAt != nil {
+				appliedAt = status.AppliedAt.Local().Format("2006-01-02 15:04:05")
+			}
+			switch {
+			case status.Modified:
+				note = "modified after it was applied"
+			case status.Unknown:
+				note = "applied by a newer version"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", status.Migration, appliedAt, note)
+		}
+		return w.Flush()
+	}
+}
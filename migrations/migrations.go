@@ -0,0 +1,461 @@
+// Package migrations keeps the database schema up to date. Migrations are numbered SQL files in
+// sql/, embedded in the binary: 0002_add_groups.up.sql applies a change and 0002_add_groups.down.sql
+// reverts it. Applied migrations are recorded in schema_migrations with a checksum of their up
+// file, so a migration that was edited after it ran is reported instead of silently diverging.
+package migrations
+
+import (
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// SourceDir is where migration files live, relative to the repository root
+const SourceDir = "migrations/sql"
+
+// migrateLockKey is the Postgres advisory lock that keeps concurrent deploys from migrating at
+// the same time
+const migrateLockKey int64 = 0x66736d6967 // "fsmig"
+
+//go:embed sql/*.sql
+var files embed.FS
+
+var (
+	// ErrModified is returned when an applied migration no longer matches its file
+	ErrModified = errors.New("migration was modified after it was applied")
+	// ErrIrreversible is returned when rolling back a migration that has no down file
+	ErrIrreversible = errors.New("migration has no down file")
+	// ErrBaselined is returned when baselining a database that already records migrations
+	ErrBaselined = errors.New("database already records applied migrations, baseline only applies to unmigrated databases")
+)
+
+var filePattern = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// Migration is a schema change
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string // empty when the migration cannot be reverted
+	Checksum string // SHA-256 of Up
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+// Status is a migration and whether it has been applied. Migrations that were applied by a newer
+// binary have no Up or Down.
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+	Modified  bool // the applied checksum differs from the file's
+	Unknown   bool // applied, but this binary has no file for it
+}
+
+// Migrator applies the embedded migrations to a database
+type Migrator struct {
+	db         *pgxpool.Pool
+	migrations []Migration
+}
+
+// NewMigrator creates a Migrator for the migrations embedded in the binary
+func NewMigrator(db *pgxpool.Pool) (*Migrator, error) {
+	embedded, err := fs.Sub(files, "sql")
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := Load(embedded)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{
+		db:         db,
+		migrations: migrations,
+	}, nil
+}
+
+// Load reads the migration files at the root of fsys, ordered by version
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := filePattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migration file %s is not named like 0001_name.up.sql", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		contents, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		}
+		if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names, %s and %s", version, migration.Name, match[2])
+		}
+		if match[3] == "up" {
+			migration.Up = string(contents)
+			migration.Checksum = checksum(contents)
+		} else {
+			migration.Down = string(contents)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, fmt.Errorf("migration %s has no up file", migration)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+func checksum(contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return hex.EncodeToString(sum[:])
+}
+
+// applied is a row of schema_migrations
+type applied struct {
+	version   int
+	name      string
+	checksum  string
+	appliedAt time.Time
+}
+
+// Up applies every pending migration in order, each in its own transaction, and returns the
+// migrations it applied. It refuses to run when an applied migration was modified.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var done []Migration
+	err := m.locked(ctx, func(conn *pgxpool.Conn) error {
+		statuses, err := m.status(ctx, conn)
+		if err != nil {
+			return err
+		}
+		pending, err := planUp(statuses)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range pending {
+			if err := m.apply(ctx, conn, migration); err != nil {
+				return err
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down reverts the last steps applied migrations, newest first, and returns them. Nothing is
+// reverted when one of them cannot be.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var done []Migration
+	err := m.locked(ctx, func(conn *pgxpool.Conn) error {
+		statuses, err := m.status(ctx, conn)
+		if err != nil {
+			return err
+		}
+		reverting, err := planDown(statuses, steps)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range reverting {
+			if err := m.revert(ctx, conn, migration); err != nil {
+				return err
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Baseline records the migrations up to and including version as applied without running them,
+// for a database whose schema was created before it was migrated, e.g. from the old
+// config/db_create.sql, which matches version 1. It refuses to run once migrations are recorded.
+func (m *Migrator) Baseline(ctx context.Context, version int) ([]Migration, error) {
+	var done []Migration
+	err := m.locked(ctx, func(conn *pgxpool.Conn) error {
+		statuses, err := m.status(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			if status.AppliedAt != nil {
+				return ErrBaselined
+			}
+		}
+		if !slices.ContainsFunc(m.migrations, func(migration Migration) bool { return migration.Version == version }) {
+			return fmt.Errorf("there is no migration %d", version)
+		}
+
+		return inTx(ctx, conn, func(tx pgx.Tx) error {
+			for _, migration := range m.migrations {
+				if migration.Version > version {
+					break
+				}
+				_, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)",
+					migration.Version, migration.Name, migration.Checksum)
+				if err != nil {
+					return fmt.Errorf("failed to record %s: %v", migration, err)
+				}
+				done = append(done, migration)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return done, nil
+}
+
+// Status lists every migration, embedded or applied, ordered by version
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var statuses []Status
+	err := m.locked(ctx, func(conn *pgxpool.Conn) error {
+		var err error
+		statuses, err = m.status(ctx, conn)
+		return err
+	})
+	return statuses, err
+}
+
+// Pending returns the migrations that have not been applied yet, without waiting for the lock
+func (m *Migrator) Pending(ctx context.Context) ([]Migration, error) {
+	conn, err := m.db.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire connection: %v", err)
+	}
+	defer conn.Release()
+
+	var exists bool
+	if err := conn.QueryRow(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %v", err)
+	}
+	if !exists {
+		return m.migrations, nil
+	}
+
+	statuses, err := m.status(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, status := range statuses {
+		if status.AppliedAt == nil {
+			pending = append(pending, status.Migration)
+		}
+	}
+	return pending, nil
+}
+
+// locked runs fn on a connection holding the migration lock, waiting for other deploys to finish
+// migrating first
+func (m *Migrator) locked(ctx context.Context, fn func(conn *pgxpool.Conn) error) error {
+	conn, err := m.db.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %v", err)
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrateLockKey); err != nil {
+		return fmt.Errorf("failed to take migration lock: %v", err)
+	}
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", migrateLockKey)
+
+	_, err = conn.Exec(ctx,
+		`CREATE TABLE IF NOT EXISTS schema_migrations (
+		     version INTEGER PRIMARY KEY,
+		     name VARCHAR(255) NOT NULL,
+		     checksum CHAR(64) NOT NULL, -- SHA-256 of the up file
+		     applied_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+		 )`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %v", err)
+	}
+
+	return fn(conn)
+}
+
+func (m *Migrator) status(ctx context.Context, conn *pgxpool.Conn) ([]Status, error) {
+	rows, err := conn.Query(ctx, "SELECT version, name, checksum, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %v", err)
+	}
+	defer rows.Close()
+
+	appliedByVersion := make(map[int]applied)
+	for rows.Next() {
+		var a applied
+		if err := rows.Scan(&a.version, &a.name, &a.checksum, &a.appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan schema_migrations: %v", err)
+		}
+		appliedByVersion[a.version] = a
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %v", err)
+	}
+
+	return merge(m.migrations, appliedByVersion), nil
+}
+
+// merge pairs the embedded migrations with the applied ones. appliedByVersion is consumed.
+func merge(migrations []Migration, appliedByVersion map[int]applied) []Status {
+	statuses := make([]Status, 0, len(migrations))
+	for _, migration := range migrations {
+		status := Status{Migration: migration}
+		if a, ok := appliedByVersion[migration.Version]; ok {
+			appliedAt := a.appliedAt
+			status.AppliedAt = &appliedAt
+			status.Modified = a.checksum != migration.Checksum
+			delete(appliedByVersion, migration.Version)
+		}
+		statuses = append(statuses, status)
+	}
+	for _, a := range appliedByVersion {
+		appliedAt := a.appliedAt
+		statuses = append(statuses, Status{
+			Migration: Migration{Version: a.version, Name: a.name, Checksum: a.checksum},
+			AppliedAt: &appliedAt,
+			Unknown:   true,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses
+}
+
+// planUp returns the migrations Up applies, or ErrModified if an applied one was edited
+func planUp(statuses []Status) ([]Migration, error) {
+	var pending []Migration
+	for _, status := range statuses {
+		if status.Modified {
+			return nil, fmt.Errorf("%s: %w", status.Migration, ErrModified)
+		}
+		if status.AppliedAt == nil {
+			pending = append(pending, status.Migration)
+		}
+	}
+	return pending, nil
+}
+
+// planDown returns the last steps applied migrations, newest first, or an error if one of them
+// cannot be reverted
+func planDown(statuses []Status, steps int) ([]Migration, error) {
+	var reverting []Migration
+	for i := len(statuses) - 1; i >= 0 && len(reverting) < steps; i-- {
+		status := statuses[i]
+		if status.AppliedAt == nil {
+			continue
+		}
+		if status.Unknown {
+			return nil, fmt.Errorf("%s was applied by a newer version and cannot be reverted by this one", status.Migration)
+		}
+		if status.Down == "" {
+			return nil, fmt.Errorf("%s: %w", status.Migration, ErrIrreversible)
+		}
+		reverting = append(reverting, status.Migration)
+	}
+	return reverting, nil
+}
+
+func (m *Migrator) apply(ctx context.Context, conn *pgxpool.Conn, migration Migration) error {
+	return inTx(ctx, conn, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, migration.Up); err != nil {
+			return fmt.Errorf("failed to apply %s: %v", migration, err)
+		}
+		_, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)",
+			migration.Version, migration.Name, migration.Checksum)
+		if err != nil {
+			return fmt.Errorf("failed to record %s: %v", migration, err)
+		}
+		return nil
+	})
+}
+
+func (m *Migrator) revert(ctx context.Context, conn *pgxpool.Conn, migration Migration) error {
+	return inTx(ctx, conn, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, migration.Down); err != nil {
+			return fmt.Errorf("failed to revert %s: %v", migration, err)
+		}
+		if _, err := tx.Exec(ctx, "DELETE FROM schema_migrations WHERE version = $1", migration.Version); err != nil {
+			return fmt.Errorf("failed to unrecord %s: %v", migration, err)
+		}
+		return nil
+	})
+}
+
+func inTx(ctx context.Context, conn *pgxpool.Conn, fn func(tx pgx.Tx) error) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Create writes empty up and down files for a new migration to dir, numbered after the highest
+// existing version, and returns their paths
+func Create(dir, name string) ([]string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	name = strings.Join(strings.FieldsFunc(name, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+	}), "_")
+	if name == "" {
+		return nil, errors.New("migration name is required")
+	}
+
+	existing, err := Load(os.DirFS(dir))
+	if err != nil {
+		return nil, err
+	}
+	version := 1
+	if len(existing) > 0 {
+		version = existing[len(existing)-1].Version + 1
+	}
+
+	var paths []string
+	for _, direction := range []string{"up", "down"} {
+		path := filepath.Join(dir, fmt.Sprintf("%04d_%s.%s.sql", version, name, direction))
+		contents := fmt.Sprintf("-- %s: %s\n", direction, strings.ReplaceAll(name, "_", " "))
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
@@ -0,0 +1,235 @@
+package migrations
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	fsys := fstest.MapFS{
+		"0010_add_tags.up.sql":     {Data: []byte("ALTER TABLE activities ADD tags TEXT;")},
+		"0002_users.up.sql":        {Data: []byte("CREATE TABLE users ();")},
+		"0002_users.down.sql":      {Data: []byte("DROP TABLE users;")},
+		"0001_init.up.sql":         {Data: []byte("CREATE TABLE locations ();")},
+		"0010_add_tags.down.sql":   {Data: []byte("ALTER TABLE activities DROP tags;")},
+		"0003_irreversible.up.sql": {Data: []byte("DELETE FROM users;")},
+	}
+
+	migrations, err := Load(fsys)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	want := []string{"0001_init", "0002_users", "0003_irreversible", "0010_add_tags"}
+	if len(migrations) != len(want) {
+		t.Fatalf("Load returned %v, want %v", migrations, want)
+	}
+	for i, migration := range migrations {
+		if migration.String() != want[i] {
+			t.Errorf("migration %d is %s, want %s", i, migration, want[i])
+		}
+		sum := sha256.Sum256(fsys[migration.String()+".up.sql"].Data)
+		if migration.Checksum != hex.EncodeToString(sum[:]) {
+			t.Errorf("%s: checksum %s is not the SHA-256 of its up file", migration, migration.Checksum)
+		}
+	}
+	if migrations[1].Down != "DROP TABLE users;" {
+		t.Errorf("0002_users down %q", migrations[1].Down)
+	}
+	if migrations[2].Down != "" {
+		t.Errorf("0003_irreversible down %q, want none", migrations[2].Down)
+	}
+}
+
+func TestLoadRejects(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  string // a part of the error
+	}{
+		{"badly named", []string{"0001_init.up.sql", "init.sql"}, "init.sql is not named"},
+		{"upper case", []string{"0001_Init.up.sql"}, "is not named"},
+		{"other direction", []string{"0001_init.sideways.sql"}, "is not named"},
+		{"two names", []string{"0001_init.up.sql", "0001_start.down.sql"}, "has two names"},
+		{"no up file", []string{"0001_init.up.sql", "0002_users.down.sql"}, "0002_users has no up file"},
+	}
+	for _, tt := range tests {
+		fsys := fstest.MapFS{}
+		for _, file := range tt.files {
+			fsys[file] = &fstest.MapFile{Data: []byte("SELECT 1;")}
+		}
+		if _, err := Load(fsys); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want one containing %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestEmbedded(t *testing.T) {
+	embedded, err := fs.Sub(files, "sql")
+	if err != nil {
+		t.Fatalf("fs.Sub: %v", err)
+	}
+	migrations, err := Load(embedded)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			t.Errorf("migration %s is numbered %d, want %d", migration, migration.Version, i+1)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	appliedAt := time.Date(2024, 9, 1, 12, 0, 0, 0, time.UTC)
+	migrations := []Migration{
+		{Version: 1, Name: "init", Up: "CREATE TABLE a ();", Checksum: checksum([]byte("CREATE TABLE a ();"))},
+		{Version: 2, Name: "users", Up: "CREATE TABLE b ();", Checksum: checksum([]byte("CREATE TABLE b ();"))},
+		{Version: 3, Name: "tags", Up: "CREATE TABLE c ();", Checksum: checksum([]byte("CREATE TABLE c ();"))},
+	}
+	appliedByVersion := map[int]applied{
+		1: {version: 1, name: "init", checksum: migrations[0].Checksum, appliedAt: appliedAt},
+		2: {version: 2, name: "users", checksum: checksum([]byte("CREATE TABLE users ();")), appliedAt: appliedAt},
+		5: {version: 5, name: "newer", checksum: "abc", appliedAt: appliedAt},
+	}
+
+	statuses := merge(migrations, appliedByVersion)
+	tests := []struct {
+		name         string
+		wantApplied  bool
+		wantModified bool
+		wantUnknown  bool
+	}{
+		{"0001_init", true, false, false},
+		{"0002_users", true, true, false},
+		{"0003_tags", false, false, false},
+		{"0005_newer", true, false, true},
+	}
+	if len(statuses) != len(tests) {
+		t.Fatalf("merge returned %d statuses, want %d", len(statuses), len(tests))
+	}
+	for i, tt := range tests {
+		status := statuses[i]
+		if status.String() != tt.name {
+			t.Errorf("status %d is %s, want %s", i, status, tt.name)
+		}
+		if (status.AppliedAt != nil) != tt.wantApplied || status.Modified != tt.wantModified || status.Unknown != tt.wantUnknown {
+			t.Errorf("%s: applied %v, modified %v, unknown %v, want %v, %v, %v", tt.name,
+				status.AppliedAt != nil, status.Modified, status.Unknown, tt.wantApplied, tt.wantModified, tt.wantUnknown)
+		}
+	}
+}
+
+func TestPlanUp(t *testing.T) {
+	appliedAt := time.Now()
+	statuses := []Status{
+		{Migration: Migration{Version: 1, Name: "init"}, AppliedAt: &appliedAt},
+		{Migration: Migration{Version: 2, Name: "users"}},
+		{Migration: Migration{Version: 3, Name: "tags"}},
+	}
+	pending, err := planUp(statuses)
+	if err != nil {
+		t.Fatalf("planUp: %v", err)
+	}
+	if len(pending) != 2 || pending[0].Version != 2 || pending[1].Version != 3 {
+		t.Errorf("planUp = %v, want 0002_users and 0003_tags", pending)
+	}
+
+	// Nothing is applied when an applied migration was edited since
+	statuses[0].Modified = true
+	if pending, err := planUp(statuses); !errors.Is(err, ErrModified) || pending != nil {
+		t.Errorf("planUp with a modified migration = %v, %v, want %v", pending, err, ErrModified)
+	}
+}
+
+func TestPlanDown(t *testing.T) {
+	appliedAt := time.Now()
+	status := func(version int, down string, applied bool) Status {
+		s := Status{Migration: Migration{Version: version, Name: "m", Down: down}}
+		if applied {
+			s.AppliedAt = &appliedAt
+		}
+		return s
+	}
+	unknown := status(4, "", true)
+	unknown.Unknown = true
+
+	tests := []struct {
+		name     string
+		statuses []Status
+		steps    int
+		want     []int  // versions, in order
+		wantErr  string // a part of the error
+	}{
+		{"newest first", []Status{status(1, "x", true), status(2, "x", true), status(3, "x", false)}, 1, []int{2}, ""},
+		{"several", []Status{status(1, "x", true), status(2, "x", true)}, 2, []int{2, 1}, ""},
+		{"more than applied", []Status{status(1, "x", true), status(2, "x", false)}, 5, []int{1}, ""},
+		{"nothing applied", []Status{status(1, "x", false)}, 1, nil, ""},
+		{"irreversible", []Status{status(1, "x", true), status(2, "", true)}, 2, nil, ErrIrreversible.Error()},
+		{"irreversible beyond steps", []Status{status(1, "", true), status(2, "x", true)}, 1, []int{2}, ""},
+		{"applied by a newer binary", []Status{status(3, "x", true), unknown}, 1, nil, "applied by a newer version"},
+	}
+	for _, tt := range tests {
+		got, err := planDown(tt.statuses, tt.steps)
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: error %v, want one containing %q", tt.name, err, tt.wantErr)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: planDown = %v, want versions %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i].Version != tt.want[i] {
+				t.Errorf("%s: planDown = %v, want versions %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	dir := t.TempDir()
+
+	paths, err := Create(dir, "  Add user Tags! ")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	want := []string{filepath.Join(dir, "0001_add_user_tags.up.sql"), filepath.Join(dir, "0001_add_user_tags.down.sql")}
+	if len(paths) != 2 || paths[0] != want[0] || paths[1] != want[1] {
+		t.Errorf("Create = %v, want %v", paths, want)
+	}
+
+	// The next one is numbered after the highest version, not the count
+	if err := os.WriteFile(filepath.Join(dir, "0007_later.up.sql"), []byte("SELECT 1;"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	paths, err = Create(dir, "drop-tags")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if filepath.Base(paths[0]) != "0008_drop_tags.up.sql" {
+		t.Errorf("Create = %v, want 0008_drop_tags", paths)
+	}
+
+	migrations, err := Load(os.DirFS(dir))
+	if err != nil {
+		t.Fatalf("Load of the created files: %v", err)
+	}
+	if len(migrations) != 3 {
+		t.Errorf("Load of the created files = %v", migrations)
+	}
+
+	if _, err := Create(dir, "!!!"); err == nil {
+		t.Errorf("Create accepted a name without letters or digits")
+	}
+}
@@ -0,0 +1,11 @@
+-- Drops everything 0001_initial_schema.up.sql creates
+
+DROP TABLE IF EXISTS activity_participants;
+DROP TABLE IF EXISTS user_activity_preferences_participants;
+DROP TABLE IF EXISTS user_availability;
+DROP TABLE IF EXISTS friends;
+DROP TABLE IF EXISTS scheduled_activities;
+DROP TABLE IF EXISTS user_activity_preferences;
+DROP TABLE IF EXISTS activities;
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS locations;
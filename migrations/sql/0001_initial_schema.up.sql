@@ -1,3 +1,7 @@
+-- Initial schema, as config/db_create.sql created it. Databases created from that file already
+-- have these tables: record this migration without running it with `migrate baseline`.
+-- user_activity_preferences is created before scheduled_activities, which references it.
+
 CREATE TABLE locations (
     id SERIAL PRIMARY KEY,
     name VARCHAR(100) NOT NULL,
@@ -36,6 +40,22 @@ CREATE TABLE activities (
     REFERENCES locations (id)
 );
 
+CREATE TABLE user_activity_preferences (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    activity_id INTEGER NOT NULL,
+    frequency INTEGER NOT NULL,
+    frequency_period VARCHAR(50) NOT NULL, -- e.g., 'daily', 'weekly', 'monthly'
+    days_of_week VARCHAR(50),
+    CONSTRAINT fk_user_id FOREIGN KEY (user_id)
+    REFERENCES users (id) ON DELETE CASCADE,
+    CONSTRAINT fk_activity_id FOREIGN KEY (activity_id)
+    REFERENCES activities (id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_user_activity_preferences_user_id ON user_activity_preferences (user_id); -- Index on user_id
+CREATE INDEX idx_user_activity_preferences_activity_id ON user_activity_preferences (activity_id); -- Index on activity_id
+
 CREATE TABLE scheduled_activities (
     id SERIAL PRIMARY KEY,
     activity_id INTEGER NOT NULL,
@@ -82,22 +102,6 @@ CREATE TABLE user_availability (
 
 CREATE INDEX idx_user_availability_user_id ON user_availability (user_id); -- Index on user_id
 
-CREATE TABLE user_activity_preferences (
-    id SERIAL PRIMARY KEY,
-    user_id INTEGER NOT NULL,
-    activity_id INTEGER NOT NULL,
-    frequency INTEGER NOT NULL,
-    frequency_period VARCHAR(50) NOT NULL, -- e.g., 'daily', 'weekly', 'monthly'
-    days_of_week VARCHAR(50),
-    CONSTRAINT fk_user_id FOREIGN KEY (user_id)
-    REFERENCES users (id) ON DELETE CASCADE,
-    CONSTRAINT fk_activity_id FOREIGN KEY (activity_id)
-    REFERENCES activities (id) ON DELETE CASCADE
-);
-
-CREATE INDEX idx_user_activity_preferences_user_id ON user_activity_preferences (user_id); -- Index on user_id
-CREATE INDEX idx_user_activity_preferences_activity_id ON user_activity_preferences (activity_id); -- Index on activity_id
-
 CREATE TABLE user_activity_preferences_participants (
     id SERIAL PRIMARY KEY,
     user_activity_preference_id INTEGER NOT NULL,
@@ -0,0 +1,16 @@
+-- Sessions for the auth service. users.password holds a bcrypt hash from now on; plaintext
+-- passwords are upgraded on the next login.
+
+CREATE TABLE user_sessions (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    refresh_token_hash CHAR(64) NOT NULL, -- SHA-256 of the refresh token, the token itself is never stored
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ,
+    CONSTRAINT fk_user_id FOREIGN KEY (user_id)
+    REFERENCES users (id) ON DELETE CASCADE,
+    CONSTRAINT uq_refresh_token_hash UNIQUE (refresh_token_hash)
+);
+
+CREATE INDEX idx_user_sessions_user_id ON user_sessions (user_id);
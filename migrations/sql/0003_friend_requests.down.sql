@@ -0,0 +1,9 @@
+-- Requests that were not accepted have no equivalent without a status
+DELETE FROM friends WHERE status <> 'accepted';
+
+DROP INDEX IF EXISTS idx_friends_friend_id_status;
+
+ALTER TABLE friends
+    DROP CONSTRAINT IF EXISTS chk_friend_status,
+    DROP COLUMN IF EXISTS responded_at,
+    DROP COLUMN IF EXISTS status;
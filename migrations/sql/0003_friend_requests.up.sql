@@ -0,0 +1,11 @@
+-- Friend requests. user_id is the user who sent the request, or who placed the block. Rows from
+-- before requests existed are friendships and become accepted.
+
+ALTER TABLE friends
+    ADD COLUMN status VARCHAR(20) NOT NULL DEFAULT 'accepted', -- 'pending', 'accepted', 'declined', 'blocked'
+    ADD COLUMN responded_at TIMESTAMP,
+    ADD CONSTRAINT chk_friend_status CHECK (status IN ('pending', 'accepted', 'declined', 'blocked'));
+
+ALTER TABLE friends ALTER COLUMN status SET DEFAULT 'pending';
+
+CREATE INDEX idx_friends_friend_id_status ON friends (friend_id, status); -- Incoming requests
@@ -0,0 +1,5 @@
+ALTER TABLE user_activity_preferences
+    DROP COLUMN IF EXISTS exdates,
+    DROP COLUMN IF EXISTS time_zone,
+    DROP COLUMN IF EXISTS dtstart,
+    DROP COLUMN IF EXISTS rrule;
@@ -0,0 +1,7 @@
+-- RFC 5545 recurrence rules on user activity preferences
+
+ALTER TABLE user_activity_preferences
+    ADD COLUMN rrule TEXT, -- RFC 5545 RRULE value, e.g. 'FREQ=WEEKLY;BYDAY=TU'
+    ADD COLUMN dtstart TIMESTAMP, -- wall-clock time of the first occurrence in time_zone
+    ADD COLUMN time_zone VARCHAR(64), -- IANA time zone, e.g. 'America/Halifax'
+    ADD COLUMN exdates TEXT[]; -- wall-clock occurrences to skip, same format as dtstart
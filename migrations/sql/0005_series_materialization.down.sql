@@ -0,0 +1,5 @@
+ALTER TABLE scheduled_activities
+    DROP CONSTRAINT IF EXISTS uq_scheduled_activities_preference_occurrence;
+
+ALTER TABLE user_activity_preferences
+    DROP COLUMN IF EXISTS materialized_until;
@@ -0,0 +1,7 @@
+-- Recurring series are materialized ahead of time by a background worker
+
+ALTER TABLE user_activity_preferences
+    ADD COLUMN materialized_until TIMESTAMPTZ; -- scheduled_activities exist for every occurrence before this
+
+ALTER TABLE scheduled_activities
+    ADD CONSTRAINT uq_scheduled_activities_preference_occurrence UNIQUE (user_activity_preference_id, scheduled_at); -- One row per series occurrence
@@ -0,0 +1,5 @@
+ALTER TABLE scheduled_activities
+    DROP CONSTRAINT IF EXISTS uq_scheduled_activities_preference_occurrence,
+    ADD CONSTRAINT uq_scheduled_activities_preference_occurrence UNIQUE (user_activity_preference_id, scheduled_at),
+    DROP COLUMN IF EXISTS is_exception,
+    DROP COLUMN IF EXISTS recurrence_id;
@@ -0,0 +1,12 @@
+-- Occurrences of a series remember the occurrence they were generated for, so that they can be
+-- moved and edited on their own. Existing occurrences have not been moved yet.
+
+ALTER TABLE scheduled_activities
+    ADD COLUMN recurrence_id TIMESTAMPTZ, -- the series occurrence this row was generated for (RFC 5545 RECURRENCE-ID)
+    ADD COLUMN is_exception BOOLEAN NOT NULL DEFAULT FALSE; -- edited on its own, kept when the series is regenerated
+
+UPDATE scheduled_activities SET recurrence_id = scheduled_at WHERE user_activity_preference_id IS NOT NULL;
+
+ALTER TABLE scheduled_activities
+    DROP CONSTRAINT uq_scheduled_activities_preference_occurrence,
+    ADD CONSTRAINT uq_scheduled_activities_preference_occurrence UNIQUE (user_activity_preference_id, recurrence_id); -- One row per series occurrence
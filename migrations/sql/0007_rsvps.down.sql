@@ -0,0 +1,4 @@
+ALTER TABLE activity_participants
+    DROP CONSTRAINT IF EXISTS chk_invite_status,
+    DROP COLUMN IF EXISTS responded_at,
+    DROP COLUMN IF EXISTS comment;
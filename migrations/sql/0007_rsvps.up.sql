@@ -0,0 +1,9 @@
+-- RSVPs: a comment and the time of the last answer on each invitation, and a fixed set of
+-- statuses. 'Rejected' was the old name of 'Declined'.
+
+UPDATE activity_participants SET invite_status = 'Declined' WHERE invite_status = 'Rejected';
+
+ALTER TABLE activity_participants
+    ADD COLUMN comment VARCHAR(500),
+    ADD COLUMN responded_at TIMESTAMPTZ, -- when the invitee last changed invite_status
+    ADD CONSTRAINT chk_invite_status CHECK (invite_status IN ('Pending', 'Accepted', 'Declined', 'Maybe', 'Tentative'));
@@ -0,0 +1,17 @@
+-- Waitlisted invitations go back to waiting for an answer
+UPDATE activity_participants SET invite_status = 'Pending' WHERE invite_status = 'Waitlisted';
+
+ALTER TABLE activity_participants
+    DROP CONSTRAINT IF EXISTS chk_invite_status,
+    ADD CONSTRAINT chk_invite_status CHECK (invite_status IN ('Pending', 'Accepted', 'Declined', 'Maybe', 'Tentative')),
+    DROP COLUMN IF EXISTS waitlisted_at;
+
+ALTER TABLE scheduled_activities
+    DROP CONSTRAINT IF EXISTS chk_scheduled_activities_capacity,
+    DROP COLUMN IF EXISTS max_participants,
+    DROP COLUMN IF EXISTS min_participants;
+
+ALTER TABLE activities
+    DROP CONSTRAINT IF EXISTS chk_activities_capacity,
+    DROP COLUMN IF EXISTS max_participants,
+    DROP COLUMN IF EXISTS min_participants;
@@ -0,0 +1,16 @@
+-- Participant limits, counted in accepted invitations, and a waitlist for full activities
+
+ALTER TABLE activities
+    ADD COLUMN min_participants INTEGER, -- default limits for its scheduled activities, counted in accepted invitations
+    ADD COLUMN max_participants INTEGER,
+    ADD CONSTRAINT chk_activities_capacity CHECK (min_participants >= 1 AND max_participants >= 1 AND min_participants <= max_participants);
+
+ALTER TABLE scheduled_activities
+    ADD COLUMN min_participants INTEGER, -- overrides the activity's limits; cancelled when not reached by the cutoff
+    ADD COLUMN max_participants INTEGER, -- further acceptances are waitlisted
+    ADD CONSTRAINT chk_scheduled_activities_capacity CHECK (min_participants >= 1 AND max_participants >= 1 AND min_participants <= max_participants);
+
+ALTER TABLE activity_participants
+    ADD COLUMN waitlisted_at TIMESTAMPTZ, -- position on the waitlist while invite_status is 'Waitlisted'
+    DROP CONSTRAINT chk_invite_status,
+    ADD CONSTRAINT chk_invite_status CHECK (invite_status IN ('Pending', 'Accepted', 'Waitlisted', 'Declined', 'Maybe', 'Tentative'));
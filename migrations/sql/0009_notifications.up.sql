@@ -0,0 +1,21 @@
+-- In-app notifications and the domain events that create them
+
+CREATE TABLE notifications (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL, -- the recipient
+    type VARCHAR(50) NOT NULL, -- e.g., 'friend_request', 'activity_invite', 'activity_cancelled'
+    actor_id INTEGER, -- the user whose action caused the notification
+    scheduled_activity_id INTEGER,
+    data JSONB,
+    read_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_notifications_user_id FOREIGN KEY (user_id)
+    REFERENCES users (id) ON DELETE CASCADE,
+    CONSTRAINT fk_notifications_actor_id FOREIGN KEY (actor_id)
+    REFERENCES users (id) ON DELETE SET NULL,
+    CONSTRAINT fk_notifications_scheduled_activity_id FOREIGN KEY (scheduled_activity_id)
+    REFERENCES scheduled_activities (id) ON DELETE SET NULL
+);
+
+CREATE INDEX idx_notifications_user_id ON notifications (user_id, id DESC);
+CREATE INDEX idx_notifications_user_id_unread ON notifications (user_id, id DESC) WHERE read_at IS NULL;
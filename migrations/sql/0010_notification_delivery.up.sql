@@ -0,0 +1,44 @@
+-- Push and email delivery of notifications
+
+CREATE TABLE user_devices (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    platform VARCHAR(10) NOT NULL, -- 'ios' (APNs) or 'android' (FCM)
+    token VARCHAR(4096) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP, -- when the app last registered the token
+    CONSTRAINT fk_user_devices_user_id FOREIGN KEY (user_id)
+    REFERENCES users (id) ON DELETE CASCADE,
+    CONSTRAINT uq_user_devices_platform_token UNIQUE (platform, token), -- A phone belongs to whoever signed in last
+    CONSTRAINT chk_user_devices_platform CHECK (platform IN ('ios', 'android'))
+);
+
+CREATE INDEX idx_user_devices_user_id ON user_devices (user_id);
+
+-- One row per device or email address a notification is sent to, doubling as the delivery log
+CREATE TABLE notification_deliveries (
+    id SERIAL PRIMARY KEY,
+    notification_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    channel VARCHAR(10) NOT NULL, -- 'ios', 'android' or 'email'
+    device_id INTEGER, -- cleared when the device is unregistered
+    target VARCHAR(4096) NOT NULL, -- device token or email address at the time of sending
+    provider VARCHAR(20), -- transport of the last attempt, e.g. 'apns', 'smtp', 'stub'
+    status VARCHAR(10) NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_error TEXT,
+    sent_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_notification_deliveries_notification_id FOREIGN KEY (notification_id)
+    REFERENCES notifications (id) ON DELETE CASCADE,
+    CONSTRAINT fk_notification_deliveries_user_id FOREIGN KEY (user_id)
+    REFERENCES users (id) ON DELETE CASCADE,
+    CONSTRAINT fk_notification_deliveries_device_id FOREIGN KEY (device_id)
+    REFERENCES user_devices (id) ON DELETE SET NULL,
+    CONSTRAINT chk_notification_deliveries_channel CHECK (channel IN ('ios', 'android', 'email')),
+    CONSTRAINT chk_notification_deliveries_status CHECK (status IN ('pending', 'sent', 'failed'))
+);
+
+CREATE INDEX idx_notification_deliveries_due ON notification_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX idx_notification_deliveries_notification_id ON notification_deliveries (notification_id);
@@ -0,0 +1,50 @@
+-- Signed webhook subscriptions, fed by a transactional outbox
+
+-- Transactional outbox: domain events written in the same transaction as the change they describe
+CREATE TABLE outbox_events (
+    id SERIAL PRIMARY KEY,
+    event_type VARCHAR(64) NOT NULL, -- e.g., 'scheduled_activity.created', 'activity_participant.status_changed'
+    payload JSONB NOT NULL,
+    audience INTEGER[] NOT NULL DEFAULT '{}', -- users whose webhooks may receive the event
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    dispatched_at TIMESTAMPTZ -- when the event was fanned out to webhook_deliveries
+);
+
+CREATE INDEX idx_outbox_events_undispatched ON outbox_events (id) WHERE dispatched_at IS NULL;
+
+CREATE TABLE webhook_subscriptions (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    url VARCHAR(2048) NOT NULL,
+    events TEXT[] NOT NULL, -- subscribed event types
+    secret VARCHAR(100) NOT NULL, -- HMAC-SHA256 signing key
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_webhook_subscriptions_user_id FOREIGN KEY (user_id)
+    REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_webhook_subscriptions_user_id ON webhook_subscriptions (user_id);
+
+CREATE TABLE webhook_deliveries (
+    id SERIAL PRIMARY KEY,
+    subscription_id INTEGER NOT NULL,
+    event_id INTEGER NOT NULL,
+    status VARCHAR(10) NOT NULL DEFAULT 'pending', -- 'dead' deliveries are the dead-letter queue
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_status_code INTEGER,
+    last_error TEXT,
+    delivered_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_webhook_deliveries_subscription_id FOREIGN KEY (subscription_id)
+    REFERENCES webhook_subscriptions (id) ON DELETE CASCADE,
+    CONSTRAINT fk_webhook_deliveries_event_id FOREIGN KEY (event_id)
+    REFERENCES outbox_events (id) ON DELETE CASCADE,
+    CONSTRAINT uq_webhook_deliveries_subscription_event UNIQUE (subscription_id, event_id),
+    CONSTRAINT chk_webhook_deliveries_status CHECK (status IN ('pending', 'delivered', 'dead'))
+);
+
+CREATE INDEX idx_webhook_deliveries_due ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX idx_webhook_deliveries_dead ON webhook_deliveries (subscription_id, updated_at DESC) WHERE status = 'dead';
@@ -0,0 +1,23 @@
+-- Reminders of upcoming activities
+
+CREATE TABLE reminder_preferences (
+    user_id INTEGER PRIMARY KEY,
+    offsets_minutes INTEGER[] NOT NULL, -- e.g. '{1440,60}' for a day and an hour before; empty turns reminders off
+    time_zone VARCHAR(64) NOT NULL DEFAULT 'UTC', -- IANA time zone whole-day reminders follow
+    CONSTRAINT fk_reminder_preferences_user_id FOREIGN KEY (user_id)
+    REFERENCES users (id) ON DELETE CASCADE
+);
+
+-- Reminders already sent, so that each is sent once per start time of a scheduled activity
+CREATE TABLE sent_reminders (
+    user_id INTEGER NOT NULL,
+    scheduled_activity_id INTEGER NOT NULL,
+    scheduled_at TIMESTAMPTZ NOT NULL, -- the start time the reminder was for
+    offset_minutes INTEGER NOT NULL,
+    sent_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT pk_sent_reminders PRIMARY KEY (user_id, scheduled_activity_id, scheduled_at, offset_minutes),
+    CONSTRAINT fk_sent_reminders_user_id FOREIGN KEY (user_id)
+    REFERENCES users (id) ON DELETE CASCADE,
+    CONSTRAINT fk_sent_reminders_scheduled_activity_id FOREIGN KEY (scheduled_activity_id)
+    REFERENCES scheduled_activities (id) ON DELETE CASCADE
+);
@@ -0,0 +1,10 @@
+-- Subscribable iCalendar feeds
+
+CREATE TABLE calendar_feeds (
+    user_id INTEGER PRIMARY KEY, -- one feed per user, rotating it replaces the token
+    token_hash CHAR(64) NOT NULL, -- SHA-256 of the feed token, the token itself is never stored
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_calendar_feeds_user_id FOREIGN KEY (user_id)
+    REFERENCES users (id) ON DELETE CASCADE,
+    CONSTRAINT uq_calendar_feeds_token_hash UNIQUE (token_hash)
+);
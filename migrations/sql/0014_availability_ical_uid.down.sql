@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_user_availability_ical_uid;
+
+ALTER TABLE user_availability
+    DROP COLUMN IF EXISTS ical_uid;
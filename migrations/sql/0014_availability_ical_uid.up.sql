@@ -0,0 +1,7 @@
+-- Availability blackouts imported from iCalendar files remember the event they came from, so
+-- that importing the file again replaces them
+
+ALTER TABLE user_availability
+    ADD COLUMN ical_uid VARCHAR(255); -- UID of the imported calendar event the row blacks out
+
+CREATE INDEX idx_user_availability_ical_uid ON user_availability (user_id, ical_uid) WHERE ical_uid IS NOT NULL;
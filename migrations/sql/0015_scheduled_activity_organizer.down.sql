@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_scheduled_activities_organizer_id;
+
+ALTER TABLE scheduled_activities
+    DROP CONSTRAINT IF EXISTS fk_scheduled_activities_organizer_id,
+    DROP COLUMN IF EXISTS organizer_id;
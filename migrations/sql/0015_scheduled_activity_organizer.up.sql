@@ -0,0 +1,14 @@
+-- Scheduled activities remember who organizes them: the creator of a one-off activity, or the
+-- owner of the preference a series occurrence was generated from. Existing one-off activities
+-- have no known creator and can only be edited once an organizer is set.
+
+ALTER TABLE scheduled_activities
+    ADD COLUMN organizer_id INTEGER, -- the only user who may edit it or invite others to it
+    ADD CONSTRAINT fk_scheduled_activities_organizer_id FOREIGN KEY (organizer_id)
+    REFERENCES users (id) ON DELETE SET NULL;
+
+UPDATE scheduled_activities sa SET organizer_id = uap.user_id
+FROM user_activity_preferences uap
+WHERE uap.id = sa.user_activity_preference_id;
+
+CREATE INDEX idx_scheduled_activities_organizer_id ON scheduled_activities (organizer_id);
@@ -0,0 +1,7 @@
+ALTER TABLE locations
+    DROP CONSTRAINT IF EXISTS fk_locations_created_by,
+    DROP COLUMN IF EXISTS created_by;
+
+ALTER TABLE activities
+    DROP CONSTRAINT IF EXISTS fk_activities_created_by,
+    DROP COLUMN IF EXISTS created_by;
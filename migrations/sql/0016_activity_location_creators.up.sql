@@ -0,0 +1,12 @@
+-- Activities and locations remember who created them, the only user who may edit or delete them.
+-- Existing rows have no known creator and can no longer be changed through the API.
+
+ALTER TABLE activities
+    ADD COLUMN created_by INTEGER,
+    ADD CONSTRAINT fk_activities_created_by FOREIGN KEY (created_by)
+    REFERENCES users (id) ON DELETE SET NULL;
+
+ALTER TABLE locations
+    ADD COLUMN created_by INTEGER,
+    ADD CONSTRAINT fk_locations_created_by FOREIGN KEY (created_by)
+    REFERENCES users (id) ON DELETE SET NULL;
@@ -0,0 +1,179 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"friendsocial/auth"
+	"friendsocial/query"
+	"net/http"
+)
+
+// NotificationService defines the methods for reading and acknowledging notifications
+type NotificationService interface {
+	ReadByUser(ctx context.Context, userID string, params query.Params) (query.Page[Notification], error)
+	Read(ctx context.Context, id string) (Notification, bool, error)
+	MarkRead(ctx context.Context, id string) (Notification, bool, error)
+	MarkAllRead(ctx context.Context, userID string) (int64, error)
+}
+
+// NotificationError represents the structure of an error response
+type NotificationError struct {
+	StatusCode int    `json:"status_code"`
+	Error      string `json:"error"`
+}
+
+// MarkAllReadResponse reports how many notifications were marked as read
+type MarkAllReadResponse struct {
+	Updated int64 `json:"updated"`
+}
+
+// NotificationHTTPHandler handles HTTP requests for notifications
+type NotificationHTTPHandler struct {
+	notificationService NotificationService
+}
+
+// NewNotificationHTTPHandler creates a new handler for notifications
+func NewNotificationHTTPHandler(notificationService NotificationService) *NotificationHTTPHandler {
+	return &NotificationHTTPHandler{
+		notificationService: notificationService,
+	}
+}
+
+// HandleHTTPGetByUser retrieves a user's notifications, newest first
+//
+//	@Summary		Get a user's notifications
+//	@Description	Retrieve a page of notifications, newest first. Filter with id, type, unread, actor_id, scheduled_activity_id and created_at, e.g. ?unread=true
+//	@Tags			notifications
+//	@Produce		json
+//	@Param			user_id	path		int		true	"User ID"
+//	@Param			limit	query		int		false	"Items per page, defaults to 50, at most 200"
+//	@Param			cursor	query		string	false	"next_cursor of the previous page"
+//	@Param			sort	query		string	false	"Field to sort by, prefixed with - for descending: id, created_at"
+//	@Success		200		{object}	query.Page[Notification]
+//	@Failure		400		{object}	NotificationError
+//	@Failure		500		{object}	NotificationError
+//	@Router			/notifications/user/{user_id} [get]
+func (nH *NotificationHTTPHandler) HandleHTTPGetByUser(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("user_id")
+
+	params, err := query.Parse(r.URL.RawQuery, listSpec)
+	if err != nil {
+		nH.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	notifications, err := nH.notificationService.ReadByUser(r.Context(), userID, params)
+	if err != nil {
+		nH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(notifications)
+	if err != nil {
+		nH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// HandleHTTPPutRead marks a notification as read
+//
+//	@Summary		Mark a notification as read
+//	@Description	Mark a notification as read
+//	@Tags			notifications
+//	@Produce		json
+//	@Param			id	path		int	true	"Notification ID"
+//	@Success		200	{object}	Notification
+//	@Failure		404	{object}	NotificationError
+//	@Failure		500	{object}	NotificationError
+//	@Router			/notifications/{id}/read [put]
+func (nH *NotificationHTTPHandler) HandleHTTPPutRead(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	notification, found, err := nH.notificationService.MarkRead(r.Context(), id)
+	if err != nil {
+		nH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if !found {
+		nH.errorResponse(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(notification)
+	if err != nil {
+		nH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// HandleHTTPPutReadAll marks all of a user's notifications as read
+//
+//	@Summary		Mark all notifications as read
+//	@Description	Mark every unread notification of a user as read
+//	@Tags			notifications
+//	@Produce		json
+//	@Param			user_id	path		int	true	"User ID"
+//	@Success		200		{object}	MarkAllReadResponse
+//	@Failure		500		{object}	NotificationError
+//	@Router			/notifications/user/{user_id}/read [put]
+func (nH *NotificationHTTPHandler) HandleHTTPPutReadAll(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("user_id")
+
+	updated, err := nH.notificationService.MarkAllRead(r.Context(), userID)
+	if err != nil {
+		nH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(MarkAllReadResponse{Updated: updated})
+	if err != nil {
+		nH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// RegisterRoutes adds the notification routes to mux
+func (nH *NotificationHTTPHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /notifications/user/{user_id}", nH.HandleHTTPGetByUser)
+	mux.HandleFunc("PUT /notifications/user/{user_id}/read", nH.HandleHTTPPutReadAll)
+	mux.HandleFunc("PUT /notifications/{id}/read", nH.HandleHTTPPutRead)
+}
+
+// AuthorizationRules returns the ownership rules for notification routes. Users only see and
+// acknowledge their own notifications.
+func (nH *NotificationHTTPHandler) AuthorizationRules() map[string]auth.Rule {
+	return map[string]auth.Rule{
+		"GET /notifications/user/{user_id}":      auth.Self("user_id"),
+		"PUT /notifications/user/{user_id}/read": auth.Self("user_id"),
+		"PUT /notifications/{id}/read":           nH.isRecipient,
+	}
+}
+
+// isRecipient allows the user the notification in the path was sent to
+func (nH *NotificationHTTPHandler) isRecipient(r *http.Request, callerID int) (bool, error) {
+	notification, found, err := nH.notificationService.Read(r.Context(), r.PathValue("id"))
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		// Let the handler answer 404
+		return true, nil
+	}
+	return notification.UserID == callerID, nil
+}
+
+func (nH *NotificationHTTPHandler) errorResponse(w http.ResponseWriter, statusCode int, errorString string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	encodingError := json.NewEncoder(w).Encode(NotificationError{
+		StatusCode: statusCode,
+		Error:      errorString,
+	})
+	if encodingError != nil {
+		http.Error(w, encodingError.Error(), http.StatusInternalServerError)
+	}
+}
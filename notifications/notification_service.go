@@ -0,0 +1,220 @@
+package notifications
+
+import (
+	"context"
+	"friendsocial/query"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/lib/pq"
+)
+
+// Notification types
+const (
+	TypeFriendRequest       = "friend_request"
+	TypeFriendAccepted      = "friend_accepted"
+	TypeActivityInvite      = "activity_invite"
+	TypeRSVP                = "rsvp"
+	TypeWaitlistPromoted    = "waitlist_promoted"
+	TypeActivityRescheduled = "activity_rescheduled"
+	TypeActivityCancelled   = "activity_cancelled"
+	TypeActivityReminder    = "activity_reminder"
+)
+
+type Notification struct {
+	ID                  int                    `json:"id"`
+	UserID              int                    `json:"user_id"`
+	Type                string                 `json:"type"`
+	ActorID             *int                   `json:"actor_id,omitempty"` // the user whose action caused the notification
+	ScheduledActivityID *int                   `json:"scheduled_activity_id,omitempty"`
+	Data                map[string]interface{} `json:"data,omitempty"`
+	ReadAt              *time.Time             `json:"read_at,omitempty"`
+	CreatedAt           time.Time              `json:"created_at"`
+}
+
+// Execer is implemented by *pgxpool.Pool and pgx.Tx, so that notifications are written in the
+// same transaction as the change they announce
+type Execer interface {
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error)
+}
+
+// EmailTypes are the notification types that are also sent by email. All types are pushed to the
+// recipient's registered devices.
+var EmailTypes = []string{TypeActivityInvite, TypeWaitlistPromoted, TypeActivityRescheduled, TypeActivityCancelled}
+
+// enqueueDeliveries queues the deliveries of the notifications in an "inserted" CTE returning id,
+// user_id and type: one per registered device, and an email for EmailTypes. The delivery
+// dispatcher sends them.
+var enqueueDeliveries = `
+	 INSERT INTO notification_deliveries (notification_id, user_id, channel, device_id, target)
+	 SELECT inserted.id, inserted.user_id, d.platform, d.id, d.token
+	 FROM inserted
+	 JOIN user_devices d ON d.user_id = inserted.user_id
+	 UNION ALL
+	 SELECT inserted.id, inserted.user_id, 'email', NULL, u.email
+	 FROM inserted
+	 JOIN users u ON u.id = inserted.user_id
+	 WHERE inserted.type IN ('` + strings.Join(EmailTypes, "', '") + `')`
+
+// notificationColumns is the column list scanned by scanNotification
+const notificationColumns = "id, user_id, type, actor_id, scheduled_activity_id, data, read_at, created_at"
+
+func scanNotification(row pgx.Row) (Notification, error) {
+	var notification Notification
+	err := row.Scan(&notification.ID, &notification.UserID, &notification.Type, &notification.ActorID,
+		&notification.ScheduledActivityID, &notification.Data, &notification.ReadAt, &notification.CreatedAt)
+	return notification, err
+}
+
+// Emit stores notifications and queues their delivery. Users are never notified of their own
+// actions.
+func Emit(ctx context.Context, db Execer, notifications ...Notification) error {
+	for _, notification := range notifications {
+		if notification.ActorID != nil && *notification.ActorID == notification.UserID {
+			continue
+		}
+		_, err := db.Exec(ctx,
+			`WITH inserted AS (
+			     INSERT INTO notifications (user_id, type, actor_id, scheduled_activity_id, data)
+			     VALUES ($1, $2, $3, $4, $5)
+			     RETURNING id, user_id, type
+			 )`+enqueueDeliveries,
+			notification.UserID, notification.Type, notification.ActorID, notification.ScheduledActivityID, notification.Data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EmitToAttendees sends a notification to the organizer and every invitee who has not declined
+// one of the given scheduled activities, once per user, except the actor. The notification's
+// UserID is ignored.
+func EmitToAttendees(ctx context.Context, db Execer, scheduledActivityIDs []int, notification Notification) error {
+	_, err := db.Exec(ctx,
+		`WITH inserted AS (
+		     INSERT INTO notifications (user_id, type, actor_id, scheduled_activity_id, data)
+		     SELECT recipients.user_id, $2, $3, $4, $5
+		     FROM (
+		         SELECT user_id FROM activity_participants
+		         WHERE scheduled_activity_id = ANY($1) AND invite_status <> 'Declined'
+		         UNION
+		         SELECT organizer_id FROM scheduled_activities
+		         WHERE id = ANY($1) AND organizer_id IS NOT NULL
+		     ) recipients
+		     WHERE recipients.user_id IS DISTINCT FROM $3
+		     RETURNING id, user_id, type
+		 )`+enqueueDeliveries,
+		pq.Array(scheduledActivityIDs), notification.Type, notification.ActorID, notification.ScheduledActivityID, notification.Data)
+	return err
+}
+
+// EmitToOrganizer sends a notification to the organizer of a scheduled activity, unless they are
+// the actor
+func EmitToOrganizer(ctx context.Context, db Execer, scheduledActivityID int, notification Notification) error {
+	_, err := db.Exec(ctx,
+		`WITH inserted AS (
+		     INSERT INTO notifications (user_id, type, actor_id, scheduled_activity_id, data)
+		     SELECT organizer_id, $2, $3, id, $4
+		     FROM scheduled_activities
+		     WHERE id = $1 AND organizer_id IS NOT NULL AND organizer_id IS DISTINCT FROM $3
+		     RETURNING id, user_id, type
+		 )`+enqueueDeliveries,
+		scheduledActivityID, notification.Type, notification.ActorID, notification.Data)
+	return err
+}
+
+type Service struct {
+	db *pgxpool.Pool
+}
+
+func NewService(db *pgxpool.Pool) *Service {
+	return &Service{
+		db: db,
+	}
+}
+
+// listSpec are the fields a user's notifications can be listed by
+var listSpec = query.Spec{
+	Fields: map[string]query.Field{
+		"id":                    {Column: "id", Kind: query.Int},
+		"type":                  {Column: "type", Kind: query.String},
+		"unread":                {Column: "(read_at IS NULL)", Kind: query.Bool},
+		"actor_id":              {Column: "actor_id", Kind: query.Int},
+		"scheduled_activity_id": {Column: "scheduled_activity_id", Kind: query.Int},
+		"created_at":            {Column: "created_at", Kind: query.Time, Sortable: true},
+	},
+	Key:         "id",
+	DefaultSort: "-id",
+}
+
+// ReadByUser returns a page of a user's notifications, newest first unless params sort them
+// otherwise
+func (s *Service) ReadByUser(ctx context.Context, userID string, params query.Params) (query.Page[Notification], error) {
+	sql, args := params.Apply("SELECT "+notificationColumns+" FROM (SELECT * FROM notifications WHERE user_id = $1) notifications", userID)
+	rows, err := s.db.Query(ctx, sql, args...)
+	if err != nil {
+		return query.Page[Notification]{}, err
+	}
+	defer rows.Close()
+
+	var notifications []Notification
+	for rows.Next() {
+		notification, err := scanNotification(rows)
+		if err != nil {
+			return query.Page[Notification]{}, err
+		}
+		notifications = append(notifications, notification)
+	}
+	if err := rows.Err(); err != nil {
+		return query.Page[Notification]{}, err
+	}
+
+	return query.NewPage(params, notifications, func(notification Notification, sort string) (int, interface{}) {
+		return notification.ID, notification.CreatedAt
+	}), nil
+}
+
+// Read returns a single notification
+func (s *Service) Read(ctx context.Context, id string) (Notification, bool, error) {
+	notification, err := scanNotification(s.db.QueryRow(ctx,
+		"SELECT "+notificationColumns+" FROM notifications WHERE id = $1", id))
+	if err == pgx.ErrNoRows {
+		return Notification{}, false, nil
+	}
+	if err != nil {
+		return Notification{}, false, err
+	}
+
+	return notification, true, nil
+}
+
+// MarkRead marks a notification as read. Marking it again keeps the first read_at.
+func (s *Service) MarkRead(ctx context.Context, id string) (Notification, bool, error) {
+	notification, err := scanNotification(s.db.QueryRow(ctx,
+		`UPDATE notifications SET read_at = COALESCE(read_at, now())
+		 WHERE id = $1
+		 RETURNING `+notificationColumns, id))
+	if err == pgx.ErrNoRows {
+		return Notification{}, false, nil
+	}
+	if err != nil {
+		return Notification{}, false, err
+	}
+
+	return notification, true, nil
+}
+
+// MarkAllRead marks every unread notification of a user as read and returns how many there were
+func (s *Service) MarkAllRead(ctx context.Context, userID string) (int64, error) {
+	cmdTag, err := s.db.Exec(ctx,
+		"UPDATE notifications SET read_at = now() WHERE user_id = $1 AND read_at IS NULL", userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return cmdTag.RowsAffected(), nil
+}
@@ -2,31 +2,28 @@ package postgres
 
 import (
 	"context"
-	"fmt"
+	"friendsocial/config"
 	"log"
 
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
-const (
-	DB_USER     = "mitchell.zinck"
-	DB_PASSWORD = ""
-	DB_NAME     = "friendsocialdb"
-)
-
 var DB *pgxpool.Pool
 
-func InitDB() {
+func InitDB(settings config.Database) {
 	var err error
-	psqlInfo := fmt.Sprintf("postgresql://%s:%s@localhost:5432/%s?sslmode=disable",
-		DB_USER, DB_PASSWORD, DB_NAME)
 
-	config, err := pgxpool.ParseConfig(psqlInfo)
+	poolConfig, err := pgxpool.ParseConfig(settings.DSN)
 	if err != nil {
 		log.Fatalf("Unable to parse connection string: %v", err)
 	}
+	poolConfig.MaxConns = settings.MaxConns
+	poolConfig.MinConns = settings.MinConns
+	poolConfig.MaxConnLifetime = settings.MaxConnLifetime
+	poolConfig.MaxConnIdleTime = settings.MaxConnIdleTime
+	poolConfig.ConnConfig.ConnectTimeout = settings.ConnectTimeout
 
-	DB, err = pgxpool.ConnectConfig(context.Background(), config)
+	DB, err = pgxpool.ConnectConfig(context.Background(), poolConfig)
 	if err != nil {
 		log.Fatalf("Unable to connect to database: %v", err)
 	}
@@ -0,0 +1,323 @@
+// Package query parses the list parameters shared by every collection endpoint (limit, cursor,
+// sort and field filters) and turns them into SQL.
+//
+// Filters are written as field, operator and value, e.g. ?scheduled_at>=2024-09-01&is_active=true
+// or ?city=Halifax. The operators are =, !=, >, >=, < and <=; booleans only support = and !=.
+// Pages are keyset-paginated: next_cursor points after the last row of a page, so rows inserted
+// or deleted meanwhile do not shift the pages that follow.
+package query
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultLimit = 50
+	MaxLimit     = 200
+)
+
+var ErrInvalidQuery = errors.New("invalid query")
+
+// Kind is the type of a field's values
+type Kind int
+
+const (
+	Int Kind = iota
+	String
+	Bool
+	Time // RFC 3339 timestamps, or dates meaning midnight UTC
+	Date // YYYY-MM-DD
+)
+
+// Field is something a list can be filtered, and optionally sorted, by
+type Field struct {
+	Column string // SQL column or expression
+	Kind   Kind
+	// Sortable fields must be NOT NULL, since rows are paginated by comparing their values
+	Sortable bool
+}
+
+// Spec describes the fields a list accepts, by their name in the query string. Every list is
+// ordered by Key last so that pages are stable; Key must be a unique, NOT NULL integer column.
+type Spec struct {
+	Fields      map[string]Field
+	Key         string
+	DefaultSort string // field name, prefixed with "-" for descending
+}
+
+// Filter is a condition on a field
+type Filter struct {
+	Field    string
+	Operator string
+	Value    interface{}
+}
+
+// Params are the parsed list parameters of a request
+type Params struct {
+	Limit   int
+	Sort    string // field name
+	Desc    bool
+	Filters []Filter
+	after   *cursor
+	spec    Spec
+}
+
+// cursor is the position after the last row of a page
+type cursor struct {
+	Sort  string      `json:"s"` // sort the cursor was made for, e.g. "-scheduled_at"
+	Value interface{} `json:"v"` // sort field value of the row, nil when sorting by the key
+	Key   int         `json:"k"`
+}
+
+// Page is a page of a list. NextCursor is nil on the last page.
+type Page[T any] struct {
+	Data       []T     `json:"data"`
+	NextCursor *string `json:"next_cursor"`
+}
+
+var filterPattern = regexp.MustCompile(`^([a-z_]+)(>=|<=|!=|>|<|=)(.*)$`)
+
+// reserved are the parameters that are not filters
+var reserved = map[string]bool{"limit": true, "cursor": true, "sort": true}
+
+// Parse reads list parameters from a raw query string. It is given the raw string rather than
+// url.Values because operators such as >= would otherwise be split into key and value.
+func Parse(rawQuery string, spec Spec) (Params, error) {
+	params := Params{Limit: DefaultLimit, spec: spec}
+	params.Sort, params.Desc = splitSort(spec.DefaultSort)
+	if params.Sort == "" {
+		params.Sort = spec.Key
+	}
+
+	var rawCursor string
+	for _, part := range strings.FieldsFunc(rawQuery, func(r rune) bool { return r == '&' }) {
+		decoded, err := url.QueryUnescape(part)
+		if err != nil {
+			return Params{}, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+		}
+		match := filterPattern.FindStringSubmatch(decoded)
+		if match == nil {
+			return Params{}, fmt.Errorf("%w: cannot read %q", ErrInvalidQuery, decoded)
+		}
+		name, operator, value := match[1], match[2], match[3]
+
+		if reserved[name] {
+			if operator != "=" {
+				return Params{}, fmt.Errorf("%w: %s only supports =", ErrInvalidQuery, name)
+			}
+			switch name {
+			case "limit":
+				limit, err := strconv.Atoi(value)
+				if err != nil || limit < 1 || limit > MaxLimit {
+					return Params{}, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidQuery, MaxLimit)
+				}
+				params.Limit = limit
+			case "cursor":
+				rawCursor = value
+			case "sort":
+				sort, desc := splitSort(value)
+				if field, ok := spec.Fields[sort]; (!ok || !field.Sortable) && sort != spec.Key {
+					return Params{}, fmt.Errorf("%w: cannot sort by %q", ErrInvalidQuery, sort)
+				}
+				params.Sort, params.Desc = sort, desc
+			}
+			continue
+		}
+
+		field, ok := spec.Fields[name]
+		if !ok {
+			return Params{}, fmt.Errorf("%w: unknown field %q", ErrInvalidQuery, name)
+		}
+		if field.Kind == Bool && operator != "=" && operator != "!=" {
+			return Params{}, fmt.Errorf("%w: %s only supports = and !=", ErrInvalidQuery, name)
+		}
+		parsed, err := parseValue(field.Kind, value)
+		if err != nil {
+			return Params{}, fmt.Errorf("%w: %s: %v", ErrInvalidQuery, name, err)
+		}
+		params.Filters = append(params.Filters, Filter{Field: name, Operator: operator, Value: parsed})
+	}
+
+	if rawCursor != "" {
+		after, err := params.decodeCursor(rawCursor)
+		if err != nil {
+			return Params{}, err
+		}
+		params.after = &after
+	}
+
+	return params, nil
+}
+
+// Apply appends the filters, the cursor condition, the order and the limit to a SELECT that has
+// no WHERE, ORDER BY or LIMIT of its own. args are the SELECT's own arguments; the returned
+// arguments include them. One row more than the limit is selected so that NewPage can tell
+// whether there is a next page.
+func (p Params) Apply(selectSQL string, args ...interface{}) (string, []interface{}) {
+	var conditions []string
+	placeholder := func(value interface{}) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	for _, filter := range p.Filters {
+		conditions = append(conditions, p.spec.Fields[filter.Field].Column+" "+sqlOperator(filter.Operator)+" "+placeholder(filter.Value))
+	}
+
+	comparison := ">"
+	direction := "ASC"
+	if p.Desc {
+		comparison, direction = "<", "DESC"
+	}
+
+	if p.after != nil {
+		if p.Sort == p.spec.Key {
+			conditions = append(conditions, p.spec.Key+" "+comparison+" "+placeholder(p.after.Key))
+		} else {
+			column := p.spec.Fields[p.Sort].Column
+			conditions = append(conditions, fmt.Sprintf("(%s, %s) %s (%s, %s)",
+				column, p.spec.Key, comparison, placeholder(p.after.Value), placeholder(p.after.Key)))
+		}
+	}
+
+	var builder strings.Builder
+	builder.WriteString(selectSQL)
+	if len(conditions) > 0 {
+		builder.WriteString(" WHERE " + strings.Join(conditions, " AND "))
+	}
+	if p.Sort == p.spec.Key {
+		builder.WriteString(" ORDER BY " + p.spec.Key + " " + direction)
+	} else {
+		builder.WriteString(" ORDER BY " + p.spec.Fields[p.Sort].Column + " " + direction + ", " + p.spec.Key + " " + direction)
+	}
+	builder.WriteString(" LIMIT " + placeholder(p.Limit+1))
+
+	return builder.String(), args
+}
+
+// NewPage trims the extra row selected by Apply and points next_cursor after the last item.
+// position returns an item's key and the value of the field named sort; the value is ignored
+// when the list is sorted by its key.
+func NewPage[T any](p Params, items []T, position func(item T, sort string) (key int, value interface{})) Page[T] {
+	page := Page[T]{Data: items}
+	if page.Data == nil {
+		page.Data = []T{}
+	}
+	if len(items) <= p.Limit {
+		return page
+	}
+
+	page.Data = items[:p.Limit]
+	key, value := position(page.Data[p.Limit-1], p.Sort)
+	after := cursor{Sort: p.sortName(), Key: key}
+	if p.Sort != p.spec.Key {
+		if t, ok := value.(time.Time); ok {
+			value = t.Format(time.RFC3339Nano)
+		}
+		after.Value = value
+	}
+
+	encoded, _ := json.Marshal(after)
+	next := base64.RawURLEncoding.EncodeToString(encoded)
+	page.NextCursor = &next
+	return page
+}
+
+func (p Params) sortName() string {
+	if p.Desc {
+		return "-" + p.Sort
+	}
+	return p.Sort
+}
+
+func (p Params) decodeCursor(raw string) (cursor, error) {
+	invalid := fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+
+	decoded, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return cursor{}, invalid
+	}
+	var after cursor
+	if err := json.Unmarshal(decoded, &after); err != nil {
+		return cursor{}, invalid
+	}
+	if after.Sort != p.sortName() {
+		return cursor{}, fmt.Errorf("%w: cursor was made for sort=%s", ErrInvalidQuery, after.Sort)
+	}
+	if p.Sort == p.spec.Key {
+		return after, nil
+	}
+
+	// JSON numbers and timestamps come back as float64 and string
+	var text string
+	switch value := after.Value.(type) {
+	case string:
+		text = value
+	case float64:
+		text = strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		text = strconv.FormatBool(value)
+	default:
+		return cursor{}, invalid
+	}
+	after.Value, err = parseValue(p.spec.Fields[p.Sort].Kind, text)
+	if err != nil {
+		return cursor{}, invalid
+	}
+	return after, nil
+}
+
+func parseValue(kind Kind, value string) (interface{}, error) {
+	switch kind {
+	case Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", value)
+		}
+		return n, nil
+	case Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not true or false", value)
+		}
+		return b, nil
+	case Time:
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return t, nil
+		}
+		t, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an RFC 3339 timestamp or a date", value)
+		}
+		return t, nil
+	case Date:
+		if _, err := time.Parse("2006-01-02", value); err != nil {
+			return nil, fmt.Errorf("%q is not a date", value)
+		}
+		return value, nil
+	default:
+		return value, nil
+	}
+}
+
+func splitSort(sort string) (string, bool) {
+	if field, found := strings.CutPrefix(sort, "-"); found {
+		return field, true
+	}
+	return sort, false
+}
+
+func sqlOperator(operator string) string {
+	if operator == "!=" {
+		return "<>"
+	}
+	return operator
+}
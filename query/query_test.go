@@ -0,0 +1,213 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+var testSpec = Spec{
+	Fields: map[string]Field{
+		"scheduled_at": {Column: "sa.scheduled_at", Kind: Time, Sortable: true},
+		"capacity":     {Column: "sa.capacity", Kind: Int, Sortable: true},
+		"city":         {Column: "l.city", Kind: String},
+		"is_active":    {Column: "sa.is_active", Kind: Bool},
+		"date":         {Column: "sa.date", Kind: Date},
+	},
+	Key:         "sa.id",
+	DefaultSort: "-scheduled_at",
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		rawQuery string
+		limit    int
+		sort     string
+		desc     bool
+		filters  string // fmt.Sprint of the filters
+		wantErr  bool
+	}{
+		{rawQuery: "", limit: DefaultLimit, sort: "scheduled_at", desc: true, filters: "[]"},
+		{rawQuery: "limit=10&sort=capacity", limit: 10, sort: "capacity", filters: "[]"},
+		{rawQuery: "sort=-sa.id", limit: DefaultLimit, sort: "sa.id", desc: true, filters: "[]"},
+		{
+			rawQuery: "scheduled_at>=2024-09-01&is_active=true&city=Halifax",
+			limit:    DefaultLimit, sort: "scheduled_at", desc: true,
+			filters: "[{scheduled_at >= 2024-09-01 00:00:00 +0000 UTC} {is_active = true} {city = Halifax}]",
+		},
+		{
+			rawQuery: "scheduled_at%3C2024-09-01T19:00:00%2B02:00&capacity!=4&date<=2024-09-30",
+			limit:    DefaultLimit, sort: "scheduled_at", desc: true,
+			filters: "[{scheduled_at < 2024-09-01 19:00:00 +0200 +0200} {capacity != 4} {date <= 2024-09-30}]",
+		},
+		{rawQuery: "city=St.%20John%27s", limit: DefaultLimit, sort: "scheduled_at", desc: true, filters: "[{city = St. John's}]"},
+		{rawQuery: "limit=0", wantErr: true},
+		{rawQuery: "limit=201", wantErr: true},
+		{rawQuery: "limit>=5", wantErr: true},
+		{rawQuery: "sort=city", wantErr: true},
+		{rawQuery: "sort=unknown", wantErr: true},
+		{rawQuery: "unknown=1", wantErr: true},
+		{rawQuery: "is_active>true", wantErr: true},
+		{rawQuery: "capacity=many", wantErr: true},
+		{rawQuery: "scheduled_at>=yesterday", wantErr: true},
+		{rawQuery: "date=2024-13-01", wantErr: true},
+		{rawQuery: "Capacity=1", wantErr: true},
+		{rawQuery: "city%ZZ", wantErr: true},
+		{rawQuery: "cursor=!!!", wantErr: true},
+	}
+	for _, tt := range tests {
+		params, err := Parse(tt.rawQuery, testSpec)
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidQuery) {
+				t.Errorf("Parse(%q) error = %v, want ErrInvalidQuery", tt.rawQuery, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.rawQuery, err)
+			continue
+		}
+		if params.Limit != tt.limit || params.Sort != tt.sort || params.Desc != tt.desc {
+			t.Errorf("Parse(%q) = limit %d, sort %q, desc %v, want %d, %q, %v",
+				tt.rawQuery, params.Limit, params.Sort, params.Desc, tt.limit, tt.sort, tt.desc)
+		}
+		filters := fmt.Sprint(params.Filters)
+		if params.Filters == nil {
+			filters = "[]"
+		}
+		if filters != tt.filters {
+			t.Errorf("Parse(%q) filters = %s, want %s", tt.rawQuery, filters, tt.filters)
+		}
+	}
+}
+
+// selectSQL is a SELECT with an argument of its own, which the placeholders of Apply follow
+const selectSQL = "SELECT sa.* FROM scheduled_activities sa JOIN locations l ON l.id = sa.location_id AND sa.organizer_id = $1"
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		rawQuery string
+		wantSQL  string
+		wantArgs string
+	}{
+		{
+			rawQuery: "",
+			wantSQL:  selectSQL + " ORDER BY sa.scheduled_at DESC, sa.id DESC LIMIT $2",
+			wantArgs: "[7 51]",
+		},
+		{
+			rawQuery: "limit=5&sort=sa.id&capacity!=4&city=Halifax",
+			wantSQL:  selectSQL + " WHERE sa.capacity <> $2 AND l.city = $3 ORDER BY sa.id ASC LIMIT $4",
+			wantArgs: "[7 4 Halifax 6]",
+		},
+		{
+			rawQuery: "sort=capacity&is_active=false&capacity>=2",
+			wantSQL:  selectSQL + " WHERE sa.is_active = $2 AND sa.capacity >= $3 ORDER BY sa.capacity ASC, sa.id ASC LIMIT $4",
+			wantArgs: "[7 false 2 51]",
+		},
+	}
+	for _, tt := range tests {
+		params, err := Parse(tt.rawQuery, testSpec)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.rawQuery, err)
+			continue
+		}
+		sql, args := params.Apply(selectSQL, 7)
+		if sql != tt.wantSQL {
+			t.Errorf("Apply for %q:\n got %s\nwant %s", tt.rawQuery, sql, tt.wantSQL)
+		}
+		if got := fmt.Sprint(args); got != tt.wantArgs {
+			t.Errorf("Apply for %q args = %s, want %s", tt.rawQuery, got, tt.wantArgs)
+		}
+	}
+}
+
+// row is an item of a list in the cursor tests
+type row struct {
+	id          int
+	scheduledAt time.Time
+	capacity    int
+}
+
+func position(item row, sort string) (int, interface{}) {
+	switch sort {
+	case "scheduled_at":
+		return item.id, item.scheduledAt
+	case "capacity":
+		return item.id, item.capacity
+	}
+	return item.id, nil
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	at := time.Date(2024, 9, 3, 19, 0, 0, 123456789, time.FixedZone("", -4*60*60))
+	rows := []row{
+		{id: 3, scheduledAt: at, capacity: 8},
+		{id: 9, scheduledAt: at.Add(time.Hour), capacity: 4},
+		{id: 5, scheduledAt: at.Add(2 * time.Hour), capacity: 2},
+	}
+
+	tests := []struct {
+		rawQuery  string
+		condition string
+		wantArgs  string
+	}{
+		{
+			rawQuery:  "limit=2",
+			condition: " WHERE (sa.scheduled_at, sa.id) < ($2, $3) ORDER BY sa.scheduled_at DESC, sa.id DESC LIMIT $4",
+			wantArgs:  fmt.Sprint([]interface{}{7, at.Add(time.Hour), 9, 3}),
+		},
+		{
+			rawQuery:  "limit=2&sort=capacity&city=Halifax",
+			condition: " WHERE l.city = $2 AND (sa.capacity, sa.id) > ($3, $4) ORDER BY sa.capacity ASC, sa.id ASC LIMIT $5",
+			wantArgs:  "[7 Halifax 4 9 3]",
+		},
+		{
+			rawQuery:  "limit=2&sort=-sa.id",
+			condition: " WHERE sa.id < $2 ORDER BY sa.id DESC LIMIT $3",
+			wantArgs:  "[7 9 3]",
+		},
+	}
+	for _, tt := range tests {
+		params, err := Parse(tt.rawQuery, testSpec)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.rawQuery, err)
+			continue
+		}
+		page := NewPage(params, rows, position)
+		if len(page.Data) != 2 || page.NextCursor == nil {
+			t.Errorf("%q: first page has %d items and cursor %v", tt.rawQuery, len(page.Data), page.NextCursor)
+			continue
+		}
+
+		next, err := Parse(tt.rawQuery+"&cursor="+*page.NextCursor, testSpec)
+		if err != nil {
+			t.Errorf("%q: the next page cannot be read: %v", tt.rawQuery, err)
+			continue
+		}
+		sql, args := next.Apply(selectSQL, 7)
+		if sql != selectSQL+tt.condition {
+			t.Errorf("%q: next page:\n got %s\nwant %s", tt.rawQuery, sql, selectSQL+tt.condition)
+		}
+		if got := fmt.Sprint(args); got != tt.wantArgs {
+			t.Errorf("%q: next page args = %s, want %s", tt.rawQuery, got, tt.wantArgs)
+		}
+
+		// A cursor only fits the sort it was made for
+		if _, err := Parse("sort=-capacity&cursor="+*page.NextCursor, testSpec); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%q: cursor was accepted for another sort: %v", tt.rawQuery, err)
+		}
+	}
+
+	params, err := Parse("limit=3", testSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page := NewPage(params, rows, position); page.NextCursor != nil || len(page.Data) != 3 {
+		t.Errorf("last page has %d items and a next cursor: %v", len(page.Data), page.NextCursor != nil)
+	}
+	if page := NewPage(params, []row(nil), position); page.Data == nil {
+		t.Errorf("empty page has nil data")
+	}
+}
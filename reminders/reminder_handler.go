@@ -0,0 +1,138 @@
+package reminders
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"friendsocial/auth"
+	"net/http"
+	"strconv"
+)
+
+// ReminderService defines the methods for handling reminder preferences
+type ReminderService interface {
+	Read(ctx context.Context, userID int) (Preferences, error)
+	Update(ctx context.Context, userID int, preferences Preferences) (Preferences, error)
+}
+
+// ReminderError represents the structure of an error response
+type ReminderError struct {
+	StatusCode int    `json:"status_code"`
+	Error      string `json:"error"`
+}
+
+// ReminderHTTPHandler handles HTTP requests for reminder preferences
+type ReminderHTTPHandler struct {
+	reminderService ReminderService
+}
+
+// NewReminderHTTPHandler creates a new handler for reminder preferences
+func NewReminderHTTPHandler(reminderService ReminderService) *ReminderHTTPHandler {
+	return &ReminderHTTPHandler{
+		reminderService: reminderService,
+	}
+}
+
+// HandleHTTPGet retrieves a user's reminder preferences
+//
+//	@Summary		Get reminder preferences
+//	@Description	Retrieve when a user is reminded of the activities they accepted. Users who never set preferences get the defaults.
+//	@Tags			reminders
+//	@Produce		json
+//	@Param			id	path		int	true	"User ID"
+//	@Success		200	{object}	Preferences
+//	@Failure		400	{object}	ReminderError
+//	@Failure		500	{object}	ReminderError
+//	@Router			/users/{id}/reminder_preferences [get]
+func (rH *ReminderHTTPHandler) HandleHTTPGet(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		rH.errorResponse(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	preferences, err := rH.reminderService.Read(r.Context(), userID)
+	if err != nil {
+		rH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(preferences)
+	if err != nil {
+		rH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// HandleHTTPPut replaces a user's reminder preferences
+//
+//	@Summary		Update reminder preferences
+//	@Description	Set how many minutes before an accepted activity reminders are sent, and the time zone whole-day reminders follow. An empty list turns reminders off.
+//	@Tags			reminders
+//	@Accept			json
+//	@Produce		json
+//	@Param			id			path		int			true	"User ID"
+//	@Param			preferences	body		Preferences	true	"Reminder preferences"
+//	@Success		200			{object}	Preferences
+//	@Failure		400			{object}	ReminderError
+//	@Failure		500			{object}	ReminderError
+//	@Router			/users/{id}/reminder_preferences [put]
+func (rH *ReminderHTTPHandler) HandleHTTPPut(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		rH.errorResponse(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	var preferences Preferences
+	err = json.NewDecoder(r.Body).Decode(&preferences)
+	if err != nil {
+		rH.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	preferences, err = rH.reminderService.Update(r.Context(), userID, preferences)
+	if errors.Is(err, ErrInvalidPreferences) {
+		rH.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		rH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(preferences)
+	if err != nil {
+		rH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// RegisterRoutes adds the reminder preference routes to mux
+func (rH *ReminderHTTPHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /users/{id}/reminder_preferences", rH.HandleHTTPGet)
+	mux.HandleFunc("PUT /users/{id}/reminder_preferences", rH.HandleHTTPPut)
+}
+
+// AuthorizationRules returns the ownership rules for reminder routes. Users only see and change
+// their own preferences.
+func (rH *ReminderHTTPHandler) AuthorizationRules() map[string]auth.Rule {
+	return map[string]auth.Rule{
+		"GET /users/{id}/reminder_preferences": auth.Self("id"),
+		"PUT /users/{id}/reminder_preferences": auth.Self("id"),
+	}
+}
+
+func (rH *ReminderHTTPHandler) errorResponse(w http.ResponseWriter, statusCode int, errorString string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	encodingError := json.NewEncoder(w).Encode(ReminderError{
+		StatusCode: statusCode,
+		Error:      errorString,
+	})
+	if encodingError != nil {
+		http.Error(w, encodingError.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,107 @@
+package reminders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/lib/pq"
+)
+
+const (
+	// maxOffset is the earliest a reminder can be sent before an activity, in minutes
+	maxOffset = 7 * 24 * 60
+	// maxReminders is how many reminders a user can have per activity
+	maxReminders = 5
+)
+
+// DefaultOffsets are the reminders of users who have not set their own: a day and an hour before
+var DefaultOffsets = []int{24 * 60, 60}
+
+var ErrInvalidPreferences = errors.New("invalid reminder preferences")
+
+// Preferences are a user's reminder settings. Each offset sends one reminder that many minutes
+// before an activity the user accepted; offsets of whole days keep the activity's wall-clock time
+// in TimeZone, so "1 day before" does not shift by an hour across daylight saving changes. No
+// offsets turns reminders off.
+type Preferences struct {
+	UserID   int    `json:"user_id"`
+	Offsets  []int  `json:"offsets_minutes"`
+	TimeZone string `json:"time_zone"` // IANA time zone, e.g. 'America/Halifax'
+}
+
+// Validate checks the offsets and time zone, and sorts the offsets from earliest to latest reminder
+func (p *Preferences) Validate() error {
+	if p.TimeZone == "" {
+		p.TimeZone = "UTC"
+	}
+	if _, err := time.LoadLocation(p.TimeZone); err != nil {
+		return fmt.Errorf("%w: unknown time_zone %q", ErrInvalidPreferences, p.TimeZone)
+	}
+	if p.Offsets == nil {
+		p.Offsets = []int{}
+	}
+	if len(p.Offsets) > maxReminders {
+		return fmt.Errorf("%w: at most %d reminders", ErrInvalidPreferences, maxReminders)
+	}
+	for _, offset := range p.Offsets {
+		if offset < 1 || offset > maxOffset {
+			return fmt.Errorf("%w: offsets must be between 1 and %d minutes", ErrInvalidPreferences, maxOffset)
+		}
+	}
+	slices.Sort(p.Offsets)
+	p.Offsets = slices.Compact(p.Offsets)
+	slices.Reverse(p.Offsets)
+	return nil
+}
+
+type Service struct {
+	db *pgxpool.Pool
+}
+
+func NewService(db *pgxpool.Pool) *Service {
+	return &Service{
+		db: db,
+	}
+}
+
+// Read returns a user's reminder preferences, or the defaults if they never set any
+func (s *Service) Read(ctx context.Context, userID int) (Preferences, error) {
+	preferences := Preferences{UserID: userID}
+	err := s.db.QueryRow(ctx,
+		"SELECT offsets_minutes, time_zone FROM reminder_preferences WHERE user_id = $1",
+		userID).Scan(&preferences.Offsets, &preferences.TimeZone)
+	if err == pgx.ErrNoRows {
+		preferences.Offsets = DefaultOffsets
+		preferences.TimeZone = "UTC"
+		return preferences, nil
+	}
+	if err != nil {
+		return Preferences{}, err
+	}
+
+	return preferences, nil
+}
+
+// Update replaces a user's reminder preferences. Reminders already sent are not sent again.
+func (s *Service) Update(ctx context.Context, userID int, preferences Preferences) (Preferences, error) {
+	preferences.UserID = userID
+	if err := preferences.Validate(); err != nil {
+		return Preferences{}, err
+	}
+
+	_, err := s.db.Exec(ctx,
+		`INSERT INTO reminder_preferences (user_id, offsets_minutes, time_zone)
+		 VALUES ($1, $2, $3)
+		 ON CONFLICT (user_id) DO UPDATE SET offsets_minutes = EXCLUDED.offsets_minutes, time_zone = EXCLUDED.time_zone`,
+		userID, pq.Array(preferences.Offsets), preferences.TimeZone)
+	if err != nil {
+		return Preferences{}, err
+	}
+
+	return preferences, nil
+}
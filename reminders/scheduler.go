@@ -0,0 +1,215 @@
+package reminders
+
+import (
+	"context"
+	"fmt"
+	"friendsocial/notifications"
+	"friendsocial/worker"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// schedulerLockKey is the Postgres advisory lock that keeps server instances from sending
+// reminders at the same time
+const schedulerLockKey int64 = 0x6673726d64 // "fsrmd"
+
+// Scheduler periodically reminds users of the upcoming scheduled activities they accepted. Every
+// reminder is recorded in sent_reminders together with the notification, so each is sent exactly
+// once per start time; moving an activity reminds its participants again for the new time.
+type Scheduler struct {
+	service  *Service
+	interval time.Duration
+}
+
+// NewScheduler creates a Scheduler that runs every interval
+func NewScheduler(service *Service, interval time.Duration) *Scheduler {
+	return &Scheduler{
+		service:  service,
+		interval: interval,
+	}
+}
+
+// upcomingAttendance is an accepted invitation to an upcoming scheduled activity
+type upcomingAttendance struct {
+	userID              int
+	scheduledActivityID int
+	scheduledAt         time.Time
+	offsets             []int
+	timeZone            string
+}
+
+// Run sends due reminders immediately and then every interval until ctx is done, see
+// worker.RunEvery.
+func (s *Scheduler) Run(ctx context.Context) {
+	worker.RunEvery(ctx, s.interval, func(ctx context.Context) {
+		sent, err := s.RunOnce(ctx)
+		if err != nil {
+			log.Printf("reminder scheduler: %v", err)
+		} else if sent > 0 {
+			log.Printf("reminder scheduler: sent %d reminders", sent)
+		}
+	})
+}
+
+// RunOnce sends every reminder that is due and returns how many were sent. It does nothing if
+// another instance holds the advisory lock.
+func (s *Scheduler) RunOnce(ctx context.Context) (int, error) {
+	conn, err := s.service.db.Acquire(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to acquire connection: %v", err)
+	}
+	defer conn.Release()
+
+	var locked bool
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", schedulerLockKey).Scan(&locked); err != nil {
+		return 0, fmt.Errorf("failed to take advisory lock: %v", err)
+	}
+	if !locked {
+		return 0, nil
+	}
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", schedulerLockKey)
+
+	now := time.Now()
+
+	// Inactive activities and anything but acceptances are never reminded of. The lookahead is
+	// a day longer than the earliest reminder to cover offsets of whole days across DST changes.
+	rows, err := conn.Query(ctx,
+		`SELECT ap.user_id, sa.id, sa.scheduled_at,
+		        COALESCE(rp.offsets_minutes, $3), COALESCE(rp.time_zone, 'UTC')
+		 FROM scheduled_activities sa
+		 JOIN activity_participants ap ON ap.scheduled_activity_id = sa.id
+		 LEFT JOIN reminder_preferences rp ON rp.user_id = ap.user_id
+		 WHERE sa.is_active AND ap.invite_status = 'Accepted'
+		   AND sa.scheduled_at > $1 AND sa.scheduled_at <= $2
+		 ORDER BY sa.scheduled_at`,
+		now, now.Add((maxOffset+24*60)*time.Minute), pq.Array(DefaultOffsets))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read upcoming activities: %v", err)
+	}
+	var attendances []upcomingAttendance
+	for rows.Next() {
+		var attendance upcomingAttendance
+		err := rows.Scan(&attendance.userID, &attendance.scheduledActivityID, &attendance.scheduledAt,
+			&attendance.offsets, &attendance.timeZone)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan upcoming activity: %v", err)
+		}
+		attendances = append(attendances, attendance)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read upcoming activities: %v", err)
+	}
+
+	sent := 0
+	for _, attendance := range attendances {
+		if ctx.Err() != nil {
+			return sent, ctx.Err()
+		}
+
+		due := dueOffsets(attendance, now)
+		if len(due) == 0 {
+			continue
+		}
+
+		ok, err := s.remind(ctx, attendance, due)
+		if err != nil {
+			// One broken reminder should not hold back the others
+			log.Printf("reminder scheduler: user %d, scheduled activity %d: %v", attendance.userID, attendance.scheduledActivityID, err)
+			continue
+		}
+		if ok {
+			sent++
+		}
+	}
+
+	return sent, nil
+}
+
+// dueOffsets returns the offsets whose reminder time has come, latest reminder last
+func dueOffsets(attendance upcomingAttendance, now time.Time) []int {
+	loc, err := time.LoadLocation(attendance.timeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+
+	var due []int
+	for _, offset := range attendance.offsets {
+		if !remindAt(attendance.scheduledAt, offset, loc).After(now) {
+			due = append(due, offset)
+		}
+	}
+	return due
+}
+
+// remindAt returns when the reminder offset minutes before scheduledAt is due. Offsets of whole
+// days go back that many calendar days in loc.
+func remindAt(scheduledAt time.Time, offset int, loc *time.Location) time.Time {
+	if offset%(24*60) == 0 {
+		return scheduledAt.In(loc).AddDate(0, 0, -offset/(24*60))
+	}
+	return scheduledAt.Add(-time.Duration(offset) * time.Minute)
+}
+
+// remind records the due reminders of an attendance and notifies the user of the latest new one.
+// Earlier reminders that were missed, e.g. because the user accepted an hour before the activity,
+// are recorded without being sent so that the user gets one reminder rather than a burst. It
+// reports whether a notification was sent.
+func (s *Scheduler) remind(ctx context.Context, attendance upcomingAttendance, due []int) (bool, error) {
+	tx, err := s.service.db.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	var recorded []int
+	err = tx.QueryRow(ctx,
+		`WITH inserted AS (
+		     INSERT INTO sent_reminders (user_id, scheduled_activity_id, scheduled_at, offset_minutes)
+		     SELECT $1, $2, $3, offset_minutes FROM unnest($4::int[]) AS offset_minutes
+		     ON CONFLICT (user_id, scheduled_activity_id, scheduled_at, offset_minutes) DO NOTHING
+		     RETURNING offset_minutes
+		 )
+		 SELECT COALESCE(array_agg(offset_minutes), '{}') FROM inserted`,
+		attendance.userID, attendance.scheduledActivityID, attendance.scheduledAt, pq.Array(due)).Scan(&recorded)
+	if err != nil {
+		return false, fmt.Errorf("failed to record reminders: %v", err)
+	}
+	if len(recorded) == 0 {
+		return false, nil
+	}
+
+	// The smallest offset is the reminder closest to the activity
+	latest := slices.Min(recorded)
+	if slices.Min(due) != latest {
+		// A closer reminder was already sent, the rest are stale
+		if err := tx.Commit(ctx); err != nil {
+			return false, fmt.Errorf("failed to commit transaction: %v", err)
+		}
+		return false, nil
+	}
+
+	err = notifications.Emit(ctx, tx, notifications.Notification{
+		UserID:              attendance.userID,
+		Type:                notifications.TypeActivityReminder,
+		ScheduledActivityID: &attendance.scheduledActivityID,
+		Data: map[string]interface{}{
+			"offset_minutes": latest,
+			"scheduled_at":   attendance.scheduledAt,
+			"time_zone":      attendance.timeZone,
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to notify user: %v", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return true, nil
+}
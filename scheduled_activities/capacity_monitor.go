@@ -0,0 +1,185 @@
+package scheduled_activities
+
+import (
+	"context"
+	"fmt"
+	"friendsocial/activity_participants"
+	"friendsocial/worker"
+	"log"
+	"time"
+)
+
+// capacityLockKey is the Postgres advisory lock that keeps server instances from enforcing
+// capacity at the same time
+const capacityLockKey int64 = 0x6673636170 // "fscap"
+
+// CapacityMonitor periodically cancels scheduled activities that have not reached their minimum
+// number of accepted participants by the cutoff, and promotes waitlisted participants of
+// activities that have room again, e.g. after an activity's max_participants was raised.
+type CapacityMonitor struct {
+	service  *Service
+	interval time.Duration
+	cutoff   time.Duration
+}
+
+// NewCapacityMonitor creates a CapacityMonitor that runs every interval and cancels under-filled
+// scheduled activities once they start within cutoff
+func NewCapacityMonitor(service *Service, interval time.Duration, cutoff time.Duration) *CapacityMonitor {
+	return &CapacityMonitor{
+		service:  service,
+		interval: interval,
+		cutoff:   cutoff,
+	}
+}
+
+// Run enforces capacity immediately and then every interval until ctx is done, see
+// worker.RunEvery.
+func (m *CapacityMonitor) Run(ctx context.Context) {
+	worker.RunEvery(ctx, m.interval, func(ctx context.Context) {
+		cancelled, promoted, err := m.RunOnce(ctx)
+		if err != nil {
+			log.Printf("capacity monitor: %v", err)
+		} else if len(cancelled) > 0 || promoted > 0 {
+			log.Printf("capacity monitor: cancelled %d scheduled activities, promoted %d waitlisted participants", len(cancelled), promoted)
+		}
+	})
+}
+
+// RunOnce cancels the under-filled scheduled activities that start within the cutoff and promotes
+// waitlisted participants where there is room. It returns the IDs of the cancelled activities and
+// the number of promoted participants, and does nothing if another instance holds the advisory lock.
+func (m *CapacityMonitor) RunOnce(ctx context.Context) ([]int, int, error) {
+	conn, err := m.service.db.Acquire(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to acquire connection: %v", err)
+	}
+	defer conn.Release()
+
+	var locked bool
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", capacityLockKey).Scan(&locked); err != nil {
+		return nil, 0, fmt.Errorf("failed to take advisory lock: %v", err)
+	}
+	if !locked {
+		return nil, 0, nil
+	}
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", capacityLockKey)
+
+	now := time.Now()
+
+	cancelled, err := m.cancelUnderfilled(ctx, now)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := conn.Query(ctx,
+		`SELECT DISTINCT sa.id
+		 FROM scheduled_activities sa
+		 JOIN activity_participants ap ON ap.scheduled_activity_id = sa.id
+		 WHERE sa.is_active AND sa.scheduled_at > $1 AND ap.invite_status = 'Waitlisted'`,
+		now)
+	if err != nil {
+		return cancelled, 0, fmt.Errorf("failed to read waitlists: %v", err)
+	}
+	var waitlisted []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return cancelled, 0, fmt.Errorf("failed to scan waitlisted scheduled activity: %v", err)
+		}
+		waitlisted = append(waitlisted, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return cancelled, 0, fmt.Errorf("waitlist rows iteration error: %v", err)
+	}
+
+	promoted := 0
+	for _, id := range waitlisted {
+		if ctx.Err() != nil {
+			return cancelled, promoted, ctx.Err()
+		}
+
+		participants, err := m.promote(ctx, id)
+		if err != nil {
+			// One broken waitlist should not hold back the others
+			log.Printf("capacity monitor: scheduled activity %d: %v", id, err)
+			continue
+		}
+		promoted += len(participants)
+	}
+
+	return cancelled, promoted, nil
+}
+
+// cancelUnderfilled deactivates the scheduled activities that start within the cutoff without
+// enough accepted participants and tells their attendees
+func (m *CapacityMonitor) cancelUnderfilled(ctx context.Context, now time.Time) ([]int, error) {
+	tx, err := m.service.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	rows, err := tx.Query(ctx,
+		`UPDATE scheduled_activities sa
+		 SET is_active = FALSE
+		 FROM activities a
+		 WHERE a.id = sa.activity_id
+		   AND sa.is_active AND sa.scheduled_at > $1 AND sa.scheduled_at <= $2
+		   AND COALESCE(sa.min_participants, a.min_participants) > (
+		       SELECT count(*) FROM activity_participants ap
+		       WHERE ap.scheduled_activity_id = sa.id AND ap.invite_status = 'Accepted')
+		 RETURNING sa.id`,
+		now, now.Add(m.cutoff))
+	if err != nil {
+		return nil, fmt.Errorf("failed to cancel under-filled scheduled activities: %v", err)
+	}
+	cancelled := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan cancelled scheduled activity: %v", err)
+		}
+		cancelled = append(cancelled, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cancelled rows iteration error: %v", err)
+	}
+
+	for _, id := range cancelled {
+		if err := notifyCancelled(ctx, tx, []int{id}, &id, map[string]interface{}{"reason": reasonMinParticipants}); err != nil {
+			return nil, fmt.Errorf("failed to notify attendees: %v", err)
+		}
+	}
+	if err := publishDeactivatedIDs(ctx, tx, cancelled, reasonMinParticipants); err != nil {
+		return nil, fmt.Errorf("failed to publish events: %v", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return cancelled, nil
+}
+
+func (m *CapacityMonitor) promote(ctx context.Context, scheduledActivityID int) ([]activity_participants.ActivityParticipant, error) {
+	tx, err := m.service.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	participants, err := activity_participants.PromoteWaitlisted(ctx, tx, scheduledActivityID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to promote waitlisted participants: %v", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return participants, nil
+}
@@ -0,0 +1,203 @@
+package scheduled_activities
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/lib/pq"
+)
+
+// participantLockClass is the first key of the per-user advisory locks taken by lockParticipants
+const participantLockClass int32 = 0x66737061 // "fspa"
+
+// Conflict reasons
+const (
+	ConflictScheduledActivity = "scheduled_activity" // the user organizes, attends or is invited to an overlapping activity
+	ConflictUnavailable       = "unavailable"        // the window overlaps one of the user's is_available=false rows
+)
+
+// Conflict describes why one participant cannot attend a requested window
+type Conflict struct {
+	UserID              int       `json:"user_id"`
+	Reason              string    `json:"reason"`
+	RequestedStart      time.Time `json:"requested_start"`
+	RequestedEnd        time.Time `json:"requested_end"`
+	ConflictStart       time.Time `json:"conflict_start"`
+	ConflictEnd         time.Time `json:"conflict_end"`
+	ScheduledActivityID *int      `json:"scheduled_activity_id,omitempty"`
+	ActivityID          *int      `json:"activity_id,omitempty"`
+	AvailabilityID      *int      `json:"availability_id,omitempty"`
+}
+
+// ConflictError is returned when a scheduled activity cannot be created because some of its
+// participants are busy
+type ConflictError struct {
+	Conflicts []Conflict
+}
+
+func (e *ConflictError) Error() string {
+	userIDs := make(map[int]bool)
+	for _, conflict := range e.Conflicts {
+		userIDs[conflict.UserID] = true
+	}
+	return fmt.Sprintf("%d scheduling conflict(s) for %d participant(s)", len(e.Conflicts), len(userIDs))
+}
+
+// window is a requested time range for a scheduled activity
+type window struct {
+	start time.Time
+	end   time.Time
+}
+
+// lockParticipants returns the given users plus, when preferenceID is set, the owner and members of
+// that preference, and takes a transaction advisory lock on each of them in ascending order. Two
+// creations sharing a participant therefore check conflicts and insert one after the other, and
+// the order keeps them from deadlocking.
+func lockParticipants(ctx context.Context, tx pgx.Tx, userIDs []int, preferenceID *int) ([]int, error) {
+	if userIDs == nil {
+		userIDs = []int{}
+	}
+
+	rows, err := tx.Query(
+		ctx,
+		`SELECT unnest($1::int[]) AS user_id
+		 UNION SELECT user_id FROM user_activity_preferences WHERE id = $2
+		 UNION SELECT user_id FROM user_activity_preferences_participants WHERE user_activity_preference_id = $2
+		 ORDER BY 1`,
+		pq.Array(userIDs), preferenceID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read participants: %w", err)
+	}
+	defer rows.Close()
+
+	participantIDs := []int{}
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, fmt.Errorf("failed to scan participant: %w", err)
+		}
+		participantIDs = append(participantIDs, userID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("participant rows iteration error: %w", err)
+	}
+	rows.Close()
+
+	for _, userID := range participantIDs {
+		if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1, $2)", participantLockClass, userID); err != nil {
+			return nil, fmt.Errorf("failed to lock participant %d: %w", userID, err)
+		}
+	}
+
+	return participantIDs, nil
+}
+
+// findConflicts checks every window against the active scheduled activities the users organize or
+// have accepted or pending invitations to, and against their blackout rows in user_availability,
+// in a single query. It runs in the transaction that inserts or moves the activities, after
+// lockParticipants. exceptID is the activity being moved, which cannot conflict with itself, or
+// nil. The result is keyed by the index of the window.
+func findConflicts(ctx context.Context, tx pgx.Tx, userIDs []int, windows []window, loc *time.Location, exceptID *int) (map[int][]Conflict, error) {
+	if len(windows) == 0 {
+		return map[int][]Conflict{}, nil
+	}
+
+	starts := make([]time.Time, len(windows))
+	ends := make([]time.Time, len(windows))
+	dates := make([]time.Time, len(windows))
+	weekdays := make([]string, len(windows))
+	for i, w := range windows {
+		starts[i] = w.start
+		ends[i] = w.end
+		// Weekly and specific_date availability rows refer to the organizer's calendar
+		local := w.start.In(loc)
+		dates[i] = time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.UTC)
+		weekdays[i] = strings.ToLower(local.Weekday().String())
+	}
+	if userIDs == nil {
+		userIDs = []int{}
+	}
+
+	rows, err := tx.Query(
+		ctx,
+		`WITH participants AS (
+		     SELECT unnest($1::int[]) AS user_id),
+		 windows AS (
+		     SELECT * FROM unnest($2::timestamptz[], $3::timestamptz[], $4::date[], $5::text[])
+		         WITH ORDINALITY AS w(window_start, window_end, local_date, weekday, idx)),
+		 booked AS (
+		     SELECT sa.id, sa.activity_id, sa.scheduled_at AS busy_start, sa.scheduled_at + a.estimated_time AS busy_end, ap.user_id
+		     FROM scheduled_activities sa
+		     JOIN activities a ON a.id = sa.activity_id
+		     JOIN activity_participants ap ON ap.scheduled_activity_id = sa.id
+		     WHERE sa.is_active AND sa.id IS DISTINCT FROM $8 AND ap.invite_status IN ('Accepted', 'Pending')
+		       AND ap.user_id IN (SELECT user_id FROM participants)
+		     -- Organizers are not participants of their own activities but attend them all the same.
+		     -- UNION drops the row of an organizer who is also invited.
+		     UNION
+		     SELECT sa.id, sa.activity_id, sa.scheduled_at, sa.scheduled_at + a.estimated_time, sa.organizer_id
+		     FROM scheduled_activities sa
+		     JOIN activities a ON a.id = sa.activity_id
+		     WHERE sa.is_active AND sa.id IS DISTINCT FROM $8 AND sa.organizer_id IN (SELECT user_id FROM participants)),
+		 blackouts AS (
+		     SELECT ua.id, ua.user_id, w.idx,
+		            w.local_date + ua.start_time AS busy_start,
+		            w.local_date + ua.end_time + CASE WHEN ua.end_time <= ua.start_time THEN INTERVAL '1 day' ELSE INTERVAL '0' END AS busy_end
+		     FROM user_availability ua
+		     JOIN windows w ON (ua.specific_date = w.local_date
+		                        OR (ua.specific_date IS NULL AND lower(trim(ua.day_of_week)) = w.weekday))
+		     WHERE NOT ua.is_available AND ua.user_id IN (SELECT user_id FROM participants))
+		 SELECT w.idx, b.user_id, $6::text, b.busy_start, b.busy_end, b.id, b.activity_id, NULL::int
+		 FROM windows w
+		 JOIN booked b ON b.busy_start < w.window_end AND b.busy_end > w.window_start
+		 UNION ALL
+		 SELECT w.idx, bo.user_id, $7::text, bo.busy_start, bo.busy_end, NULL::int, NULL::int, bo.id
+		 FROM windows w
+		 JOIN blackouts bo ON bo.idx = w.idx AND bo.busy_start < w.window_end AND bo.busy_end > w.window_start
+		 ORDER BY 1, 2, 4`,
+		pq.Array(userIDs), starts, ends, dates, weekdays, ConflictScheduledActivity, ConflictUnavailable, exceptID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check conflicts: %w", err)
+	}
+	defer rows.Close()
+
+	conflicts := make(map[int][]Conflict)
+	for rows.Next() {
+		var idx int
+		var conflict Conflict
+		if err := rows.Scan(&idx, &conflict.UserID, &conflict.Reason, &conflict.ConflictStart, &conflict.ConflictEnd, &conflict.ScheduledActivityID, &conflict.ActivityID, &conflict.AvailabilityID); err != nil {
+			return nil, fmt.Errorf("failed to scan conflict: %w", err)
+		}
+		// WITH ORDINALITY counts from 1
+		idx--
+		conflict.RequestedStart = windows[idx].start
+		conflict.RequestedEnd = windows[idx].end
+		conflicts[idx] = append(conflicts[idx], conflict)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("conflict rows iteration error: %w", err)
+	}
+
+	return conflicts, nil
+}
+
+// flattenConflicts lists conflicts in window order
+func flattenConflicts(conflicts map[int][]Conflict) []Conflict {
+	indexes := make([]int, 0, len(conflicts))
+	for idx := range conflicts {
+		indexes = append(indexes, idx)
+	}
+	sort.Ints(indexes)
+
+	flattened := []Conflict{}
+	for _, idx := range indexes {
+		flattened = append(flattened, conflicts[idx]...)
+	}
+	return flattened
+}
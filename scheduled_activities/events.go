@@ -0,0 +1,83 @@
+package scheduled_activities
+
+import (
+	"context"
+	"friendsocial/webhooks"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/lib/pq"
+)
+
+// Reasons given in scheduled_activity.deactivated events
+const (
+	reasonCancelled       = "cancelled"        // is_active was turned off
+	reasonDeleted         = "deleted"          // the row was deleted
+	reasonSeriesChanged   = "series_changed"   // the series' new rule no longer produces the occurrence
+	reasonMinParticipants = "min_participants" // not enough participants accepted by the cutoff
+)
+
+// publishCreated writes a scheduled_activity.created event to the outbox. Publish it after the
+// invitations, so that the invitees' webhooks receive it too.
+func publishCreated(ctx context.Context, tx pgx.Tx, scheduledActivity ScheduledActivity) error {
+	return webhooks.Publish(ctx, tx, webhooks.EventScheduledActivityCreated, scheduledActivity.ID, map[string]interface{}{
+		"scheduled_activity": scheduledActivity,
+	})
+}
+
+// publishChange writes a rescheduled or deactivated event for an edited scheduled activity
+func publishChange(ctx context.Context, tx pgx.Tx, before ScheduledActivity, after ScheduledActivity) error {
+	switch {
+	case before.IsActive && !after.IsActive:
+		return publishDeactivated(ctx, tx, after, reasonCancelled)
+	case after.IsActive && !after.ScheduledAt.Equal(before.ScheduledAt):
+		return webhooks.Publish(ctx, tx, webhooks.EventScheduledActivityRescheduled, after.ID, map[string]interface{}{
+			"scheduled_activity":    after,
+			"previous_scheduled_at": before.ScheduledAt,
+		})
+	}
+	return nil
+}
+
+// publishDeactivated writes a scheduled_activity.deactivated event to the outbox. Deleted
+// scheduled activities must be published before the row goes.
+func publishDeactivated(ctx context.Context, tx pgx.Tx, scheduledActivity ScheduledActivity, reason string) error {
+	return webhooks.Publish(ctx, tx, webhooks.EventScheduledActivityDeactivated, scheduledActivity.ID, map[string]interface{}{
+		"scheduled_activity": scheduledActivity,
+		"reason":             reason,
+	})
+}
+
+// publishDeactivatedIDs publishes publishDeactivated for each of the scheduled activities
+func publishDeactivatedIDs(ctx context.Context, tx pgx.Tx, scheduledActivityIDs []int, reason string) error {
+	if len(scheduledActivityIDs) == 0 {
+		return nil
+	}
+
+	rows, err := tx.Query(ctx,
+		"SELECT "+scheduledActivityColumns+" FROM scheduled_activities WHERE id = ANY($1) ORDER BY id",
+		pq.Array(scheduledActivityIDs))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var scheduledActivities []ScheduledActivity
+	for rows.Next() {
+		scheduledActivity, err := scanScheduledActivity(rows)
+		if err != nil {
+			return err
+		}
+		scheduledActivities = append(scheduledActivities, scheduledActivity)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, scheduledActivity := range scheduledActivities {
+		if err := publishDeactivated(ctx, tx, scheduledActivity, reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
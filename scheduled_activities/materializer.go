@@ -0,0 +1,123 @@
+package scheduled_activities
+
+import (
+	"context"
+	"fmt"
+	"friendsocial/user_activity_preferences"
+	"friendsocial/worker"
+	"log"
+	"time"
+)
+
+// materializerLockKey is the Postgres advisory lock that keeps server instances from materializing
+// series at the same time
+const materializerLockKey int64 = 0x66736d6174 // "fsmat"
+
+// Materializer periodically extends every recurring series so that its scheduled activities exist
+// up to the service's horizon. Progress is stored in user_activity_preferences.materialized_until,
+// so a restarted server picks up where the last run stopped.
+type Materializer struct {
+	service  *Service
+	interval time.Duration
+}
+
+// NewMaterializer creates a Materializer that runs every interval
+func NewMaterializer(service *Service, interval time.Duration) *Materializer {
+	return &Materializer{
+		service:  service,
+		interval: interval,
+	}
+}
+
+// Run materializes series immediately and then every interval until ctx is done, see
+// worker.RunEvery.
+func (m *Materializer) Run(ctx context.Context) {
+	worker.RunEvery(ctx, m.interval, func(ctx context.Context) {
+		created, err := m.RunOnce(ctx)
+		if err != nil {
+			log.Printf("materializer: %v", err)
+		} else if created > 0 {
+			log.Printf("materializer: created %d scheduled activities", created)
+		}
+	})
+}
+
+// RunOnce extends every series that is behind the horizon and returns how many scheduled
+// activities were created. It does nothing if another instance holds the advisory lock.
+func (m *Materializer) RunOnce(ctx context.Context) (int, error) {
+	conn, err := m.service.db.Acquire(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to acquire connection: %v", err)
+	}
+	defer conn.Release()
+
+	var locked bool
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", materializerLockKey).Scan(&locked); err != nil {
+		return 0, fmt.Errorf("failed to take advisory lock: %v", err)
+	}
+	if !locked {
+		return 0, nil
+	}
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", materializerLockKey)
+
+	now := time.Now()
+	horizon := now.Add(m.service.horizon)
+
+	preferences, err := m.service.preferences.ReadDueForMaterialization(ctx, horizon)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read recurring preferences: %v", err)
+	}
+
+	created := 0
+	for _, preference := range preferences {
+		if ctx.Err() != nil {
+			return created, ctx.Err()
+		}
+
+		from := now
+		if preference.MaterializedUntil != nil && preference.MaterializedUntil.After(from) {
+			from = *preference.MaterializedUntil
+		}
+
+		scheduledActivities, err := m.materializePreference(ctx, preference, from, horizon)
+		if err != nil {
+			// One broken series should not hold back the others
+			log.Printf("materializer: preference %d: %v", preference.ID, err)
+			continue
+		}
+		created += len(scheduledActivities)
+	}
+
+	return created, nil
+}
+
+func (m *Materializer) materializePreference(ctx context.Context, preference user_activity_preferences.UserActivityPreference, from time.Time, to time.Time) ([]ScheduledActivity, error) {
+	tx, err := m.service.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	// The series may have been edited or deleted since it was read
+	preference, found, err := user_activity_preferences.ReadForUpdate(ctx, tx, preference.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !found || preference.RRule == "" {
+		return nil, nil
+	}
+	if preference.MaterializedUntil != nil && preference.MaterializedUntil.After(from) {
+		from = *preference.MaterializedUntil
+	}
+
+	scheduledActivities, err := materialize(ctx, tx, preference, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return scheduledActivities, nil
+}
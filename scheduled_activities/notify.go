@@ -0,0 +1,77 @@
+package scheduled_activities
+
+import (
+	"context"
+	"friendsocial/notifications"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// notifyChange tells the attendees of a scheduled activity that it was cancelled or moved
+func notifyChange(ctx context.Context, tx pgx.Tx, before ScheduledActivity, after ScheduledActivity) error {
+	switch {
+	case before.IsActive && !after.IsActive:
+		return notifyCancelled(ctx, tx, []int{after.ID}, &after.ID, map[string]interface{}{
+			"scheduled_at": after.ScheduledAt,
+		})
+	case after.IsActive && !after.ScheduledAt.Equal(before.ScheduledAt):
+		return notifications.EmitToAttendees(ctx, tx, []int{after.ID}, notifications.Notification{
+			Type:                notifications.TypeActivityRescheduled,
+			ScheduledActivityID: &after.ID,
+			Data: map[string]interface{}{
+				"previous_scheduled_at": before.ScheduledAt,
+				"scheduled_at":          after.ScheduledAt,
+			},
+		})
+	}
+	return nil
+}
+
+// notifyCancelled tells the attendees of scheduled activities that they will not take place. It
+// must run before the rows are deleted, since their invitations go with them.
+func notifyCancelled(ctx context.Context, tx pgx.Tx, scheduledActivityIDs []int, scheduledActivityID *int, data map[string]interface{}) error {
+	if len(scheduledActivityIDs) == 0 {
+		return nil
+	}
+	return notifications.EmitToAttendees(ctx, tx, scheduledActivityIDs, notifications.Notification{
+		Type:                notifications.TypeActivityCancelled,
+		ScheduledActivityID: scheduledActivityID,
+		Data:                data,
+	})
+}
+
+// notifyInvited tells each user invited to new scheduled activities, such as a series' new
+// occurrences, about them once, pointing at the first one
+func notifyInvited(ctx context.Context, tx pgx.Tx, organizerID *int, preferenceID *int, invited map[int][]int) error {
+	for userID, scheduledActivityIDs := range invited {
+		first := scheduledActivityIDs[0]
+		for _, id := range scheduledActivityIDs[1:] {
+			if id < first {
+				first = id
+			}
+		}
+		data := map[string]interface{}{
+			"occurrences": len(scheduledActivityIDs),
+		}
+		if preferenceID != nil {
+			data["user_activity_preference_id"] = *preferenceID
+		}
+		err := notifications.Emit(ctx, tx, notifications.Notification{
+			UserID:              userID,
+			Type:                notifications.TypeActivityInvite,
+			ActorID:             organizerID,
+			ScheduledActivityID: &first,
+			Data:                data,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upcoming reports whether a scheduled activity is still worth announcing changes for
+func upcoming(scheduledActivity ScheduledActivity) bool {
+	return scheduledActivity.IsActive && scheduledActivity.ScheduledAt.After(time.Now())
+}
@@ -1,7 +1,12 @@
 package scheduled_activities
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"friendsocial/activity_participants"
+	"friendsocial/auth"
+	"friendsocial/query"
 	"friendsocial/user_activity_preferences"
 	"net/http"
 	"strconv"
@@ -10,14 +15,17 @@ import (
 
 // ScheduledActivityService defines the interface for scheduled activity operations.
 type ScheduledActivityService interface {
-	Create(scheduledActivity ScheduledActivity) (ScheduledActivity, error)
-	CreateMultiple(activityID int, selectedDates []string, startTime string, endTime string, timeZone string) ([]ScheduledActivity, error)
-	ReadAll() ([]ScheduledActivity, error)
-	Read(ids []int) ([]ScheduledActivity, error)
-	Update(id string, scheduledActivity ScheduledActivity) (ScheduledActivity, bool, error)
-	Delete(id string) (bool, error)
-	CreateRepeatingScheduledActivity(preference user_activity_preferences.UserActivityPreference, startTime string, timeZone string) ([]ScheduledActivity, error)
-	DeclineRepeatedActivity(userID int, scheduledActivityID int) error
+	Create(ctx context.Context, scheduledActivity ScheduledActivity, participantIDs []int) (ScheduledActivity, error)
+	CreateMultiple(ctx context.Context, organizerID int, activityID int, selectedDates []string, startTime string, endTime string, timeZone string, participantIDs []int) ([]ScheduledActivity, []Conflict, error)
+	ReadAll(ctx context.Context, params query.Params) (query.Page[ScheduledActivity], error)
+	Read(ctx context.Context, ids []int) ([]ScheduledActivity, error)
+	Update(ctx context.Context, id string, scheduledActivity ScheduledActivity) (ScheduledActivity, bool, error)
+	Delete(ctx context.Context, id string) (bool, error)
+	CreateRepeatingScheduledActivity(ctx context.Context, preference user_activity_preferences.UserActivityPreference, startTime string, timeZone string) ([]ScheduledActivity, error)
+	DeclineRepeatedActivity(ctx context.Context, userID int, scheduledActivityID int) error
+	CanEdit(ctx context.Context, id string, userID int) (bool, error)
+	EditSeries(ctx context.Context, id string, edit SeriesEdit) (SeriesEditResult, bool, error)
+	OwnsSeries(ctx context.Context, id string, userID int) (bool, error)
 }
 
 // ScheduledActivityError represents an error response.
@@ -28,42 +36,75 @@ type ScheduledActivityError struct {
 	Error      string `json:"error"`
 }
 
+// ScheduledActivityConflictError is the error response for a scheduled activity whose participants are busy
+type ScheduledActivityConflictError struct {
+	StatusCode int        `json:"status_code"`
+	Error      string     `json:"error"`
+	Conflicts  []Conflict `json:"conflicts"`
+}
+
 // ScheduledActivityHTTPHandler is the HTTP handler for scheduled activity operations.
 type ScheduledActivityHTTPHandler struct {
 	scheduledActivityService ScheduledActivityService
-	services                 *map[string]interface{}
+	preferences              PreferenceReader
 }
 
-// NewScheduledActivityHTTPHandler creates a new ScheduledActivityHTTPHandler.
-func NewScheduledActivityHTTPHandler(scheduledActivityService ScheduledActivityService, services *map[string]interface{}) *ScheduledActivityHTTPHandler {
+// NewScheduledActivityHTTPHandler creates a new ScheduledActivityHTTPHandler. The preferences are
+// read when a series is created from one.
+func NewScheduledActivityHTTPHandler(scheduledActivityService ScheduledActivityService, preferences PreferenceReader) *ScheduledActivityHTTPHandler {
 	return &ScheduledActivityHTTPHandler{
 		scheduledActivityService: scheduledActivityService,
-		services:                 services,
+		preferences:              preferences,
 	}
 }
 
+// CreateRequest is a scheduled activity along with the users who will be invited to it
+type CreateRequest struct {
+	ScheduledActivity
+	ParticipantIDs []int `json:"participant_ids"`
+}
+
 // HandleHTTPPost handles the creation of a new user activity.
 //
 //	@Summary		Create a new scheduled activity
-//	@Description	Create a new scheduled activity
+//	@Description	Create a new scheduled activity and invite its participants if none of them, nor the organizer, are busy. Only the owner of user_activity_preference_id may set it, which invites the preference's members too.
 //	@Tags			scheduled_activities
 //	@Accept			json
 //	@Produce		json
-//	@Param			userActivity	body		UserActivity	true	"User Activity"
-//	@Success		201				{object}	ScheduledActivity
-//	@Failure		400				{object}	ScheduledActivityError
-//	@Failure		500				{object}	ScheduledActivityError
+//	@Param			request	body		CreateRequest	true	"Scheduled activity and participant IDs"
+//	@Success		201		{object}	ScheduledActivity
+//	@Failure		400		{object}	ScheduledActivityError
+//	@Failure		403		{object}	ScheduledActivityError
+//	@Failure		409		{object}	ScheduledActivityConflictError
+//	@Failure		500		{object}	ScheduledActivityError
 //	@Router			/scheduled_activity [post]
 func (uH *ScheduledActivityHTTPHandler) HandleHTTPPost(w http.ResponseWriter, r *http.Request) {
-	var scheduledActivity ScheduledActivity
-	err := json.NewDecoder(r.Body).Decode(&scheduledActivity)
+	var request CreateRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
 		uH.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	newScheduledActivity, err := uH.scheduledActivityService.Create(scheduledActivity)
+	// The caller organizes what they create, whatever the body says
+	callerID, _ := auth.CallerID(r.Context())
+	request.ScheduledActivity.OrganizerID = &callerID
+
+	newScheduledActivity, err := uH.scheduledActivityService.Create(r.Context(), request.ScheduledActivity, request.ParticipantIDs)
 	if err != nil {
+		var conflictErr *ConflictError
+		if errors.As(err, &conflictErr) {
+			uH.conflictResponse(w, conflictErr)
+			return
+		}
+		if err == activity_participants.ErrInvalidCapacity {
+			uH.errorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err == activity_participants.ErrBlocked {
+			uH.errorResponse(w, http.StatusForbidden, err.Error())
+			return
+		}
 		uH.errorResponse(w, http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -78,23 +119,32 @@ func (uH *ScheduledActivityHTTPHandler) HandleHTTPPost(w http.ResponseWriter, r
 }
 
 type CreateMultipleRequest struct {
-	ActivityID    int      `json:"activity_id"`
-	SelectedDates []string `json:"selected_dates"`
-	StartTime     string   `json:"start_time"`
-	EndTime       string   `json:"end_time"`
-	TimeZone      string   `json:"time_zone"`
+	ActivityID     int      `json:"activity_id"`
+	SelectedDates  []string `json:"selected_dates"`
+	StartTime      string   `json:"start_time"`
+	EndTime        string   `json:"end_time"`
+	TimeZone       string   `json:"time_zone"`
+	ParticipantIDs []int    `json:"participant_ids"`
+}
+
+// CreateMultipleResponse lists the scheduled activities that were created and the conflicts that
+// kept the remaining dates from being scheduled
+type CreateMultipleResponse struct {
+	ScheduledActivities []ScheduledActivity `json:"scheduled_activities"`
+	Conflicts           []Conflict          `json:"conflicts"`
 }
 
 // HandleHTTPPostMultiple handles the creation of multiple scheduled activities.
 //
 //	@Summary		Create multiple scheduled activities
-//	@Description	Create multiple scheduled activities
+//	@Description	Schedule an activity on each selected date and invite the participants, reporting the dates where participants are busy
 //	@Tags			scheduled_activities
 //	@Accept			json
 //	@Produce		json
-//	@Param			scheduledActivities	body		[]ScheduledActivity	true	"Scheduled Activities"
-//	@Success		201				{object}	ScheduledActivity
+//	@Param			request	body		CreateMultipleRequest	true	"Activity, dates, times and participant IDs"
+//	@Success		201				{object}	CreateMultipleResponse
 //	@Failure		400				{object}	ScheduledActivityError
+//	@Failure		403				{object}	ScheduledActivityError
 //	@Failure		500				{object}	ScheduledActivityError
 //	@Router			/scheduled_activities [post]
 func (uH *ScheduledActivityHTTPHandler) HandleHTTPPostMultiple(w http.ResponseWriter, r *http.Request) {
@@ -105,13 +155,21 @@ func (uH *ScheduledActivityHTTPHandler) HandleHTTPPostMultiple(w http.ResponseWr
 		return
 	}
 
-	newScheduledActivities, err := uH.scheduledActivityService.CreateMultiple(
+	callerID, _ := auth.CallerID(r.Context())
+	newScheduledActivities, conflicts, err := uH.scheduledActivityService.CreateMultiple(
+		r.Context(),
+		callerID,
 		createMultipleRequest.ActivityID,
 		createMultipleRequest.SelectedDates,
 		createMultipleRequest.StartTime,
 		createMultipleRequest.EndTime,
 		createMultipleRequest.TimeZone,
+		createMultipleRequest.ParticipantIDs,
 	)
+	if err == activity_participants.ErrBlocked {
+		uH.errorResponse(w, http.StatusForbidden, err.Error())
+		return
+	}
 	if err != nil {
 		uH.errorResponse(w, http.StatusInternalServerError, err.Error())
 		return
@@ -119,7 +177,13 @@ func (uH *ScheduledActivityHTTPHandler) HandleHTTPPostMultiple(w http.ResponseWr
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	err = json.NewEncoder(w).Encode(newScheduledActivities)
+	if newScheduledActivities == nil {
+		newScheduledActivities = []ScheduledActivity{}
+	}
+	err = json.NewEncoder(w).Encode(CreateMultipleResponse{
+		ScheduledActivities: newScheduledActivities,
+		Conflicts:           conflicts,
+	})
 	if err != nil {
 		uH.errorResponse(w, http.StatusInternalServerError, err.Error())
 		return
@@ -129,21 +193,29 @@ func (uH *ScheduledActivityHTTPHandler) HandleHTTPPostMultiple(w http.ResponseWr
 // HandleHTTPGet handles fetching all scheduled activities.
 //
 //	@Summary		Get all scheduled activities
-//	@Description	Get all scheduled activities
+//	@Description	Get all scheduled activities. Filter with id, activity_id, is_active, scheduled_at, user_activity_preference_id and is_exception, e.g. ?scheduled_at>=2024-09-01&is_active=true
 //	@Tags			scheduled_activities
 //	@Produce		json
-//	@Param			ids	query		[]string	false	"Scheduled Activity IDs"
-//	@Success		200	{array}		ScheduledActivity
-//	@Failure		400	{object}	ScheduledActivityError
-//	@Failure		500	{object}	ScheduledActivityError
+//	@Param			limit	query		int		false	"Items per page, defaults to 50, at most 200"
+//	@Param			cursor	query		string	false	"next_cursor of the previous page"
+//	@Param			sort	query		string	false	"Field to sort by, prefixed with - for descending: id, scheduled_at"
+//	@Success		200		{object}	query.Page[ScheduledActivity]
+//	@Failure		400		{object}	ScheduledActivityError
+//	@Failure		500		{object}	ScheduledActivityError
 //	@Router			/scheduled_activity [get]
 func (uH *ScheduledActivityHTTPHandler) HandleHTTPGet(w http.ResponseWriter, r *http.Request) {
-	scheduledActivities, err := uH.scheduledActivityService.ReadAll()
+	params, err := query.Parse(r.URL.RawQuery, listSpec)
 	if err != nil {
 		uH.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
+	scheduledActivities, err := uH.scheduledActivityService.ReadAll(r.Context(), params)
+	if err != nil {
+		uH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(scheduledActivities)
 	if err != nil {
@@ -177,7 +249,7 @@ func (uH *ScheduledActivityHTTPHandler) HandleHTTPGetWithID(w http.ResponseWrite
 		}
 		intIDs = append(intIDs, intID)
 	}
-	scheduledActivities, err := uH.scheduledActivityService.Read(intIDs)
+	scheduledActivities, err := uH.scheduledActivityService.Read(r.Context(), intIDs)
 	if err != nil {
 		uH.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -199,7 +271,7 @@ func (uH *ScheduledActivityHTTPHandler) HandleHTTPGetWithID(w http.ResponseWrite
 // HandleHTTPPut handles updating a user activity by ID.
 //
 //	@Summary		Update a user activity by ID
-//	@Description	Update a user activity by ID
+//	@Description	Update a user activity by ID. Moving it fails if the organizer or a participant is busy at the new time. user_activity_preference_id cannot be changed.
 //	@Tags			scheduled_activities
 //	@Accept			json
 //	@Produce		json
@@ -208,6 +280,7 @@ func (uH *ScheduledActivityHTTPHandler) HandleHTTPGetWithID(w http.ResponseWrite
 //	@Success		200				{object}	ScheduledActivity
 //	@Failure		400				{object}	ScheduledActivityError
 //	@Failure		404				{object}	ScheduledActivityError
+//	@Failure		409				{object}	ScheduledActivityConflictError
 //	@Failure		500				{object}	ScheduledActivityError
 //	@Router			/scheduled_activities/{id} [put]
 func (uH *ScheduledActivityHTTPHandler) HandleHTTPPut(w http.ResponseWriter, r *http.Request) {
@@ -220,8 +293,13 @@ func (uH *ScheduledActivityHTTPHandler) HandleHTTPPut(w http.ResponseWriter, r *
 		return
 	}
 
-	scheduledActivity, found, err := uH.scheduledActivityService.Update(id, updatedScheduledActivity)
+	scheduledActivity, found, err := uH.scheduledActivityService.Update(r.Context(), id, updatedScheduledActivity)
 	if err != nil {
+		var conflictErr *ConflictError
+		if errors.As(err, &conflictErr) {
+			uH.conflictResponse(w, conflictErr)
+			return
+		}
 		uH.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
 	}
@@ -239,6 +317,53 @@ func (uH *ScheduledActivityHTTPHandler) HandleHTTPPut(w http.ResponseWriter, r *
 	}
 }
 
+// HandleHTTPPutSeries handles editing one, the following or all occurrences of a recurring series.
+//
+//	@Summary		Edit a recurring series
+//	@Description	Edit this occurrence only (it becomes an exception), this and following occurrences (the series is split), or all upcoming occurrences. Unaffected occurrences keep their RSVPs. Moving dtstart to another time of day moves the exdates with it.
+//	@Tags			scheduled_activities
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		string		true	"Scheduled Activity ID"
+//	@Param			edit	body		SeriesEdit	true	"Scope and changes"
+//	@Success		200		{object}	SeriesEditResult
+//	@Failure		400		{object}	ScheduledActivityError
+//	@Failure		404		{object}	ScheduledActivityError
+//	@Failure		500		{object}	ScheduledActivityError
+//	@Router			/scheduled_activity/{id}/series [put]
+func (uH *ScheduledActivityHTTPHandler) HandleHTTPPutSeries(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	var edit SeriesEdit
+	err := json.NewDecoder(r.Body).Decode(&edit)
+	if err != nil {
+		uH.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result, found, err := uH.scheduledActivityService.EditSeries(r.Context(), id, edit)
+	if err != nil {
+		if errors.Is(err, ErrInvalidSeriesEdit) || errors.Is(err, ErrNotInSeries) || errors.Is(err, user_activity_preferences.ErrInvalidRecurrence) {
+			uH.errorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		uH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if !found {
+		uH.errorResponse(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		uH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
 // HandleHTTPDelete handles deleting a user activity by ID.
 //
 //	@Summary		Delete a user activity by ID
@@ -253,7 +378,7 @@ func (uH *ScheduledActivityHTTPHandler) HandleHTTPPut(w http.ResponseWriter, r *
 func (uH *ScheduledActivityHTTPHandler) HandleHTTPDelete(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 
-	found, err := uH.scheduledActivityService.Delete(id)
+	found, err := uH.scheduledActivityService.Delete(r.Context(), id)
 	if err != nil {
 		uH.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -267,6 +392,91 @@ func (uH *ScheduledActivityHTTPHandler) HandleHTTPDelete(w http.ResponseWriter,
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// RegisterRoutes adds the scheduled activity routes to mux
+func (uH *ScheduledActivityHTTPHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("POST /scheduled_activity", uH.HandleHTTPPost)
+	mux.HandleFunc("POST /scheduled_activities", uH.HandleHTTPPostMultiple)
+	mux.HandleFunc("GET /scheduled_activities", uH.HandleHTTPGet)
+	mux.HandleFunc("GET /scheduled_activities/{ids}", uH.HandleHTTPGetWithID)
+	mux.HandleFunc("PUT /scheduled_activity/{id}", uH.HandleHTTPPut)
+	mux.HandleFunc("PUT /scheduled_activity/{id}/series", uH.HandleHTTPPutSeries)
+	mux.HandleFunc("DELETE /scheduled_activity/{id}", uH.HandleHTTPDelete)
+	mux.HandleFunc("POST /scheduled_activity/repeat", uH.HandleHTTPPostRepeatScheduledActivity)
+	mux.HandleFunc("POST /scheduled_activity/repeat/decline", uH.HandleHTTPPostDeclineRepeatedActivity)
+}
+
+// AuthorizationRules returns the ownership rules for scheduled activity routes
+func (uH *ScheduledActivityHTTPHandler) AuthorizationRules() map[string]auth.Rule {
+	return map[string]auth.Rule{
+		"POST /scheduled_activity":                uH.ownsBodyActivityPreference,
+		"PUT /scheduled_activity/{id}":            uH.canEdit,
+		"DELETE /scheduled_activity/{id}":         uH.canEdit,
+		"PUT /scheduled_activity/{id}/series":     uH.ownsSeries,
+		"POST /scheduled_activity/repeat":         uH.ownsBodyPreference,
+		"POST /scheduled_activity/repeat/decline": uH.isBodyUser,
+	}
+}
+
+// canEdit allows only the organizer of the scheduled activity in the path
+func (uH *ScheduledActivityHTTPHandler) canEdit(r *http.Request, callerID int) (bool, error) {
+	return uH.scheduledActivityService.CanEdit(r.Context(), r.PathValue("id"), callerID)
+}
+
+// ownsSeries allows only the organizer to change a whole series
+func (uH *ScheduledActivityHTTPHandler) ownsSeries(r *http.Request, callerID int) (bool, error) {
+	return uH.scheduledActivityService.OwnsSeries(r.Context(), r.PathValue("id"), callerID)
+}
+
+// ownsBodyPreference allows only the owner of a preference to expand it into scheduled activities
+func (uH *ScheduledActivityHTTPHandler) ownsBodyPreference(r *http.Request, callerID int) (bool, error) {
+	var request RepeatScheduledActivityRequest
+	if err := auth.PeekJSON(r, &request); err != nil {
+		// Let the handler answer 400
+		return true, nil
+	}
+
+	preference, found, err := uH.preferences.Read(r.Context(), request.PreferenceID)
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		// Let the handler report the missing preference
+		return true, nil
+	}
+	return preference.UserID == callerID, nil
+}
+
+// ownsBodyActivityPreference allows only the owner of a preference to schedule an activity for it,
+// which invites the preference's members and makes the activity part of its series
+func (uH *ScheduledActivityHTTPHandler) ownsBodyActivityPreference(r *http.Request, callerID int) (bool, error) {
+	var request CreateRequest
+	if err := auth.PeekJSON(r, &request); err != nil {
+		// Let the handler answer 400
+		return true, nil
+	}
+	if request.UserActivityPreferenceID == nil {
+		return true, nil
+	}
+
+	preference, found, err := uH.preferences.Read(r.Context(), strconv.Itoa(*request.UserActivityPreferenceID))
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		return false, nil
+	}
+	return preference.UserID == callerID, nil
+}
+
+// isBodyUser stops callers from declining a series on behalf of someone else
+func (uH *ScheduledActivityHTTPHandler) isBodyUser(r *http.Request, callerID int) (bool, error) {
+	var request DeclineRepeatedActivityRequest
+	if err := auth.PeekJSON(r, &request); err != nil {
+		return true, nil
+	}
+	return request.UserID == strconv.Itoa(callerID), nil
+}
+
 func (uH *ScheduledActivityHTTPHandler) errorResponse(w http.ResponseWriter, statusCode int, errorString string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
@@ -279,6 +489,20 @@ func (uH *ScheduledActivityHTTPHandler) errorResponse(w http.ResponseWriter, sta
 	}
 }
 
+// conflictResponse sends a 409 listing the participants who are busy
+func (uH *ScheduledActivityHTTPHandler) conflictResponse(w http.ResponseWriter, conflictErr *ConflictError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	encodingError := json.NewEncoder(w).Encode(ScheduledActivityConflictError{
+		StatusCode: http.StatusConflict,
+		Error:      conflictErr.Error(),
+		Conflicts:  conflictErr.Conflicts,
+	})
+	if encodingError != nil {
+		http.Error(w, encodingError.Error(), http.StatusInternalServerError)
+	}
+}
+
 type RepeatScheduledActivityRequest struct {
 	PreferenceID string `json:"preference_id"`
 	StartTime    string `json:"start_time"`
@@ -305,14 +529,18 @@ func (h *ScheduledActivityHTTPHandler) HandleHTTPPostRepeatScheduledActivity(w h
 		return
 	}
 
-	preference, _, err := (*h.services)["user_activity_preferences"].(user_activity_preferences.UserActivityPreferenceService).Read(request.PreferenceID)
+	preference, _, err := h.preferences.Read(r.Context(), request.PreferenceID)
 	if err != nil {
 		h.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	scheduledActivities, err := h.scheduledActivityService.CreateRepeatingScheduledActivity(preference, request.StartTime, request.TimeZone)
+	scheduledActivities, err := h.scheduledActivityService.CreateRepeatingScheduledActivity(r.Context(), preference, request.StartTime, request.TimeZone)
 	if err != nil {
+		if errors.Is(err, user_activity_preferences.ErrInvalidRecurrence) {
+			h.errorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
 		h.errorResponse(w, http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -364,7 +592,7 @@ func (h *ScheduledActivityHTTPHandler) HandleHTTPPostDeclineRepeatedActivity(w h
 		return
 	}
 
-	err = h.scheduledActivityService.DeclineRepeatedActivity(userID, scheduledActivityID)
+	err = h.scheduledActivityService.DeclineRepeatedActivity(r.Context(), userID, scheduledActivityID)
 
 	if err != nil {
 		h.errorResponse(w, http.StatusInternalServerError, err.Error())
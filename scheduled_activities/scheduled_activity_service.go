@@ -3,12 +3,13 @@ package scheduled_activities
 import (
 	"context"
 	"fmt"
+	"friendsocial/activity_participants"
+	"friendsocial/query"
 	"friendsocial/user_activity_preferences"
-	"strconv"
-	"strings"
-	"sync"
+	"slices"
 	"time"
 
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/lib/pq"
 )
@@ -19,31 +20,119 @@ type ScheduledActivity struct {
 	IsActive                 bool      `json:"is_active"`
 	ScheduledAt              time.Time `json:"scheduled_at"` // New field for scheduled_at
 	UserActivityPreferenceID *int      `json:"user_activity_preference_id"`
+	// RecurrenceID is the series occurrence the row was generated for. It stays put when the
+	// occurrence is moved.
+	RecurrenceID *time.Time `json:"recurrence_id,omitempty"`
+	IsException  bool       `json:"is_exception"` // edited on its own, kept when the series is regenerated
+	// Participant limits; nil falls back to the activity's
+	MinParticipants *int `json:"min_participants,omitempty"`
+	MaxParticipants *int `json:"max_participants,omitempty"`
+	// OrganizerID is the user who created the activity, or who owns its series. Only they may
+	// edit it; it is set on creation and cannot be changed.
+	OrganizerID *int `json:"organizer_id"`
+}
+
+// scheduledActivityColumns is the column list scanned by scanScheduledActivity
+const scheduledActivityColumns = "id, activity_id, is_active, scheduled_at, user_activity_preference_id, recurrence_id, is_exception, min_participants, max_participants, organizer_id"
+
+func scanScheduledActivity(row pgx.Row) (ScheduledActivity, error) {
+	var scheduledActivity ScheduledActivity
+	err := row.Scan(&scheduledActivity.ID, &scheduledActivity.ActivityID, &scheduledActivity.IsActive, &scheduledActivity.ScheduledAt,
+		&scheduledActivity.UserActivityPreferenceID, &scheduledActivity.RecurrenceID, &scheduledActivity.IsException,
+		&scheduledActivity.MinParticipants, &scheduledActivity.MaxParticipants, &scheduledActivity.OrganizerID)
+	return scheduledActivity, err
+}
+
+// PreferenceReader reads the preferences that recurring series are generated from.
+// *user_activity_preferences.Service implements it.
+type PreferenceReader interface {
+	Read(ctx context.Context, id string) (user_activity_preferences.UserActivityPreference, bool, error)
+	ReadDueForMaterialization(ctx context.Context, until time.Time) ([]user_activity_preferences.UserActivityPreference, error)
 }
 
 type Service struct {
-	sync.Mutex
-	db       *pgxpool.Pool
-	services *map[string]interface{}
+	db          *pgxpool.Pool
+	preferences PreferenceReader
+	horizon     time.Duration // how far ahead recurring series are materialized
 }
 
-func NewService(db *pgxpool.Pool, services *map[string]interface{}) *Service {
+func NewService(db *pgxpool.Pool, preferences PreferenceReader, horizon time.Duration) *Service {
 	return &Service{
-		db:       db,
-		services: services,
+		db:          db,
+		preferences: preferences,
+		horizon:     horizon,
 	}
 }
 
-// Create a new scheduled activity
-func (service *Service) Create(scheduledActivity ScheduledActivity) (ScheduledActivity, error) {
-	service.Lock()
-	defer service.Unlock()
+// Create a new scheduled activity and invite the participants, and the owner and members of its
+// preference if it has one, to it. They and the organizer must be free for the activity's
+// estimated time, otherwise a *ConflictError lists who is busy and why.
+func (service *Service) Create(ctx context.Context, scheduledActivity ScheduledActivity, participantIDs []int) (ScheduledActivity, error) {
+	if err := activity_participants.ValidateCapacity(scheduledActivity.MinParticipants, scheduledActivity.MaxParticipants); err != nil {
+		return ScheduledActivity{}, err
+	}
+
+	estimatedDuration, err := service.getEstimatedTime(ctx, scheduledActivity.ActivityID)
+	if err != nil {
+		return ScheduledActivity{}, fmt.Errorf("failed to get estimated time: %w", err)
+	}
+
+	tx, err := service.db.Begin(ctx)
+	if err != nil {
+		return ScheduledActivity{}, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	attendeeIDs, err := lockParticipants(ctx, tx, withOrganizer(participantIDs, scheduledActivity.OrganizerID), scheduledActivity.UserActivityPreferenceID)
+	if err != nil {
+		return ScheduledActivity{}, err
+	}
+	inviteeIDs := withoutOrganizer(attendeeIDs, scheduledActivity.OrganizerID)
+	if err := checkBlocked(ctx, tx, scheduledActivity.OrganizerID, inviteeIDs); err != nil {
+		return ScheduledActivity{}, err
+	}
+	conflicts, err := findConflicts(
+		ctx,
+		tx,
+		attendeeIDs,
+		[]window{{start: scheduledActivity.ScheduledAt, end: scheduledActivity.ScheduledAt.Add(estimatedDuration)}},
+		scheduledActivity.ScheduledAt.Location(),
+		nil,
+	)
+	if err != nil {
+		return ScheduledActivity{}, err
+	}
+	if len(conflicts) > 0 {
+		return ScheduledActivity{}, &ConflictError{Conflicts: flattenConflicts(conflicts)}
+	}
 
+	scheduledActivity, err = insert(ctx, tx, scheduledActivity)
+	if err != nil {
+		return ScheduledActivity{}, err
+	}
+	err = invite(ctx, tx, scheduledActivity.OrganizerID, scheduledActivity.UserActivityPreferenceID, inviteeIDs, []int{scheduledActivity.ID})
+	if err != nil {
+		return ScheduledActivity{}, err
+	}
+	if err := publishCreated(ctx, tx, scheduledActivity); err != nil {
+		return ScheduledActivity{}, fmt.Errorf("failed to publish event: %v", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return ScheduledActivity{}, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return scheduledActivity, nil
+}
+
+// insert creates a scheduled activity. Its creation is published once its participants are invited.
+func insert(ctx context.Context, tx pgx.Tx, scheduledActivity ScheduledActivity) (ScheduledActivity, error) {
 	var id int
-	err := service.db.QueryRow(
-		context.Background(),
-		"INSERT INTO scheduled_activities (activity_id, is_active, scheduled_at, user_activity_preference_id) VALUES ($1, $2, $3, $4) RETURNING id",
+	err := tx.QueryRow(
+		ctx,
+		"INSERT INTO scheduled_activities (activity_id, is_active, scheduled_at, user_activity_preference_id, min_participants, max_participants, organizer_id) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id",
 		scheduledActivity.ActivityID, scheduledActivity.IsActive, scheduledActivity.ScheduledAt, scheduledActivity.UserActivityPreferenceID,
+		scheduledActivity.MinParticipants, scheduledActivity.MaxParticipants, scheduledActivity.OrganizerID,
 	).Scan(&id)
 	if err != nil {
 		// Log the error and the values being inserted
@@ -54,41 +143,171 @@ func (service *Service) Create(scheduledActivity ScheduledActivity) (ScheduledAc
 	}
 
 	scheduledActivity.ID = id
+
 	return scheduledActivity, nil
 }
 
+// withOrganizer returns the user IDs followed by the organizer's, if there is one
+func withOrganizer(userIDs []int, organizerID *int) []int {
+	ids := slices.Clone(userIDs)
+	if organizerID != nil {
+		ids = append(ids, *organizerID)
+	}
+	return ids
+}
+
+// withoutOrganizer returns the user IDs other than the organizer's
+func withoutOrganizer(userIDs []int, organizerID *int) []int {
+	ids := []int{}
+	for _, userID := range userIDs {
+		if organizerID == nil || userID != *organizerID {
+			ids = append(ids, userID)
+		}
+	}
+	return ids
+}
+
+// checkBlocked returns activity_participants.ErrBlocked if the organizer and one of the invitees
+// have blocked each other
+func checkBlocked(ctx context.Context, tx pgx.Tx, organizerID *int, inviteeIDs []int) error {
+	if organizerID == nil || len(inviteeIDs) == 0 {
+		return nil
+	}
+
+	var blocked bool
+	err := tx.QueryRow(
+		ctx,
+		`SELECT EXISTS (
+		     SELECT 1 FROM friends f
+		     JOIN unnest($2::int[]) AS invitee(user_id)
+		       ON f.user_ordered_id1 = LEAST($1::int, invitee.user_id)
+		      AND f.user_ordered_id2 = GREATEST($1::int, invitee.user_id)
+		     WHERE f.status = 'blocked')`,
+		*organizerID, pq.Array(inviteeIDs),
+	).Scan(&blocked)
+	if err != nil {
+		return fmt.Errorf("failed to check blocks: %v", err)
+	}
+	if blocked {
+		return activity_participants.ErrBlocked
+	}
+
+	return nil
+}
+
+// invite adds the users to each of the scheduled activities as Pending participants and notifies
+// them once. They are the users whose conflicts were checked in the same transaction.
+func invite(ctx context.Context, tx pgx.Tx, organizerID *int, preferenceID *int, userIDs []int, scheduledActivityIDs []int) error {
+	if len(userIDs) == 0 || len(scheduledActivityIDs) == 0 {
+		return nil
+	}
+
+	rows, err := tx.Query(
+		ctx,
+		`INSERT INTO activity_participants (user_id, scheduled_activity_id, invite_status)
+		 SELECT u.id, sa.id, 'Pending'
+		 FROM unnest($1::int[]) AS u(id)
+		 CROSS JOIN unnest($2::int[]) AS sa(id)
+		 ON CONFLICT (user_id, scheduled_activity_id) DO NOTHING
+		 RETURNING user_id, scheduled_activity_id`,
+		pq.Array(userIDs), pq.Array(scheduledActivityIDs),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert activity participants: %v", err)
+	}
+	invited := make(map[int][]int)
+	for rows.Next() {
+		var userID, scheduledActivityID int
+		if err := rows.Scan(&userID, &scheduledActivityID); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan inserted activity participant: %v", err)
+		}
+		invited[userID] = append(invited[userID], scheduledActivityID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to insert activity participants: %v", err)
+	}
+
+	if err := notifyInvited(ctx, tx, organizerID, preferenceID, invited); err != nil {
+		return fmt.Errorf("failed to notify invitees: %v", err)
+	}
+
+	return nil
+}
+
+// lockScheduledActivity reads a scheduled activity in tx and locks it until tx ends. An occurrence
+// of a series is locked after the series' preference, which is returned as well, so that edits of
+// a series and of its occurrences take their locks in the same order.
+func lockScheduledActivity(ctx context.Context, tx pgx.Tx, id string) (ScheduledActivity, *user_activity_preferences.UserActivityPreference, error) {
+	for {
+		var preferenceID *int
+		err := tx.QueryRow(ctx, "SELECT user_activity_preference_id FROM scheduled_activities WHERE id = $1", id).Scan(&preferenceID)
+		if err != nil {
+			return ScheduledActivity{}, nil, err
+		}
+
+		var preference *user_activity_preferences.UserActivityPreference
+		if preferenceID != nil {
+			locked, found, err := user_activity_preferences.ReadForUpdate(ctx, tx, *preferenceID)
+			if err != nil {
+				return ScheduledActivity{}, nil, err
+			}
+			if found {
+				preference = &locked
+			}
+		}
+
+		scheduledActivity, err := scanScheduledActivity(tx.QueryRow(ctx,
+			"SELECT "+scheduledActivityColumns+" FROM scheduled_activities WHERE id = $1 FOR UPDATE", id))
+		if err != nil {
+			return ScheduledActivity{}, nil, err
+		}
+
+		// Splitting a series may have moved the occurrence to another preference meanwhile
+		current := scheduledActivity.UserActivityPreferenceID
+		if (current == nil && preferenceID == nil) || (current != nil && preferenceID != nil && *current == *preferenceID) {
+			return scheduledActivity, preference, nil
+		}
+	}
+}
+
+// CreateMultiple schedules the activity on each selected date the participants and the organizer
+// are free, organized by organizerID, and invites the participants to every date it creates. Dates
+// in the past are skipped and dates with conflicts are returned instead of being created.
 func (service *Service) CreateMultiple(
+	ctx context.Context,
+	organizerID int,
 	activityID int,
 	selectedDates []string,
 	scheduledActivitiesStartTime string,
 	scheduledActivitiesEndTime string,
 	timeZone string,
-) ([]ScheduledActivity, error) {
-
-	var scheduledActivities []ScheduledActivity
-
+	participantIDs []int,
+) ([]ScheduledActivity, []Conflict, error) {
 	// Parse the start and end times
 	startTimeParsed, err := time.Parse(time.RFC3339, scheduledActivitiesStartTime)
 	if err != nil {
-		return nil, fmt.Errorf("invalid start time format: %v", err)
+		return nil, nil, fmt.Errorf("invalid start time format: %v", err)
 	}
 
 	endTimeParsed, err := time.Parse(time.RFC3339, scheduledActivitiesEndTime)
 	if err != nil {
-		return nil, fmt.Errorf("invalid end time format: %v", err)
+		return nil, nil, fmt.Errorf("invalid end time format: %v", err)
 	}
 
 	// Load the time zone
 	loc, err := time.LoadLocation(timeZone)
 	if err != nil {
-		return nil, fmt.Errorf("invalid time zone: %v", err)
+		return nil, nil, fmt.Errorf("invalid time zone: %v", err)
 	}
 
+	var windows []window
 	for _, dateStr := range selectedDates {
 		// Parse the date
 		date, err := time.ParseInLocation("2006-01-02", dateStr, loc)
 		if err != nil {
-			return nil, fmt.Errorf("invalid date format: %v", err)
+			return nil, nil, fmt.Errorf("invalid date format: %v", err)
 		}
 
 		// Skip past dates
@@ -96,104 +315,89 @@ func (service *Service) CreateMultiple(
 			continue
 		}
 
-		// Combine date and start time
-		scheduledAt := time.Date(
+		// Combine the date with the start and end times
+		desiredStart := time.Date(
 			date.Year(), date.Month(), date.Day(),
 			startTimeParsed.Hour(), startTimeParsed.Minute(), startTimeParsed.Second(), 0,
 			loc,
 		)
-
-		// Check availability
-		available, err := service.checkIfUserIsAvailable(scheduledAt, startTimeParsed, endTimeParsed, loc)
-		if err != nil {
-			return nil, err
+		desiredEnd := time.Date(
+			date.Year(), date.Month(), date.Day(),
+			endTimeParsed.Hour(), endTimeParsed.Minute(), endTimeParsed.Second(), 0,
+			loc,
+		)
+		if !desiredEnd.After(desiredStart) {
+			desiredEnd = desiredEnd.AddDate(0, 0, 1)
 		}
-		if !available {
+
+		windows = append(windows, window{start: desiredStart, end: desiredEnd})
+	}
+
+	tx, err := service.db.Begin(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	attendeeIDs, err := lockParticipants(ctx, tx, withOrganizer(participantIDs, &organizerID), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	inviteeIDs := withoutOrganizer(attendeeIDs, &organizerID)
+	if err := checkBlocked(ctx, tx, &organizerID, inviteeIDs); err != nil {
+		return nil, nil, err
+	}
+	conflicts, err := findConflicts(ctx, tx, attendeeIDs, windows, loc, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var scheduledActivities []ScheduledActivity
+	for i, w := range windows {
+		if len(conflicts[i]) > 0 {
 			continue
 		}
 
 		scheduledActivity := ScheduledActivity{
 			ActivityID:               activityID,
 			IsActive:                 true,
-			ScheduledAt:              scheduledAt,
+			ScheduledAt:              w.start,
 			UserActivityPreferenceID: nil,
+			OrganizerID:              &organizerID,
 		}
 
-		newScheduledActivity, err := service.Create(scheduledActivity)
+		newScheduledActivity, err := insert(ctx, tx, scheduledActivity)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create scheduled activity for date %s: %w", dateStr, err)
+			return nil, nil, fmt.Errorf("failed to create scheduled activity for date %s: %w", w.start.Format("2006-01-02"), err)
 		}
 
 		scheduledActivities = append(scheduledActivities, newScheduledActivity)
 	}
 
-	return scheduledActivities, nil
-}
-
-func (service *Service) checkIfUserIsAvailable(
-	date time.Time,
-	desiredStartTime time.Time,
-	desiredEndTime time.Time,
-	loc *time.Location,
-) (bool, error) {
-
-	// Adjust desiredStartTime and desiredEndTime to the specific date
-	desiredStart := time.Date(
-		date.Year(), date.Month(), date.Day(),
-		desiredStartTime.Hour(), desiredStartTime.Minute(), desiredStartTime.Second(), 0,
-		loc,
-	)
-	desiredEnd := time.Date(
-		date.Year(), date.Month(), date.Day(),
-		desiredEndTime.Hour(), desiredEndTime.Minute(), desiredEndTime.Second(), 0,
-		loc,
-	)
-
-	// Retrieve scheduled activities on the date
-	rows, err := service.db.Query(
-		context.Background(),
-		"SELECT id, activity_id, is_active, scheduled_at, user_activity_preference_id FROM scheduled_activities WHERE DATE(scheduled_at) = $1",
-		date.Format("2006-01-02"),
-	)
-	if err != nil {
-		return false, err
+	scheduledActivityIDs := make([]int, len(scheduledActivities))
+	for i, scheduledActivity := range scheduledActivities {
+		scheduledActivityIDs[i] = scheduledActivity.ID
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var scheduledActivity ScheduledActivity
-		if err := rows.Scan(
-			&scheduledActivity.ID,
-			&scheduledActivity.ActivityID,
-			&scheduledActivity.IsActive,
-			&scheduledActivity.ScheduledAt,
-			&scheduledActivity.UserActivityPreferenceID,
-		); err != nil {
-			return false, err
-		}
-
-		// Get estimated time for the activity
-		estimatedDuration, err := service.getEstimatedTime(scheduledActivity.ActivityID)
-		if err != nil {
-			return false, err
+	if err := invite(ctx, tx, &organizerID, nil, inviteeIDs, scheduledActivityIDs); err != nil {
+		return nil, nil, err
+	}
+	for _, scheduledActivity := range scheduledActivities {
+		if err := publishCreated(ctx, tx, scheduledActivity); err != nil {
+			return nil, nil, fmt.Errorf("failed to publish event: %v", err)
 		}
+	}
 
-		activityStart := scheduledActivity.ScheduledAt
-		activityEnd := activityStart.Add(estimatedDuration)
-
-		// Check for time overlap
-		if activityStart.Before(desiredEnd) && activityEnd.After(desiredStart) {
-			return false, nil // Not available
-		}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, nil, fmt.Errorf("failed to commit transaction: %v", err)
 	}
 
-	return true, nil // Available
+	return scheduledActivities, flattenConflicts(conflicts), nil
 }
 
-func (service *Service) getEstimatedTime(activityID int) (time.Duration, error) {
+func (service *Service) getEstimatedTime(ctx context.Context, activityID int) (time.Duration, error) {
 	var estimatedTimeInSeconds float64
 	err := service.db.QueryRow(
-		context.Background(),
+		ctx,
 		"SELECT EXTRACT(EPOCH FROM estimated_time) FROM activities WHERE id = $1",
 		activityID,
 	).Scan(&estimatedTimeInSeconds)
@@ -205,50 +409,63 @@ func (service *Service) getEstimatedTime(activityID int) (time.Duration, error)
 	return time.Duration(estimatedTimeInSeconds) * time.Second, nil
 }
 
-// Read all user activities for a specific user
-func (service *Service) ReadAll() ([]ScheduledActivity, error) {
-	service.Lock()
-	defer service.Unlock()
+// listSpec are the fields scheduled activities can be listed by
+var listSpec = query.Spec{
+	Fields: map[string]query.Field{
+		"id":                          {Column: "id", Kind: query.Int},
+		"activity_id":                 {Column: "activity_id", Kind: query.Int},
+		"is_active":                   {Column: "COALESCE(is_active, TRUE)", Kind: query.Bool},
+		"scheduled_at":                {Column: "scheduled_at", Kind: query.Time, Sortable: true},
+		"user_activity_preference_id": {Column: "user_activity_preference_id", Kind: query.Int},
+		"is_exception":                {Column: "is_exception", Kind: query.Bool},
+	},
+	Key: "id",
+}
 
-	rows, err := service.db.Query(context.Background(), "SELECT id, activity_id, is_active, scheduled_at, user_activity_preference_id FROM scheduled_activities")
+// ReadAll reads a page of scheduled activities
+func (service *Service) ReadAll(ctx context.Context, params query.Params) (query.Page[ScheduledActivity], error) {
+	sql, args := params.Apply("SELECT " + scheduledActivityColumns + " FROM scheduled_activities")
+	rows, err := service.db.Query(ctx, sql, args...)
 	if err != nil {
-		return nil, err
+		return query.Page[ScheduledActivity]{}, err
 	}
 	defer rows.Close()
 
 	var scheduledActivities []ScheduledActivity
 	for rows.Next() {
-		var scheduledActivity ScheduledActivity
-		if err := rows.Scan(&scheduledActivity.ID, &scheduledActivity.ActivityID, &scheduledActivity.IsActive, &scheduledActivity.ScheduledAt, &scheduledActivity.UserActivityPreferenceID); err != nil {
-			return nil, err
+		scheduledActivity, err := scanScheduledActivity(rows)
+		if err != nil {
+			return query.Page[ScheduledActivity]{}, err
 		}
 		scheduledActivities = append(scheduledActivities, scheduledActivity)
 	}
+	if err := rows.Err(); err != nil {
+		return query.Page[ScheduledActivity]{}, err
+	}
 
-	return scheduledActivities, nil
+	return query.NewPage(params, scheduledActivities, func(scheduledActivity ScheduledActivity, sort string) (int, interface{}) {
+		return scheduledActivity.ID, scheduledActivity.ScheduledAt
+	}), nil
 }
 
 // Read specific user activities by ID
-func (service *Service) Read(ids []int) ([]ScheduledActivity, error) {
-	service.Lock()
-	defer service.Unlock()
-
+func (service *Service) Read(ctx context.Context, ids []int) ([]ScheduledActivity, error) {
 	if len(ids) == 0 {
 		return []ScheduledActivity{}, nil
 	}
 
-	query := "SELECT id, activity_id, is_active, scheduled_at, user_activity_preference_id FROM scheduled_activities WHERE id = ANY($1)"
+	query := "SELECT " + scheduledActivityColumns + " FROM scheduled_activities WHERE id = ANY($1)"
 	var scheduledActivities []ScheduledActivity
 
-	rows, err := service.db.Query(context.Background(), query, pq.Array(ids))
+	rows, err := service.db.Query(ctx, query, pq.Array(ids))
 	if err != nil {
 		return nil, fmt.Errorf("query failed: %w", err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var scheduledActivity ScheduledActivity
-		if err := rows.Scan(&scheduledActivity.ID, &scheduledActivity.ActivityID, &scheduledActivity.IsActive, &scheduledActivity.ScheduledAt, &scheduledActivity.UserActivityPreferenceID); err != nil {
+		scheduledActivity, err := scanScheduledActivity(rows)
+		if err != nil {
 			return nil, fmt.Errorf("scanning row failed: %w", err)
 		}
 		scheduledActivities = append(scheduledActivities, scheduledActivity)
@@ -261,47 +478,217 @@ func (service *Service) Read(ids []int) ([]ScheduledActivity, error) {
 	return scheduledActivities, nil
 }
 
-// Update an existing user activity
-func (service *Service) Update(id string, scheduledActivity ScheduledActivity) (ScheduledActivity, bool, error) {
-	service.Lock()
-	defer service.Unlock()
+// Update an existing user activity. Raising its capacity promotes waitlisted participants, and
+// attendees are told when it is moved or cancelled. Moving it, changing its activity or reactivating
+// it checks the organizer and the accepted and pending participants for conflicts like Create; a
+// *ConflictError lists who is busy. Its preference cannot be changed.
+func (service *Service) Update(ctx context.Context, id string, scheduledActivity ScheduledActivity) (ScheduledActivity, bool, error) {
+	if err := activity_participants.ValidateCapacity(scheduledActivity.MinParticipants, scheduledActivity.MaxParticipants); err != nil {
+		return ScheduledActivity{}, false, err
+	}
+
+	tx, err := service.db.Begin(ctx)
+	if err != nil {
+		return ScheduledActivity{}, false, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	previous, err := scanScheduledActivity(tx.QueryRow(ctx,
+		"SELECT "+scheduledActivityColumns+" FROM scheduled_activities WHERE id = $1 FOR UPDATE", id))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return ScheduledActivity{}, false, nil
+		}
+		return ScheduledActivity{}, false, err
+	}
+
+	if scheduledActivity.IsActive && (!previous.IsActive || !scheduledActivity.ScheduledAt.Equal(previous.ScheduledAt) || scheduledActivity.ActivityID != previous.ActivityID) {
+		if err := checkMoveConflicts(ctx, tx, previous, scheduledActivity); err != nil {
+			return ScheduledActivity{}, true, err
+		}
+	}
 
-	cmdTag, err := service.db.Exec(context.Background(), "UPDATE scheduled_activities SET activity_id = $1, is_active = $2, scheduled_at = $3, user_activity_preference_id = $4 WHERE id = $5",
-		scheduledActivity.ActivityID, scheduledActivity.IsActive, scheduledActivity.ScheduledAt, scheduledActivity.UserActivityPreferenceID, id)
+	// Editing a single occurrence of a series turns it into an exception
+	err = tx.QueryRow(ctx,
+		`UPDATE scheduled_activities
+		 SET activity_id = $1, is_active = $2, scheduled_at = $3,
+		     min_participants = $4, max_participants = $5,
+		     is_exception = is_exception OR recurrence_id IS NOT NULL
+		 WHERE id = $6
+		 RETURNING id, user_activity_preference_id, recurrence_id, is_exception, organizer_id`,
+		scheduledActivity.ActivityID, scheduledActivity.IsActive, scheduledActivity.ScheduledAt,
+		scheduledActivity.MinParticipants, scheduledActivity.MaxParticipants, id,
+	).Scan(&scheduledActivity.ID, &scheduledActivity.UserActivityPreferenceID, &scheduledActivity.RecurrenceID, &scheduledActivity.IsException, &scheduledActivity.OrganizerID)
 	if err != nil {
+		if err == pgx.ErrNoRows {
+			return ScheduledActivity{}, false, nil
+		}
 		return ScheduledActivity{}, false, err
 	}
 
-	if cmdTag.RowsAffected() == 0 {
-		return ScheduledActivity{}, false, nil
+	if _, err := activity_participants.PromoteWaitlisted(ctx, tx, scheduledActivity.ID); err != nil {
+		return ScheduledActivity{}, true, fmt.Errorf("failed to promote waitlisted participants: %v", err)
+	}
+
+	if err := notifyChange(ctx, tx, previous, scheduledActivity); err != nil {
+		return ScheduledActivity{}, true, fmt.Errorf("failed to notify attendees: %v", err)
+	}
+	if err := publishChange(ctx, tx, previous, scheduledActivity); err != nil {
+		return ScheduledActivity{}, true, fmt.Errorf("failed to publish event: %v", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return ScheduledActivity{}, true, fmt.Errorf("failed to commit transaction: %v", err)
 	}
 
 	return scheduledActivity, true, nil
 }
 
-// Delete a user activity by ID
-func (service *Service) Delete(id string) (bool, error) {
-	service.Lock()
-	defer service.Unlock()
+// checkMoveConflicts returns a *ConflictError if the organizer or an accepted or pending participant
+// of the scheduled activity is busy at its updated time. It locks them like Create.
+func checkMoveConflicts(ctx context.Context, tx pgx.Tx, previous ScheduledActivity, updated ScheduledActivity) error {
+	var estimatedSeconds float64
+	err := tx.QueryRow(ctx, "SELECT EXTRACT(EPOCH FROM estimated_time) FROM activities WHERE id = $1", updated.ActivityID).Scan(&estimatedSeconds)
+	if err != nil {
+		return fmt.Errorf("failed to get estimated time: %w", err)
+	}
 
-	cmdTag, err := service.db.Exec(context.Background(), "DELETE FROM scheduled_activities WHERE id = $1", id)
+	rows, err := tx.Query(ctx,
+		"SELECT user_id FROM activity_participants WHERE scheduled_activity_id = $1 AND invite_status IN ('Accepted', 'Pending')",
+		previous.ID)
+	if err != nil {
+		return fmt.Errorf("failed to read participants: %w", err)
+	}
+	var participantIDs []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan participant: %w", err)
+		}
+		participantIDs = append(participantIDs, userID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("participant rows iteration error: %w", err)
+	}
+
+	attendeeIDs, err := lockParticipants(ctx, tx, withOrganizer(participantIDs, previous.OrganizerID), nil)
+	if err != nil {
+		return err
+	}
+	start := updated.ScheduledAt
+	conflicts, err := findConflicts(
+		ctx,
+		tx,
+		attendeeIDs,
+		[]window{{start: start, end: start.Add(time.Duration(estimatedSeconds) * time.Second)}},
+		start.Location(),
+		&previous.ID,
+	)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return &ConflictError{Conflicts: flattenConflicts(conflicts)}
+	}
+
+	return nil
+}
+
+// Delete a user activity by ID. Attendees of upcoming activities are told it is cancelled.
+// Deleting an occurrence of a series adds it to the series' EXDATEs so that it is not generated again.
+func (service *Service) Delete(ctx context.Context, id string) (bool, error) {
+	tx, err := service.db.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	scheduledActivity, _, err := lockScheduledActivity(ctx, tx, id)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if upcoming(scheduledActivity) {
+		err = notifyCancelled(ctx, tx, []int{scheduledActivity.ID}, nil, map[string]interface{}{
+			"scheduled_activity_id": scheduledActivity.ID,
+			"activity_id":           scheduledActivity.ActivityID,
+			"scheduled_at":          scheduledActivity.ScheduledAt,
+		})
+		if err != nil {
+			return false, fmt.Errorf("failed to notify attendees: %v", err)
+		}
+	}
+
+	if scheduledActivity.IsActive {
+		if err := publishDeactivated(ctx, tx, scheduledActivity, reasonDeleted); err != nil {
+			return false, fmt.Errorf("failed to publish event: %v", err)
+		}
+	}
+
+	_, err = tx.Exec(ctx, "DELETE FROM scheduled_activities WHERE id = $1", scheduledActivity.ID)
 	if err != nil {
 		return false, err
 	}
+	preferenceID, recurrenceID := scheduledActivity.UserActivityPreferenceID, scheduledActivity.RecurrenceID
 
-	if cmdTag.RowsAffected() == 0 {
-		return false, nil
+	if preferenceID != nil && recurrenceID != nil {
+		_, err = tx.Exec(ctx,
+			`UPDATE user_activity_preferences
+			 SET exdates = array_append(COALESCE(exdates, '{}'), to_char($2::timestamptz AT TIME ZONE time_zone, 'YYYY-MM-DD"T"HH24:MI:SS'))
+			 WHERE id = $1 AND time_zone IS NOT NULL`,
+			*preferenceID, *recurrenceID)
+		if err != nil {
+			return false, fmt.Errorf("failed to record excluded occurrence: %v", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %v", err)
 	}
 
 	return true, nil
 }
 
-// Get all active user activities for a specific user
-func (service *Service) GetActiveScheduledActivities(userID string) ([]ScheduledActivity, error) {
-	service.Lock()
-	defer service.Unlock()
+// CanEdit reports whether a user may change a scheduled activity, which only its organizer may.
+// Unknown IDs report true so that callers can answer 404 rather than 403.
+func (service *Service) CanEdit(ctx context.Context, id string, userID int) (bool, error) {
+	var allowed bool
+	err := service.db.QueryRow(ctx,
+		`SELECT NOT EXISTS (SELECT 1 FROM scheduled_activities WHERE id = $1)
+		     OR EXISTS (SELECT 1 FROM scheduled_activities WHERE id = $1 AND organizer_id = $2)`,
+		id, userID).Scan(&allowed)
+	if err != nil {
+		return false, err
+	}
+
+	return allowed, nil
+}
+
+// OwnsSeries reports whether a user owns the preference that generated a scheduled activity.
+// Unknown IDs and one-off activities report true so that callers can answer 404 or 400 rather than 403.
+func (service *Service) OwnsSeries(ctx context.Context, id string, userID int) (bool, error) {
+	var allowed bool
+	err := service.db.QueryRow(ctx,
+		`SELECT NOT EXISTS (
+		     SELECT 1 FROM scheduled_activities sa
+		     JOIN user_activity_preferences uap ON uap.id = sa.user_activity_preference_id
+		     WHERE sa.id = $1 AND uap.user_id <> $2)`,
+		id, userID).Scan(&allowed)
+	if err != nil {
+		return false, err
+	}
 
-	rows, err := service.db.Query(context.Background(), "SELECT id, activity_id, is_active, scheduled_at, user_activity_preference_id FROM scheduled_activities WHERE is_active = TRUE")
+	return allowed, nil
+}
+
+// Get all active user activities for a specific user
+func (service *Service) GetActiveScheduledActivities(ctx context.Context, userID string) ([]ScheduledActivity, error) {
+	rows, err := service.db.Query(ctx, "SELECT "+scheduledActivityColumns+" FROM scheduled_activities WHERE is_active = TRUE")
 	if err != nil {
 		return nil, err
 	}
@@ -309,8 +696,8 @@ func (service *Service) GetActiveScheduledActivities(userID string) ([]Scheduled
 
 	var activeScheduledActivities []ScheduledActivity
 	for rows.Next() {
-		var scheduledActivity ScheduledActivity
-		if err := rows.Scan(&scheduledActivity.ID, &scheduledActivity.ActivityID, &scheduledActivity.IsActive, &scheduledActivity.ScheduledAt, &scheduledActivity.UserActivityPreferenceID); err != nil {
+		scheduledActivity, err := scanScheduledActivity(rows)
+		if err != nil {
 			return nil, err
 		}
 		activeScheduledActivities = append(activeScheduledActivities, scheduledActivity)
@@ -320,11 +707,8 @@ func (service *Service) GetActiveScheduledActivities(userID string) ([]Scheduled
 }
 
 // Get all inactive user activities for a specific user
-func (service *Service) GetInactiveScheduledActivities(userID string) ([]ScheduledActivity, error) {
-	service.Lock()
-	defer service.Unlock()
-
-	rows, err := service.db.Query(context.Background(), "SELECT id, activity_id, is_active, scheduled_at, user_activity_preference_id FROM scheduled_activities WHERE is_active = FALSE")
+func (service *Service) GetInactiveScheduledActivities(ctx context.Context, userID string) ([]ScheduledActivity, error) {
+	rows, err := service.db.Query(ctx, "SELECT "+scheduledActivityColumns+" FROM scheduled_activities WHERE is_active = FALSE")
 	if err != nil {
 		return nil, err
 	}
@@ -332,8 +716,8 @@ func (service *Service) GetInactiveScheduledActivities(userID string) ([]Schedul
 
 	var inactiveScheduledActivities []ScheduledActivity
 	for rows.Next() {
-		var scheduledActivity ScheduledActivity
-		if err := rows.Scan(&scheduledActivity.ID, &scheduledActivity.ActivityID, &scheduledActivity.IsActive, &scheduledActivity.ScheduledAt, &scheduledActivity.UserActivityPreferenceID); err != nil {
+		scheduledActivity, err := scanScheduledActivity(rows)
+		if err != nil {
 			return nil, err
 		}
 		inactiveScheduledActivities = append(inactiveScheduledActivities, scheduledActivity)
@@ -342,8 +726,8 @@ func (service *Service) GetInactiveScheduledActivities(userID string) ([]Schedul
 	return inactiveScheduledActivities, nil
 }
 
-func (s *Service) DeclineRepeatedActivity(userID int, scheduledActivityID int) error {
-	tx, err := s.db.Begin(context.Background())
+func (s *Service) DeclineRepeatedActivity(ctx context.Context, userID int, scheduledActivityID int) error {
+	tx, err := s.db.Begin(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %v", err)
 	}
@@ -351,7 +735,7 @@ func (s *Service) DeclineRepeatedActivity(userID int, scheduledActivityID int) e
 
 	// Get the user_activity_preference_id for the scheduled activity
 	var userActivityPreferenceID int
-	err = tx.QueryRow(context.Background(),
+	err = tx.QueryRow(ctx,
 		"SELECT user_activity_preference_id FROM scheduled_activities WHERE id = $1",
 		scheduledActivityID).Scan(&userActivityPreferenceID)
 	if err != nil {
@@ -359,216 +743,227 @@ func (s *Service) DeclineRepeatedActivity(userID int, scheduledActivityID int) e
 	}
 
 	// Delete all activity participants for this user and all scheduled activities linked to the same user_activity_preference
-	_, err = tx.Exec(context.Background(),
+	rows, err := tx.Query(ctx,
 		`DELETE FROM activity_participants
 		 WHERE user_id = $1 AND scheduled_activity_id IN (
 			 SELECT id FROM scheduled_activities
 			 WHERE user_activity_preference_id = $2 AND scheduled_at >= NOW()
-		 )`,
+		 )
+		 RETURNING scheduled_activity_id, invite_status`,
 		userID, userActivityPreferenceID)
 	if err != nil {
 		return fmt.Errorf("failed to delete activity participants: %v", err)
 	}
+	var vacated []int
+	for rows.Next() {
+		var id int
+		var status string
+		if err := rows.Scan(&id, &status); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan deleted activity participant: %v", err)
+		}
+		if status == activity_participants.StatusAccepted {
+			vacated = append(vacated, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to delete activity participants: %v", err)
+	}
+
+	// Hand the places the user accepted to the waitlist, locking the occurrences in ID order so that
+	// concurrent declines of the same series cannot deadlock
+	slices.Sort(vacated)
+	for _, id := range vacated {
+		if _, err := activity_participants.PromoteWaitlisted(ctx, tx, id); err != nil {
+			return fmt.Errorf("failed to promote waitlisted participants: %v", err)
+		}
+	}
+
+	// Leave the series too, so that occurrences materialized later do not invite the user again
+	_, err = tx.Exec(ctx,
+		"DELETE FROM user_activity_preferences_participants WHERE user_id = $1 AND user_activity_preference_id = $2",
+		userID, userActivityPreferenceID)
+	if err != nil {
+		return fmt.Errorf("failed to delete preference participant: %v", err)
+	}
 
-	return tx.Commit(context.Background())
+	return tx.Commit(ctx)
 }
 
+// CreateRepeatingScheduledActivity creates the scheduled activities and pending invitations for
+// a preference's occurrences over the materialization horizon. The Materializer keeps extending
+// the series from there. Preferences without an RRULE are converted from their legacy frequency
+// fields, starting today at startTime in timeZone, and the converted rule is saved.
 func (s *Service) CreateRepeatingScheduledActivity(
+	ctx context.Context,
 	preference user_activity_preferences.UserActivityPreference,
 	startTime string,
 	timeZone string,
 ) ([]ScheduledActivity, error) {
 	// Start a transaction
-	tx, err := s.db.Begin(context.Background())
+	tx, err := s.db.Begin(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to begin transaction: %v", err)
 	}
 	defer tx.Rollback(context.Background())
 
-	now := time.Now()
-	sixMonthsLater := now.AddDate(0, 6, 0)
-
-	// Parse days of week
-	daysOfWeek := []time.Weekday{}
-	for _, day := range strings.Split(preference.DaysOfWeek, ",") {
-		dayInt, err := strconv.Atoi(strings.TrimSpace(day))
-		if err != nil {
-			return nil, fmt.Errorf("invalid day of week: %v", err)
-		}
-		daysOfWeek = append(daysOfWeek, time.Weekday(dayInt))
-	}
-
-	// Load time zone and parse start time outside the loop
-	loc, err := time.LoadLocation(timeZone)
+	// A concurrent call may have converted the rule already
+	preferenceID := preference.ID
+	preference, found, err := user_activity_preferences.ReadForUpdate(ctx, tx, preferenceID)
 	if err != nil {
-		return nil, fmt.Errorf("invalid time zone: %v", err)
+		return nil, err
 	}
-	startTimeParsed, err := time.Parse(time.RFC3339, startTime)
-	if err != nil {
-		return nil, fmt.Errorf("invalid start time format: %v", err)
+	if !found {
+		return nil, fmt.Errorf("user activity preference %d no longer exists", preferenceID)
 	}
 
-	// Collect scheduled activities data
-	scheduledActivitiesData := [][]interface{}{}
-	scheduledActivities := []ScheduledActivity{}
+	now := time.Now()
 
-	for currentDate := now; currentDate.Before(sixMonthsLater); currentDate = currentDate.AddDate(0, 0, 1) {
-		if !containsWeekday(daysOfWeek, currentDate.Weekday()) {
-			continue
+	if preference.RRule == "" {
+		loc, err := time.LoadLocation(timeZone)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid time zone: %v", user_activity_preferences.ErrInvalidRecurrence, err)
 		}
-
-		if !shouldScheduleActivity(preference, currentDate, now) {
-			continue
+		startTimeParsed, err := time.Parse(time.RFC3339, startTime)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid start time format: %v", user_activity_preferences.ErrInvalidRecurrence, err)
 		}
 
-		scheduledAt := time.Date(
-			currentDate.Year(), currentDate.Month(), currentDate.Day(),
+		preference.RRule, err = preference.LegacyRRule()
+		if err != nil {
+			return nil, err
+		}
+		today := now.In(loc)
+		preference.DTStart = time.Date(
+			today.Year(), today.Month(), today.Day(),
 			startTimeParsed.Hour(), startTimeParsed.Minute(), startTimeParsed.Second(), 0,
 			loc,
-		)
+		).Format("2006-01-02T15:04:05")
+		preference.TimeZone = timeZone
 
-		data := []interface{}{
-			preference.ActivityID, // activity_id
-			true,                  // is_active
-			scheduledAt,           // scheduled_at
-			preference.ID,         // user_activity_preference_id
+		_, err = tx.Exec(ctx,
+			"UPDATE user_activity_preferences SET rrule = $1, dtstart = $2::timestamp, time_zone = $3 WHERE id = $4",
+			preference.RRule, preference.DTStart, preference.TimeZone, preference.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to save converted rule: %v", err)
 		}
-		scheduledActivitiesData = append(scheduledActivitiesData, data)
+	}
 
-		// Collect ScheduledActivity structs for returning
-		scheduledActivities = append(scheduledActivities, ScheduledActivity{
-			ActivityID:               preference.ActivityID,
-			IsActive:                 true,
-			ScheduledAt:              scheduledAt,
-			UserActivityPreferenceID: &preference.ID,
-		})
+	scheduledActivities, err := materialize(ctx, tx, preference, now, now.Add(s.horizon))
+	if err != nil {
+		return nil, err
 	}
 
-	// Batch insert scheduled activities
-	if len(scheduledActivitiesData) > 0 {
-		columns := []string{"activity_id", "is_active", "scheduled_at", "user_activity_preference_id"}
-		valueStrings := []string{}
-		values := []interface{}{}
+	// Commit the transaction
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
 
-		for _, data := range scheduledActivitiesData {
-			valuePlaceholder := []string{}
-			for j := range columns {
-				values = append(values, data[j])
-				valuePlaceholder = append(valuePlaceholder, fmt.Sprintf("$%d", len(values)))
-			}
-			valueStrings = append(valueStrings, fmt.Sprintf("(%s)", strings.Join(valuePlaceholder, ", ")))
-		}
+	return scheduledActivities, nil
+}
 
-		query := fmt.Sprintf(
-			"INSERT INTO scheduled_activities (%s) VALUES %s RETURNING id",
-			strings.Join(columns, ", "),
-			strings.Join(valueStrings, ", "),
-		)
+// materialize creates the scheduled activities for a preference's occurrences in [from, to) that
+// do not exist yet, invites the preference's participants to them and records how far the series
+// has been materialized. Existing occurrences are left untouched, so it is safe to run repeatedly.
+func materialize(ctx context.Context, tx pgx.Tx, preference user_activity_preferences.UserActivityPreference, from time.Time, to time.Time) ([]ScheduledActivity, error) {
+	recurrence, err := preference.Recurrence()
+	if err != nil {
+		return nil, err
+	}
+	occurrences := recurrence.Between(from, to)
 
-		rows, err := tx.Query(context.Background(), query, values...)
+	scheduledActivities := []ScheduledActivity{}
+	if len(occurrences) > 0 {
+		rows, err := tx.Query(
+			ctx,
+			`INSERT INTO scheduled_activities (activity_id, is_active, scheduled_at, user_activity_preference_id, recurrence_id, organizer_id)
+			 SELECT $1, TRUE, occurrence, $2, occurrence, $4 FROM unnest($3::timestamptz[]) AS occurrence
+			 ON CONFLICT (user_activity_preference_id, recurrence_id) DO NOTHING
+			 RETURNING id, scheduled_at, recurrence_id`,
+			preference.ActivityID, preference.ID, occurrences, preference.UserID,
+		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to batch insert scheduled activities: %v", err)
 		}
 		defer rows.Close()
 
-		// Collect inserted IDs
-		idx := 0
 		for rows.Next() {
-			var id int
-			if err := rows.Scan(&id); err != nil {
-				return nil, fmt.Errorf("failed to scan inserted scheduled activity ID: %v", err)
+			scheduledActivity := ScheduledActivity{
+				ActivityID:               preference.ActivityID,
+				IsActive:                 true,
+				UserActivityPreferenceID: &preference.ID,
+				OrganizerID:              &preference.UserID,
 			}
-			scheduledActivities[idx].ID = id
-			idx++
-		}
-	}
-
-	// Fetch participants for the user activity preference
-	rows, err := tx.Query(
-		context.Background(),
-		"SELECT user_id FROM user_activity_preferences_participants WHERE user_activity_preference_id = $1",
-		preference.ID,
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch participants: %v", err)
-	}
-	defer rows.Close()
-
-	var participantUserIDs []int
-	for rows.Next() {
-		var userID int
-		if err := rows.Scan(&userID); err != nil {
-			return nil, fmt.Errorf("failed to scan participant user ID: %v", err)
-		}
-		participantUserIDs = append(participantUserIDs, userID)
-	}
-
-	// Collect activity participants data
-	activityParticipantsData := [][]interface{}{}
-	for _, scheduledActivity := range scheduledActivities {
-		for _, userID := range participantUserIDs {
-			data := []interface{}{
-				userID,               // user_id
-				scheduledActivity.ID, // scheduled_activity_id
-				"Pending",            // invite_status
+			if err := rows.Scan(&scheduledActivity.ID, &scheduledActivity.ScheduledAt, &scheduledActivity.RecurrenceID); err != nil {
+				return nil, fmt.Errorf("failed to scan inserted scheduled activity: %v", err)
 			}
-			activityParticipantsData = append(activityParticipantsData, data)
+			scheduledActivities = append(scheduledActivities, scheduledActivity)
 		}
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to batch insert scheduled activities: %v", err)
+		}
+		rows.Close()
 	}
 
-	// Batch insert activity participants
-	if len(activityParticipantsData) > 0 {
-		columns := []string{"user_id", "scheduled_activity_id", "invite_status"}
-		valueStrings := []string{}
-		values := []interface{}{}
-
-		for _, data := range activityParticipantsData {
-			valuePlaceholder := []string{}
-			for j := range columns {
-				values = append(values, data[j])
-				valuePlaceholder = append(valuePlaceholder, fmt.Sprintf("$%d", len(values)))
-			}
-			valueStrings = append(valueStrings, fmt.Sprintf("(%s)", strings.Join(valuePlaceholder, ", ")))
+	if len(scheduledActivities) > 0 {
+		scheduledActivityIDs := make([]int, len(scheduledActivities))
+		for i, scheduledActivity := range scheduledActivities {
+			scheduledActivityIDs[i] = scheduledActivity.ID
 		}
 
-		query := fmt.Sprintf(
-			"INSERT INTO activity_participants (%s) VALUES %s",
-			strings.Join(columns, ", "),
-			strings.Join(valueStrings, ", "),
+		// Invite the preference's participants, skipping anyone blocked by or blocking the owner
+		rows, err := tx.Query(
+			ctx,
+			`INSERT INTO activity_participants (user_id, scheduled_activity_id, invite_status)
+			 SELECT uapp.user_id, sa.id, 'Pending'
+			 FROM unnest($2::int[]) AS sa(id)
+			 CROSS JOIN user_activity_preferences_participants uapp
+			 JOIN user_activity_preferences uap ON uap.id = uapp.user_activity_preference_id
+			 WHERE uapp.user_activity_preference_id = $1
+			   AND NOT EXISTS (
+			       SELECT 1 FROM friends f
+			       WHERE f.status = 'blocked'
+			         AND f.user_ordered_id1 = LEAST(uapp.user_id, uap.user_id)
+			         AND f.user_ordered_id2 = GREATEST(uapp.user_id, uap.user_id))
+			 ON CONFLICT (user_id, scheduled_activity_id) DO NOTHING
+			 RETURNING user_id, scheduled_activity_id`,
+			preference.ID, pq.Array(scheduledActivityIDs),
 		)
-
-		_, err := tx.Exec(context.Background(), query, values...)
 		if err != nil {
 			return nil, fmt.Errorf("failed to batch insert activity participants: %v", err)
 		}
-	}
-
-	// Commit the transaction
-	if err := tx.Commit(context.Background()); err != nil {
-		return nil, fmt.Errorf("failed to commit transaction: %v", err)
-	}
+		invited := make(map[int][]int)
+		for rows.Next() {
+			var userID, scheduledActivityID int
+			if err := rows.Scan(&userID, &scheduledActivityID); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan inserted activity participant: %v", err)
+			}
+			invited[userID] = append(invited[userID], scheduledActivityID)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to batch insert activity participants: %v", err)
+		}
 
-	return scheduledActivities, nil
-}
+		if err := notifyInvited(ctx, tx, &preference.UserID, &preference.ID, invited); err != nil {
+			return nil, fmt.Errorf("failed to notify invitees: %v", err)
+		}
 
-func containsWeekday(days []time.Weekday, day time.Weekday) bool {
-	for _, d := range days {
-		if d == day {
-			return true
+		for _, scheduledActivity := range scheduledActivities {
+			if err := publishCreated(ctx, tx, scheduledActivity); err != nil {
+				return nil, fmt.Errorf("failed to publish event: %v", err)
+			}
 		}
 	}
-	return false
-}
 
-func shouldScheduleActivity(preference user_activity_preferences.UserActivityPreference, currentDate, startDate time.Time) bool {
-	switch preference.FrequencyPeriod {
-	case "week":
-		weeksSinceStart := int(currentDate.Sub(startDate).Hours() / 168) // 168 hours in a week
-		return weeksSinceStart%preference.Frequency == 0
-	case "month":
-		monthsSinceStart := int(currentDate.Sub(startDate).Hours() / 730) // Approximate hours in a month
-		return monthsSinceStart%preference.Frequency == 0
-	default:
-		return false
+	_, err = tx.Exec(ctx,
+		"UPDATE user_activity_preferences SET materialized_until = GREATEST(COALESCE(materialized_until, $2), $2) WHERE id = $1",
+		preference.ID, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record materialization horizon: %v", err)
 	}
+
+	return scheduledActivities, nil
 }
@@ -0,0 +1,387 @@
+package scheduled_activities
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"friendsocial/activity_participants"
+	"friendsocial/user_activity_preferences"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/lib/pq"
+)
+
+// Series edit scopes
+const (
+	ScopeThis      = "this"      // only the given occurrence, which becomes an exception
+	ScopeFollowing = "following" // the given occurrence and every later one, splitting the series
+	ScopeAll       = "all"       // every upcoming occurrence of the series
+)
+
+var (
+	ErrInvalidSeriesEdit = errors.New("invalid series edit")
+	ErrNotInSeries       = errors.New("scheduled activity is not part of a recurring series")
+)
+
+// SeriesEdit describes a change to one or more occurrences of a recurring series. ScheduledAt and
+// IsActive only apply to a single occurrence, the rule fields only to "following" and "all".
+type SeriesEdit struct {
+	Scope       string     `json:"scope"`
+	ActivityID  *int       `json:"activity_id,omitempty"`
+	ScheduledAt *time.Time `json:"scheduled_at,omitempty"`
+	IsActive    *bool      `json:"is_active,omitempty"`
+	RRule       *string    `json:"rrule,omitempty"`
+	DTStart     *string    `json:"dtstart,omitempty"`
+	TimeZone    *string    `json:"time_zone,omitempty"`
+	ExDates     *[]string  `json:"exdates,omitempty"`
+}
+
+// SeriesEditResult is the series the edit ended up in and its occurrences from the edited one on
+type SeriesEditResult struct {
+	Preference          user_activity_preferences.UserActivityPreference `json:"preference"`
+	ScheduledActivities []ScheduledActivity                              `json:"scheduled_activities"`
+}
+
+// EditSeries applies an edit to the occurrence with the given ID and, depending on the scope, the
+// rest of its series. Regenerated occurrences keep their row, and with it their RSVPs, when the new
+// rule still produces them; other upcoming occurrences are replaced. Exceptions are never touched
+// by "following" or "all".
+func (service *Service) EditSeries(ctx context.Context, id string, edit SeriesEdit) (SeriesEditResult, bool, error) {
+	tx, err := service.db.Begin(ctx)
+	if err != nil {
+		return SeriesEditResult{}, false, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	occurrence, preference, err := lockScheduledActivity(ctx, tx, id)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return SeriesEditResult{}, false, nil
+		}
+		return SeriesEditResult{}, false, err
+	}
+	if preference == nil || occurrence.RecurrenceID == nil || preference.RRule == "" {
+		return SeriesEditResult{}, true, ErrNotInSeries
+	}
+
+	var result SeriesEditResult
+	switch edit.Scope {
+	case ScopeThis:
+		result, err = service.editOccurrence(ctx, tx, *preference, occurrence, edit)
+	case ScopeFollowing:
+		result, err = service.editFollowing(ctx, tx, *preference, occurrence, edit)
+	case ScopeAll:
+		result, err = service.editAll(ctx, tx, *preference, edit)
+	default:
+		err = fmt.Errorf("%w: scope must be %q, %q or %q", ErrInvalidSeriesEdit, ScopeThis, ScopeFollowing, ScopeAll)
+	}
+	if err != nil {
+		return SeriesEditResult{}, true, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return SeriesEditResult{}, true, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return result, true, nil
+}
+
+// editOccurrence changes one occurrence and marks it as an exception. Moving it to another time
+// asks everyone to respond again.
+func (service *Service) editOccurrence(ctx context.Context, tx pgx.Tx, preference user_activity_preferences.UserActivityPreference, occurrence ScheduledActivity, edit SeriesEdit) (SeriesEditResult, error) {
+	if edit.RRule != nil || edit.DTStart != nil || edit.TimeZone != nil || edit.ExDates != nil {
+		return SeriesEditResult{}, fmt.Errorf("%w: rrule, dtstart, time_zone and exdates cannot change for a single occurrence", ErrInvalidSeriesEdit)
+	}
+
+	previous := occurrence
+	moved := edit.ScheduledAt != nil && !edit.ScheduledAt.Equal(occurrence.ScheduledAt)
+	if edit.ActivityID != nil {
+		occurrence.ActivityID = *edit.ActivityID
+	}
+	if edit.ScheduledAt != nil {
+		occurrence.ScheduledAt = *edit.ScheduledAt
+	}
+	if edit.IsActive != nil {
+		occurrence.IsActive = *edit.IsActive
+	}
+	occurrence.IsException = true
+
+	_, err := tx.Exec(ctx,
+		"UPDATE scheduled_activities SET activity_id = $1, scheduled_at = $2, is_active = $3, is_exception = TRUE WHERE id = $4",
+		occurrence.ActivityID, occurrence.ScheduledAt, occurrence.IsActive, occurrence.ID)
+	if err != nil {
+		return SeriesEditResult{}, fmt.Errorf("failed to update occurrence: %v", err)
+	}
+
+	if err := notifyChange(ctx, tx, previous, occurrence); err != nil {
+		return SeriesEditResult{}, fmt.Errorf("failed to notify attendees: %v", err)
+	}
+	if err := publishChange(ctx, tx, previous, occurrence); err != nil {
+		return SeriesEditResult{}, fmt.Errorf("failed to publish event: %v", err)
+	}
+
+	if moved {
+		if err := activity_participants.ResetInvitations(ctx, tx, occurrence.ID); err != nil {
+			return SeriesEditResult{}, fmt.Errorf("failed to reset invitations: %v", err)
+		}
+	}
+
+	return SeriesEditResult{Preference: preference, ScheduledActivities: []ScheduledActivity{occurrence}}, nil
+}
+
+// editAll changes the series itself and regenerates its upcoming occurrences
+func (service *Service) editAll(ctx context.Context, tx pgx.Tx, preference user_activity_preferences.UserActivityPreference, edit SeriesEdit) (SeriesEditResult, error) {
+	updated, err := applySeriesEdit(preference, edit)
+	if err != nil {
+		return SeriesEditResult{}, err
+	}
+
+	_, err = tx.Exec(ctx,
+		`UPDATE user_activity_preferences
+		 SET activity_id = $1, frequency = $2, frequency_period = $3, days_of_week = $4, rrule = $5, dtstart = $6::timestamp, time_zone = $7,
+		     exdates = $8
+		 WHERE id = $9`,
+		updated.ActivityID, updated.Frequency, updated.FrequencyPeriod, updated.DaysOfWeek, updated.RRule, updated.DTStart, updated.TimeZone,
+		pq.Array(updated.ExDates), updated.ID)
+	if err != nil {
+		return SeriesEditResult{}, fmt.Errorf("failed to update series: %v", err)
+	}
+
+	return service.regenerate(ctx, tx, updated, time.Now())
+}
+
+// editFollowing ends the series just before the occurrence and starts a new series there with the
+// edit applied. The new series gets the same participants, and the occurrences from the split on
+// move over to it.
+func (service *Service) editFollowing(ctx context.Context, tx pgx.Tx, preference user_activity_preferences.UserActivityPreference, occurrence ScheduledActivity, edit SeriesEdit) (SeriesEditResult, error) {
+	split := *occurrence.RecurrenceID
+
+	recurrence, err := preference.Recurrence()
+	if err != nil {
+		return SeriesEditResult{}, err
+	}
+	// EXDATEs still count towards COUNT
+	earlier := len(user_activity_preferences.Recurrence{Rule: recurrence.Rule, Start: recurrence.Start}.Between(recurrence.Start, split))
+	if earlier == 0 {
+		// Nothing comes before the occurrence, so this is the whole series
+		return service.editAll(ctx, tx, preference, edit)
+	}
+
+	// End the original series just before the split
+	truncated := recurrence.Rule
+	until := split.Add(-time.Second)
+	truncated.Count = 0
+	truncated.Until = &until
+	_, err = tx.Exec(ctx,
+		"UPDATE user_activity_preferences SET rrule = $1 WHERE id = $2",
+		truncated.String(), preference.ID)
+	if err != nil {
+		return SeriesEditResult{}, fmt.Errorf("failed to end series: %v", err)
+	}
+
+	// The new series starts at the split occurrence and, unless it gets a rule of its own, keeps
+	// whatever is left of the original COUNT
+	following := preference
+	if edit.DTStart == nil {
+		loc := recurrence.Start.Location()
+		if edit.TimeZone != nil {
+			if loc, err = time.LoadLocation(*edit.TimeZone); err != nil {
+				return SeriesEditResult{}, fmt.Errorf("%w: invalid time_zone: %v", ErrInvalidSeriesEdit, err)
+			}
+		}
+		dtstart := split.In(loc).Format("2006-01-02T15:04:05")
+		edit.DTStart = &dtstart
+	}
+	if edit.RRule == nil && recurrence.Rule.Count > 0 {
+		remaining := recurrence.Rule
+		remaining.Count -= earlier
+		if remaining.Count < 1 {
+			return SeriesEditResult{}, fmt.Errorf("%w: the series has no occurrences left to edit", ErrInvalidSeriesEdit)
+		}
+		rule := remaining.String()
+		edit.RRule = &rule
+	}
+	following, err = applySeriesEdit(following, edit)
+	if err != nil {
+		return SeriesEditResult{}, err
+	}
+
+	err = tx.QueryRow(ctx,
+		`INSERT INTO user_activity_preferences (user_id, activity_id, frequency, frequency_period, days_of_week, rrule, dtstart, time_zone, exdates, materialized_until)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7::timestamp, $8, $9, $10) RETURNING id`,
+		following.UserID, following.ActivityID, following.Frequency, following.FrequencyPeriod, following.DaysOfWeek,
+		following.RRule, following.DTStart, following.TimeZone, pq.Array(following.ExDates), following.MaterializedUntil,
+	).Scan(&following.ID)
+	if err != nil {
+		return SeriesEditResult{}, fmt.Errorf("failed to create series: %v", err)
+	}
+
+	_, err = tx.Exec(ctx,
+		`INSERT INTO user_activity_preferences_participants (user_activity_preference_id, user_id)
+		 SELECT $2, user_id FROM user_activity_preferences_participants WHERE user_activity_preference_id = $1`,
+		preference.ID, following.ID)
+	if err != nil {
+		return SeriesEditResult{}, fmt.Errorf("failed to copy series participants: %v", err)
+	}
+
+	_, err = tx.Exec(ctx,
+		"UPDATE scheduled_activities SET user_activity_preference_id = $2 WHERE user_activity_preference_id = $1 AND recurrence_id >= $3",
+		preference.ID, following.ID, split)
+	if err != nil {
+		return SeriesEditResult{}, fmt.Errorf("failed to move occurrences to the new series: %v", err)
+	}
+
+	from := split
+	if now := time.Now(); now.After(from) {
+		from = now
+	}
+	return service.regenerate(ctx, tx, following, from)
+}
+
+// regenerate brings a series' occurrences from the given time on in line with its rule: rows the
+// rule no longer produces are deleted, the others keep their invitations and take the series'
+// activity, and missing ones are created. Exceptions are left alone.
+func (service *Service) regenerate(ctx context.Context, tx pgx.Tx, preference user_activity_preferences.UserActivityPreference, from time.Time) (SeriesEditResult, error) {
+	recurrence, err := preference.Recurrence()
+	if err != nil {
+		return SeriesEditResult{}, err
+	}
+
+	to := time.Now().Add(service.horizon)
+	if preference.MaterializedUntil != nil && preference.MaterializedUntil.After(to) {
+		to = *preference.MaterializedUntil
+	}
+	occurrences := recurrence.Between(from, to)
+	if occurrences == nil {
+		occurrences = []time.Time{}
+	}
+
+	var outdated []int
+	err = tx.QueryRow(ctx,
+		`SELECT COALESCE(array_agg(id), '{}') FROM scheduled_activities
+		 WHERE user_activity_preference_id = $1 AND recurrence_id >= $2 AND NOT is_exception
+		   AND NOT (recurrence_id = ANY($3::timestamptz[]))`,
+		preference.ID, from, occurrences).Scan(&outdated)
+	if err != nil {
+		return SeriesEditResult{}, fmt.Errorf("failed to find outdated occurrences: %v", err)
+	}
+
+	// Occurrences the new rule no longer produces are cancelled; new ones are announced as invitations
+	err = notifyCancelled(ctx, tx, outdated, nil, map[string]interface{}{
+		"user_activity_preference_id": preference.ID,
+		"occurrences":                 len(outdated),
+	})
+	if err != nil {
+		return SeriesEditResult{}, fmt.Errorf("failed to notify attendees: %v", err)
+	}
+	if err := publishDeactivatedIDs(ctx, tx, outdated, reasonSeriesChanged); err != nil {
+		return SeriesEditResult{}, fmt.Errorf("failed to publish events: %v", err)
+	}
+
+	_, err = tx.Exec(ctx, "DELETE FROM scheduled_activities WHERE id = ANY($1)", pq.Array(outdated))
+	if err != nil {
+		return SeriesEditResult{}, fmt.Errorf("failed to delete outdated occurrences: %v", err)
+	}
+
+	_, err = tx.Exec(ctx,
+		`UPDATE scheduled_activities SET activity_id = $3
+		 WHERE user_activity_preference_id = $1 AND recurrence_id >= $2 AND NOT is_exception`,
+		preference.ID, from, preference.ActivityID)
+	if err != nil {
+		return SeriesEditResult{}, fmt.Errorf("failed to update occurrences: %v", err)
+	}
+
+	if _, err := materialize(ctx, tx, preference, from, to); err != nil {
+		return SeriesEditResult{}, err
+	}
+
+	rows, err := tx.Query(ctx,
+		`SELECT `+scheduledActivityColumns+`
+		 FROM scheduled_activities
+		 WHERE user_activity_preference_id = $1 AND recurrence_id >= $2
+		 ORDER BY scheduled_at`,
+		preference.ID, from)
+	if err != nil {
+		return SeriesEditResult{}, err
+	}
+	defer rows.Close()
+
+	result := SeriesEditResult{Preference: preference, ScheduledActivities: []ScheduledActivity{}}
+	for rows.Next() {
+		scheduledActivity, err := scanScheduledActivity(rows)
+		if err != nil {
+			return SeriesEditResult{}, err
+		}
+		result.ScheduledActivities = append(result.ScheduledActivities, scheduledActivity)
+	}
+	result.Preference.MaterializedUntil = &to
+
+	return result, rows.Err()
+}
+
+// applySeriesEdit returns the preference with the edit's series fields applied and validated. When
+// DTSTART moves to another time of day and the edit brings no EXDATEs of its own, the EXDATEs at
+// the old time move with it, so that skipped occurrences stay skipped.
+func applySeriesEdit(preference user_activity_preferences.UserActivityPreference, edit SeriesEdit) (user_activity_preferences.UserActivityPreference, error) {
+	if edit.ScheduledAt != nil || edit.IsActive != nil {
+		return preference, fmt.Errorf("%w: scheduled_at and is_active only apply to a single occurrence, change dtstart or rrule instead", ErrInvalidSeriesEdit)
+	}
+
+	if edit.ActivityID != nil {
+		preference.ActivityID = *edit.ActivityID
+	}
+	if edit.RRule != nil {
+		preference.RRule = *edit.RRule
+	}
+	if edit.ExDates != nil {
+		preference.ExDates = *edit.ExDates
+	}
+	if edit.DTStart != nil {
+		if edit.ExDates == nil {
+			preference.ExDates = shiftExDates(preference.ExDates, preference.DTStart, *edit.DTStart)
+		}
+		preference.DTStart = *edit.DTStart
+	}
+	if edit.TimeZone != nil {
+		preference.TimeZone = *edit.TimeZone
+	}
+
+	if err := preference.Normalize(); err != nil {
+		return preference, err
+	}
+	return preference, nil
+}
+
+// shiftExDates moves the EXDATEs at the time of day of the old DTSTART to that of the new one.
+// EXDATEs that do not parse are left for Normalize to reject.
+func shiftExDates(exDates []string, oldDTStart string, newDTStart string) []string {
+	const layout = "2006-01-02T15:04:05"
+	oldStart, err := time.Parse(layout, oldDTStart)
+	if err != nil {
+		return exDates
+	}
+	newStart, err := time.Parse(layout, newDTStart)
+	if err != nil {
+		return exDates
+	}
+	oldHour, oldMinute, oldSecond := oldStart.Clock()
+	newHour, newMinute, newSecond := newStart.Clock()
+	if oldHour == newHour && oldMinute == newMinute && oldSecond == newSecond {
+		return exDates
+	}
+
+	shifted := make([]string, len(exDates))
+	for i, exDate := range exDates {
+		excluded, err := time.Parse(layout, exDate)
+		if err != nil {
+			shifted[i] = exDate
+			continue
+		}
+		if hour, minute, second := excluded.Clock(); hour == oldHour && minute == oldMinute && second == oldSecond {
+			excluded = time.Date(excluded.Year(), excluded.Month(), excluded.Day(), newHour, newMinute, newSecond, 0, time.UTC)
+		}
+		shifted[i] = excluded.Format(layout)
+	}
+	return shifted
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// timeoutMessage is the error of the 503 sent for a request that ran out of time
+const timeoutMessage = "request timed out"
+
+// TimeoutError is the body of the 503 sent for a request that ran out of time, shaped like the
+// handlers' error responses
+type TimeoutError struct {
+	StatusCode int    `json:"status_code"`
+	Error      string `json:"error"`
+}
+
+// routeTimeouts bounds how long each route's handler may run. The request context carries the
+// deadline, so the database work of a request that runs out of time is cancelled.
+type routeTimeouts struct {
+	mux      *http.ServeMux
+	fallback time.Duration
+	routes   map[string]time.Duration // by mux pattern
+}
+
+func newRouteTimeouts(mux *http.ServeMux, fallback time.Duration) *routeTimeouts {
+	return &routeTimeouts{
+		mux:      mux,
+		fallback: fallback,
+		routes:   make(map[string]time.Duration),
+	}
+}
+
+// Set gives patterns a timeout other than the fallback. Zero means no limit.
+func (t *routeTimeouts) Set(timeout time.Duration, patterns ...string) {
+	for _, pattern := range patterns {
+		t.routes[pattern] = timeout
+	}
+}
+
+// Middleware applies the timeout of the route a request is for before calling next. When the
+// deadline passes before the handler has written anything, the client gets a JSON 503 at once and
+// whatever the handler writes later is dropped. A handler that has started its response is left to
+// finish it, its context cancelled.
+func (t *routeTimeouts) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := t.fallback
+		if _, pattern := t.mux.Handler(r); pattern != "" {
+			if routeTimeout, ok := t.routes[pattern]; ok {
+				timeout = routeTimeout
+			}
+		}
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		tw := &timeoutWriter{ctx: ctx, w: w, header: make(http.Header)}
+		done := make(chan struct{})
+		panicked := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			next.ServeHTTP(tw, r.WithContext(ctx))
+			close(done)
+		}()
+
+		select {
+		case p := <-panicked:
+			panic(p)
+		case <-done:
+		case <-ctx.Done():
+			if !tw.timeout() {
+				// The response has started, so it cannot become a 503 any more
+				select {
+				case p := <-panicked:
+					panic(p)
+				case <-done:
+				}
+			}
+		}
+	})
+}
+
+// timeoutWriter passes a handler's response through to w until the request times out. Headers are
+// kept apart from w's, so that a handler still running after the 503 was sent does not touch w.
+type timeoutWriter struct {
+	ctx    context.Context // carries the deadline of the request
+	w      http.ResponseWriter
+	header http.Header
+
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(statusCode int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.writeHeader(statusCode)
+}
+
+func (tw *timeoutWriter) writeHeader(statusCode int) {
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	// A handler that notices the deadline first, e.g. through a cancelled query, must not answer
+	// in place of the 503
+	if errors.Is(tw.ctx.Err(), context.DeadlineExceeded) {
+		tw.sendTimeout()
+		return
+	}
+	tw.wroteHeader = true
+	for key, values := range tw.header {
+		tw.w.Header()[key] = values
+	}
+	tw.w.WriteHeader(statusCode)
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.writeHeader(http.StatusOK)
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	return tw.w.Write(p)
+}
+
+// timeout sends the 503 unless the handler has written something already, and reports whether it
+// did. Writes after it are dropped.
+func (tw *timeoutWriter) timeout() bool {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.wroteHeader {
+		return false
+	}
+	if !tw.timedOut {
+		tw.sendTimeout()
+	}
+	return true
+}
+
+// sendTimeout writes the 503. tw.mu must be held.
+func (tw *timeoutWriter) sendTimeout() {
+	tw.timedOut = true
+
+	tw.w.Header().Set("Content-Type", "application/json")
+	tw.w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(tw.w).Encode(TimeoutError{
+		StatusCode: http.StatusServiceUnavailable,
+		Error:      timeoutMessage,
+	})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRouteTimeouts(t *testing.T) {
+	lateWrite := make(chan error, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /fast", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Handler", "fast")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("done"))
+	})
+	mux.HandleFunc("GET /slow", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		w.Header().Set("X-Handler", "slow")
+		_, err := w.Write([]byte("too late"))
+		lateWrite <- err
+	})
+	mux.HandleFunc("GET /streaming", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("started "))
+		<-r.Context().Done()
+		w.Write([]byte("and finished"))
+	})
+	mux.HandleFunc("GET /unlimited", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Deadline(); ok {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	mux.HandleFunc("GET /panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("handler failed")
+	})
+
+	timeouts := newRouteTimeouts(mux, 20*time.Millisecond)
+	timeouts.Set(0, "GET /unlimited")
+	handler := timeouts.Middleware(mux)
+
+	tests := []struct {
+		target     string
+		wantStatus int
+		wantBody   string
+		wantHeader string // X-Handler
+	}{
+		{"/fast", http.StatusAccepted, "done", "fast"},
+		{"/streaming", http.StatusOK, "started and finished", ""},
+		{"/unlimited", http.StatusOK, "", ""},
+		{"/missing", http.StatusNotFound, "404 page not found\n", ""},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", tt.target, nil))
+		if recorder.Code != tt.wantStatus || recorder.Body.String() != tt.wantBody || recorder.Header().Get("X-Handler") != tt.wantHeader {
+			t.Errorf("GET %s = %d %q with X-Handler %q, want %d %q with %q", tt.target,
+				recorder.Code, recorder.Body, recorder.Header().Get("X-Handler"), tt.wantStatus, tt.wantBody, tt.wantHeader)
+		}
+	}
+
+	// A handler that has written nothing when its time is up gets the JSON 503
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/slow", nil))
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("GET /slow = %d with Content-Type %q", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+	var body TimeoutError
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil || body.StatusCode != http.StatusServiceUnavailable || body.Error != timeoutMessage {
+		t.Errorf("GET /slow body = %s (%v)", recorder.Body, err)
+	}
+	if err := <-lateWrite; !errors.Is(err, http.ErrHandlerTimeout) {
+		t.Errorf("late write error = %v, want http.ErrHandlerTimeout", err)
+	}
+	if recorder.Header().Get("X-Handler") != "" {
+		t.Errorf("a header set after the timeout reached the response")
+	}
+
+	// Panics reach the server, which logs them and closes the connection
+	func() {
+		defer func() {
+			if p := recover(); p != "handler failed" {
+				t.Errorf("recovered %v, want the handler's panic", p)
+			}
+		}()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/panic", nil))
+	}()
+}
@@ -0,0 +1,535 @@
+package user_activity_preferences
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Frequencies supported by RRule
+const (
+	FreqDaily   = "DAILY"
+	FreqWeekly  = "WEEKLY"
+	FreqMonthly = "MONTHLY"
+	FreqYearly  = "YEARLY"
+)
+
+// maxPeriods bounds expansion of rules whose BY* parts can never match, e.g. BYMONTHDAY=31;BYMONTH=2
+const maxPeriods = 100000
+
+var ErrInvalidRecurrence = errors.New("invalid recurrence")
+
+var weekdayCodes = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// WeekdayNum is a BYDAY entry such as TU, 2MO or -1FR. N is zero when no ordinal is given.
+type WeekdayNum struct {
+	Weekday time.Weekday
+	N       int
+}
+
+// RRule is a parsed RFC 5545 recurrence rule
+type RRule struct {
+	Freq       string
+	Interval   int
+	Count      int
+	Until      *time.Time
+	ByDay      []WeekdayNum
+	ByMonthDay []int
+	ByMonth    []int
+	BySetPos   []int
+	WeekStart  time.Weekday
+}
+
+// ParseRRule parses the value of an RRULE property, with or without the "RRULE:" prefix. An UNTIL
+// without a trailing Z is read as wall-clock time in loc, and a date-only UNTIL includes that whole day.
+func ParseRRule(value string, loc *time.Location) (RRule, error) {
+	rule := RRule{Interval: 1, WeekStart: time.Monday}
+
+	value = strings.TrimPrefix(strings.TrimSpace(value), "RRULE:")
+	if value == "" {
+		return RRule{}, fmt.Errorf("%w: rrule is empty", ErrInvalidRecurrence)
+	}
+
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(value, ";") {
+		key, val, found := strings.Cut(part, "=")
+		key = strings.ToUpper(strings.TrimSpace(key))
+		val = strings.ToUpper(strings.TrimSpace(val))
+		if !found || val == "" {
+			return RRule{}, fmt.Errorf("%w: malformed rule part %q", ErrInvalidRecurrence, part)
+		}
+		if seen[key] {
+			return RRule{}, fmt.Errorf("%w: %s is given more than once", ErrInvalidRecurrence, key)
+		}
+		seen[key] = true
+
+		var err error
+		switch key {
+		case "FREQ":
+			switch val {
+			case FreqDaily, FreqWeekly, FreqMonthly, FreqYearly:
+				rule.Freq = val
+			default:
+				err = fmt.Errorf("unsupported FREQ %q", val)
+			}
+		case "INTERVAL":
+			rule.Interval, err = parseIntInRange(val, 1, 1000)
+		case "COUNT":
+			rule.Count, err = parseIntInRange(val, 1, 10000)
+		case "UNTIL":
+			var until time.Time
+			until, err = parseUntil(val, loc)
+			rule.Until = &until
+		case "BYDAY":
+			for _, day := range strings.Split(val, ",") {
+				var weekdayNum WeekdayNum
+				weekdayNum, err = parseWeekdayNum(day)
+				if err != nil {
+					break
+				}
+				rule.ByDay = append(rule.ByDay, weekdayNum)
+			}
+		case "BYMONTHDAY":
+			rule.ByMonthDay, err = parseIntList(val, -31, 31)
+		case "BYMONTH":
+			rule.ByMonth, err = parseIntList(val, 1, 12)
+		case "BYSETPOS":
+			rule.BySetPos, err = parseIntList(val, -366, 366)
+		case "WKST":
+			weekday, ok := weekdayCodes[val]
+			if !ok {
+				err = fmt.Errorf("unknown weekday %q", val)
+			}
+			rule.WeekStart = weekday
+		default:
+			err = fmt.Errorf("unsupported rule part %s", key)
+		}
+		if err != nil {
+			return RRule{}, fmt.Errorf("%w: %s: %v", ErrInvalidRecurrence, key, err)
+		}
+	}
+
+	if err := rule.validate(); err != nil {
+		return RRule{}, fmt.Errorf("%w: %v", ErrInvalidRecurrence, err)
+	}
+
+	return rule, nil
+}
+
+// String formats the rule as an RRULE value, with UNTIL in UTC
+func (rule RRule) String() string {
+	parts := []string{"FREQ=" + rule.Freq}
+	if rule.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(rule.Interval))
+	}
+	if rule.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(rule.Count))
+	}
+	if rule.Until != nil {
+		parts = append(parts, "UNTIL="+rule.Until.UTC().Format("20060102T150405Z"))
+	}
+	if len(rule.ByMonth) > 0 {
+		parts = append(parts, "BYMONTH="+joinInts(rule.ByMonth))
+	}
+	if len(rule.ByMonthDay) > 0 {
+		parts = append(parts, "BYMONTHDAY="+joinInts(rule.ByMonthDay))
+	}
+	if len(rule.ByDay) > 0 {
+		var days []string
+		for _, weekdayNum := range rule.ByDay {
+			day := strings.ToUpper(weekdayNum.Weekday.String()[:2])
+			if weekdayNum.N != 0 {
+				day = strconv.Itoa(weekdayNum.N) + day
+			}
+			days = append(days, day)
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if len(rule.BySetPos) > 0 {
+		parts = append(parts, "BYSETPOS="+joinInts(rule.BySetPos))
+	}
+	if rule.WeekStart != time.Monday {
+		parts = append(parts, "WKST="+strings.ToUpper(rule.WeekStart.String()[:2]))
+	}
+	return strings.Join(parts, ";")
+}
+
+func (rule RRule) validate() error {
+	if rule.Freq == "" {
+		return errors.New("FREQ is required")
+	}
+	if rule.Count > 0 && rule.Until != nil {
+		return errors.New("COUNT and UNTIL must not both be given")
+	}
+	if rule.Freq == FreqWeekly && len(rule.ByMonthDay) > 0 {
+		return errors.New("BYMONTHDAY must not be used with FREQ=WEEKLY")
+	}
+	for _, weekdayNum := range rule.ByDay {
+		if weekdayNum.N == 0 {
+			continue
+		}
+		switch {
+		case rule.Freq == FreqMonthly || (rule.Freq == FreqYearly && len(rule.ByMonth) > 0):
+			if weekdayNum.N < -5 || weekdayNum.N > 5 {
+				return fmt.Errorf("BYDAY ordinal %d is out of range for a month", weekdayNum.N)
+			}
+		case rule.Freq == FreqYearly:
+			if weekdayNum.N < -53 || weekdayNum.N > 53 {
+				return fmt.Errorf("BYDAY ordinal %d is out of range for a year", weekdayNum.N)
+			}
+		default:
+			return fmt.Errorf("BYDAY ordinals are only allowed with FREQ=MONTHLY or FREQ=YEARLY")
+		}
+	}
+	if len(rule.BySetPos) > 0 && len(rule.ByDay) == 0 && len(rule.ByMonthDay) == 0 && len(rule.ByMonth) == 0 {
+		return errors.New("BYSETPOS requires BYDAY, BYMONTHDAY or BYMONTH")
+	}
+	return nil
+}
+
+// Recurrence is a rule anchored at its first occurrence, minus the excluded occurrences
+type Recurrence struct {
+	Rule    RRule
+	Start   time.Time // DTSTART, in the series' time zone
+	ExDates []time.Time
+}
+
+// Between returns the occurrences in [from, to) in order. Occurrences keep DTSTART's wall-clock
+// time in its location, so their UTC offset follows daylight saving time.
+func (r Recurrence) Between(from time.Time, to time.Time) []time.Time {
+	excluded := make(map[int64]bool, len(r.ExDates))
+	for _, exDate := range r.ExDates {
+		excluded[exDate.Unix()] = true
+	}
+
+	loc := r.Start.Location()
+	lastDate := civilDate(to.In(loc))
+	count := 0
+
+	var occurrences []time.Time
+	period := r.Rule.firstPeriod(civilDate(r.Start))
+	for i := 0; i < maxPeriods && !period.After(lastDate); i++ {
+		for _, date := range r.Rule.datesIn(period, r.Start) {
+			occurrence := time.Date(date.Year(), date.Month(), date.Day(), r.Start.Hour(), r.Start.Minute(), r.Start.Second(), 0, loc)
+			if occurrence.Before(r.Start) {
+				continue
+			}
+			if r.Rule.Until != nil && occurrence.After(*r.Rule.Until) {
+				return occurrences
+			}
+			count++
+			if r.Rule.Count > 0 && count > r.Rule.Count {
+				return occurrences
+			}
+			if !occurrence.Before(to) {
+				return occurrences
+			}
+			if occurrence.Before(from) || excluded[occurrence.Unix()] {
+				continue
+			}
+			occurrences = append(occurrences, occurrence)
+		}
+		period = r.Rule.nextPeriod(period)
+	}
+
+	return occurrences
+}
+
+// firstPeriod returns the first day of the period containing date
+func (rule RRule) firstPeriod(date time.Time) time.Time {
+	switch rule.Freq {
+	case FreqWeekly:
+		return date.AddDate(0, 0, -int((date.Weekday()-rule.WeekStart+7)%7))
+	case FreqMonthly:
+		return time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC)
+	case FreqYearly:
+		return time.Date(date.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return date
+	}
+}
+
+func (rule RRule) nextPeriod(period time.Time) time.Time {
+	switch rule.Freq {
+	case FreqWeekly:
+		return period.AddDate(0, 0, 7*rule.Interval)
+	case FreqMonthly:
+		return period.AddDate(0, rule.Interval, 0)
+	case FreqYearly:
+		return period.AddDate(rule.Interval, 0, 0)
+	default:
+		return period.AddDate(0, 0, rule.Interval)
+	}
+}
+
+// datesIn returns the sorted dates a period expands to, after BYSETPOS
+func (rule RRule) datesIn(period time.Time, start time.Time) []time.Time {
+	var dates []time.Time
+
+	switch rule.Freq {
+	case FreqDaily:
+		if rule.matchesWeekday(period) && rule.matchesMonthDay(period) {
+			dates = append(dates, period)
+		}
+	case FreqWeekly:
+		for offset := 0; offset < 7; offset++ {
+			date := period.AddDate(0, 0, offset)
+			if len(rule.ByDay) == 0 && date.Weekday() != start.Weekday() {
+				continue
+			}
+			if rule.matchesWeekday(date) {
+				dates = append(dates, date)
+			}
+		}
+	case FreqMonthly:
+		dates = rule.monthDates(period.Year(), period.Month(), start)
+	case FreqYearly:
+		switch {
+		case len(rule.ByMonth) > 0:
+			for _, month := range sortedInts(rule.ByMonth) {
+				dates = append(dates, rule.monthDates(period.Year(), time.Month(month), start)...)
+			}
+			// BYMONTH is applied here, the filter below would be a no-op
+			return rule.applySetPos(dates)
+		case len(rule.ByMonthDay) > 0:
+			for month := time.January; month <= time.December; month++ {
+				dates = append(dates, rule.monthDates(period.Year(), month, start)...)
+			}
+		case len(rule.ByDay) > 0:
+			first := time.Date(period.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+			dates = spanWeekdays(first, first.AddDate(1, 0, 0), rule.ByDay)
+		default:
+			date := time.Date(period.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+			if date.Day() == start.Day() {
+				dates = append(dates, date)
+			}
+		}
+	}
+
+	var inMonth []time.Time
+	for _, date := range dates {
+		if len(rule.ByMonth) == 0 || containsInt(rule.ByMonth, int(date.Month())) {
+			inMonth = append(inMonth, date)
+		}
+	}
+
+	return rule.applySetPos(inMonth)
+}
+
+// monthDates expands BYMONTHDAY and BYDAY within one month, intersecting them when both are given
+func (rule RRule) monthDates(year int, month time.Month, start time.Time) []time.Time {
+	first := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	next := first.AddDate(0, 1, 0)
+	daysInMonth := next.AddDate(0, 0, -1).Day()
+
+	if len(rule.ByMonthDay) == 0 && len(rule.ByDay) == 0 {
+		if start.Day() > daysInMonth {
+			return nil
+		}
+		return []time.Time{first.AddDate(0, 0, start.Day()-1)}
+	}
+
+	if len(rule.ByDay) > 0 {
+		var dates []time.Time
+		for _, date := range spanWeekdays(first, next, rule.ByDay) {
+			if rule.matchesMonthDay(date) {
+				dates = append(dates, date)
+			}
+		}
+		return dates
+	}
+
+	var dates []time.Time
+	for day := 1; day <= daysInMonth; day++ {
+		date := first.AddDate(0, 0, day-1)
+		if rule.matchesMonthDay(date) {
+			dates = append(dates, date)
+		}
+	}
+	return dates
+}
+
+// spanWeekdays returns the dates in [first, end) matching BYDAY, with ordinals counted within the span
+func spanWeekdays(first time.Time, end time.Time, byDay []WeekdayNum) []time.Time {
+	byWeekday := make(map[time.Weekday][]time.Time)
+	for date := first; date.Before(end); date = date.AddDate(0, 0, 1) {
+		byWeekday[date.Weekday()] = append(byWeekday[date.Weekday()], date)
+	}
+
+	matched := make(map[time.Time]bool)
+	for _, weekdayNum := range byDay {
+		candidates := byWeekday[weekdayNum.Weekday]
+		switch {
+		case weekdayNum.N == 0:
+			for _, date := range candidates {
+				matched[date] = true
+			}
+		case weekdayNum.N > 0 && weekdayNum.N <= len(candidates):
+			matched[candidates[weekdayNum.N-1]] = true
+		case weekdayNum.N < 0 && -weekdayNum.N <= len(candidates):
+			matched[candidates[len(candidates)+weekdayNum.N]] = true
+		}
+	}
+
+	dates := make([]time.Time, 0, len(matched))
+	for date := range matched {
+		dates = append(dates, date)
+	}
+	sort.Slice(dates, func(i, j int) bool {
+		return dates[i].Before(dates[j])
+	})
+	return dates
+}
+
+func (rule RRule) matchesWeekday(date time.Time) bool {
+	if len(rule.ByDay) == 0 {
+		return true
+	}
+	for _, weekdayNum := range rule.ByDay {
+		if weekdayNum.Weekday == date.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule RRule) matchesMonthDay(date time.Time) bool {
+	if len(rule.ByMonthDay) == 0 {
+		return true
+	}
+	daysInMonth := time.Date(date.Year(), date.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	for _, monthDay := range rule.ByMonthDay {
+		if monthDay == date.Day() || (monthDay < 0 && daysInMonth+1+monthDay == date.Day()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule RRule) applySetPos(dates []time.Time) []time.Time {
+	sort.Slice(dates, func(i, j int) bool {
+		return dates[i].Before(dates[j])
+	})
+	if len(rule.BySetPos) == 0 {
+		return dates
+	}
+
+	picked := make(map[int]bool)
+	for _, pos := range rule.BySetPos {
+		switch {
+		case pos > 0 && pos <= len(dates):
+			picked[pos-1] = true
+		case pos < 0 && -pos <= len(dates):
+			picked[len(dates)+pos] = true
+		}
+	}
+
+	var selected []time.Time
+	for i, date := range dates {
+		if picked[i] {
+			selected = append(selected, date)
+		}
+	}
+	return selected
+}
+
+// civilDate drops the time of day, keeping the calendar date in t's location
+func civilDate(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func parseUntil(value string, loc *time.Location) (time.Time, error) {
+	if until, err := time.Parse("20060102T150405Z", value); err == nil {
+		return until, nil
+	}
+	if until, err := time.ParseInLocation("20060102T150405", value, loc); err == nil {
+		return until, nil
+	}
+	date, err := time.ParseInLocation("20060102", value, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not a date or date-time", value)
+	}
+	return date.AddDate(0, 0, 1).Add(-time.Second), nil
+}
+
+func parseWeekdayNum(value string) (WeekdayNum, error) {
+	value = strings.TrimSpace(value)
+	if len(value) < 2 {
+		return WeekdayNum{}, fmt.Errorf("unknown weekday %q", value)
+	}
+
+	weekday, ok := weekdayCodes[value[len(value)-2:]]
+	if !ok {
+		return WeekdayNum{}, fmt.Errorf("unknown weekday %q", value)
+	}
+
+	weekdayNum := WeekdayNum{Weekday: weekday}
+	if ordinal := value[:len(value)-2]; ordinal != "" {
+		n, err := strconv.Atoi(ordinal)
+		if err != nil || n == 0 {
+			return WeekdayNum{}, fmt.Errorf("invalid weekday ordinal %q", ordinal)
+		}
+		weekdayNum.N = n
+	}
+	return weekdayNum, nil
+}
+
+func parseIntList(value string, min int, max int) ([]int, error) {
+	var ints []int
+	for _, part := range strings.Split(value, ",") {
+		n, err := parseIntInRange(part, min, max)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, errors.New("0 is not allowed")
+		}
+		ints = append(ints, n)
+	}
+	return ints, nil
+}
+
+func parseIntInRange(value string, min int, max int) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number", value)
+	}
+	if n < min || n > max {
+		return 0, fmt.Errorf("%d is not between %d and %d", n, min, max)
+	}
+	return n, nil
+}
+
+func joinInts(ints []int) string {
+	parts := make([]string, len(ints))
+	for i, n := range ints {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ",")
+}
+
+func sortedInts(ints []int) []int {
+	sorted := append([]int(nil), ints...)
+	sort.Ints(sorted)
+	return sorted
+}
+
+func containsInt(ints []int, n int) bool {
+	for _, i := range ints {
+		if i == n {
+			return true
+		}
+	}
+	return false
+}
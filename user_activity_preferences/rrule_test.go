@@ -0,0 +1,227 @@
+package user_activity_preferences
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+const occurrenceLayout = "2006-01-02T15:04:05-07:00"
+
+func TestRecurrenceBetween(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A Tuesday
+	start := time.Date(2024, 9, 3, 19, 0, 0, 0, newYork)
+
+	tests := []struct {
+		name    string
+		rrule   string
+		exDates []time.Time
+		from    time.Time
+		to      time.Time
+		want    []string
+	}{
+		{
+			name:  "weekly keeps the wall-clock time across the end of DST",
+			rrule: "FREQ=WEEKLY;BYDAY=TU",
+			from:  time.Date(2024, 10, 22, 0, 0, 0, 0, newYork),
+			to:    time.Date(2024, 11, 13, 0, 0, 0, 0, newYork),
+			want: []string{
+				"2024-10-22T19:00:00-04:00",
+				"2024-10-29T19:00:00-04:00",
+				"2024-11-05T19:00:00-05:00",
+				"2024-11-12T19:00:00-05:00",
+			},
+		},
+		{
+			name:  "daily keeps the wall-clock time across the start of DST",
+			rrule: "FREQ=DAILY",
+			from:  time.Date(2025, 3, 8, 0, 0, 0, 0, newYork),
+			to:    time.Date(2025, 3, 10, 0, 0, 0, 0, newYork),
+			want: []string{
+				"2025-03-08T19:00:00-05:00",
+				"2025-03-09T19:00:00-04:00",
+			},
+		},
+		{
+			name:  "last weekday of the month with BYSETPOS=-1",
+			rrule: "FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1",
+			from:  start,
+			to:    time.Date(2025, 1, 1, 0, 0, 0, 0, newYork),
+			want: []string{
+				"2024-09-30T19:00:00-04:00",
+				"2024-10-31T19:00:00-04:00",
+				"2024-11-29T19:00:00-05:00",
+				"2024-12-31T19:00:00-05:00",
+			},
+		},
+		{
+			name:  "first weekday of the month with BYSETPOS=1 skips the one before DTSTART",
+			rrule: "FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=1",
+			from:  start,
+			to:    time.Date(2025, 1, 1, 0, 0, 0, 0, newYork),
+			want: []string{
+				"2024-10-01T19:00:00-04:00",
+				"2024-11-01T19:00:00-04:00",
+				"2024-12-02T19:00:00-05:00",
+			},
+		},
+		{
+			name:  "last Friday of the month",
+			rrule: "FREQ=MONTHLY;BYDAY=-1FR",
+			from:  start,
+			to:    time.Date(2025, 1, 1, 0, 0, 0, 0, newYork),
+			want: []string{
+				"2024-09-27T19:00:00-04:00",
+				"2024-10-25T19:00:00-04:00",
+				"2024-11-29T19:00:00-05:00",
+				"2024-12-27T19:00:00-05:00",
+			},
+		},
+		{
+			name:  "BYMONTHDAY=31 skips shorter months",
+			rrule: "FREQ=MONTHLY;BYMONTHDAY=31",
+			from:  start,
+			to:    time.Date(2025, 4, 1, 0, 0, 0, 0, newYork),
+			want: []string{
+				"2024-10-31T19:00:00-04:00",
+				"2024-12-31T19:00:00-05:00",
+				"2025-01-31T19:00:00-05:00",
+				"2025-03-31T19:00:00-04:00",
+			},
+		},
+		{
+			name:  "BYMONTHDAY=-1 is the last day of every month",
+			rrule: "FREQ=MONTHLY;BYMONTHDAY=-1",
+			from:  start,
+			to:    time.Date(2024, 12, 1, 0, 0, 0, 0, newYork),
+			want: []string{
+				"2024-09-30T19:00:00-04:00",
+				"2024-10-31T19:00:00-04:00",
+				"2024-11-30T19:00:00-05:00",
+			},
+		},
+		{
+			name:  "UNTIL in UTC is inclusive",
+			rrule: "FREQ=DAILY;UNTIL=20240905T230000Z",
+			from:  start,
+			to:    time.Date(2024, 10, 1, 0, 0, 0, 0, newYork),
+			want: []string{
+				"2024-09-03T19:00:00-04:00",
+				"2024-09-04T19:00:00-04:00",
+				"2024-09-05T19:00:00-04:00",
+			},
+		},
+		{
+			name:  "UNTIL in wall-clock time stops before a later occurrence",
+			rrule: "FREQ=DAILY;UNTIL=20240905T185959",
+			from:  start,
+			to:    time.Date(2024, 10, 1, 0, 0, 0, 0, newYork),
+			want: []string{
+				"2024-09-03T19:00:00-04:00",
+				"2024-09-04T19:00:00-04:00",
+			},
+		},
+		{
+			name:  "a date-only UNTIL includes the whole day",
+			rrule: "FREQ=DAILY;UNTIL=20240905",
+			from:  start,
+			to:    time.Date(2024, 10, 1, 0, 0, 0, 0, newYork),
+			want: []string{
+				"2024-09-03T19:00:00-04:00",
+				"2024-09-04T19:00:00-04:00",
+				"2024-09-05T19:00:00-04:00",
+			},
+		},
+		{
+			name:    "EXDATEs still count towards COUNT",
+			rrule:   "FREQ=DAILY;COUNT=3",
+			exDates: []time.Time{time.Date(2024, 9, 4, 19, 0, 0, 0, newYork)},
+			from:    start,
+			to:      time.Date(2024, 10, 1, 0, 0, 0, 0, newYork),
+			want: []string{
+				"2024-09-03T19:00:00-04:00",
+				"2024-09-05T19:00:00-04:00",
+			},
+		},
+		{
+			name:  "every other week on two days",
+			rrule: "FREQ=WEEKLY;INTERVAL=2;BYDAY=TU,TH",
+			from:  start,
+			to:    time.Date(2024, 9, 20, 0, 0, 0, 0, newYork),
+			want: []string{
+				"2024-09-03T19:00:00-04:00",
+				"2024-09-05T19:00:00-04:00",
+				"2024-09-17T19:00:00-04:00",
+				"2024-09-19T19:00:00-04:00",
+			},
+		},
+		{
+			name:  "a rule that never matches ends",
+			rrule: "FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=31",
+			from:  start,
+			to:    time.Date(2030, 1, 1, 0, 0, 0, 0, newYork),
+			want:  nil,
+		},
+	}
+	for _, tt := range tests {
+		rule, err := ParseRRule(tt.rrule, newYork)
+		if err != nil {
+			t.Errorf("%s: ParseRRule(%q): %v", tt.name, tt.rrule, err)
+			continue
+		}
+		recurrence := Recurrence{Rule: rule, Start: start, ExDates: tt.exDates}
+
+		var got []string
+		for _, occurrence := range recurrence.Between(tt.from, tt.to) {
+			got = append(got, occurrence.Format(occurrenceLayout))
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: Between = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseRRule(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string // String() of the parsed rule, empty when the rule is invalid
+	}{
+		{"FREQ=WEEKLY;BYDAY=TU", "FREQ=WEEKLY;BYDAY=TU"},
+		{"RRULE:freq=monthly;byday=-1fr", "FREQ=MONTHLY;BYDAY=-1FR"},
+		{"FREQ=MONTHLY;INTERVAL=1;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1", "FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1"},
+		{"FREQ=DAILY;UNTIL=20240905T230000Z", "FREQ=DAILY;UNTIL=20240905T230000Z"},
+		{"FREQ=WEEKLY;WKST=SU;INTERVAL=2", "FREQ=WEEKLY;INTERVAL=2;WKST=SU"},
+		{"", ""},
+		{"FREQ=HOURLY", ""},
+		{"INTERVAL=2", ""},
+		{"FREQ=DAILY;FREQ=WEEKLY", ""},
+		{"FREQ=DAILY;COUNT=2;UNTIL=20240905", ""},
+		{"FREQ=WEEKLY;BYMONTHDAY=1", ""},
+		{"FREQ=WEEKLY;BYDAY=1MO", ""},
+		{"FREQ=MONTHLY;BYDAY=6MO", ""},
+		{"FREQ=MONTHLY;BYSETPOS=1", ""},
+		{"FREQ=MONTHLY;BYMONTHDAY=32", ""},
+		{"FREQ=DAILY;BYHOUR=9", ""},
+	}
+	for _, tt := range tests {
+		rule, err := ParseRRule(tt.value, time.UTC)
+		if tt.want == "" {
+			if !errors.Is(err, ErrInvalidRecurrence) {
+				t.Errorf("ParseRRule(%q) error = %v, want ErrInvalidRecurrence", tt.value, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseRRule(%q): %v", tt.value, err)
+			continue
+		}
+		if got := rule.String(); got != tt.want {
+			t.Errorf("ParseRRule(%q).String() = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
@@ -1,18 +1,24 @@
 package user_activity_preferences
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"friendsocial/auth"
+	"friendsocial/query"
 	"net/http"
+	"time"
 )
 
 // UserActivityPreferenceService defines the interface for user activity preference operations
 type UserActivityPreferenceService interface {
-	Create(preference UserActivityPreference) (UserActivityPreference, error)
-	ReadAll() ([]UserActivityPreference, error)
-	Read(id string) (UserActivityPreference, bool, error)
-	Update(id string, preference UserActivityPreference) (UserActivityPreference, bool, error)
-	Delete(id string) (bool, error)
-	ReadByUserID(userID string) ([]UserActivityPreference, error)
+	Create(ctx context.Context, preference UserActivityPreference) (UserActivityPreference, error)
+	ReadAll(ctx context.Context, params query.Params) (query.Page[UserActivityPreference], error)
+	Read(ctx context.Context, id string) (UserActivityPreference, bool, error)
+	Update(ctx context.Context, id string, preference UserActivityPreference) (UserActivityPreference, bool, error)
+	Delete(ctx context.Context, id string) (bool, error)
+	ReadByUserID(ctx context.Context, userID string) ([]UserActivityPreference, error)
+	ReadDueForMaterialization(ctx context.Context, until time.Time) ([]UserActivityPreference, error)
 }
 
 // UserActivityPreferenceError represents the error response
@@ -36,7 +42,7 @@ func NewUserActivityPreferenceHTTPHandler(preferenceService UserActivityPreferen
 // HandleHTTPPost creates a new user activity preference
 //
 //	@Summary		Create a new user activity preference
-//	@Description	Create a new user activity preference
+//	@Description	Create a new user activity preference. Recurring series are described by an RFC 5545 rrule with dtstart and time_zone, or by the legacy frequency fields.
 //	@Tags			preferences
 //	@Accept			json
 //	@Produce		json
@@ -53,8 +59,12 @@ func (h *UserActivityPreferenceHTTPHandler) HandleHTTPPost(w http.ResponseWriter
 		return
 	}
 
-	newPreference, err := h.preferenceService.Create(preference)
+	newPreference, err := h.preferenceService.Create(r.Context(), preference)
 	if err != nil {
+		if errors.Is(err, ErrInvalidRecurrence) {
+			h.errorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
 		h.errorResponse(w, http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -71,20 +81,29 @@ func (h *UserActivityPreferenceHTTPHandler) HandleHTTPPost(w http.ResponseWriter
 // HandleHTTPGet retrieves all user activity preferences
 //
 //	@Summary		Get all user activity preferences
-//	@Description	Retrieve all user activity preferences
+//	@Description	Retrieve all user activity preferences. Filter with id, user_id, activity_id and frequency_period, e.g. ?user_id=3
 //	@Tags			preferences
 //	@Produce		json
-//	@Success		200	{array}		UserActivityPreference
-//	@Failure		400	{object}	UserActivityPreferenceError
-//	@Failure		500	{object}	UserActivityPreferenceError
+//	@Param			limit	query		int		false	"Items per page, defaults to 50, at most 200"
+//	@Param			cursor	query		string	false	"next_cursor of the previous page"
+//	@Param			sort	query		string	false	"Field to sort by, prefixed with - for descending: id"
+//	@Success		200		{object}	query.Page[UserActivityPreference]
+//	@Failure		400		{object}	UserActivityPreferenceError
+//	@Failure		500		{object}	UserActivityPreferenceError
 //	@Router			/preferences [get]
 func (h *UserActivityPreferenceHTTPHandler) HandleHTTPGet(w http.ResponseWriter, r *http.Request) {
-	preferences, err := h.preferenceService.ReadAll()
+	params, err := query.Parse(r.URL.RawQuery, listSpec)
 	if err != nil {
 		h.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
+	preferences, err := h.preferenceService.ReadAll(r.Context(), params)
+	if err != nil {
+		h.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(preferences)
 	if err != nil {
@@ -109,7 +128,7 @@ func (h *UserActivityPreferenceHTTPHandler) HandleHTTPGet(w http.ResponseWriter,
 func (h *UserActivityPreferenceHTTPHandler) HandleHTTPGetWithID(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 
-	preference, found, err := h.preferenceService.Read(id)
+	preference, found, err := h.preferenceService.Read(r.Context(), id)
 	if err != nil {
 		h.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -131,7 +150,7 @@ func (h *UserActivityPreferenceHTTPHandler) HandleHTTPGetWithID(w http.ResponseW
 // HandleHTTPPut updates a user activity preference by ID
 //
 //	@Summary		Update a user activity preference by ID
-//	@Description	Update a user activity preference by ID
+//	@Description	Update a user activity preference by ID. The rrule, dtstart, time_zone and exdates of a recurring series are changed with PUT /scheduled_activity/{id}/series instead, so that its occurrences follow.
 //	@Tags			preferences
 //	@Accept			json
 //	@Produce		json
@@ -152,7 +171,7 @@ func (h *UserActivityPreferenceHTTPHandler) HandleHTTPPut(w http.ResponseWriter,
 		return
 	}
 
-	preference, found, err := h.preferenceService.Update(id, newPreference)
+	preference, found, err := h.preferenceService.Update(r.Context(), id, newPreference)
 	if err != nil {
 		h.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -185,7 +204,7 @@ func (h *UserActivityPreferenceHTTPHandler) HandleHTTPPut(w http.ResponseWriter,
 func (h *UserActivityPreferenceHTTPHandler) HandleHTTPDelete(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 
-	found, err := h.preferenceService.Delete(id)
+	found, err := h.preferenceService.Delete(r.Context(), id)
 	if err != nil {
 		h.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -199,6 +218,48 @@ func (h *UserActivityPreferenceHTTPHandler) HandleHTTPDelete(w http.ResponseWrit
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// RegisterRoutes adds the user activity preference routes to mux
+func (h *UserActivityPreferenceHTTPHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("POST /user_activity_preference", h.HandleHTTPPost)
+	mux.HandleFunc("GET /user_activity_preferences", h.HandleHTTPGet)
+	mux.HandleFunc("GET /user_activity_preference/{id}", h.HandleHTTPGetWithID)
+	mux.HandleFunc("PUT /user_activity_preference/{id}", h.HandleHTTPPut)
+	mux.HandleFunc("DELETE /user_activity_preference/{id}", h.HandleHTTPDelete)
+	mux.HandleFunc("GET /user_activity_preferences/user/{user_id}", h.HandleHTTPGetByUserID)
+}
+
+// AuthorizationRules returns the ownership rules for user activity preference routes
+func (h *UserActivityPreferenceHTTPHandler) AuthorizationRules() map[string]auth.Rule {
+	return map[string]auth.Rule{
+		"POST /user_activity_preference":        h.isBodyOwner,
+		"PUT /user_activity_preference/{id}":    auth.AllOf(h.isOwner, h.isBodyOwner),
+		"DELETE /user_activity_preference/{id}": h.isOwner,
+	}
+}
+
+// isOwner allows the user who created the preference in the path
+func (h *UserActivityPreferenceHTTPHandler) isOwner(r *http.Request, callerID int) (bool, error) {
+	preference, found, err := h.preferenceService.Read(r.Context(), r.PathValue("id"))
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		// Let the handler answer 404
+		return true, nil
+	}
+	return preference.UserID == callerID, nil
+}
+
+// isBodyOwner stops callers from creating preferences on behalf of someone else
+func (h *UserActivityPreferenceHTTPHandler) isBodyOwner(r *http.Request, callerID int) (bool, error) {
+	var preference UserActivityPreference
+	if err := auth.PeekJSON(r, &preference); err != nil {
+		// Let the handler answer 400
+		return true, nil
+	}
+	return preference.UserID == callerID, nil
+}
+
 // errorResponse sends an error response with the given status code and error message
 func (h *UserActivityPreferenceHTTPHandler) errorResponse(w http.ResponseWriter, statusCode int, errorString string) {
 	w.Header().Set("Content-Type", "application/json")
@@ -216,7 +277,7 @@ func (h *UserActivityPreferenceHTTPHandler) errorResponse(w http.ResponseWriter,
 func (h *UserActivityPreferenceHTTPHandler) HandleHTTPGetByUserID(w http.ResponseWriter, r *http.Request) {
 	userID := r.PathValue("user_id")
 
-	preferences, err := h.preferenceService.ReadByUserID(userID)
+	preferences, err := h.preferenceService.ReadByUserID(r.Context(), userID)
 	if err != nil {
 		h.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
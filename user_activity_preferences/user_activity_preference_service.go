@@ -2,43 +2,182 @@ package user_activity_preferences
 
 import (
 	"context"
-	"sync"
+	"errors"
+	"fmt"
+	"friendsocial/query"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/lib/pq"
 )
 
+// ErrSeriesChange is returned when an update would change the rule of a series whose occurrences
+// already exist. Those changes go through the series endpoint, which regenerates the occurrences.
+var ErrSeriesChange = errors.New("rrule, dtstart, time_zone and exdates of a recurring series can only be changed with PUT /scheduled_activity/{id}/series")
+
+// dtstartLayout is the wall-clock format of DTStart and ExDates, interpreted in TimeZone
+const dtstartLayout = "2006-01-02T15:04:05"
+
 type UserActivityPreference struct {
-	ID              int    `json:"id"`
-	UserID          int    `json:"user_id"`
-	ActivityID      int    `json:"activity_id"`
-	Frequency       int    `json:"frequency"`
-	FrequencyPeriod string `json:"frequency_period"`
-	DaysOfWeek      string `json:"days_of_week"`
+	ID              int      `json:"id"`
+	UserID          int      `json:"user_id"`
+	ActivityID      int      `json:"activity_id"`
+	Frequency       int      `json:"frequency"`
+	FrequencyPeriod string   `json:"frequency_period"`
+	DaysOfWeek      string   `json:"days_of_week"`
+	RRule           string   `json:"rrule,omitempty"`     // RFC 5545 RRULE value, e.g. FREQ=WEEKLY;BYDAY=TU
+	DTStart         string   `json:"dtstart,omitempty"`   // first occurrence, e.g. 2024-09-03T19:00:00
+	TimeZone        string   `json:"time_zone,omitempty"` // IANA time zone of DTStart and ExDates
+	ExDates         []string `json:"exdates,omitempty"`   // occurrences to skip, in the DTStart format
+	// MaterializedUntil is how far ahead the series' scheduled activities have been created
+	MaterializedUntil *time.Time `json:"materialized_until,omitempty"`
+}
+
+// preferenceColumns lists the columns scanned by scanPreference
+const preferenceColumns = `id, user_id, activity_id, frequency, frequency_period, COALESCE(days_of_week, ''),
+	COALESCE(rrule, ''), COALESCE(to_char(dtstart, 'YYYY-MM-DD"T"HH24:MI:SS'), ''), COALESCE(time_zone, ''), COALESCE(exdates, '{}'), materialized_until`
+
+func scanPreference(row pgx.Row, preference *UserActivityPreference) error {
+	return row.Scan(&preference.ID, &preference.UserID, &preference.ActivityID, &preference.Frequency, &preference.FrequencyPeriod, &preference.DaysOfWeek,
+		&preference.RRule, &preference.DTStart, &preference.TimeZone, &preference.ExDates, &preference.MaterializedUntil)
+}
+
+// Recurrence parses the preference's RRULE, DTSTART, time zone and EXDATEs
+func (preference UserActivityPreference) Recurrence() (Recurrence, error) {
+	if preference.RRule == "" {
+		return Recurrence{}, fmt.Errorf("%w: rrule is required", ErrInvalidRecurrence)
+	}
+	if preference.TimeZone == "" {
+		return Recurrence{}, fmt.Errorf("%w: time_zone is required with rrule", ErrInvalidRecurrence)
+	}
+	loc, err := time.LoadLocation(preference.TimeZone)
+	if err != nil {
+		return Recurrence{}, fmt.Errorf("%w: invalid time_zone: %v", ErrInvalidRecurrence, err)
+	}
+
+	start, err := time.ParseInLocation(dtstartLayout, preference.DTStart, loc)
+	if err != nil {
+		return Recurrence{}, fmt.Errorf("%w: dtstart must look like %s: %v", ErrInvalidRecurrence, dtstartLayout, err)
+	}
+
+	rule, err := ParseRRule(preference.RRule, loc)
+	if err != nil {
+		return Recurrence{}, err
+	}
+
+	recurrence := Recurrence{Rule: rule, Start: start}
+	for _, exDate := range preference.ExDates {
+		excluded, err := time.ParseInLocation(dtstartLayout, exDate, loc)
+		if err != nil {
+			return Recurrence{}, fmt.Errorf("%w: exdate %q must look like %s", ErrInvalidRecurrence, exDate, dtstartLayout)
+		}
+		recurrence.ExDates = append(recurrence.ExDates, excluded)
+	}
+
+	return recurrence, nil
+}
+
+// LegacyRRule translates frequency, frequency_period and days_of_week (comma separated weekday
+// numbers, Sunday is 0) into an RRULE
+func (preference UserActivityPreference) LegacyRRule() (string, error) {
+	var freq string
+	switch strings.ToLower(preference.FrequencyPeriod) {
+	case "day", "daily":
+		freq = FreqDaily
+	case "week", "weekly":
+		freq = FreqWeekly
+	case "month", "monthly":
+		freq = FreqMonthly
+	case "year", "yearly":
+		freq = FreqYearly
+	default:
+		return "", fmt.Errorf("%w: unknown frequency_period %q", ErrInvalidRecurrence, preference.FrequencyPeriod)
+	}
+
+	interval := preference.Frequency
+	if interval < 1 {
+		interval = 1
+	}
+
+	rule := fmt.Sprintf("FREQ=%s;INTERVAL=%d", freq, interval)
+	if strings.TrimSpace(preference.DaysOfWeek) != "" {
+		var days []string
+		for _, day := range strings.Split(preference.DaysOfWeek, ",") {
+			dayInt, err := strconv.Atoi(strings.TrimSpace(day))
+			if err != nil || dayInt < 0 || dayInt > 6 {
+				return "", fmt.Errorf("%w: invalid day of week %q", ErrInvalidRecurrence, day)
+			}
+			days = append(days, strings.ToUpper(time.Weekday(dayInt).String()[:2]))
+		}
+		rule += ";BYDAY=" + strings.Join(days, ",")
+	}
+
+	return rule, nil
+}
+
+// Normalize validates the RRULE, when there is one, and fills the legacy frequency columns from it
+func (preference *UserActivityPreference) Normalize() error {
+	if preference.RRule == "" {
+		return nil
+	}
+
+	recurrence, err := preference.Recurrence()
+	if err != nil {
+		return err
+	}
+
+	preference.RRule = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(preference.RRule)), "RRULE:")
+	preference.Frequency = recurrence.Rule.Interval
+	preference.FrequencyPeriod = map[string]string{
+		FreqDaily:   "day",
+		FreqWeekly:  "week",
+		FreqMonthly: "month",
+		FreqYearly:  "year",
+	}[recurrence.Rule.Freq]
+
+	var days []string
+	for _, weekdayNum := range recurrence.Rule.ByDay {
+		days = append(days, strconv.Itoa(int(weekdayNum.Weekday)))
+	}
+	preference.DaysOfWeek = strings.Join(days, ",")
+
+	return nil
+}
+
+// nullIfEmpty stores optional text columns as NULL
+func nullIfEmpty(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
 }
 
 type Service struct {
-	sync.Mutex
-	db       *pgxpool.Pool
-	services *map[string]interface{}
+	db *pgxpool.Pool
 }
 
-func NewService(db *pgxpool.Pool, services *map[string]interface{}) *Service {
+func NewService(db *pgxpool.Pool) *Service {
 	return &Service{
-		db:       db,
-		services: services,
+		db: db,
 	}
 }
 
-func (s *Service) Create(preference UserActivityPreference) (UserActivityPreference, error) {
-	s.Lock()
-	defer s.Unlock()
+func (s *Service) Create(ctx context.Context, preference UserActivityPreference) (UserActivityPreference, error) {
+	if err := preference.Normalize(); err != nil {
+		return UserActivityPreference{}, err
+	}
+
 	var id int
 	err := s.db.QueryRow(
-		context.Background(),
-		`INSERT INTO user_activity_preferences (user_id, activity_id, frequency, frequency_period, days_of_week) 
-		 VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		ctx,
+		`INSERT INTO user_activity_preferences (user_id, activity_id, frequency, frequency_period, days_of_week, rrule, dtstart, time_zone, exdates) 
+		 VALUES ($1, $2, $3, $4, $5, $6, $7::timestamp, $8, $9) RETURNING id`,
 		preference.UserID, preference.ActivityID, preference.Frequency, preference.FrequencyPeriod, preference.DaysOfWeek,
+		nullIfEmpty(preference.RRule), nullIfEmpty(preference.DTStart), nullIfEmpty(preference.TimeZone), pq.Array(preference.ExDates),
 	).Scan(&id)
 	if err != nil {
 		return UserActivityPreference{}, err
@@ -48,34 +187,45 @@ func (s *Service) Create(preference UserActivityPreference) (UserActivityPrefere
 	return preference, nil
 }
 
-func (s *Service) ReadAll() ([]UserActivityPreference, error) {
-	s.Lock()
-	defer s.Unlock()
+// listSpec are the fields preferences can be listed by
+var listSpec = query.Spec{
+	Fields: map[string]query.Field{
+		"id":               {Column: "id", Kind: query.Int},
+		"user_id":          {Column: "user_id", Kind: query.Int},
+		"activity_id":      {Column: "activity_id", Kind: query.Int},
+		"frequency_period": {Column: "frequency_period", Kind: query.String},
+	},
+	Key: "id",
+}
 
-	rows, err := s.db.Query(context.Background(), "SELECT id, user_id, activity_id, frequency, frequency_period, days_of_week FROM user_activity_preferences")
+func (s *Service) ReadAll(ctx context.Context, params query.Params) (query.Page[UserActivityPreference], error) {
+	sql, args := params.Apply("SELECT " + preferenceColumns + " FROM user_activity_preferences")
+	rows, err := s.db.Query(ctx, sql, args...)
 	if err != nil {
-		return nil, err
+		return query.Page[UserActivityPreference]{}, err
 	}
 	defer rows.Close()
 
 	var preferences []UserActivityPreference
 	for rows.Next() {
 		var preference UserActivityPreference
-		if err := rows.Scan(&preference.ID, &preference.UserID, &preference.ActivityID, &preference.Frequency, &preference.FrequencyPeriod, &preference.DaysOfWeek); err != nil {
-			return nil, err
+		if err := scanPreference(rows, &preference); err != nil {
+			return query.Page[UserActivityPreference]{}, err
 		}
 		preferences = append(preferences, preference)
 	}
+	if err := rows.Err(); err != nil {
+		return query.Page[UserActivityPreference]{}, err
+	}
 
-	return preferences, nil
+	return query.NewPage(params, preferences, func(preference UserActivityPreference, sort string) (int, interface{}) {
+		return preference.ID, nil
+	}), nil
 }
 
-func (s *Service) Read(id string) (UserActivityPreference, bool, error) {
-	s.Lock()
-	defer s.Unlock()
-
+func (s *Service) Read(ctx context.Context, id string) (UserActivityPreference, bool, error) {
 	var preference UserActivityPreference
-	err := s.db.QueryRow(context.Background(), "SELECT id, user_id, activity_id, frequency, frequency_period, days_of_week FROM user_activity_preferences WHERE id = $1", id).Scan(&preference.ID, &preference.UserID, &preference.ActivityID, &preference.Frequency, &preference.FrequencyPeriod, &preference.DaysOfWeek)
+	err := scanPreference(s.db.QueryRow(ctx, "SELECT "+preferenceColumns+" FROM user_activity_preferences WHERE id = $1", id), &preference)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return UserActivityPreference{}, false, nil
@@ -86,27 +236,70 @@ func (s *Service) Read(id string) (UserActivityPreference, bool, error) {
 	return preference, true, nil
 }
 
-func (s *Service) Update(id string, preference UserActivityPreference) (UserActivityPreference, bool, error) {
-	s.Lock()
-	defer s.Unlock()
-
-	cmdTag, err := s.db.Exec(context.Background(), "UPDATE user_activity_preferences SET user_id = $1, activity_id = $2, frequency = $3, frequency_period = $4 WHERE id = $5", preference.UserID, preference.ActivityID, preference.Frequency, preference.FrequencyPeriod, id)
+// ReadForUpdate reads a preference in tx and locks it until tx ends. Transactions that change a
+// series or generate its occurrences take this lock before locking any of the occurrences.
+func ReadForUpdate(ctx context.Context, tx pgx.Tx, id int) (UserActivityPreference, bool, error) {
+	var preference UserActivityPreference
+	err := scanPreference(tx.QueryRow(ctx, "SELECT "+preferenceColumns+" FROM user_activity_preferences WHERE id = $1 FOR UPDATE", id), &preference)
 	if err != nil {
+		if err == pgx.ErrNoRows {
+			return UserActivityPreference{}, false, nil
+		}
 		return UserActivityPreference{}, false, err
 	}
 
-	if cmdTag.RowsAffected() == 0 {
+	return preference, true, nil
+}
+
+// Update changes a preference. Once it has an RRULE its rule, start, time zone and EXDATEs are
+// left to the series endpoint, and changing them returns ErrSeriesChange.
+func (s *Service) Update(ctx context.Context, id string, preference UserActivityPreference) (UserActivityPreference, bool, error) {
+	if err := preference.Normalize(); err != nil {
+		return UserActivityPreference{}, false, err
+	}
+
+	preferenceID, err := strconv.Atoi(id)
+	if err != nil {
 		return UserActivityPreference{}, false, nil
 	}
 
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return UserActivityPreference{}, false, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	current, found, err := ReadForUpdate(ctx, tx, preferenceID)
+	if err != nil || !found {
+		return UserActivityPreference{}, found, err
+	}
+	if current.RRule != "" && (preference.RRule != current.RRule || preference.DTStart != current.DTStart ||
+		preference.TimeZone != current.TimeZone || !slices.Equal(preference.ExDates, current.ExDates)) {
+		return UserActivityPreference{}, true, ErrSeriesChange
+	}
+
+	_, err = tx.Exec(ctx,
+		`UPDATE user_activity_preferences
+		 SET user_id = $1, activity_id = $2, frequency = $3, frequency_period = $4, days_of_week = $5,
+		     rrule = $6, dtstart = $7::timestamp, time_zone = $8, exdates = $9
+		 WHERE id = $10`,
+		preference.UserID, preference.ActivityID, preference.Frequency, preference.FrequencyPeriod, preference.DaysOfWeek,
+		nullIfEmpty(preference.RRule), nullIfEmpty(preference.DTStart), nullIfEmpty(preference.TimeZone), pq.Array(preference.ExDates), id)
+	if err != nil {
+		return UserActivityPreference{}, true, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return UserActivityPreference{}, true, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	preference.ID = current.ID
+	preference.MaterializedUntil = current.MaterializedUntil
 	return preference, true, nil
 }
 
-func (s *Service) Delete(id string) (bool, error) {
-	s.Lock()
-	defer s.Unlock()
-
-	cmdTag, err := s.db.Exec(context.Background(), "DELETE FROM user_activity_preferences WHERE id = $1", id)
+func (s *Service) Delete(ctx context.Context, id string) (bool, error) {
+	cmdTag, err := s.db.Exec(ctx, "DELETE FROM user_activity_preferences WHERE id = $1", id)
 	if err != nil {
 		return false, err
 	}
@@ -119,11 +312,8 @@ func (s *Service) Delete(id string) (bool, error) {
 }
 
 // Add a new method to read preferences by user ID
-func (s *Service) ReadByUserID(userID string) ([]UserActivityPreference, error) {
-	s.Lock()
-	defer s.Unlock()
-
-	rows, err := s.db.Query(context.Background(), "SELECT id, user_id, activity_id, frequency, frequency_period, days_of_week FROM user_activity_preferences WHERE user_id = $1", userID)
+func (s *Service) ReadByUserID(ctx context.Context, userID string) ([]UserActivityPreference, error) {
+	rows, err := s.db.Query(ctx, "SELECT "+preferenceColumns+" FROM user_activity_preferences WHERE user_id = $1", userID)
 	if err != nil {
 		return nil, err
 	}
@@ -132,7 +322,7 @@ func (s *Service) ReadByUserID(userID string) ([]UserActivityPreference, error)
 	var preferences []UserActivityPreference
 	for rows.Next() {
 		var preference UserActivityPreference
-		if err := rows.Scan(&preference.ID, &preference.UserID, &preference.ActivityID, &preference.Frequency, &preference.FrequencyPeriod, &preference.DaysOfWeek); err != nil {
+		if err := scanPreference(rows, &preference); err != nil {
 			return nil, err
 		}
 		preferences = append(preferences, preference)
@@ -140,3 +330,26 @@ func (s *Service) ReadByUserID(userID string) ([]UserActivityPreference, error)
 
 	return preferences, nil
 }
+
+// ReadDueForMaterialization returns the recurring preferences whose scheduled activities have not
+// been created up to the given time
+func (s *Service) ReadDueForMaterialization(ctx context.Context, until time.Time) ([]UserActivityPreference, error) {
+	rows, err := s.db.Query(ctx,
+		"SELECT "+preferenceColumns+" FROM user_activity_preferences WHERE rrule IS NOT NULL AND (materialized_until IS NULL OR materialized_until < $1) ORDER BY id",
+		until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var preferences []UserActivityPreference
+	for rows.Next() {
+		var preference UserActivityPreference
+		if err := scanPreference(rows, &preference); err != nil {
+			return nil, err
+		}
+		preferences = append(preferences, preference)
+	}
+
+	return preferences, rows.Err()
+}
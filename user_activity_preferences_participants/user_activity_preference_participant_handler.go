@@ -1,17 +1,21 @@
 package user_activity_preferences_participants
 
 import (
+	"context"
 	"encoding/json"
+	"friendsocial/auth"
+	"friendsocial/query"
 	"net/http"
 )
 
 type UserActivityPreferenceParticipantService interface {
-	Create(participant UserActivityPreferenceParticipant) (UserActivityPreferenceParticipant, error)
-	ReadAll() ([]UserActivityPreferenceParticipant, error)
-	Read(id string) (UserActivityPreferenceParticipant, bool, error)
-	Update(id string, participant UserActivityPreferenceParticipant) (UserActivityPreferenceParticipant, bool, error)
-	Delete(id string) (bool, error)
-	ReadByPreferenceID(preferenceID string) ([]UserActivityPreferenceParticipant, error)
+	Create(ctx context.Context, participant UserActivityPreferenceParticipant) (UserActivityPreferenceParticipant, error)
+	ReadAll(ctx context.Context, params query.Params) (query.Page[UserActivityPreferenceParticipant], error)
+	Read(ctx context.Context, id string) (UserActivityPreferenceParticipant, bool, error)
+	Update(ctx context.Context, id string, participant UserActivityPreferenceParticipant) (UserActivityPreferenceParticipant, bool, error)
+	Delete(ctx context.Context, id string) (bool, error)
+	ReadByPreferenceID(ctx context.Context, preferenceID string) ([]UserActivityPreferenceParticipant, error)
+	PreferenceOwnerID(ctx context.Context, preferenceID int) (int, bool, error)
 }
 
 // UserActivityPreferenceParticipantError represents the error response
@@ -39,7 +43,11 @@ func (h *UserActivityPreferenceParticipantHTTPHandler) HandleHTTPPost(w http.Res
 		return
 	}
 
-	createdParticipant, err := h.participantService.Create(participant)
+	createdParticipant, err := h.participantService.Create(r.Context(), participant)
+	if err == ErrBlocked {
+		h.errorResponse(w, http.StatusForbidden, err.Error())
+		return
+	}
 	if err != nil {
 		h.errorResponse(w, http.StatusInternalServerError, err.Error())
 		return
@@ -54,7 +62,13 @@ func (h *UserActivityPreferenceParticipantHTTPHandler) HandleHTTPPost(w http.Res
 }
 
 func (h *UserActivityPreferenceParticipantHTTPHandler) HandleHTTPGet(w http.ResponseWriter, r *http.Request) {
-	participants, err := h.participantService.ReadAll()
+	params, err := query.Parse(r.URL.RawQuery, listSpec)
+	if err != nil {
+		h.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	participants, err := h.participantService.ReadAll(r.Context(), params)
 	if err != nil {
 		h.errorResponse(w, http.StatusInternalServerError, err.Error())
 		return
@@ -71,7 +85,7 @@ func (h *UserActivityPreferenceParticipantHTTPHandler) HandleHTTPGet(w http.Resp
 func (h *UserActivityPreferenceParticipantHTTPHandler) HandleHTTPGetByPreferenceID(w http.ResponseWriter, r *http.Request) {
 	preferenceID := r.PathValue("preference_id")
 
-	participants, err := h.participantService.ReadByPreferenceID(preferenceID)
+	participants, err := h.participantService.ReadByPreferenceID(r.Context(), preferenceID)
 	if err != nil {
 		h.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -88,7 +102,7 @@ func (h *UserActivityPreferenceParticipantHTTPHandler) HandleHTTPGetByPreference
 func (h *UserActivityPreferenceParticipantHTTPHandler) HandleHTTPDelete(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 
-	success, err := h.participantService.Delete(id)
+	success, err := h.participantService.Delete(r.Context(), id)
 	if err != nil {
 		h.errorResponse(w, http.StatusInternalServerError, err.Error())
 		return
@@ -112,7 +126,7 @@ func (h *UserActivityPreferenceParticipantHTTPHandler) HandleHTTPPut(w http.Resp
 		return
 	}
 
-	updatedParticipant, success, err := h.participantService.Update(id, participant)
+	updatedParticipant, success, err := h.participantService.Update(r.Context(), id, participant)
 	if err != nil {
 		h.errorResponse(w, http.StatusInternalServerError, err.Error())
 		return
@@ -131,6 +145,67 @@ func (h *UserActivityPreferenceParticipantHTTPHandler) HandleHTTPPut(w http.Resp
 	}
 }
 
+// RegisterRoutes adds the preference participant routes to mux
+func (h *UserActivityPreferenceParticipantHTTPHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("POST /user_activity_preference_participant", h.HandleHTTPPost)
+	mux.HandleFunc("GET /user_activity_preference_participants", h.HandleHTTPGet)
+	mux.HandleFunc("GET /user_activity_preference_participant/{preference_id}", h.HandleHTTPGetByPreferenceID)
+	mux.HandleFunc("PUT /user_activity_preference_participant/{id}", h.HandleHTTPPut)
+	mux.HandleFunc("DELETE /user_activity_preference_participant/{id}", h.HandleHTTPDelete)
+	mux.HandleFunc("GET /user_activity_preference_participants/preference/{preference_id}", h.HandleHTTPGetByPreferenceID)
+}
+
+// AuthorizationRules returns the ownership rules for preference participant routes. Only the owner
+// of a preference manages its participants, though participants may remove themselves.
+func (h *UserActivityPreferenceParticipantHTTPHandler) AuthorizationRules() map[string]auth.Rule {
+	return map[string]auth.Rule{
+		"POST /user_activity_preference_participant":        h.ownsBodyPreference,
+		"PUT /user_activity_preference_participant/{id}":    auth.AllOf(h.ownsParticipantPreference, h.ownsBodyPreference),
+		"DELETE /user_activity_preference_participant/{id}": auth.AnyOf(h.isParticipant, h.ownsParticipantPreference),
+	}
+}
+
+func (h *UserActivityPreferenceParticipantHTTPHandler) ownsPreference(ctx context.Context, preferenceID int, callerID int) (bool, error) {
+	ownerID, found, err := h.participantService.PreferenceOwnerID(ctx, preferenceID)
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		// Let the handler report the missing preference
+		return true, nil
+	}
+	return ownerID == callerID, nil
+}
+
+// ownsBodyPreference allows the owner of the preference named in the request body
+func (h *UserActivityPreferenceParticipantHTTPHandler) ownsBodyPreference(r *http.Request, callerID int) (bool, error) {
+	var participant UserActivityPreferenceParticipant
+	if err := auth.PeekJSON(r, &participant); err != nil {
+		// Let the handler answer 400
+		return true, nil
+	}
+	return h.ownsPreference(r.Context(), participant.UserActivityPreferenceID, callerID)
+}
+
+// ownsParticipantPreference allows the owner of the preference the participant row in the path belongs to
+func (h *UserActivityPreferenceParticipantHTTPHandler) ownsParticipantPreference(r *http.Request, callerID int) (bool, error) {
+	participant, _, err := h.participantService.Read(r.Context(), r.PathValue("id"))
+	if err != nil {
+		// Read reports missing rows as errors, let the handler answer
+		return true, nil
+	}
+	return h.ownsPreference(r.Context(), participant.UserActivityPreferenceID, callerID)
+}
+
+// isParticipant allows the user of the participant row in the path
+func (h *UserActivityPreferenceParticipantHTTPHandler) isParticipant(r *http.Request, callerID int) (bool, error) {
+	participant, _, err := h.participantService.Read(r.Context(), r.PathValue("id"))
+	if err != nil {
+		return false, nil
+	}
+	return participant.UserID == callerID, nil
+}
+
 // errorResponse sends an error response with the given status code and error message
 func (h *UserActivityPreferenceParticipantHTTPHandler) errorResponse(w http.ResponseWriter, statusCode int, errorString string) {
 	w.Header().Set("Content-Type", "application/json")
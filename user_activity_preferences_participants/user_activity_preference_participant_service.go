@@ -2,11 +2,19 @@ package user_activity_preferences_participants
 
 import (
 	"context"
-	"sync"
+	"errors"
+	"fmt"
+	"friendsocial/friends"
+	"friendsocial/query"
+	"strconv"
 
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
+// ErrBlocked is returned when the participant and the preference owner have blocked each other
+var ErrBlocked = errors.New("user cannot be added because of a block")
+
 type UserActivityPreferenceParticipant struct {
 	ID                       int `json:"id"`
 	UserActivityPreferenceID int `json:"user_activity_preference_id"`
@@ -14,7 +22,6 @@ type UserActivityPreferenceParticipant struct {
 }
 
 type Service struct {
-	sync.Mutex
 	db *pgxpool.Pool
 }
 
@@ -26,31 +33,64 @@ func NewService(db *pgxpool.Pool) *Service {
 
 // Implement Create, ReadAll, Read, Update, Delete methods similar to UserActivityPreference Service
 
-func (s *Service) Create(participant UserActivityPreferenceParticipant) (UserActivityPreferenceParticipant, error) {
-	s.Lock()
-	defer s.Unlock()
+func (s *Service) Create(ctx context.Context, participant UserActivityPreferenceParticipant) (UserActivityPreferenceParticipant, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return UserActivityPreferenceParticipant{}, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	var ownerID int
+	err = tx.QueryRow(ctx, "SELECT user_id FROM user_activity_preferences WHERE id = $1", participant.UserActivityPreferenceID).Scan(&ownerID)
+	if err != nil {
+		return UserActivityPreferenceParticipant{}, fmt.Errorf("failed to read preference: %v", err)
+	}
+
+	// friends.Block holds the same lock while it places a block, so the check below either sees a
+	// block between the participant and the owner or the block is placed after this insert
+	if err := friends.LockPair(ctx, tx, strconv.Itoa(participant.UserID), strconv.Itoa(ownerID)); err != nil {
+		return UserActivityPreferenceParticipant{}, err
+	}
 
 	query := `
 		INSERT INTO user_activity_preferences_participants (user_activity_preference_id, user_id)
-		VALUES ($1, $2)
+		SELECT $1, $2
+		WHERE NOT EXISTS (
+			SELECT 1 FROM friends f
+			JOIN user_activity_preferences uap ON uap.id = $1
+			WHERE f.status = 'blocked'
+			  AND f.user_ordered_id1 = LEAST($2::int, uap.user_id)
+			  AND f.user_ordered_id2 = GREATEST($2::int, uap.user_id)
+		)
 		RETURNING id, user_activity_preference_id, user_id
 	`
 
-	err := s.db.QueryRow(context.Background(), query, participant.UserActivityPreferenceID, participant.UserID).Scan(&participant.ID, &participant.UserActivityPreferenceID, &participant.UserID)
+	err = tx.QueryRow(ctx, query, participant.UserActivityPreferenceID, participant.UserID).Scan(&participant.ID, &participant.UserActivityPreferenceID, &participant.UserID)
 	if err != nil {
+		if err == pgx.ErrNoRows {
+			return UserActivityPreferenceParticipant{}, ErrBlocked
+		}
 		return UserActivityPreferenceParticipant{}, err
 	}
 
-	return participant, nil
+	return participant, tx.Commit(ctx)
 }
 
-func (s *Service) ReadAll() ([]UserActivityPreferenceParticipant, error) {
-	s.Lock()
-	defer s.Unlock()
+// listSpec are the fields participants can be listed by
+var listSpec = query.Spec{
+	Fields: map[string]query.Field{
+		"id":                          {Column: "id", Kind: query.Int},
+		"user_activity_preference_id": {Column: "user_activity_preference_id", Kind: query.Int},
+		"user_id":                     {Column: "user_id", Kind: query.Int},
+	},
+	Key: "id",
+}
 
-	rows, err := s.db.Query(context.Background(), "SELECT id, user_activity_preference_id, user_id FROM user_activity_preferences_participants")
+func (s *Service) ReadAll(ctx context.Context, params query.Params) (query.Page[UserActivityPreferenceParticipant], error) {
+	sql, args := params.Apply("SELECT id, user_activity_preference_id, user_id FROM user_activity_preferences_participants")
+	rows, err := s.db.Query(ctx, sql, args...)
 	if err != nil {
-		return nil, err
+		return query.Page[UserActivityPreferenceParticipant]{}, err
 	}
 	defer rows.Close()
 
@@ -58,18 +98,20 @@ func (s *Service) ReadAll() ([]UserActivityPreferenceParticipant, error) {
 	for rows.Next() {
 		var participant UserActivityPreferenceParticipant
 		if err := rows.Scan(&participant.ID, &participant.UserActivityPreferenceID, &participant.UserID); err != nil {
-			return nil, err
+			return query.Page[UserActivityPreferenceParticipant]{}, err
 		}
 		participants = append(participants, participant)
 	}
+	if err := rows.Err(); err != nil {
+		return query.Page[UserActivityPreferenceParticipant]{}, err
+	}
 
-	return participants, nil
+	return query.NewPage(params, participants, func(participant UserActivityPreferenceParticipant, sort string) (int, interface{}) {
+		return participant.ID, nil
+	}), nil
 }
 
-func (s *Service) Read(id string) (UserActivityPreferenceParticipant, bool, error) {
-	s.Lock()
-	defer s.Unlock()
-
+func (s *Service) Read(ctx context.Context, id string) (UserActivityPreferenceParticipant, bool, error) {
 	query := `
 		SELECT id, user_activity_preference_id, user_id
 		FROM user_activity_preferences_participants
@@ -77,7 +119,7 @@ func (s *Service) Read(id string) (UserActivityPreferenceParticipant, bool, erro
 	`
 
 	var participant UserActivityPreferenceParticipant
-	err := s.db.QueryRow(context.Background(), query, id).Scan(&participant.ID, &participant.UserActivityPreferenceID, &participant.UserID)
+	err := s.db.QueryRow(ctx, query, id).Scan(&participant.ID, &participant.UserActivityPreferenceID, &participant.UserID)
 	if err != nil {
 		return UserActivityPreferenceParticipant{}, false, err
 	}
@@ -85,10 +127,7 @@ func (s *Service) Read(id string) (UserActivityPreferenceParticipant, bool, erro
 	return participant, true, nil
 }
 
-func (s *Service) Update(id string, participant UserActivityPreferenceParticipant) (UserActivityPreferenceParticipant, bool, error) {
-	s.Lock()
-	defer s.Unlock()
-
+func (s *Service) Update(ctx context.Context, id string, participant UserActivityPreferenceParticipant) (UserActivityPreferenceParticipant, bool, error) {
 	query := `
 		UPDATE user_activity_preferences_participants
 		SET user_activity_preference_id = $1, user_id = $2
@@ -96,7 +135,7 @@ func (s *Service) Update(id string, participant UserActivityPreferenceParticipan
 		RETURNING id, user_activity_preference_id, user_id
 	`
 
-	err := s.db.QueryRow(context.Background(), query, participant.UserActivityPreferenceID, participant.UserID, id).Scan(&participant.ID, &participant.UserActivityPreferenceID, &participant.UserID)
+	err := s.db.QueryRow(ctx, query, participant.UserActivityPreferenceID, participant.UserID, id).Scan(&participant.ID, &participant.UserActivityPreferenceID, &participant.UserID)
 	if err != nil {
 		return UserActivityPreferenceParticipant{}, false, err
 	}
@@ -104,16 +143,13 @@ func (s *Service) Update(id string, participant UserActivityPreferenceParticipan
 	return participant, true, nil
 }
 
-func (s *Service) Delete(id string) (bool, error) {
-	s.Lock()
-	defer s.Unlock()
-
+func (s *Service) Delete(ctx context.Context, id string) (bool, error) {
 	query := `
 		DELETE FROM user_activity_preferences_participants 
 		WHERE id = $1
 	`
 
-	result, err := s.db.Exec(context.Background(), query, id)
+	result, err := s.db.Exec(ctx, query, id)
 	if err != nil {
 		return false, err
 	}
@@ -121,11 +157,22 @@ func (s *Service) Delete(id string) (bool, error) {
 	return result.RowsAffected() > 0, nil
 }
 
-func (s *Service) ReadByPreferenceID(preferenceID string) ([]UserActivityPreferenceParticipant, error) {
-	s.Lock()
-	defer s.Unlock()
+// PreferenceOwnerID returns the user who owns a user activity preference
+func (s *Service) PreferenceOwnerID(ctx context.Context, preferenceID int) (int, bool, error) {
+	var userID int
+	err := s.db.QueryRow(ctx, "SELECT user_id FROM user_activity_preferences WHERE id = $1", preferenceID).Scan(&userID)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+
+	return userID, true, nil
+}
 
-	rows, err := s.db.Query(context.Background(), "SELECT id, user_activity_preference_id, user_id FROM user_activity_preferences_participants WHERE user_activity_preference_id = $1", preferenceID)
+func (s *Service) ReadByPreferenceID(ctx context.Context, preferenceID string) ([]UserActivityPreferenceParticipant, error) {
+	rows, err := s.db.Query(ctx, "SELECT id, user_activity_preference_id, user_id FROM user_activity_preferences_participants WHERE user_activity_preference_id = $1", preferenceID)
 	if err != nil {
 		return nil, err
 	}
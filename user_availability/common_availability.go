@@ -0,0 +1,466 @@
+package user_availability
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/lib/pq"
+)
+
+// maxCommonRangeDays bounds how many days a single common availability search may span
+const maxCommonRangeDays = 92
+
+var ErrInvalidCommonRequest = errors.New("invalid common availability request")
+
+// CommonAvailabilityRequest asks for the time slots in which a group of users is free
+type CommonAvailabilityRequest struct {
+	UserIDs            []int  `json:"user_ids"`
+	StartDate          string `json:"start_date"` // YYYY-MM-DD, inclusive
+	EndDate            string `json:"end_date"`   // YYYY-MM-DD, inclusive
+	MinDurationMinutes int    `json:"min_duration_minutes,omitempty"`
+	ActivityID         *int   `json:"activity_id,omitempty"` // estimated_time is used when min_duration_minutes is omitted
+	TimeZone           string `json:"time_zone"`
+	Quorum             int    `json:"quorum,omitempty"` // minimum number of free users, defaults to everyone
+	Limit              int    `json:"limit,omitempty"`  // defaults to 20, at most 100
+}
+
+// CommonSlot is a maximal window in which the same set of users is free
+type CommonSlot struct {
+	Start              time.Time `json:"start"`
+	End                time.Time `json:"end"`
+	DurationMinutes    int       `json:"duration_minutes"`
+	AvailableUserIDs   []int     `json:"available_user_ids"`
+	UnavailableUserIDs []int     `json:"unavailable_user_ids"`
+}
+
+type interval struct {
+	start time.Time
+	end   time.Time
+}
+
+// availabilityWindow is a user_availability row with its times split into a clock time and a UTC
+// offset so it can be placed on any date. Only specific_date rows use the offset, see on.
+type availabilityWindow struct {
+	userID       int
+	dayOfWeek    string
+	startClock   string
+	startOffset  int
+	endClock     string
+	endOffset    int
+	isAvailable  bool
+	specificDate *time.Time
+}
+
+// FindCommonSlots returns the slots between the request's start and end dates in which at least a
+// quorum of the users is free for the minimum duration. For each date a user's specific_date rows
+// replace their weekly windows, and is_available=false rows, weekly or specific, are blacked out.
+// Weekly windows are wall-clock times in the request's time zone, so they follow its daylight
+// saving changes.
+// Slots are ranked by the number of free users, then by start time.
+func (s *Service) FindCommonSlots(ctx context.Context, request CommonAvailabilityRequest) ([]CommonSlot, error) {
+	userIDs := uniqueIDs(request.UserIDs)
+	if len(userIDs) == 0 {
+		return nil, fmt.Errorf("%w: user_ids must not be empty", ErrInvalidCommonRequest)
+	}
+
+	loc, err := time.LoadLocation(request.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid time zone: %v", ErrInvalidCommonRequest, err)
+	}
+
+	startDate, err := time.ParseInLocation("2006-01-02", request.StartDate, loc)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid start_date: %v", ErrInvalidCommonRequest, err)
+	}
+	endDate, err := time.ParseInLocation("2006-01-02", request.EndDate, loc)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid end_date: %v", ErrInvalidCommonRequest, err)
+	}
+	if endDate.Before(startDate) {
+		return nil, fmt.Errorf("%w: end_date is before start_date", ErrInvalidCommonRequest)
+	}
+	if endDate.Sub(startDate) > maxCommonRangeDays*24*time.Hour {
+		return nil, fmt.Errorf("%w: date range must not exceed %d days", ErrInvalidCommonRequest, maxCommonRangeDays)
+	}
+
+	quorum := request.Quorum
+	if quorum == 0 {
+		quorum = len(userIDs)
+	}
+	if quorum < 1 || quorum > len(userIDs) {
+		return nil, fmt.Errorf("%w: quorum must be between 1 and %d", ErrInvalidCommonRequest, len(userIDs))
+	}
+
+	limit := request.Limit
+	if limit == 0 {
+		limit = 20
+	}
+	if limit < 1 || limit > 100 {
+		return nil, fmt.Errorf("%w: limit must be between 1 and 100", ErrInvalidCommonRequest)
+	}
+
+	if request.MinDurationMinutes < 0 {
+		return nil, fmt.Errorf("%w: min_duration_minutes must not be negative", ErrInvalidCommonRequest)
+	}
+
+	minDuration := time.Duration(request.MinDurationMinutes) * time.Minute
+	if minDuration == 0 {
+		if request.ActivityID == nil {
+			return nil, fmt.Errorf("%w: min_duration_minutes or activity_id is required", ErrInvalidCommonRequest)
+		}
+		minDuration, err = s.readEstimatedTime(ctx, *request.ActivityID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	windows, err := s.readWindows(ctx, userIDs, startDate, endDate)
+	if err != nil {
+		return nil, err
+	}
+
+	rangeStart := startDate
+	rangeEnd := endDate.AddDate(0, 0, 1)
+	free := make(map[int][]interval, len(userIDs))
+	for _, userID := range userIDs {
+		free[userID] = freeIntervals(windows[userID], rangeStart, rangeEnd)
+	}
+
+	slots := commonSlots(userIDs, free, quorum, minDuration)
+	sort.SliceStable(slots, func(i, j int) bool {
+		if len(slots[i].AvailableUserIDs) != len(slots[j].AvailableUserIDs) {
+			return len(slots[i].AvailableUserIDs) > len(slots[j].AvailableUserIDs)
+		}
+		return slots[i].Start.Before(slots[j].Start)
+	})
+	if len(slots) > limit {
+		slots = slots[:limit]
+	}
+	for i := range slots {
+		slots[i].Start = slots[i].Start.In(loc)
+		slots[i].End = slots[i].End.In(loc)
+	}
+
+	return slots, nil
+}
+
+func (s *Service) readEstimatedTime(ctx context.Context, activityID int) (time.Duration, error) {
+	var estimatedTimeInSeconds float64
+	err := s.db.QueryRow(
+		ctx,
+		"SELECT EXTRACT(EPOCH FROM estimated_time) FROM activities WHERE id = $1",
+		activityID,
+	).Scan(&estimatedTimeInSeconds)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return 0, fmt.Errorf("%w: activity %d does not exist", ErrInvalidCommonRequest, activityID)
+		}
+		return 0, err
+	}
+
+	return time.Duration(estimatedTimeInSeconds) * time.Second, nil
+}
+
+// readWindows loads the weekly rows and the specific_date rows inside the date range for the users
+func (s *Service) readWindows(ctx context.Context, userIDs []int, startDate time.Time, endDate time.Time) (map[int][]availabilityWindow, error) {
+	rows, err := s.db.Query(
+		ctx,
+		`SELECT user_id, day_of_week,
+		        start_time::time::text, EXTRACT(TIMEZONE FROM start_time)::int,
+		        end_time::time::text, EXTRACT(TIMEZONE FROM end_time)::int,
+		        is_available, specific_date
+		 FROM user_availability
+		 WHERE user_id = ANY($1)
+		   AND (specific_date IS NULL OR specific_date BETWEEN $2::date AND $3::date)`,
+		pq.Array(userIDs), startDate.Format("2006-01-02"), endDate.Format("2006-01-02"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	windows := make(map[int][]availabilityWindow)
+	for rows.Next() {
+		var window availabilityWindow
+		if err := rows.Scan(&window.userID, &window.dayOfWeek, &window.startClock, &window.startOffset, &window.endClock, &window.endOffset, &window.isAvailable, &window.specificDate); err != nil {
+			return nil, err
+		}
+		windows[window.userID] = append(windows[window.userID], window)
+	}
+
+	return windows, rows.Err()
+}
+
+// freeIntervals places a user's windows on every date of the range and returns the sorted,
+// non-overlapping intervals in which the user is free
+func freeIntervals(windows []availabilityWindow, rangeStart time.Time, rangeEnd time.Time) []interval {
+	var available, blackouts []interval
+	for date := rangeStart; date.Before(rangeEnd); date = date.AddDate(0, 0, 1) {
+		dateKey := date.Format("2006-01-02")
+
+		hasOverride := false
+		for _, window := range windows {
+			if window.isAvailable && window.specificDate != nil && window.specificDate.Format("2006-01-02") == dateKey {
+				hasOverride = true
+				break
+			}
+		}
+
+		for _, window := range windows {
+			if window.specificDate != nil {
+				if window.specificDate.Format("2006-01-02") != dateKey {
+					continue
+				}
+			} else if !strings.EqualFold(strings.TrimSpace(window.dayOfWeek), date.Weekday().String()) {
+				continue
+			} else if window.isAvailable && hasOverride {
+				continue
+			}
+
+			placed, ok := window.on(date)
+			if !ok {
+				continue
+			}
+			if window.isAvailable {
+				available = append(available, placed)
+			} else {
+				blackouts = append(blackouts, placed)
+			}
+		}
+	}
+
+	return clip(subtract(merge(available), merge(blackouts)), rangeStart, rangeEnd)
+}
+
+// on places the window on a calendar date. A specific_date row keeps the UTC offset it was stored
+// with, while the clock times of a weekly row are read in the date's location: the offset stored
+// in a TIMETZ is the one in effect when the row was written, and would shift a weekly 18:00 by an
+// hour across a daylight saving change. Windows ending at or before their start run past midnight
+// into the next day.
+func (window availabilityWindow) on(date time.Time) (interval, bool) {
+	start, err := time.Parse("15:04:05", window.startClock)
+	if err != nil {
+		return interval{}, false
+	}
+	end, err := time.Parse("15:04:05", window.endClock)
+	if err != nil {
+		return interval{}, false
+	}
+
+	startLoc, endLoc := date.Location(), date.Location()
+	if window.specificDate != nil {
+		startLoc, endLoc = time.FixedZone("", window.startOffset), time.FixedZone("", window.endOffset)
+	}
+
+	placed := interval{
+		start: time.Date(date.Year(), date.Month(), date.Day(), start.Hour(), start.Minute(), start.Second(), 0, startLoc),
+		end:   time.Date(date.Year(), date.Month(), date.Day(), end.Hour(), end.Minute(), end.Second(), 0, endLoc),
+	}
+	if !placed.end.After(placed.start) {
+		placed.end = time.Date(date.Year(), date.Month(), date.Day()+1, end.Hour(), end.Minute(), end.Second(), 0, endLoc)
+	}
+
+	return placed, true
+}
+
+// merge sorts intervals and joins the ones that overlap or touch
+func merge(intervals []interval) []interval {
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i].start.Before(intervals[j].start)
+	})
+
+	var merged []interval
+	for _, current := range intervals {
+		last := len(merged) - 1
+		if last >= 0 && !current.start.After(merged[last].end) {
+			if current.end.After(merged[last].end) {
+				merged[last].end = current.end
+			}
+			continue
+		}
+		merged = append(merged, current)
+	}
+
+	return merged
+}
+
+// subtract removes the busy intervals from the free ones. Both must be merged.
+func subtract(free []interval, busy []interval) []interval {
+	var result []interval
+	for _, current := range free {
+		for _, blocked := range busy {
+			if !blocked.end.After(current.start) || !blocked.start.Before(current.end) {
+				continue
+			}
+			if blocked.start.After(current.start) {
+				result = append(result, interval{start: current.start, end: blocked.start})
+			}
+			current.start = blocked.end
+			if !current.end.After(current.start) {
+				break
+			}
+		}
+		if current.end.After(current.start) {
+			result = append(result, current)
+		}
+	}
+
+	return result
+}
+
+// clip drops the parts of intervals that fall outside the range
+func clip(intervals []interval, rangeStart time.Time, rangeEnd time.Time) []interval {
+	var clipped []interval
+	for _, current := range intervals {
+		if current.start.Before(rangeStart) {
+			current.start = rangeStart
+		}
+		if current.end.After(rangeEnd) {
+			current.end = rangeEnd
+		}
+		if current.end.After(current.start) {
+			clipped = append(clipped, current)
+		}
+	}
+
+	return clipped
+}
+
+// commonSlots sweeps every user's free intervals and returns the maximal windows in which the
+// same users are free, keeping those with at least quorum users that last at least minDuration.
+// Adjacent windows that both reach the quorum are merged for as long as at least quorum users are
+// free throughout, so one user joining late does not split a window that the others share.
+func commonSlots(userIDs []int, free map[int][]interval, quorum int, minDuration time.Duration) []CommonSlot {
+	var boundaries []time.Time
+	for _, userID := range userIDs {
+		for _, current := range free[userID] {
+			boundaries = append(boundaries, current.start, current.end)
+		}
+	}
+	sort.Slice(boundaries, func(i, j int) bool {
+		return boundaries[i].Before(boundaries[j])
+	})
+
+	var slots []CommonSlot
+	positions := make(map[int]int, len(userIDs))
+	for i := 0; i+1 < len(boundaries); i++ {
+		segmentStart, segmentEnd := boundaries[i], boundaries[i+1]
+		if !segmentEnd.After(segmentStart) {
+			continue
+		}
+
+		var availableIDs, unavailableIDs []int
+		for _, userID := range userIDs {
+			intervals := free[userID]
+			position := positions[userID]
+			for position < len(intervals) && !intervals[position].end.After(segmentStart) {
+				position++
+			}
+			positions[userID] = position
+
+			if position < len(intervals) && !intervals[position].start.After(segmentStart) {
+				availableIDs = append(availableIDs, userID)
+			} else {
+				unavailableIDs = append(unavailableIDs, userID)
+			}
+		}
+		if len(availableIDs) == 0 {
+			continue
+		}
+
+		last := len(slots) - 1
+		if last >= 0 && slots[last].End.Equal(segmentStart) && sameIDs(slots[last].AvailableUserIDs, availableIDs) {
+			slots[last].End = segmentEnd
+			continue
+		}
+		slots = append(slots, CommonSlot{
+			Start:              segmentStart,
+			End:                segmentEnd,
+			AvailableUserIDs:   availableIDs,
+			UnavailableUserIDs: unavailableIDs,
+		})
+	}
+
+	var merged []CommonSlot
+	for _, slot := range slots {
+		last := len(merged) - 1
+		if last >= 0 && merged[last].End.Equal(slot.Start) &&
+			len(merged[last].AvailableUserIDs) >= quorum && len(slot.AvailableUserIDs) >= quorum {
+			common := intersectIDs(merged[last].AvailableUserIDs, slot.AvailableUserIDs)
+			if len(common) >= quorum {
+				merged[last].End = slot.End
+				merged[last].AvailableUserIDs = common
+				merged[last].UnavailableUserIDs = exceptIDs(userIDs, common)
+				continue
+			}
+		}
+		merged = append(merged, slot)
+	}
+
+	var qualifying []CommonSlot
+	for _, slot := range merged {
+		duration := slot.End.Sub(slot.Start)
+		if len(slot.AvailableUserIDs) < quorum || duration < minDuration {
+			continue
+		}
+		slot.DurationMinutes = int(duration / time.Minute)
+		if slot.UnavailableUserIDs == nil {
+			slot.UnavailableUserIDs = []int{}
+		}
+		qualifying = append(qualifying, slot)
+	}
+
+	return qualifying
+}
+
+func uniqueIDs(ids []int) []int {
+	seen := make(map[int]bool, len(ids))
+	var unique []int
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+// intersectIDs returns the IDs in both a and b, in a's order
+func intersectIDs(a []int, b []int) []int {
+	var common []int
+	for _, id := range a {
+		if slices.Contains(b, id) {
+			common = append(common, id)
+		}
+	}
+	return common
+}
+
+// exceptIDs returns the IDs in a that are not in b, in a's order
+func exceptIDs(a []int, b []int) []int {
+	var rest []int
+	for _, id := range a {
+		if !slices.Contains(b, id) {
+			rest = append(rest, id)
+		}
+	}
+	return rest
+}
+
+func sameIDs(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,263 @@
+package user_availability
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// at is a time on the day the tests run on
+func at(hour int, minute int) time.Time {
+	return time.Date(2024, 9, 3, hour, minute, 0, 0, time.UTC)
+}
+
+func TestSubtract(t *testing.T) {
+	tests := []struct {
+		name string
+		free []interval
+		busy []interval
+		want []interval
+	}{
+		{
+			name: "no busy intervals",
+			free: []interval{{at(9, 0), at(17, 0)}},
+			want: []interval{{at(9, 0), at(17, 0)}},
+		},
+		{
+			name: "busy inside splits the free interval",
+			free: []interval{{at(9, 0), at(17, 0)}},
+			busy: []interval{{at(12, 0), at(13, 0)}},
+			want: []interval{{at(9, 0), at(12, 0)}, {at(13, 0), at(17, 0)}},
+		},
+		{
+			name: "busy over the start",
+			free: []interval{{at(9, 0), at(17, 0)}},
+			busy: []interval{{at(8, 0), at(10, 0)}},
+			want: []interval{{at(10, 0), at(17, 0)}},
+		},
+		{
+			name: "busy over the end",
+			free: []interval{{at(9, 0), at(17, 0)}},
+			busy: []interval{{at(16, 0), at(18, 0)}},
+			want: []interval{{at(9, 0), at(16, 0)}},
+		},
+		{
+			name: "busy over everything",
+			free: []interval{{at(9, 0), at(17, 0)}},
+			busy: []interval{{at(8, 0), at(18, 0)}},
+			want: nil,
+		},
+		{
+			name: "touching intervals do not overlap",
+			free: []interval{{at(9, 0), at(17, 0)}},
+			busy: []interval{{at(7, 0), at(9, 0)}, {at(17, 0), at(19, 0)}},
+			want: []interval{{at(9, 0), at(17, 0)}},
+		},
+		{
+			name: "several busy intervals over several free ones",
+			free: []interval{{at(9, 0), at(12, 0)}, {at(14, 0), at(18, 0)}},
+			busy: []interval{{at(10, 0), at(11, 0)}, {at(11, 30), at(15, 0)}, {at(16, 0), at(16, 30)}},
+			want: []interval{{at(9, 0), at(10, 0)}, {at(11, 0), at(11, 30)}, {at(15, 0), at(16, 0)}, {at(16, 30), at(18, 0)}},
+		},
+	}
+	for _, tt := range tests {
+		got := subtract(tt.free, tt.busy)
+		if !slices.EqualFunc(got, tt.want, func(a interval, b interval) bool {
+			return a.start.Equal(b.start) && a.end.Equal(b.end)
+		}) {
+			t.Errorf("%s: subtract = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCommonSlots(t *testing.T) {
+	type slot struct {
+		start       time.Time
+		end         time.Time
+		available   []int
+		unavailable []int
+	}
+	tests := []struct {
+		name        string
+		userIDs     []int
+		free        map[int][]interval
+		quorum      int
+		minDuration time.Duration
+		want        []slot
+	}{
+		{
+			name:    "overlap of everyone",
+			userIDs: []int{1, 2},
+			free: map[int][]interval{
+				1: {{at(18, 0), at(20, 0)}},
+				2: {{at(19, 0), at(21, 0)}},
+			},
+			quorum:      2,
+			minDuration: time.Hour,
+			want:        []slot{{at(19, 0), at(20, 0), []int{1, 2}, nil}},
+		},
+		{
+			name:    "overlap shorter than the minimum duration",
+			userIDs: []int{1, 2},
+			free: map[int][]interval{
+				1: {{at(18, 0), at(20, 0)}},
+				2: {{at(19, 0), at(21, 0)}},
+			},
+			quorum:      2,
+			minDuration: 90 * time.Minute,
+			want:        nil,
+		},
+		{
+			name:    "a late joiner does not split a window the quorum shares",
+			userIDs: []int{1, 2, 3, 4},
+			free: map[int][]interval{
+				1: {{at(18, 0), at(20, 0)}},
+				2: {{at(18, 0), at(20, 0)}},
+				3: {{at(18, 0), at(20, 0)}},
+				4: {{at(19, 0), at(20, 0)}},
+			},
+			quorum:      3,
+			minDuration: 90 * time.Minute,
+			want:        []slot{{at(18, 0), at(20, 0), []int{1, 2, 3}, []int{4}}},
+		},
+		{
+			name:    "the late joiner's hour is its own slot when it is long enough",
+			userIDs: []int{1, 2, 3, 4},
+			free: map[int][]interval{
+				1: {{at(18, 0), at(20, 0)}},
+				2: {{at(18, 0), at(20, 0)}},
+				3: {{at(18, 0), at(20, 0)}},
+				4: {{at(19, 0), at(20, 0)}},
+			},
+			quorum:      4,
+			minDuration: time.Hour,
+			want:        []slot{{at(19, 0), at(20, 0), []int{1, 2, 3, 4}, nil}},
+		},
+		{
+			name:    "adjacent windows of different users are not merged",
+			userIDs: []int{1, 2, 3, 4},
+			free: map[int][]interval{
+				1: {{at(18, 0), at(19, 0)}},
+				2: {{at(18, 0), at(19, 0)}},
+				3: {{at(19, 0), at(20, 0)}},
+				4: {{at(19, 0), at(20, 0)}},
+			},
+			quorum:      2,
+			minDuration: time.Hour,
+			want: []slot{
+				{at(18, 0), at(19, 0), []int{1, 2}, []int{3, 4}},
+				{at(19, 0), at(20, 0), []int{3, 4}, []int{1, 2}},
+			},
+		},
+		{
+			name:    "quorum of one keeps separate windows",
+			userIDs: []int{1, 2},
+			free: map[int][]interval{
+				1: {{at(10, 0), at(11, 0)}},
+				2: {{at(12, 0), at(13, 0)}},
+			},
+			quorum:      1,
+			minDuration: 30 * time.Minute,
+			want: []slot{
+				{at(10, 0), at(11, 0), []int{1}, []int{2}},
+				{at(12, 0), at(13, 0), []int{2}, []int{1}},
+			},
+		},
+		{
+			name:        "nobody free",
+			userIDs:     []int{1, 2},
+			free:        map[int][]interval{},
+			quorum:      1,
+			minDuration: time.Minute,
+			want:        nil,
+		},
+	}
+	for _, tt := range tests {
+		got := commonSlots(tt.userIDs, tt.free, tt.quorum, tt.minDuration)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %d slots, want %d: %+v", tt.name, len(got), len(tt.want), got)
+			continue
+		}
+		for i, want := range tt.want {
+			if !got[i].Start.Equal(want.start) || !got[i].End.Equal(want.end) ||
+				!slices.Equal(got[i].AvailableUserIDs, want.available) || !slices.Equal(got[i].UnavailableUserIDs, want.unavailable) {
+				t.Errorf("%s: slot %d = %+v, want %+v", tt.name, i, got[i], want)
+			}
+			if minutes := int(want.end.Sub(want.start) / time.Minute); got[i].DurationMinutes != minutes {
+				t.Errorf("%s: slot %d lasts %d minutes, want %d", tt.name, i, got[i].DurationMinutes, minutes)
+			}
+			if got[i].UnavailableUserIDs == nil {
+				t.Errorf("%s: slot %d has nil unavailable_user_ids, want an empty list", tt.name, i)
+			}
+		}
+	}
+}
+
+func TestWindowOn(t *testing.T) {
+	halifax, err := time.LoadLocation("America/Halifax")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const adt = -3 * 60 * 60 // the offset a TIMETZ written in the Halifax summer stores
+	specificDate := time.Date(2024, 11, 4, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		window    availabilityWindow
+		date      time.Time
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{
+			name:      "weekly in summer time",
+			window:    availabilityWindow{dayOfWeek: "Monday", startClock: "18:00:00", startOffset: adt, endClock: "20:00:00", endOffset: adt},
+			date:      time.Date(2024, 10, 28, 0, 0, 0, 0, halifax),
+			wantStart: time.Date(2024, 10, 28, 21, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 10, 28, 23, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "weekly keeps its clock time in winter time",
+			window:    availabilityWindow{dayOfWeek: "Monday", startClock: "18:00:00", startOffset: adt, endClock: "20:00:00", endOffset: adt},
+			date:      time.Date(2024, 11, 4, 0, 0, 0, 0, halifax),
+			wantStart: time.Date(2024, 11, 4, 22, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 11, 5, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "weekly past midnight over the change",
+			window:    availabilityWindow{dayOfWeek: "Saturday", startClock: "22:00:00", startOffset: adt, endClock: "02:00:00", endOffset: adt},
+			date:      time.Date(2024, 11, 2, 0, 0, 0, 0, halifax),
+			wantStart: time.Date(2024, 11, 3, 1, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 11, 3, 6, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "specific date keeps its offset",
+			window:    availabilityWindow{startClock: "18:00:00", startOffset: adt, endClock: "20:00:00", endOffset: adt, specificDate: &specificDate},
+			date:      time.Date(2024, 11, 4, 0, 0, 0, 0, halifax),
+			wantStart: time.Date(2024, 11, 4, 21, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 11, 4, 23, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		got, ok := tt.window.on(tt.date)
+		if !ok {
+			t.Errorf("%s: window not placed", tt.name)
+			continue
+		}
+		if !got.start.Equal(tt.wantStart) || !got.end.Equal(tt.wantEnd) {
+			t.Errorf("%s: on = %v to %v, want %v to %v", tt.name, got.start.UTC(), got.end.UTC(), tt.wantStart, tt.wantEnd)
+		}
+	}
+
+	// Over a range, each Monday is placed at 18:00 local time on its side of the change
+	weekly := availabilityWindow{dayOfWeek: "Monday", startClock: "18:00:00", startOffset: adt, endClock: "20:00:00", endOffset: adt, isAvailable: true}
+	free := freeIntervals([]availabilityWindow{weekly}, time.Date(2024, 10, 28, 0, 0, 0, 0, halifax), time.Date(2024, 11, 5, 0, 0, 0, 0, halifax))
+	want := []interval{
+		{time.Date(2024, 10, 28, 21, 0, 0, 0, time.UTC), time.Date(2024, 10, 28, 23, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 11, 4, 22, 0, 0, 0, time.UTC), time.Date(2024, 11, 5, 0, 0, 0, 0, time.UTC)},
+	}
+	if !slices.EqualFunc(free, want, func(a interval, b interval) bool {
+		return a.start.Equal(b.start) && a.end.Equal(b.end)
+	}) {
+		t.Errorf("freeIntervals = %v, want %v", free, want)
+	}
+}
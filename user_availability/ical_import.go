@@ -0,0 +1,617 @@
+package user_availability
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"friendsocial/user_activity_preferences"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	// defaultImportWindowDays is how far ahead recurring events are expanded unless asked otherwise
+	defaultImportWindowDays = 365
+	maxImportWindowDays     = 730
+	// maxICSLineLength bounds a single unfolded content line
+	maxICSLineLength = 1 << 20
+)
+
+var ErrInvalidCalendar = errors.New("invalid calendar")
+
+// ImportOptions control how an iCalendar file is turned into blackouts
+type ImportOptions struct {
+	// TimeZone is used for all-day events and times without a time zone. Defaults to UTC.
+	TimeZone string `json:"time_zone,omitempty"`
+	// WindowDays is how many days from today events are imported for, recurring or not
+	WindowDays int `json:"window_days,omitempty"`
+}
+
+// ImportResult counts the events of an import by what happened to them. An event is all
+// VEVENTs sharing a UID, i.e. a single or recurring event with its modified instances.
+type ImportResult struct {
+	Imported int `json:"imported"` // new UIDs
+	Updated  int `json:"updated"`  // UIDs imported before whose blackouts changed
+	Skipped  int `json:"skipped"`  // unchanged, free, cancelled, outside the window or unreadable
+}
+
+// icalProperty is a content line of an iCalendar object
+type icalProperty struct {
+	params map[string]string
+	value  string
+}
+
+// icalEvent is a VEVENT with its properties by name
+type icalEvent map[string][]icalProperty
+
+func (event icalEvent) first(name string) (icalProperty, bool) {
+	properties := event[name]
+	if len(properties) == 0 {
+		return icalProperty{}, false
+	}
+	return properties[0], true
+}
+
+// ImportICS turns the VEVENTs of an iCalendar file into is_available=false rows for a user, one
+// per day an event covers. Recurring events are expanded within the import window. Rows remember
+// the UID of the event they came from, so importing the same calendar again replaces an event's
+// rows instead of adding them twice; events missing from a later file are left alone.
+func (s *Service) ImportICS(ctx context.Context, userID int, calendar io.Reader, options ImportOptions) (ImportResult, error) {
+	if options.TimeZone == "" {
+		options.TimeZone = "UTC"
+	}
+	loc, err := time.LoadLocation(options.TimeZone)
+	if err != nil {
+		return ImportResult{}, fmt.Errorf("%w: invalid time zone: %v", ErrInvalidCalendar, err)
+	}
+	if options.WindowDays == 0 {
+		options.WindowDays = defaultImportWindowDays
+	}
+	if options.WindowDays < 1 || options.WindowDays > maxImportWindowDays {
+		return ImportResult{}, fmt.Errorf("%w: window_days must be between 1 and %d", ErrInvalidCalendar, maxImportWindowDays)
+	}
+
+	events, err := parseICS(calendar)
+	if err != nil {
+		return ImportResult{}, err
+	}
+
+	now := time.Now().In(loc)
+	windowStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	windowEnd := windowStart.AddDate(0, 0, options.WindowDays)
+
+	var result ImportResult
+	var uids []string
+	byUID := make(map[string][]icalEvent)
+	for _, event := range events {
+		uid, ok := event.first("UID")
+		if !ok || strings.TrimSpace(uid.value) == "" {
+			// Without a UID a re-import could not find the event again
+			result.Skipped++
+			continue
+		}
+		key := strings.TrimSpace(uid.value)
+		if _, seen := byUID[key]; !seen {
+			uids = append(uids, key)
+		}
+		byUID[key] = append(byUID[key], event)
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return ImportResult{}, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	// Imports for the same user are applied one at a time, otherwise two first imports of a
+	// calendar would both insert its events
+	_, err = tx.Exec(ctx, "SELECT 1 FROM users WHERE id = $1 FOR NO KEY UPDATE", userID)
+	if err != nil {
+		return ImportResult{}, fmt.Errorf("failed to lock user: %v", err)
+	}
+
+	existing, err := readImportedBlackouts(ctx, tx, userID)
+	if err != nil {
+		return ImportResult{}, err
+	}
+
+	for _, uid := range uids {
+		intervals, err := eventIntervals(byUID[uid], loc, windowStart, windowEnd)
+		if err != nil {
+			result.Skipped++
+			continue
+		}
+
+		var wanted []blackout
+		for _, current := range intervals {
+			wanted = append(wanted, splitByDay(current)...)
+		}
+
+		previous, imported := existing[uid]
+		if sameBlackouts(previous, wanted) {
+			result.Skipped++
+			continue
+		}
+
+		if imported {
+			_, err = tx.Exec(ctx,
+				"DELETE FROM user_availability WHERE user_id = $1 AND ical_uid = $2", userID, uid)
+			if err != nil {
+				return ImportResult{}, fmt.Errorf("failed to replace event %q: %v", uid, err)
+			}
+		}
+		for _, row := range wanted {
+			_, err = tx.Exec(ctx,
+				`INSERT INTO user_availability (user_id, day_of_week, start_time, end_time, is_available, specific_date, ical_uid)
+				 VALUES ($1, $2, $3::time with time zone, $4::time with time zone, FALSE, $5::date, $6)`,
+				userID, row.dayOfWeek, row.startTime(), row.endTime(), row.date, uid)
+			if err != nil {
+				return ImportResult{}, fmt.Errorf("failed to import event %q: %v", uid, err)
+			}
+		}
+
+		if imported {
+			result.Updated++
+		} else {
+			result.Imported++
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return ImportResult{}, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return result, nil
+}
+
+// blackout is an imported user_availability row. Its clock times carry their own UTC offsets; an
+// end at midnight is read as the end of the day.
+type blackout struct {
+	date        string // YYYY-MM-DD
+	dayOfWeek   string
+	startClock  string // HH:MM:SS
+	startOffset int    // seconds east of UTC
+	endClock    string
+	endOffset   int
+}
+
+func (b blackout) startTime() string {
+	return b.startClock + formatOffset(b.startOffset)
+}
+
+func (b blackout) endTime() string {
+	return b.endClock + formatOffset(b.endOffset)
+}
+
+func (b blackout) key() string {
+	return fmt.Sprintf("%s %s%+d %s%+d", b.date, b.startClock, b.startOffset, b.endClock, b.endOffset)
+}
+
+// readImportedBlackouts returns the user's imported rows by UID
+func readImportedBlackouts(ctx context.Context, tx pgx.Tx, userID int) (map[string][]blackout, error) {
+	rows, err := tx.Query(ctx,
+		`SELECT ical_uid, specific_date::text, day_of_week,
+		        start_time::time::text, EXTRACT(TIMEZONE FROM start_time)::int,
+		        end_time::time::text, EXTRACT(TIMEZONE FROM end_time)::int
+		 FROM user_availability
+		 WHERE user_id = $1 AND ical_uid IS NOT NULL
+		 FOR UPDATE`,
+		userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read imported events: %v", err)
+	}
+	defer rows.Close()
+
+	existing := make(map[string][]blackout)
+	for rows.Next() {
+		var uid string
+		var row blackout
+		if err := rows.Scan(&uid, &row.date, &row.dayOfWeek, &row.startClock, &row.startOffset, &row.endClock, &row.endOffset); err != nil {
+			return nil, fmt.Errorf("failed to scan imported event: %v", err)
+		}
+		existing[uid] = append(existing[uid], row)
+	}
+
+	return existing, rows.Err()
+}
+
+// sameBlackouts reports whether two sets of rows are equal, ignoring order
+func sameBlackouts(a []blackout, b []blackout) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	keys := func(blackouts []blackout) []string {
+		keys := make([]string, len(blackouts))
+		for i, row := range blackouts {
+			keys[i] = row.key()
+		}
+		slices.Sort(keys)
+		return keys
+	}
+	return slices.Equal(keys(a), keys(b))
+}
+
+// splitByDay cuts an interval at the midnights of its start's location, since a user_availability
+// row covers at most one day
+func splitByDay(current interval) []blackout {
+	var blackouts []blackout
+	loc := current.start.Location()
+	for start := current.start; start.Before(current.end); {
+		end := time.Date(start.Year(), start.Month(), start.Day()+1, 0, 0, 0, 0, loc)
+		if current.end.Before(end) {
+			end = current.end.In(loc)
+		}
+		_, startOffset := start.Zone()
+		_, endOffset := end.Zone()
+		blackouts = append(blackouts, blackout{
+			date:        start.Format("2006-01-02"),
+			dayOfWeek:   start.Weekday().String(),
+			startClock:  start.Format("15:04:05"),
+			startOffset: startOffset,
+			endClock:    end.Format("15:04:05"),
+			endOffset:   endOffset,
+		})
+		start = end
+	}
+	return blackouts
+}
+
+// formatOffset formats a UTC offset in seconds as +HH:MM
+func formatOffset(offset int) string {
+	sign := "+"
+	if offset < 0 {
+		sign, offset = "-", -offset
+	}
+	return fmt.Sprintf("%s%02d:%02d", sign, offset/3600, offset%3600/60)
+}
+
+// eventIntervals returns the busy intervals of an event that overlap the window. events are the
+// VEVENTs sharing the event's UID: at most one without a RECURRENCE-ID, which may recur, and the
+// instances that override its occurrences.
+func eventIntervals(events []icalEvent, loc *time.Location, windowStart time.Time, windowEnd time.Time) ([]interval, error) {
+	occurrences := make(map[int64]interval)
+	var overrides []icalEvent
+
+	for _, event := range events {
+		if _, ok := event.first("RECURRENCE-ID"); ok {
+			overrides = append(overrides, event)
+			continue
+		}
+		if busy(event) {
+			expanded, err := expand(event, loc, windowStart, windowEnd)
+			if err != nil {
+				return nil, err
+			}
+			for _, occurrence := range expanded {
+				occurrences[occurrence.start.Unix()] = occurrence
+			}
+		}
+	}
+
+	for _, override := range overrides {
+		recurrenceID, _, err := parseICalTime(override["RECURRENCE-ID"][0], loc)
+		if err != nil {
+			return nil, err
+		}
+		delete(occurrences, recurrenceID.Unix())
+		if !busy(override) {
+			continue
+		}
+		occurrence, err := eventInterval(override, loc)
+		if err != nil {
+			return nil, err
+		}
+		occurrences[recurrenceID.Unix()] = occurrence
+	}
+
+	var intervals []interval
+	for _, occurrence := range occurrences {
+		if occurrence.end.After(windowStart) && occurrence.start.Before(windowEnd) {
+			intervals = append(intervals, occurrence)
+		}
+	}
+	slices.SortFunc(intervals, func(a, b interval) int {
+		return a.start.Compare(b.start)
+	})
+
+	return intervals, nil
+}
+
+// busy reports whether an event blocks time. Cancelled events and events marked as free do not.
+func busy(event icalEvent) bool {
+	if status, ok := event.first("STATUS"); ok && strings.EqualFold(status.value, "CANCELLED") {
+		return false
+	}
+	if transp, ok := event.first("TRANSP"); ok && strings.EqualFold(transp.value, "TRANSPARENT") {
+		return false
+	}
+	return true
+}
+
+// expand returns the occurrences of an event, following its RRULE, RDATEs and EXDATEs. Only
+// occurrences starting before the window ends are returned.
+func expand(event icalEvent, loc *time.Location, windowStart time.Time, windowEnd time.Time) ([]interval, error) {
+	first, err := eventInterval(event, loc)
+	if err != nil {
+		return nil, err
+	}
+	duration := first.end.Sub(first.start)
+
+	rruleProperty, recurring := event.first("RRULE")
+	if !recurring {
+		return []interval{first}, nil
+	}
+
+	rule, err := user_activity_preferences.ParseRRule(rruleProperty.value, first.start.Location())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCalendar, err)
+	}
+	recurrence := user_activity_preferences.Recurrence{Rule: rule, Start: first.start}
+	for _, exDate := range event["EXDATE"] {
+		times, err := parseICalTimes(exDate, first.start.Location())
+		if err != nil {
+			return nil, err
+		}
+		recurrence.ExDates = append(recurrence.ExDates, times...)
+	}
+
+	// Occurrences that started before the window may still run into it
+	var occurrences []interval
+	for _, start := range recurrence.Between(windowStart.Add(-duration), windowEnd) {
+		occurrences = append(occurrences, interval{start: start, end: start.Add(duration)})
+	}
+	for _, rDate := range event["RDATE"] {
+		times, err := parseICalTimes(rDate, first.start.Location())
+		if err != nil {
+			return nil, err
+		}
+		for _, start := range times {
+			occurrences = append(occurrences, interval{start: start, end: start.Add(duration)})
+		}
+	}
+
+	return occurrences, nil
+}
+
+// eventInterval returns when a single VEVENT takes place. Without DTEND or DURATION, an all-day
+// event lasts one day and any other event has no length.
+func eventInterval(event icalEvent, loc *time.Location) (interval, error) {
+	dtStart, ok := event.first("DTSTART")
+	if !ok {
+		return interval{}, fmt.Errorf("%w: DTSTART is required", ErrInvalidCalendar)
+	}
+	start, allDay, err := parseICalTime(dtStart, loc)
+	if err != nil {
+		return interval{}, err
+	}
+
+	end := start
+	if allDay {
+		end = start.AddDate(0, 0, 1)
+	}
+	if dtEnd, ok := event.first("DTEND"); ok {
+		end, _, err = parseICalTime(dtEnd, start.Location())
+		if err != nil {
+			return interval{}, err
+		}
+	} else if duration, ok := event.first("DURATION"); ok {
+		end, err = addICalDuration(start, duration.value)
+		if err != nil {
+			return interval{}, err
+		}
+	}
+	if end.Before(start) {
+		return interval{}, fmt.Errorf("%w: event ends before it starts", ErrInvalidCalendar)
+	}
+
+	return interval{start: start, end: end}, nil
+}
+
+// parseICalTime parses a DATE or DATE-TIME property. Dates are midnight in loc, as are times
+// without a time zone and times whose TZID is not an IANA name. It reports whether the value
+// was a date.
+func parseICalTime(property icalProperty, loc *time.Location) (time.Time, bool, error) {
+	value := strings.TrimSpace(property.value)
+	if tzid, ok := property.params["TZID"]; ok {
+		if tzLoc, err := time.LoadLocation(strings.TrimPrefix(tzid, "/")); err == nil {
+			loc = tzLoc
+		}
+	}
+
+	if strings.EqualFold(property.params["VALUE"], "DATE") || len(value) == len("20060102") {
+		date, err := time.ParseInLocation("20060102", value, loc)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("%w: %q is not a date", ErrInvalidCalendar, value)
+		}
+		return date, true, nil
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse("20060102T150405Z", value)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("%w: %q is not a date-time", ErrInvalidCalendar, value)
+		}
+		return t.In(loc), false, nil
+	}
+	t, err := time.ParseInLocation("20060102T150405", value, loc)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("%w: %q is not a date-time", ErrInvalidCalendar, value)
+	}
+	return t, false, nil
+}
+
+// parseICalTimes parses a property holding a comma separated list of dates or date-times, such as
+// EXDATE and RDATE
+func parseICalTimes(property icalProperty, loc *time.Location) ([]time.Time, error) {
+	var times []time.Time
+	for _, value := range strings.Split(property.value, ",") {
+		t, _, err := parseICalTime(icalProperty{params: property.params, value: value}, loc)
+		if err != nil {
+			return nil, err
+		}
+		times = append(times, t)
+	}
+	return times, nil
+}
+
+// addICalDuration adds an RFC 5545 DURATION such as PT1H30M, P1D or P2W to t. Days and weeks are
+// calendar days, so they keep the wall-clock time across daylight saving changes.
+func addICalDuration(t time.Time, value string) (time.Time, error) {
+	invalid := fmt.Errorf("%w: %q is not a duration", ErrInvalidCalendar, value)
+
+	rest := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(value)), "+")
+	if strings.HasPrefix(rest, "-") {
+		return time.Time{}, fmt.Errorf("%w: negative durations are not supported", ErrInvalidCalendar)
+	}
+	rest, found := strings.CutPrefix(rest, "P")
+	if !found || rest == "" {
+		return time.Time{}, invalid
+	}
+
+	var days int
+	var clock time.Duration
+	inTime := false
+	for rest != "" {
+		if rest[0] == 'T' {
+			inTime = true
+			rest = rest[1:]
+			continue
+		}
+		i := strings.IndexAny(rest, "WDHMS")
+		if i <= 0 {
+			return time.Time{}, invalid
+		}
+		n, err := strconv.Atoi(rest[:i])
+		if err != nil {
+			return time.Time{}, invalid
+		}
+		switch unit := rest[i]; {
+		case unit == 'W' && !inTime:
+			days += 7 * n
+		case unit == 'D' && !inTime:
+			days += n
+		case unit == 'H' && inTime:
+			clock += time.Duration(n) * time.Hour
+		case unit == 'M' && inTime:
+			clock += time.Duration(n) * time.Minute
+		case unit == 'S' && inTime:
+			clock += time.Duration(n) * time.Second
+		default:
+			return time.Time{}, invalid
+		}
+		rest = rest[i+1:]
+	}
+
+	return t.AddDate(0, 0, days).Add(clock), nil
+}
+
+// parseICS reads the VEVENTs of an iCalendar object. Components nested in events, such as
+// VALARM, and everything outside events are ignored.
+func parseICS(r io.Reader) ([]icalEvent, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxICSLineLength)
+
+	var lines []string
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		// Folded lines continue with a space or tab (RFC 5545 3.1)
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			if len(lines[len(lines)-1]) > maxICSLineLength {
+				return nil, fmt.Errorf("%w: content line is too long", ErrInvalidCalendar)
+			}
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCalendar, err)
+	}
+
+	var events []icalEvent
+	var stack []string
+	var event icalEvent
+	for _, line := range lines {
+		name, property, err := parseContentLine(line)
+		if err != nil {
+			return nil, err
+		}
+
+		switch name {
+		case "BEGIN":
+			component := strings.ToUpper(property.value)
+			if component == "VEVENT" && len(stack) == 1 && stack[0] == "VCALENDAR" {
+				event = make(icalEvent)
+			}
+			stack = append(stack, component)
+		case "END":
+			component := strings.ToUpper(property.value)
+			if len(stack) == 0 || stack[len(stack)-1] != component {
+				return nil, fmt.Errorf("%w: unexpected END:%s", ErrInvalidCalendar, property.value)
+			}
+			stack = stack[:len(stack)-1]
+			if component == "VEVENT" && len(stack) == 1 {
+				events = append(events, event)
+				event = nil
+			}
+		default:
+			if event != nil && len(stack) == 2 {
+				event[name] = append(event[name], property)
+			}
+		}
+	}
+	if len(stack) != 0 {
+		return nil, fmt.Errorf("%w: BEGIN:%s is never ended", ErrInvalidCalendar, stack[len(stack)-1])
+	}
+	if events == nil && !slices.ContainsFunc(lines, func(line string) bool {
+		return strings.EqualFold(line, "BEGIN:VCALENDAR")
+	}) {
+		return nil, fmt.Errorf("%w: no VCALENDAR found", ErrInvalidCalendar)
+	}
+
+	return events, nil
+}
+
+// parseContentLine splits a content line into its upper-cased name, parameters and value.
+// Parameter values may be quoted, in which case they can contain ':' and ';'.
+func parseContentLine(line string) (string, icalProperty, error) {
+	property := icalProperty{params: make(map[string]string)}
+
+	inQuotes := false
+	valueStart := -1
+	var parts []string
+	partStart := 0
+	for i, r := range line {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+		case r == ';' && !inQuotes:
+			parts = append(parts, line[partStart:i])
+			partStart = i + 1
+		case r == ':' && !inQuotes:
+			valueStart = i + 1
+		}
+		if valueStart >= 0 {
+			break
+		}
+	}
+	if valueStart < 0 {
+		return "", icalProperty{}, fmt.Errorf("%w: malformed content line %q", ErrInvalidCalendar, line)
+	}
+	parts = append(parts, line[partStart:valueStart-1])
+	property.value = line[valueStart:]
+
+	for _, param := range parts[1:] {
+		key, value, _ := strings.Cut(param, "=")
+		property.params[strings.ToUpper(key)] = strings.Trim(value, `"`)
+	}
+
+	return strings.ToUpper(parts[0]), property, nil
+}
@@ -0,0 +1,117 @@
+package user_availability
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseICS(t *testing.T) {
+	calendar := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//Example//EN",
+		"BEGIN:VTIMEZONE",
+		"TZID:Europe/Berlin",
+		"BEGIN:STANDARD",
+		"DTSTART:19701025T030000",
+		"END:STANDARD",
+		"END:VTIMEZONE",
+		"BEGIN:VEVENT",
+		"UID:first@example.com",
+		"DTSTART;TZID=Europe/Berlin:20240903T190000",
+		"DTEND;TZID=Europe/Berlin:20240903T210000",
+		"SUMMARY:A summary that is long enough to be folded onto a",
+		"  second line",
+		"ORGANIZER;CN=\"Doe; Jane: Organizer\":mailto:jane@example.com",
+		"EXDATE:20240910T170000Z",
+		"EXDATE:20240917T170000Z",
+		"BEGIN:VALARM",
+		"ACTION:DISPLAY",
+		"TRIGGER:-PT15M",
+		"END:VALARM",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:second@example.com",
+		"dtstart;value=date:2024",
+		"\t0904",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}, "\r\n")
+
+	events, err := parseICS(strings.NewReader(calendar))
+	if err != nil {
+		t.Fatalf("parseICS: %v", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("parseICS returned %d events, want 2", len(events))
+	}
+
+	first := events[0]
+	tests := []struct {
+		name       string
+		value      string
+		param      string
+		paramValue string
+	}{
+		{name: "UID", value: "first@example.com"},
+		{name: "DTSTART", value: "20240903T190000", param: "TZID", paramValue: "Europe/Berlin"},
+		{name: "SUMMARY", value: "A summary that is long enough to be folded onto a second line"},
+		{name: "ORGANIZER", value: "mailto:jane@example.com", param: "CN", paramValue: "Doe; Jane: Organizer"},
+	}
+	for _, tt := range tests {
+		property, ok := first.first(tt.name)
+		if !ok {
+			t.Errorf("first event has no %s", tt.name)
+			continue
+		}
+		if property.value != tt.value {
+			t.Errorf("%s = %q, want %q", tt.name, property.value, tt.value)
+		}
+		if tt.param != "" && property.params[tt.param] != tt.paramValue {
+			t.Errorf("%s;%s = %q, want %q", tt.name, tt.param, property.params[tt.param], tt.paramValue)
+		}
+	}
+	if got := len(first["EXDATE"]); got != 2 {
+		t.Errorf("first event has %d EXDATEs, want 2", got)
+	}
+	if _, ok := first.first("ACTION"); ok {
+		t.Errorf("a property of the VALARM was added to the event")
+	}
+	if _, ok := first.first("TZID"); ok {
+		t.Errorf("a property of the VTIMEZONE was added to the event")
+	}
+
+	// Names and parameter names are case-insensitive; a tab also continues a line
+	second := events[1]
+	property, ok := second.first("DTSTART")
+	if !ok || property.value != "20240904" || property.params["VALUE"] != "date" {
+		t.Errorf("second event DTSTART = %+v, %v", property, ok)
+	}
+}
+
+func TestParseICSErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		calendar string
+		wantErr  bool
+	}{
+		{"empty calendar", "BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n", false},
+		{"LF line endings", "BEGIN:VCALENDAR\nBEGIN:VEVENT\nUID:a\nEND:VEVENT\nEND:VCALENDAR\n", false},
+		{"no calendar", "hello world\n", true},
+		{"nothing at all", "", true},
+		{"unbalanced END", "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nEND:VCALENDAR\r\n", true},
+		{"BEGIN never ended", "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nEND:VEVENT\r\n", true},
+		{"line without a value", "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nSUMMARY\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n", true},
+		{"unterminated quote", "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nORGANIZER;CN=\"Jane:mailto:jane@example.com\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n", true},
+	}
+	for _, tt := range tests {
+		_, err := parseICS(strings.NewReader(tt.calendar))
+		if tt.wantErr && !errors.Is(err, ErrInvalidCalendar) {
+			t.Errorf("%s: error = %v, want ErrInvalidCalendar", tt.name, err)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+	}
+}
@@ -1,17 +1,36 @@
 package user_availability
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"friendsocial/auth"
+	"friendsocial/query"
+	"io"
+	"mime"
 	"net/http"
+	"os"
+	"strconv"
 )
 
+// maxImportSize bounds an uploaded iCalendar file
+const maxImportSize = 10 << 20
+
+// LocalImportRequest imports a calendar file from the server's disk. It is only accepted when the
+// ics_import_local_paths feature is on, which is meant for development.
+type LocalImportRequest struct {
+	Path string `json:"path"`
+}
+
 type UserAvailabilityService interface {
-	Create(availability UserAvailability) (UserAvailability, error)
-	ReadAll() ([]UserAvailability, error)
-	ReadByUserID(userID string) ([]UserAvailability, error)
-	Read(id string) (UserAvailability, bool, error)
-	Update(id string, availability UserAvailability) (UserAvailability, bool, error)
-	Delete(id string) (bool, error)
+	Create(ctx context.Context, availability UserAvailability) (UserAvailability, error)
+	ReadAll(ctx context.Context, params query.Params) (query.Page[UserAvailability], error)
+	ReadByUserID(ctx context.Context, userID string) ([]UserAvailability, error)
+	Read(ctx context.Context, id string) (UserAvailability, bool, error)
+	Update(ctx context.Context, id string, availability UserAvailability) (UserAvailability, bool, error)
+	Delete(ctx context.Context, id string) (bool, error)
+	FindCommonSlots(ctx context.Context, request CommonAvailabilityRequest) ([]CommonSlot, error)
+	ImportICS(ctx context.Context, userID int, calendar io.Reader, options ImportOptions) (ImportResult, error)
 }
 
 // UserAvailabilityError represents an error response
@@ -23,12 +42,15 @@ type UserAvailabilityError struct {
 // UserAvailabilityHTTPHandler handles HTTP requests for user availability
 type UserAvailabilityHTTPHandler struct {
 	availabilityService UserAvailabilityService
+	// allowLocalImports lets calendar imports name a file on the server's disk, for development
+	allowLocalImports bool
 }
 
 // NewUserAvailabilityHTTPHandler creates a new UserAvailabilityHTTPHandler
-func NewUserAvailabilityHTTPHandler(availabilityService UserAvailabilityService) *UserAvailabilityHTTPHandler {
+func NewUserAvailabilityHTTPHandler(availabilityService UserAvailabilityService, allowLocalImports bool) *UserAvailabilityHTTPHandler {
 	return &UserAvailabilityHTTPHandler{
 		availabilityService: availabilityService,
+		allowLocalImports:   allowLocalImports,
 	}
 }
 
@@ -52,7 +74,7 @@ func (uH *UserAvailabilityHTTPHandler) HandleHTTPPost(w http.ResponseWriter, r *
 		return
 	}
 
-	newAvailability, err := uH.availabilityService.Create(availability)
+	newAvailability, err := uH.availabilityService.Create(r.Context(), availability)
 
 	if err != nil {
 		uH.errorResponse(w, http.StatusInternalServerError, err.Error())
@@ -71,20 +93,29 @@ func (uH *UserAvailabilityHTTPHandler) HandleHTTPPost(w http.ResponseWriter, r *
 // HandleHTTPGet handles retrieving all user availability records
 //
 //	@Summary		Get all user availability records
-//	@Description	Retrieve all availability records for all users
+//	@Description	Retrieve all availability records for all users. Filter with id, user_id, day_of_week, is_available and specific_date, e.g. ?user_id=3&is_available=false
 //	@Tags			User Availability
 //	@Produce		json
-//	@Success		200	{array}		UserAvailability
-//	@Failure		400	{object}	UserAvailabilityError
-//	@Failure		500	{object}	UserAvailabilityError
+//	@Param			limit	query		int		false	"Items per page, defaults to 50, at most 200"
+//	@Param			cursor	query		string	false	"next_cursor of the previous page"
+//	@Param			sort	query		string	false	"Field to sort by, prefixed with - for descending: id"
+//	@Success		200		{object}	query.Page[UserAvailability]
+//	@Failure		400		{object}	UserAvailabilityError
+//	@Failure		500		{object}	UserAvailabilityError
 //	@Router			/user_availability [get]
 func (uH *UserAvailabilityHTTPHandler) HandleHTTPGet(w http.ResponseWriter, r *http.Request) {
-	availability, err := uH.availabilityService.ReadAll()
+	params, err := query.Parse(r.URL.RawQuery, listSpec)
 	if err != nil {
 		uH.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
+	availability, err := uH.availabilityService.ReadAll(r.Context(), params)
+	if err != nil {
+		uH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(availability)
 	if err != nil {
@@ -108,7 +139,7 @@ func (uH *UserAvailabilityHTTPHandler) HandleHTTPGet(w http.ResponseWriter, r *h
 func (uH *UserAvailabilityHTTPHandler) HandleHTTPGetWithID(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 
-	availability, found, err := uH.availabilityService.Read(id)
+	availability, found, err := uH.availabilityService.Read(r.Context(), id)
 	if err != nil {
 		uH.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -151,7 +182,7 @@ func (uH *UserAvailabilityHTTPHandler) HandleHTTPPut(w http.ResponseWriter, r *h
 		return
 	}
 
-	availability, found, err := uH.availabilityService.Update(id, newAvailability)
+	availability, found, err := uH.availabilityService.Update(r.Context(), id, newAvailability)
 	if err != nil {
 		uH.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -184,7 +215,7 @@ func (uH *UserAvailabilityHTTPHandler) HandleHTTPPut(w http.ResponseWriter, r *h
 func (uH *UserAvailabilityHTTPHandler) HandleHTTPDelete(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 
-	found, err := uH.availabilityService.Delete(id)
+	found, err := uH.availabilityService.Delete(r.Context(), id)
 	if err != nil {
 		uH.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -212,7 +243,7 @@ func (uH *UserAvailabilityHTTPHandler) HandleHTTPDelete(w http.ResponseWriter, r
 //	@Router			/user_availability/user/{user_id} [get]
 func (uH *UserAvailabilityHTTPHandler) HandleHTTPGetByUserID(w http.ResponseWriter, r *http.Request) {
 	userID := r.PathValue("user_id")
-	availability, err := uH.availabilityService.ReadByUserID(userID)
+	availability, err := uH.availabilityService.ReadByUserID(r.Context(), userID)
 	if err != nil {
 		uH.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -226,6 +257,189 @@ func (uH *UserAvailabilityHTTPHandler) HandleHTTPGetByUserID(w http.ResponseWrit
 	}
 }
 
+// HandleHTTPPostCommon finds the time slots in which a group of users is free
+//
+//	@Summary		Find common availability
+//	@Description	Rank the slots in a date range where all users, or a quorum of them, are free for at least the minimum duration or the activity's estimated time
+//	@Tags			User Availability
+//	@Accept			json
+//	@Produce		json
+//	@Param			request	body		CommonAvailabilityRequest	true	"Users, date range, duration and time zone"
+//	@Success		200		{array}		CommonSlot
+//	@Failure		400		{object}	UserAvailabilityError
+//	@Failure		500		{object}	UserAvailabilityError
+//	@Router			/availability/common [post]
+func (uH *UserAvailabilityHTTPHandler) HandleHTTPPostCommon(w http.ResponseWriter, r *http.Request) {
+	var request CommonAvailabilityRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		uH.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	slots, err := uH.availabilityService.FindCommonSlots(r.Context(), request)
+	if err != nil {
+		if errors.Is(err, ErrInvalidCommonRequest) {
+			uH.errorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		uH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if slots == nil {
+		slots = []CommonSlot{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(slots)
+	if err != nil {
+		uH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// HandleHTTPPostImport imports an iCalendar file as blackouts
+//
+//	@Summary		Import a calendar
+//	@Description	Turn the events of an iCalendar (.ics) file into unavailable specific_date rows, one per day an event covers. Recurring events are expanded within the window. Send the file as the request body or as the "file" field of a multipart form. Importing a calendar again replaces the rows of the events it contains.
+//	@Tags			User Availability
+//	@Accept			text/calendar
+//	@Accept			multipart/form-data
+//	@Produce		json
+//	@Param			user_id		path		int		true	"User ID"
+//	@Param			time_zone	query		string	false	"Time zone of all-day and floating events, defaults to UTC"
+//	@Param			window_days	query		int		false	"Days from today to import, defaults to 365"
+//	@Success		200			{object}	ImportResult
+//	@Failure		400			{object}	UserAvailabilityError
+//	@Failure		500			{object}	UserAvailabilityError
+//	@Router			/user_availability/user/{user_id}/import [post]
+func (uH *UserAvailabilityHTTPHandler) HandleHTTPPostImport(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.PathValue("user_id"))
+	if err != nil {
+		uH.errorResponse(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	options := ImportOptions{TimeZone: r.URL.Query().Get("time_zone")}
+	if windowDays := r.URL.Query().Get("window_days"); windowDays != "" {
+		options.WindowDays, err = strconv.Atoi(windowDays)
+		if err != nil {
+			uH.errorResponse(w, http.StatusBadRequest, "Invalid window_days")
+			return
+		}
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	var calendar io.Reader = r.Body
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "multipart/form-data":
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			uH.errorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		defer file.Close()
+		calendar = file
+	case "application/json":
+		if !uH.allowLocalImports {
+			uH.errorResponse(w, http.StatusBadRequest, "Importing from a local path is disabled")
+			return
+		}
+		var request LocalImportRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			uH.errorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		file, err := os.Open(request.Path)
+		if err != nil {
+			uH.errorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		defer file.Close()
+		calendar = io.LimitReader(file, maxImportSize)
+	}
+
+	result, err := uH.availabilityService.ImportICS(r.Context(), userID, calendar, options)
+	if err != nil {
+		if errors.Is(err, ErrInvalidCalendar) {
+			uH.errorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		uH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		uH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// RegisterRoutes adds the user availability routes to mux
+func (uH *UserAvailabilityHTTPHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("POST /user_availability", uH.HandleHTTPPost)
+	mux.HandleFunc("GET /user_availability", uH.HandleHTTPGet)
+	mux.HandleFunc("GET /user_availability/user/{user_id}", uH.HandleHTTPGetByUserID)
+	mux.HandleFunc("GET /user_availability/{id}", uH.HandleHTTPGetWithID)
+	mux.HandleFunc("PUT /user_availability/{id}", uH.HandleHTTPPut)
+	mux.HandleFunc("DELETE /user_availability/{id}", uH.HandleHTTPDelete)
+	mux.HandleFunc("POST /availability/common", uH.HandleHTTPPostCommon)
+	mux.HandleFunc("POST /user_availability/user/{user_id}/import", uH.HandleHTTPPostImport)
+}
+
+// AuthorizationRules returns the ownership rules for user availability routes
+func (uH *UserAvailabilityHTTPHandler) AuthorizationRules() map[string]auth.Rule {
+	return map[string]auth.Rule{
+		"POST /user_availability":                       uH.isBodyOwner,
+		"PUT /user_availability/{id}":                   auth.AllOf(uH.isOwner, uH.isBodyOwner),
+		"DELETE /user_availability/{id}":                uH.isOwner,
+		"POST /availability/common":                     uH.isInCommonRequest,
+		"POST /user_availability/user/{user_id}/import": auth.Self("user_id"),
+	}
+}
+
+// isOwner allows the user the availability record in the path belongs to
+func (uH *UserAvailabilityHTTPHandler) isOwner(r *http.Request, callerID int) (bool, error) {
+	availability, found, err := uH.availabilityService.Read(r.Context(), r.PathValue("id"))
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		// Let the handler answer 404
+		return true, nil
+	}
+	return availability.UserID == callerID, nil
+}
+
+// isBodyOwner stops callers from writing availability on behalf of someone else
+func (uH *UserAvailabilityHTTPHandler) isBodyOwner(r *http.Request, callerID int) (bool, error) {
+	var availability UserAvailability
+	if err := auth.PeekJSON(r, &availability); err != nil {
+		// Let the handler answer 400
+		return true, nil
+	}
+	return availability.UserID == callerID, nil
+}
+
+// isInCommonRequest only lets callers compare calendars with a group they belong to
+func (uH *UserAvailabilityHTTPHandler) isInCommonRequest(r *http.Request, callerID int) (bool, error) {
+	var request CommonAvailabilityRequest
+	if err := auth.PeekJSON(r, &request); err != nil {
+		// Let the handler answer 400
+		return true, nil
+	}
+	for _, userID := range request.UserIDs {
+		if userID == callerID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // errorResponse sends a JSON error response
 func (uH *UserAvailabilityHTTPHandler) errorResponse(w http.ResponseWriter, statusCode int, errorString string) {
 	w.Header().Set("Content-Type", "application/json")
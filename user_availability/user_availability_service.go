@@ -2,7 +2,7 @@ package user_availability
 
 import (
 	"context"
-	"sync"
+	"friendsocial/query"
 	"time"
 
 	"github.com/jackc/pgx/v4"
@@ -20,7 +20,6 @@ type UserAvailability struct {
 }
 
 type Service struct {
-	sync.Mutex
 	db *pgxpool.Pool
 }
 
@@ -30,12 +29,9 @@ func NewService(db *pgxpool.Pool) *Service {
 	}
 }
 
-func (s *Service) Create(availability UserAvailability) (UserAvailability, error) {
-	s.Lock()
-	defer s.Unlock()
-
+func (s *Service) Create(ctx context.Context, availability UserAvailability) (UserAvailability, error) {
 	err := s.db.QueryRow(
-		context.Background(),
+		ctx,
 		`INSERT INTO user_availability (user_id, day_of_week, start_time, end_time, is_available, specific_date) 
 		 VALUES ($1, $2, $3::time with time zone, $4::time with time zone, $5, $6::date) 
 		 RETURNING id`,
@@ -49,34 +45,46 @@ func (s *Service) Create(availability UserAvailability) (UserAvailability, error
 	return availability, nil
 }
 
-func (s *Service) ReadAll() ([]UserAvailability, error) {
-	s.Lock()
-	defer s.Unlock()
+// listSpec are the fields availability can be listed by
+var listSpec = query.Spec{
+	Fields: map[string]query.Field{
+		"id":            {Column: "id", Kind: query.Int},
+		"user_id":       {Column: "user_id", Kind: query.Int},
+		"day_of_week":   {Column: "day_of_week", Kind: query.String},
+		"is_available":  {Column: "COALESCE(is_available, TRUE)", Kind: query.Bool},
+		"specific_date": {Column: "specific_date", Kind: query.Date},
+	},
+	Key: "id",
+}
 
-	rows, err := s.db.Query(context.Background(), "SELECT id, user_id, day_of_week, start_time::text, end_time::text, is_available, specific_date FROM user_availability")
+func (s *Service) ReadAll(ctx context.Context, params query.Params) (query.Page[UserAvailability], error) {
+	sql, args := params.Apply("SELECT id, user_id, day_of_week, start_time::text, end_time::text, is_available, specific_date FROM user_availability")
+	rows, err := s.db.Query(ctx, sql, args...)
 	if err != nil {
-		return nil, err
+		return query.Page[UserAvailability]{}, err
 	}
 	defer rows.Close()
 
 	var availabilities []UserAvailability
 	for rows.Next() {
 		var availability UserAvailability
-		if err := rows.Scan(&availability.ID, &availability.UserID, &availability.DayOfWeek, &availability.StartTime, &availability.EndTime, &availability.IsAvailable); err != nil {
-			return nil, err
+		if err := rows.Scan(&availability.ID, &availability.UserID, &availability.DayOfWeek, &availability.StartTime, &availability.EndTime, &availability.IsAvailable, &availability.SpecificDate); err != nil {
+			return query.Page[UserAvailability]{}, err
 		}
 		availabilities = append(availabilities, availability)
 	}
+	if err := rows.Err(); err != nil {
+		return query.Page[UserAvailability]{}, err
+	}
 
-	return availabilities, nil
+	return query.NewPage(params, availabilities, func(availability UserAvailability, sort string) (int, interface{}) {
+		return availability.ID, nil
+	}), nil
 }
 
-func (s *Service) Read(id string) (UserAvailability, bool, error) {
-	s.Lock()
-	defer s.Unlock()
-
+func (s *Service) Read(ctx context.Context, id string) (UserAvailability, bool, error) {
 	var availability UserAvailability
-	err := s.db.QueryRow(context.Background(),
+	err := s.db.QueryRow(ctx,
 		"SELECT id, user_id, day_of_week, start_time::text, end_time::text, is_available, specific_date FROM user_availability WHERE id = $1",
 		id,
 	).Scan(&availability.ID, &availability.UserID, &availability.DayOfWeek, &availability.StartTime, &availability.EndTime, &availability.IsAvailable, &availability.SpecificDate)
@@ -91,12 +99,9 @@ func (s *Service) Read(id string) (UserAvailability, bool, error) {
 	return availability, true, nil
 }
 
-func (s *Service) Update(id string, availability UserAvailability) (UserAvailability, bool, error) {
-	s.Lock()
-	defer s.Unlock()
-
+func (s *Service) Update(ctx context.Context, id string, availability UserAvailability) (UserAvailability, bool, error) {
 	cmdTag, err := s.db.Exec(
-		context.Background(),
+		ctx,
 		`UPDATE user_availability 
 		 SET user_id = $1, day_of_week = $2, start_time = $3::time with time zone, end_time = $4::time with time zone, is_available = $5, specific_date = $6::date
 		 WHERE id = $7`,
@@ -114,11 +119,8 @@ func (s *Service) Update(id string, availability UserAvailability) (UserAvailabi
 	return availability, true, nil
 }
 
-func (s *Service) ReadByUserID(userID string) ([]UserAvailability, error) {
-	s.Lock()
-	defer s.Unlock()
-
-	rows, err := s.db.Query(context.Background(), "SELECT id, user_id, day_of_week, start_time::text, end_time::text, is_available, specific_date FROM user_availability WHERE user_id = $1", userID)
+func (s *Service) ReadByUserID(ctx context.Context, userID string) ([]UserAvailability, error) {
+	rows, err := s.db.Query(ctx, "SELECT id, user_id, day_of_week, start_time::text, end_time::text, is_available, specific_date FROM user_availability WHERE user_id = $1", userID)
 	if err != nil {
 		return nil, err
 	}
@@ -136,11 +138,8 @@ func (s *Service) ReadByUserID(userID string) ([]UserAvailability, error) {
 	return availabilities, nil
 }
 
-func (s *Service) Delete(id string) (bool, error) {
-	s.Lock()
-	defer s.Unlock()
-
-	cmdTag, err := s.db.Exec(context.Background(), "DELETE FROM user_availability WHERE id = $1", id)
+func (s *Service) Delete(ctx context.Context, id string) (bool, error) {
+	cmdTag, err := s.db.Exec(ctx, "DELETE FROM user_availability WHERE id = $1", id)
 	if err != nil {
 		return false, err
 	}
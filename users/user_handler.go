@@ -1,7 +1,10 @@
 package users
 
 import (
+	"context"
 	"encoding/json"
+	"friendsocial/auth"
+	"friendsocial/query"
 	"net/http"
 	"strconv"
 	"strings"
@@ -9,12 +12,12 @@ import (
 
 // UserService defines the interface for user-related operations
 type UserService interface {
-	Create(user User) (User, error)
-	ReadAll() ([]User, error)
-	Read(ids []int) ([]User, error)
-	Update(id string, user User) (User, bool, error)
-	Delete(id string) (bool, error)
-	PartialUpdate(id string, updates map[string]interface{}) (User, bool, error) // Add this line
+	Create(ctx context.Context, user User) (User, error)
+	ReadAll(ctx context.Context, params query.Params) (query.Page[User], error)
+	Read(ctx context.Context, ids []int) ([]User, error)
+	Update(ctx context.Context, id string, user User) (User, bool, error)
+	Delete(ctx context.Context, id string) (bool, error)
+	PartialUpdate(ctx context.Context, id string, updates map[string]interface{}) (User, bool, error) // Add this line
 }
 
 // UserError defines the structure for an error response
@@ -55,7 +58,12 @@ func (uH *UserHTTPHandler) HandleHTTPPost(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	newUser, err := uH.userService.Create(user)
+	if err := auth.ValidatePassword(user.Password); err != nil {
+		uH.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	newUser, err := uH.userService.Create(r.Context(), user)
 
 	if err != nil {
 		uH.errorResponse(w, http.StatusInternalServerError, err.Error())
@@ -74,20 +82,29 @@ func (uH *UserHTTPHandler) HandleHTTPPost(w http.ResponseWriter, r *http.Request
 // HandleHTTPGet retrieves all users
 //
 //	@Summary		Get all users
-//	@Description	Retrieve all users
+//	@Description	Retrieve all users. Filter with id, name, email and location_id, e.g. ?location_id=3
 //	@Tags			users
 //	@Produce		json
-//	@Success		200	{array}		User
-//	@Failure		400	{object}	UserError
-//	@Failure		500	{object}	UserError
+//	@Param			limit	query		int		false	"Items per page, defaults to 50, at most 200"
+//	@Param			cursor	query		string	false	"next_cursor of the previous page"
+//	@Param			sort	query		string	false	"Field to sort by, prefixed with - for descending: id, name, email"
+//	@Success		200		{object}	query.Page[User]
+//	@Failure		400		{object}	UserError
+//	@Failure		500		{object}	UserError
 //	@Router			/users [get]
 func (uH *UserHTTPHandler) HandleHTTPGet(w http.ResponseWriter, r *http.Request) {
-	users, err := uH.userService.ReadAll()
+	params, err := query.Parse(r.URL.RawQuery, listSpec)
 	if err != nil {
 		uH.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
+	users, err := uH.userService.ReadAll(r.Context(), params)
+	if err != nil {
+		uH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(users)
 	if err != nil {
@@ -121,7 +138,7 @@ func (uH *UserHTTPHandler) HandleHTTPGetWithID(w http.ResponseWriter, r *http.Re
 		}
 		intIDs = append(intIDs, intID)
 	}
-	users, err := uH.userService.Read(intIDs)
+	users, err := uH.userService.Read(r.Context(), intIDs)
 	if len(users) == 0 {
 		uH.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -138,7 +155,7 @@ func (uH *UserHTTPHandler) HandleHTTPGetWithID(w http.ResponseWriter, r *http.Re
 // HandleHTTPPut updates a user by ID
 //
 //	@Summary		Update a user by ID
-//	@Description	Update an existing user with the provided payload
+//	@Description	Update an existing user with the provided payload. A new password signs the user out of every session.
 //	@Tags			users
 //	@Accept			json
 //	@Produce		json
@@ -159,7 +176,7 @@ func (uH *UserHTTPHandler) HandleHTTPPut(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	user, found, err := uH.userService.Update(id, newUser)
+	user, found, err := uH.userService.Update(r.Context(), id, newUser)
 	if err != nil {
 		uH.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -191,7 +208,7 @@ func (uH *UserHTTPHandler) HandleHTTPPut(w http.ResponseWriter, r *http.Request)
 func (uH *UserHTTPHandler) HandleHTTPDelete(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 
-	found, err := uH.userService.Delete(id)
+	found, err := uH.userService.Delete(r.Context(), id)
 	if err != nil {
 		uH.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -208,7 +225,7 @@ func (uH *UserHTTPHandler) HandleHTTPDelete(w http.ResponseWriter, r *http.Reque
 // HandleHTTPPatch updates a user partially by ID
 //
 //	@Summary		Partially update a user by ID
-//	@Description	Update specific fields of an existing user with the provided payload
+//	@Description	Update specific fields of an existing user with the provided payload. A new password signs the user out of every session.
 //	@Tags			users
 //	@Accept			json
 //	@Produce		json
@@ -229,7 +246,7 @@ func (uH *UserHTTPHandler) HandleHTTPPatch(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	user, found, err := uH.userService.PartialUpdate(id, updates)
+	user, found, err := uH.userService.PartialUpdate(r.Context(), id, updates)
 	if err != nil {
 		uH.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -248,6 +265,25 @@ func (uH *UserHTTPHandler) HandleHTTPPatch(w http.ResponseWriter, r *http.Reques
 	}
 }
 
+// RegisterRoutes adds the user routes to mux
+func (uH *UserHTTPHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("POST /users", uH.HandleHTTPPost)
+	mux.HandleFunc("GET /users", uH.HandleHTTPGet)
+	mux.HandleFunc("GET /users/{ids}", uH.HandleHTTPGetWithID)
+	mux.HandleFunc("PUT /users/{id}", uH.HandleHTTPPut)
+	mux.HandleFunc("DELETE /users/{id}", uH.HandleHTTPDelete)
+	mux.HandleFunc("PATCH /users/{id}", uH.HandleHTTPPatch)
+}
+
+// AuthorizationRules returns the ownership rules for user routes
+func (uH *UserHTTPHandler) AuthorizationRules() map[string]auth.Rule {
+	return map[string]auth.Rule{
+		"PUT /users/{id}":    auth.Self("id"),
+		"PATCH /users/{id}":  auth.Self("id"),
+		"DELETE /users/{id}": auth.Self("id"),
+	}
+}
+
 func (uH *UserHTTPHandler) errorResponse(w http.ResponseWriter, statusCode int, errorString string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
@@ -3,7 +3,9 @@ package users
 import (
 	"context"
 	"fmt"
-	"sync"
+	"friendsocial/auth"
+	"friendsocial/query"
+	"strconv"
 
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
@@ -14,13 +16,21 @@ type User struct {
 	ID             int     `json:"id"`
 	Name           string  `json:"name"`
 	Email          string  `json:"email"`
-	Password       string  `json:"password"`
+	Password       string  `json:"password,omitempty"` // Write-only, the stored hash is never returned
 	LocationID     *int    `json:"location_id,omitempty"`
 	ProfilePicture *string `json:"profile_picture,omitempty"` // Add this line
 }
 
+// Columns that PartialUpdate is allowed to touch
+var patchableColumns = map[string]bool{
+	"name":            true,
+	"email":           true,
+	"password":        true,
+	"location_id":     true,
+	"profile_picture": true,
+}
+
 type Service struct {
-	sync.Mutex
 	db *pgxpool.Pool
 }
 
@@ -30,15 +40,17 @@ func NewService(db *pgxpool.Pool) *Service {
 	}
 }
 
-func (userService *Service) Create(user User) (User, error) {
-	userService.Lock()
-	defer userService.Unlock()
+func (userService *Service) Create(ctx context.Context, user User) (User, error) {
+	passwordHash, err := auth.HashPassword(user.Password)
+	if err != nil {
+		return User{}, err
+	}
 
 	var userID int
-	err := userService.db.QueryRow(
-		context.Background(),
+	err = userService.db.QueryRow(
+		ctx,
 		"INSERT INTO users (name, email, password, location_id, profile_picture) VALUES ($1, $2, $3, $4, $5) RETURNING id",
-		user.Name, user.Email, user.Password, user.LocationID, user.ProfilePicture, // Add profile_picture
+		user.Name, user.Email, passwordHash, user.LocationID, user.ProfilePicture, // Add profile_picture
 	).Scan(&userID)
 	if err != nil {
 		return User{}, err
@@ -50,35 +62,49 @@ func (userService *Service) Create(user User) (User, error) {
 	return user, nil
 }
 
-func (userService *Service) ReadAll() ([]User, error) {
-	userService.Lock()
-	defer userService.Unlock()
+// listSpec are the fields users can be listed by
+var listSpec = query.Spec{
+	Fields: map[string]query.Field{
+		"id":          {Column: "id", Kind: query.Int},
+		"name":        {Column: "name", Kind: query.String, Sortable: true},
+		"email":       {Column: "email", Kind: query.String, Sortable: true},
+		"location_id": {Column: "location_id", Kind: query.Int},
+	},
+	Key: "id",
+}
 
-	rows, err := userService.db.Query(context.Background(), "SELECT id, name, email, password, location_id, profile_picture FROM users") // Add profile_picture
+func (userService *Service) ReadAll(ctx context.Context, params query.Params) (query.Page[User], error) {
+	sql, args := params.Apply("SELECT id, name, email, location_id, profile_picture FROM users")
+	rows, err := userService.db.Query(ctx, sql, args...)
 	if err != nil {
-		return nil, err
+		return query.Page[User]{}, err
 	}
 	defer rows.Close()
 
 	var users []User
 	for rows.Next() {
 		var user User
-		if err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.Password, &user.LocationID, &user.ProfilePicture); err != nil { // Add profile_picture
-			return nil, err
+		if err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.LocationID, &user.ProfilePicture); err != nil {
+			return query.Page[User]{}, err
 		}
 		users = append(users, user)
 	}
+	if err := rows.Err(); err != nil {
+		return query.Page[User]{}, err
+	}
 
-	return users, nil
+	return query.NewPage(params, users, func(user User, sort string) (int, interface{}) {
+		if sort == "email" {
+			return user.ID, user.Email
+		}
+		return user.ID, user.Name
+	}), nil
 }
 
-func (userService *Service) Read(ids []int) ([]User, error) {
-	userService.Lock()
-	defer userService.Unlock()
-
-	query := "SELECT id, name, email, password, location_id, profile_picture FROM users WHERE id = ANY($1)"
+func (userService *Service) Read(ctx context.Context, ids []int) ([]User, error) {
+	query := "SELECT id, name, email, location_id, profile_picture FROM users WHERE id = ANY($1)"
 	var users []User
-	rows, err := userService.db.Query(context.Background(), query, pq.Array(ids))
+	rows, err := userService.db.Query(ctx, query, pq.Array(ids))
 	if err != nil {
 		return nil, err
 	}
@@ -86,7 +112,7 @@ func (userService *Service) Read(ids []int) ([]User, error) {
 
 	for rows.Next() {
 		var user User
-		if err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.Password, &user.LocationID, &user.ProfilePicture); err != nil { // Add profile_picture
+		if err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.LocationID, &user.ProfilePicture); err != nil { // Add profile_picture
 			return nil, err
 		}
 		users = append(users, user)
@@ -99,11 +125,24 @@ func (userService *Service) Read(ids []int) ([]User, error) {
 	return users, nil
 }
 
-func (userService *Service) Update(id string, user User) (User, bool, error) {
-	userService.Lock()
-	defer userService.Unlock()
+func (userService *Service) Update(ctx context.Context, id string, user User) (User, bool, error) {
+	// An empty password leaves the current one in place
+	var passwordHash *string
+	if user.Password != "" {
+		hash, err := auth.HashPassword(user.Password)
+		if err != nil {
+			return User{}, false, err
+		}
+		passwordHash = &hash
+	}
 
-	cmdTag, err := userService.db.Exec(context.Background(), "UPDATE users SET name = $1, email = $2, password = $3, location_id = $4, profile_picture = $5 WHERE id = $6", user.Name, user.Email, user.Password, user.LocationID, user.ProfilePicture, id) // Add profile_picture
+	tx, err := userService.db.Begin(ctx)
+	if err != nil {
+		return User{}, false, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	cmdTag, err := tx.Exec(ctx, "UPDATE users SET name = $1, email = $2, password = COALESCE($3, password), location_id = $4, profile_picture = $5 WHERE id = $6", user.Name, user.Email, passwordHash, user.LocationID, user.ProfilePicture, id) // Add profile_picture
 	if err != nil {
 		return User{}, false, err
 	}
@@ -112,14 +151,24 @@ func (userService *Service) Update(id string, user User) (User, bool, error) {
 		return User{}, false, nil
 	}
 
+	// A new password signs the user out everywhere
+	if passwordHash != nil {
+		if err := auth.RevokeSessions(ctx, tx, id); err != nil {
+			return User{}, false, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return User{}, false, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	user.ID, _ = strconv.Atoi(id)
+	user.Password = ""
 	return user, true, nil
 }
 
-func (userService *Service) Delete(id string) (bool, error) {
-	userService.Lock()
-	defer userService.Unlock()
-
-	cmdTag, err := userService.db.Exec(context.Background(), "DELETE FROM users WHERE id = $1", id)
+func (userService *Service) Delete(ctx context.Context, id string) (bool, error) {
+	cmdTag, err := userService.db.Exec(ctx, "DELETE FROM users WHERE id = $1", id)
 	if err != nil {
 		return false, err
 	}
@@ -131,16 +180,27 @@ func (userService *Service) Delete(id string) (bool, error) {
 	return true, nil
 }
 
-func (userService *Service) PartialUpdate(id string, updates map[string]interface{}) (User, bool, error) {
-	userService.Lock()
-	defer userService.Unlock()
-
+func (userService *Service) PartialUpdate(ctx context.Context, id string, updates map[string]interface{}) (User, bool, error) {
 	// Build the dynamic SQL query
 	query := "UPDATE users SET"
 	args := []interface{}{}
 	argCount := 1
 
 	for key, value := range updates {
+		if !patchableColumns[key] {
+			return User{}, false, fmt.Errorf("field %q cannot be updated", key)
+		}
+		if key == "password" {
+			password, ok := value.(string)
+			if !ok {
+				return User{}, false, fmt.Errorf("password must be a string")
+			}
+			hash, err := auth.HashPassword(password)
+			if err != nil {
+				return User{}, false, err
+			}
+			value = hash
+		}
 		if argCount > 1 {
 			query += ","
 		}
@@ -152,9 +212,15 @@ func (userService *Service) PartialUpdate(id string, updates map[string]interfac
 	query += fmt.Sprintf(" WHERE id = $%d RETURNING id, name, email, location_id, profile_picture", argCount) // Add profile_picture
 	args = append(args, id)
 
+	tx, err := userService.db.Begin(ctx)
+	if err != nil {
+		return User{}, false, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(context.Background())
+
 	// Execute the update
 	var user User
-	err := userService.db.QueryRow(context.Background(), query, args...).Scan(&user.ID, &user.Name, &user.Email, &user.LocationID, &user.ProfilePicture) // Add profile_picture
+	err = tx.QueryRow(ctx, query, args...).Scan(&user.ID, &user.Name, &user.Email, &user.LocationID, &user.ProfilePicture) // Add profile_picture
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return User{}, false, nil
@@ -162,5 +228,16 @@ func (userService *Service) PartialUpdate(id string, updates map[string]interfac
 		return User{}, false, err
 	}
 
+	// A new password signs the user out everywhere
+	if _, ok := updates["password"]; ok {
+		if err := auth.RevokeSessions(ctx, tx, id); err != nil {
+			return User{}, false, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return User{}, false, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
 	return user, true, nil
 }
@@ -0,0 +1,70 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// ErrPrivateAddress is returned for webhook hosts that resolve to an address on the server's own
+// network, so that subscribers cannot make the server call its internal services or the cloud
+// metadata endpoint (169.254.169.254)
+var ErrPrivateAddress = errors.New("webhook host must resolve to a public address")
+
+// isPublicIP reports whether ip may be called by the dispatcher. Loopback, private, link-local
+// (which includes the metadata endpoint), unspecified and multicast addresses are not.
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// checkHost resolves host and rejects it unless every address it resolves to is public
+func checkHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("%w: failed to resolve %s", ErrInvalidURL, host)
+	}
+	for _, addr := range addrs {
+		if !isPublicIP(addr.IP) {
+			return fmt.Errorf("%w: %s resolves to %s", ErrPrivateAddress, host, addr.IP)
+		}
+	}
+
+	return nil
+}
+
+// dialControl rejects connections to non-public addresses. It runs after name resolution, so a
+// host that passed checkHost and was then pointed at a private address is still refused.
+func dialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("%w: %s", ErrPrivateAddress, host)
+	}
+
+	return nil
+}
+
+// newClient returns the HTTP client deliveries are sent with. It only dials public addresses,
+// ignores proxy settings and does not follow redirects, which would otherwise lead it anywhere.
+func newClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second, Control: dialControl}
+	return &http.Client{
+		Timeout: sendTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+			MaxIdleConnsPerHost: 2,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
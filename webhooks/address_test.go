@@ -0,0 +1,75 @@
+package webhooks
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"224.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+	}
+	for _, tt := range tests {
+		if got := isPublicIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("isPublicIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestDialControl(t *testing.T) {
+	tests := []struct {
+		address string
+		wantErr bool
+	}{
+		{"93.184.216.34:443", false},
+		{"[2606:2800:220:1:248:1893:25c8:1946]:443", false},
+		{"127.0.0.1:8080", true},
+		{"169.254.169.254:80", true},
+		{"[::1]:443", true},
+	}
+	for _, tt := range tests {
+		err := dialControl("tcp", tt.address, nil)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("dialControl(%s) = %v, want error %v", tt.address, err, tt.wantErr)
+		}
+		if err != nil && !errors.Is(err, ErrPrivateAddress) {
+			t.Errorf("dialControl(%s) = %v, want ErrPrivateAddress", tt.address, err)
+		}
+	}
+}
+
+func TestClientRefusesLoopback(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	_, err := newClient().Post(server.URL, "application/json", nil)
+	if !errors.Is(err, ErrPrivateAddress) {
+		t.Errorf("POST to %s: err = %v, want ErrPrivateAddress", server.URL, err)
+	}
+	if called {
+		t.Error("the loopback server was called")
+	}
+}
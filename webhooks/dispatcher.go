@@ -0,0 +1,313 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"friendsocial/worker"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/lib/pq"
+)
+
+const (
+	// MaxAttempts is how many times a delivery is tried before it becomes a dead letter
+	MaxAttempts = 8
+	// batchSize is how many events or deliveries one pass claims at most
+	batchSize = 100
+	// claimLease keeps a claimed delivery from being picked up again while it is being sent
+	claimLease = 2 * time.Minute
+	// sendTimeout bounds a single attempt, including the subscriber's response
+	sendTimeout = 10 * time.Second
+)
+
+// Request headers. The signature is "sha256=" followed by the hex HMAC-SHA256 of
+// "<timestamp>.<body>" keyed with the webhook's secret; subscribers should reject requests whose
+// timestamp is too old.
+const (
+	HeaderEvent     = "X-FriendSocial-Event"
+	HeaderEventID   = "X-FriendSocial-Event-ID"
+	HeaderTimestamp = "X-FriendSocial-Timestamp"
+	HeaderSignature = "X-FriendSocial-Signature"
+)
+
+// Envelope is the body POSTed to subscribers. The event ID stays the same across retries so that
+// subscribers can drop duplicates; delivery is at least once and not ordered.
+type Envelope struct {
+	ID        int             `json:"id"`
+	Type      string          `json:"type"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// Sign returns the signature of a request body sent at timestamp
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// backoff returns how long to wait after the given failed attempt: a minute, doubling up to six
+// hours
+func backoff(attempt int) time.Duration {
+	delay := time.Minute
+	for i := 1; i < attempt && delay < 6*time.Hour; i++ {
+		delay *= 2
+	}
+	if delay > 6*time.Hour {
+		delay = 6 * time.Hour
+	}
+	return delay
+}
+
+// Dispatcher periodically fans new outbox events out to the matching webhook subscriptions and
+// POSTs pending deliveries. Rows are claimed with SKIP LOCKED, so several server instances can
+// dispatch at the same time.
+type Dispatcher struct {
+	db       *pgxpool.Pool
+	client   *http.Client
+	interval time.Duration
+}
+
+// NewDispatcher creates a Dispatcher that runs every interval
+func NewDispatcher(db *pgxpool.Pool, interval time.Duration) *Dispatcher {
+	return &Dispatcher{
+		db:       db,
+		client:   newClient(),
+		interval: interval,
+	}
+}
+
+// claimedDelivery is a delivery claimed for sending
+type claimedDelivery struct {
+	id       int
+	attempts int
+	url      string
+	secret   string
+	envelope Envelope
+}
+
+// Run dispatches immediately and then every interval until ctx is done, see
+// worker.RunEvery.
+func (d *Dispatcher) Run(ctx context.Context) {
+	worker.RunEvery(ctx, d.interval, func(ctx context.Context) {
+		delivered, dead, err := d.RunOnce(ctx)
+		if err != nil {
+			log.Printf("webhook dispatcher: %v", err)
+		} else if delivered > 0 || dead > 0 {
+			log.Printf("webhook dispatcher: delivered %d events, %d dead letters", delivered, dead)
+		}
+	})
+}
+
+// RunOnce fans out every new outbox event and sends every delivery that is due. It returns how
+// many deliveries succeeded and how many became dead letters.
+func (d *Dispatcher) RunOnce(ctx context.Context) (int, int, error) {
+	for {
+		events, err := d.fanOut(ctx)
+		if err != nil {
+			return 0, 0, err
+		}
+		if events < batchSize {
+			break
+		}
+	}
+
+	delivered, dead := 0, 0
+	for {
+		deliveries, err := d.claim(ctx)
+		if err != nil {
+			return delivered, dead, err
+		}
+
+		for _, delivery := range deliveries {
+			status, err := d.send(ctx, delivery)
+			if err != nil {
+				// One broken delivery should not hold back the others
+				log.Printf("webhook dispatcher: delivery %d: %v", delivery.id, err)
+				continue
+			}
+			switch status {
+			case "delivered":
+				delivered++
+			case "dead":
+				dead++
+			}
+		}
+
+		if len(deliveries) < batchSize || ctx.Err() != nil {
+			return delivered, dead, ctx.Err()
+		}
+	}
+}
+
+// fanOut creates a delivery for every active subscription of a batch of new events and marks
+// them dispatched. It returns the number of events handled.
+func (d *Dispatcher) fanOut(ctx context.Context) (int, error) {
+	tx, err := d.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	var eventIDs []int
+	err = tx.QueryRow(ctx,
+		`SELECT COALESCE(array_agg(id), '{}') FROM (
+		     SELECT id FROM outbox_events
+		     WHERE dispatched_at IS NULL
+		     ORDER BY id
+		     LIMIT $1
+		     FOR UPDATE SKIP LOCKED
+		 ) due`,
+		batchSize).Scan(&eventIDs)
+	if err != nil {
+		return 0, fmt.Errorf("failed to claim events: %v", err)
+	}
+	if len(eventIDs) == 0 {
+		return 0, nil
+	}
+
+	_, err = tx.Exec(ctx,
+		`INSERT INTO webhook_deliveries (subscription_id, event_id)
+		 SELECT ws.id, e.id
+		 FROM outbox_events e
+		 JOIN webhook_subscriptions ws ON ws.active AND ws.user_id = ANY(e.audience) AND e.event_type = ANY(ws.events)
+		 WHERE e.id = ANY($1)
+		 ON CONFLICT (subscription_id, event_id) DO NOTHING`,
+		pq.Array(eventIDs))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create deliveries: %v", err)
+	}
+
+	_, err = tx.Exec(ctx, "UPDATE outbox_events SET dispatched_at = now() WHERE id = ANY($1)", pq.Array(eventIDs))
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark events dispatched: %v", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return len(eventIDs), nil
+}
+
+// claim leases a batch of due deliveries and counts the attempt
+func (d *Dispatcher) claim(ctx context.Context) ([]claimedDelivery, error) {
+	rows, err := d.db.Query(ctx,
+		`WITH claimed AS (
+		     UPDATE webhook_deliveries wd
+		     SET attempts = wd.attempts + 1, next_attempt_at = now() + make_interval(secs => $2), updated_at = now()
+		     FROM (
+		         SELECT id FROM webhook_deliveries
+		         WHERE status = 'pending' AND next_attempt_at <= now()
+		         ORDER BY next_attempt_at
+		         LIMIT $1
+		         FOR UPDATE SKIP LOCKED
+		     ) due
+		     WHERE wd.id = due.id
+		     RETURNING wd.id, wd.subscription_id, wd.event_id, wd.attempts
+		 )
+		 SELECT claimed.id, claimed.attempts, ws.url, ws.secret, e.id, e.event_type, e.created_at, e.payload
+		 FROM claimed
+		 JOIN webhook_subscriptions ws ON ws.id = claimed.subscription_id
+		 JOIN outbox_events e ON e.id = claimed.event_id
+		 ORDER BY e.id`,
+		batchSize, claimLease.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim deliveries: %v", err)
+	}
+	defer rows.Close()
+
+	var deliveries []claimedDelivery
+	for rows.Next() {
+		var delivery claimedDelivery
+		var payload []byte
+		err := rows.Scan(&delivery.id, &delivery.attempts, &delivery.url, &delivery.secret,
+			&delivery.envelope.ID, &delivery.envelope.Type, &delivery.envelope.CreatedAt, &payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan delivery: %v", err)
+		}
+		delivery.envelope.Data = payload
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// send POSTs a claimed delivery and records the outcome, returning the delivery's new status.
+// Any 2xx response counts as delivered.
+func (d *Dispatcher) send(ctx context.Context, delivery claimedDelivery) (string, error) {
+	body, err := json.Marshal(delivery.envelope)
+	if err != nil {
+		return "", err
+	}
+
+	var statusCode *int
+	sendErr := func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		timestamp := time.Now().Unix()
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "FriendSocial-Webhooks/1.0")
+		req.Header.Set(HeaderEvent, delivery.envelope.Type)
+		req.Header.Set(HeaderEventID, strconv.Itoa(delivery.envelope.ID))
+		req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+		req.Header.Set(HeaderSignature, Sign(delivery.secret, timestamp, body))
+
+		resp, err := d.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+		statusCode = &resp.StatusCode
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("subscriber answered %s", resp.Status)
+		}
+		return nil
+	}()
+
+	status := "pending"
+	switch {
+	case sendErr == nil:
+		status = "delivered"
+	case delivery.attempts >= MaxAttempts:
+		status = "dead"
+	}
+
+	var lastError *string
+	if sendErr != nil {
+		message := sendErr.Error()
+		lastError = &message
+	}
+
+	_, err = d.db.Exec(context.Background(),
+		`UPDATE webhook_deliveries
+		 SET status = $2,
+		     last_status_code = $3,
+		     last_error = $4,
+		     delivered_at = CASE WHEN $2 = 'delivered' THEN now() END,
+		     next_attempt_at = CASE WHEN $2 = 'pending' THEN now() + make_interval(secs => $5) ELSE next_attempt_at END,
+		     updated_at = now()
+		 WHERE id = $1`,
+		delivery.id, status, statusCode, lastError, backoff(delivery.attempts).Seconds())
+	if err != nil {
+		return status, fmt.Errorf("failed to record outcome: %v", err)
+	}
+
+	return status, nil
+}
@@ -0,0 +1,78 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp int64
+		body      string
+		want      string
+	}{
+		{
+			name:      "event",
+			secret:    "whsec_test",
+			timestamp: 1700000000,
+			body:      `{"id":1,"type":"scheduled_activity.created"}`,
+			want:      "sha256=" + hexHMAC("whsec_test", `1700000000.{"id":1,"type":"scheduled_activity.created"}`),
+		},
+		{
+			name:      "empty body",
+			secret:    "whsec_test",
+			timestamp: 0,
+			body:      "",
+			want:      "sha256=" + hexHMAC("whsec_test", "0."),
+		},
+	}
+	for _, tt := range tests {
+		if got := Sign(tt.secret, tt.timestamp, []byte(tt.body)); got != tt.want {
+			t.Errorf("%s: Sign = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	// Every input takes part in the signature
+	base := Sign("whsec_test", 1700000000, []byte("{}"))
+	for name, other := range map[string]string{
+		"secret":    Sign("whsec_other", 1700000000, []byte("{}")),
+		"timestamp": Sign("whsec_test", 1700000001, []byte("{}")),
+		"body":      Sign("whsec_test", 1700000000, []byte("[]")),
+	} {
+		if other == base {
+			t.Errorf("changing the %s does not change the signature", name)
+		}
+	}
+}
+
+func hexHMAC(secret string, message string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{6, 32 * time.Minute},
+		{9, 256 * time.Minute},
+		{10, 6 * time.Hour},
+		{MaxAttempts, 128 * time.Minute},
+		{100, 6 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.attempt); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
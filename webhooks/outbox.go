@@ -0,0 +1,45 @@
+package webhooks
+
+import (
+	"context"
+
+	"github.com/jackc/pgconn"
+)
+
+// Event types
+const (
+	EventScheduledActivityCreated         = "scheduled_activity.created"
+	EventScheduledActivityRescheduled     = "scheduled_activity.rescheduled"
+	EventScheduledActivityDeactivated     = "scheduled_activity.deactivated"
+	EventActivityParticipantStatusChanged = "activity_participant.status_changed"
+)
+
+// EventTypes lists every event a webhook can subscribe to
+var EventTypes = []string{
+	EventScheduledActivityCreated,
+	EventScheduledActivityRescheduled,
+	EventScheduledActivityDeactivated,
+	EventActivityParticipantStatusChanged,
+}
+
+// Execer is implemented by *pgxpool.Pool and pgx.Tx, so that events are written to the outbox in
+// the same transaction as the change they describe
+type Execer interface {
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error)
+}
+
+// Publish writes an event about a scheduled activity to the outbox. The payload is stored as JSON.
+// Only the organizer and the invitees of the scheduled activity at the time of publishing may
+// receive the event, so it must be published before the scheduled activity or its invitations are
+// deleted. The Dispatcher delivers it once the transaction commits.
+func Publish(ctx context.Context, db Execer, eventType string, scheduledActivityID int, payload interface{}) error {
+	_, err := db.Exec(ctx,
+		`INSERT INTO outbox_events (event_type, payload, audience)
+		 SELECT $1, $2::jsonb, ARRAY(
+		     SELECT user_id FROM activity_participants WHERE scheduled_activity_id = $3
+		     UNION
+		     SELECT organizer_id FROM scheduled_activities
+		     WHERE id = $3 AND organizer_id IS NOT NULL)`,
+		eventType, payload, scheduledActivityID)
+	return err
+}
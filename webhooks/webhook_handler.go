@@ -0,0 +1,259 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"friendsocial/auth"
+	"net/http"
+)
+
+// WebhookService defines the methods for managing webhook subscriptions
+type WebhookService interface {
+	Create(ctx context.Context, userID int, webhook Webhook) (Webhook, error)
+	ReadByUser(ctx context.Context, userID int) ([]Webhook, error)
+	Read(ctx context.Context, id string) (Webhook, bool, error)
+	Delete(ctx context.Context, id string) (bool, error)
+	ReadDeadLetters(ctx context.Context, id string) ([]DeadLetter, error)
+	Redeliver(ctx context.Context, id string, deliveryID string) (bool, error)
+}
+
+// WebhookError represents the structure of an error response
+type WebhookError struct {
+	StatusCode int    `json:"status_code"`
+	Error      string `json:"error"`
+}
+
+// WebhookHTTPHandler handles HTTP requests for webhook subscriptions
+type WebhookHTTPHandler struct {
+	webhookService WebhookService
+}
+
+// NewWebhookHTTPHandler creates a new handler for webhook subscriptions
+func NewWebhookHTTPHandler(webhookService WebhookService) *WebhookHTTPHandler {
+	return &WebhookHTTPHandler{
+		webhookService: webhookService,
+	}
+}
+
+// HandleHTTPPost subscribes a webhook for the caller
+//
+//	@Summary		Subscribe a webhook
+//	@Description	Subscribe a URL to domain events about the caller's scheduled activities. The URL must not resolve to a loopback, private or link-local address. The response holds the signing secret, which is not shown again.
+//	@Tags			webhooks
+//	@Accept			json
+//	@Produce		json
+//	@Param			webhook	body		Webhook	true	"URL and event types"
+//	@Success		201		{object}	Webhook
+//	@Failure		400		{object}	WebhookError
+//	@Failure		500		{object}	WebhookError
+//	@Router			/webhooks [post]
+func (wH *WebhookHTTPHandler) HandleHTTPPost(w http.ResponseWriter, r *http.Request) {
+	callerID, _ := auth.CallerID(r.Context())
+
+	var webhook Webhook
+	err := json.NewDecoder(r.Body).Decode(&webhook)
+	if err != nil {
+		wH.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	webhook, err = wH.webhookService.Create(r.Context(), callerID, webhook)
+	if errors.Is(err, ErrInvalidURL) || errors.Is(err, ErrPrivateAddress) || errors.Is(err, ErrInvalidEvents) {
+		wH.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		wH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(webhook)
+	if err != nil {
+		wH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// HandleHTTPGet retrieves the caller's webhooks
+//
+//	@Summary		Get the caller's webhooks
+//	@Description	Retrieve the caller's webhook subscriptions
+//	@Tags			webhooks
+//	@Produce		json
+//	@Success		200	{array}		Webhook
+//	@Failure		500	{object}	WebhookError
+//	@Router			/webhooks [get]
+func (wH *WebhookHTTPHandler) HandleHTTPGet(w http.ResponseWriter, r *http.Request) {
+	callerID, _ := auth.CallerID(r.Context())
+
+	webhooks, err := wH.webhookService.ReadByUser(r.Context(), callerID)
+	if err != nil {
+		wH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(webhooks)
+	if err != nil {
+		wH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// HandleHTTPGetWithID retrieves a webhook
+//
+//	@Summary		Get a webhook by ID
+//	@Description	Retrieve a webhook subscription
+//	@Tags			webhooks
+//	@Produce		json
+//	@Param			id	path		int	true	"Webhook ID"
+//	@Success		200	{object}	Webhook
+//	@Failure		404	{object}	WebhookError
+//	@Failure		500	{object}	WebhookError
+//	@Router			/webhooks/{id} [get]
+func (wH *WebhookHTTPHandler) HandleHTTPGetWithID(w http.ResponseWriter, r *http.Request) {
+	webhook, found, err := wH.webhookService.Read(r.Context(), r.PathValue("id"))
+	if err != nil {
+		wH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if !found {
+		wH.errorResponse(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(webhook)
+	if err != nil {
+		wH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// HandleHTTPDelete unsubscribes a webhook
+//
+//	@Summary		Delete a webhook
+//	@Description	Unsubscribe a webhook and drop its pending deliveries
+//	@Tags			webhooks
+//	@Param			id	path	int	true	"Webhook ID"
+//	@Success		204
+//	@Failure		404	{object}	WebhookError
+//	@Failure		500	{object}	WebhookError
+//	@Router			/webhooks/{id} [delete]
+func (wH *WebhookHTTPHandler) HandleHTTPDelete(w http.ResponseWriter, r *http.Request) {
+	deleted, err := wH.webhookService.Delete(r.Context(), r.PathValue("id"))
+	if err != nil {
+		wH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if !deleted {
+		wH.errorResponse(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleHTTPGetDeadLetters retrieves a webhook's dead letters
+//
+//	@Summary		Get a webhook's dead letters
+//	@Description	Retrieve the deliveries that failed every attempt, most recent first
+//	@Tags			webhooks
+//	@Produce		json
+//	@Param			id	path		int	true	"Webhook ID"
+//	@Success		200	{array}		DeadLetter
+//	@Failure		500	{object}	WebhookError
+//	@Router			/webhooks/{id}/dead_letters [get]
+func (wH *WebhookHTTPHandler) HandleHTTPGetDeadLetters(w http.ResponseWriter, r *http.Request) {
+	deadLetters, err := wH.webhookService.ReadDeadLetters(r.Context(), r.PathValue("id"))
+	if err != nil {
+		wH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(deadLetters)
+	if err != nil {
+		wH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// HandleHTTPPostRedeliver queues a dead letter again
+//
+//	@Summary		Redeliver a dead letter
+//	@Description	Queue a dead delivery again with a fresh set of attempts
+//	@Tags			webhooks
+//	@Param			id			path	int	true	"Webhook ID"
+//	@Param			delivery_id	path	int	true	"Delivery ID"
+//	@Success		202
+//	@Failure		404	{object}	WebhookError
+//	@Failure		500	{object}	WebhookError
+//	@Router			/webhooks/{id}/dead_letters/{delivery_id}/redeliver [post]
+func (wH *WebhookHTTPHandler) HandleHTTPPostRedeliver(w http.ResponseWriter, r *http.Request) {
+	queued, err := wH.webhookService.Redeliver(r.Context(), r.PathValue("id"), r.PathValue("delivery_id"))
+	if err != nil {
+		wH.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if !queued {
+		wH.errorResponse(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// RegisterRoutes adds the webhook routes to mux
+func (wH *WebhookHTTPHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("POST /webhooks", wH.HandleHTTPPost)
+	mux.HandleFunc("GET /webhooks", wH.HandleHTTPGet)
+	mux.HandleFunc("GET /webhooks/{id}", wH.HandleHTTPGetWithID)
+	mux.HandleFunc("DELETE /webhooks/{id}", wH.HandleHTTPDelete)
+	mux.HandleFunc("GET /webhooks/{id}/dead_letters", wH.HandleHTTPGetDeadLetters)
+	mux.HandleFunc("POST /webhooks/{id}/dead_letters/{delivery_id}/redeliver", wH.HandleHTTPPostRedeliver)
+}
+
+// AuthorizationRules returns the ownership rules for webhook routes. Users only manage their own
+// webhooks.
+func (wH *WebhookHTTPHandler) AuthorizationRules() map[string]auth.Rule {
+	return map[string]auth.Rule{
+		"POST /webhooks":                  auth.Authenticated,
+		"GET /webhooks":                   auth.Authenticated,
+		"GET /webhooks/{id}":              wH.isOwner,
+		"DELETE /webhooks/{id}":           wH.isOwner,
+		"GET /webhooks/{id}/dead_letters": wH.isOwner,
+		"POST /webhooks/{id}/dead_letters/{delivery_id}/redeliver": wH.isOwner,
+	}
+}
+
+// isOwner allows the user who subscribed the webhook in the path
+func (wH *WebhookHTTPHandler) isOwner(r *http.Request, callerID int) (bool, error) {
+	webhook, found, err := wH.webhookService.Read(r.Context(), r.PathValue("id"))
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		// Let the handler answer 404
+		return true, nil
+	}
+	return webhook.UserID == callerID, nil
+}
+
+func (wH *WebhookHTTPHandler) errorResponse(w http.ResponseWriter, statusCode int, errorString string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	encodingError := json.NewEncoder(w).Encode(WebhookError{
+		StatusCode: statusCode,
+		Error:      errorString,
+	})
+	if encodingError != nil {
+		http.Error(w, encodingError.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,190 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrInvalidURL    = errors.New("url must be an absolute http or https URL")
+	ErrInvalidEvents = errors.New("events must list at least one known event type")
+)
+
+// Webhook is a subscription to domain events. Events are POSTed to URL and signed with Secret.
+type Webhook struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"` // only returned when the webhook is created
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DeadLetter is a delivery that was given up on after MaxAttempts
+type DeadLetter struct {
+	DeliveryID     int                    `json:"delivery_id"`
+	EventID        int                    `json:"event_id"`
+	EventType      string                 `json:"event_type"`
+	Payload        map[string]interface{} `json:"payload"`
+	Attempts       int                    `json:"attempts"`
+	LastStatusCode *int                   `json:"last_status_code,omitempty"`
+	LastError      *string                `json:"last_error,omitempty"`
+	CreatedAt      time.Time              `json:"created_at"`
+	FailedAt       time.Time              `json:"failed_at"`
+}
+
+// webhookColumns is the column list scanned by scanWebhook
+const webhookColumns = "id, user_id, url, events, active, created_at"
+
+func scanWebhook(row pgx.Row) (Webhook, error) {
+	var webhook Webhook
+	err := row.Scan(&webhook.ID, &webhook.UserID, &webhook.URL, &webhook.Events, &webhook.Active, &webhook.CreatedAt)
+	return webhook, err
+}
+
+type Service struct {
+	db *pgxpool.Pool
+}
+
+func NewService(db *pgxpool.Pool) *Service {
+	return &Service{
+		db: db,
+	}
+}
+
+// Create subscribes a user's webhook and generates its signing secret. Subscribers only receive
+// events about scheduled activities they organize or are invited to. The URL's host must resolve
+// to public addresses only.
+func (s *Service) Create(ctx context.Context, userID int, webhook Webhook) (Webhook, error) {
+	parsed, err := url.Parse(webhook.URL)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		return Webhook{}, ErrInvalidURL
+	}
+	if err := checkHost(ctx, parsed.Hostname()); err != nil {
+		return Webhook{}, err
+	}
+	if len(webhook.Events) == 0 {
+		return Webhook{}, ErrInvalidEvents
+	}
+	for _, event := range webhook.Events {
+		if !slices.Contains(EventTypes, event) {
+			return Webhook{}, fmt.Errorf("%w: unknown event type %q", ErrInvalidEvents, event)
+		}
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return Webhook{}, err
+	}
+	secret := "whsec_" + hex.EncodeToString(raw)
+
+	created, err := scanWebhook(s.db.QueryRow(ctx,
+		`INSERT INTO webhook_subscriptions (user_id, url, events, secret)
+		 VALUES ($1, $2, $3, $4)
+		 RETURNING `+webhookColumns,
+		userID, webhook.URL, pq.Array(webhook.Events), secret))
+	if err != nil {
+		return Webhook{}, err
+	}
+	created.Secret = secret
+
+	return created, nil
+}
+
+// ReadByUser returns a user's webhooks without their secrets
+func (s *Service) ReadByUser(ctx context.Context, userID int) ([]Webhook, error) {
+	rows, err := s.db.Query(ctx,
+		"SELECT "+webhookColumns+" FROM webhook_subscriptions WHERE user_id = $1 ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+
+	return webhooks, rows.Err()
+}
+
+// Read returns a single webhook without its secret
+func (s *Service) Read(ctx context.Context, id string) (Webhook, bool, error) {
+	webhook, err := scanWebhook(s.db.QueryRow(ctx,
+		"SELECT "+webhookColumns+" FROM webhook_subscriptions WHERE id = $1", id))
+	if err == pgx.ErrNoRows {
+		return Webhook{}, false, nil
+	}
+	if err != nil {
+		return Webhook{}, false, err
+	}
+
+	return webhook, true, nil
+}
+
+// Delete unsubscribes a webhook. Its pending and dead deliveries go with it.
+func (s *Service) Delete(ctx context.Context, id string) (bool, error) {
+	cmdTag, err := s.db.Exec(ctx, "DELETE FROM webhook_subscriptions WHERE id = $1", id)
+	if err != nil {
+		return false, err
+	}
+
+	return cmdTag.RowsAffected() > 0, nil
+}
+
+// ReadDeadLetters returns a webhook's dead deliveries, most recently failed first
+func (s *Service) ReadDeadLetters(ctx context.Context, id string) ([]DeadLetter, error) {
+	rows, err := s.db.Query(ctx,
+		`SELECT wd.id, e.id, e.event_type, e.payload, wd.attempts, wd.last_status_code, wd.last_error, wd.created_at, wd.updated_at
+		 FROM webhook_deliveries wd
+		 JOIN outbox_events e ON e.id = wd.event_id
+		 WHERE wd.subscription_id = $1 AND wd.status = 'dead'
+		 ORDER BY wd.updated_at DESC, wd.id DESC`,
+		id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deadLetters := []DeadLetter{}
+	for rows.Next() {
+		var deadLetter DeadLetter
+		err := rows.Scan(&deadLetter.DeliveryID, &deadLetter.EventID, &deadLetter.EventType, &deadLetter.Payload,
+			&deadLetter.Attempts, &deadLetter.LastStatusCode, &deadLetter.LastError, &deadLetter.CreatedAt, &deadLetter.FailedAt)
+		if err != nil {
+			return nil, err
+		}
+		deadLetters = append(deadLetters, deadLetter)
+	}
+
+	return deadLetters, rows.Err()
+}
+
+// Redeliver queues a dead delivery of a webhook again with a fresh set of attempts
+func (s *Service) Redeliver(ctx context.Context, id string, deliveryID string) (bool, error) {
+	cmdTag, err := s.db.Exec(ctx,
+		`UPDATE webhook_deliveries
+		 SET status = 'pending', attempts = 0, next_attempt_at = now(), updated_at = now()
+		 WHERE id = $1 AND subscription_id = $2 AND status = 'dead'`,
+		deliveryID, id)
+	if err != nil {
+		return false, err
+	}
+
+	return cmdTag.RowsAffected() > 0, nil
+}
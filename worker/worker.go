@@ -0,0 +1,25 @@
+// Package worker runs the periodic background jobs of the server.
+package worker
+
+import (
+	"context"
+	"time"
+)
+
+// RunEvery calls fn immediately and then every interval until ctx is done. fn gets a context that
+// is never cancelled, so a run in progress when ctx is done is finished, not cancelled, before
+// RunEvery returns.
+func RunEvery(ctx context.Context, interval time.Duration, fn func(context.Context)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		fn(context.WithoutCancel(ctx))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
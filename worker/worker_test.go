@@ -0,0 +1,46 @@
+package worker
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRunEvery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	runs := 0
+	done := make(chan struct{})
+	go func() {
+		RunEvery(ctx, time.Millisecond, func(runCtx context.Context) {
+			runs++
+			if runs == 3 {
+				cancel()
+			}
+			// The run that sees ctx done still gets a live context
+			if runCtx.Err() != nil {
+				t.Errorf("run %d got a cancelled context", runs)
+			}
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunEvery did not return after ctx was done")
+	}
+	if runs != 3 {
+		t.Errorf("%d runs, want 3", runs)
+	}
+}
+
+func TestRunEveryRunsImmediately(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	runs := 0
+	RunEvery(ctx, time.Hour, func(context.Context) { runs++ })
+	if runs != 1 {
+		t.Errorf("%d runs with ctx already done, want 1", runs)
+	}
+}